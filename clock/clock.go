@@ -0,0 +1,144 @@
+// Package clock provides an injectable source of time, so that time-dependent
+// behavior (exponential backoff, connection staleness, stall detection) can be
+// tested without actually waiting.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Clock tells the time and knows how to wait.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+// Real is a Clock backed by the standard time package.
+var Real Clock = realClock{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Or returns c if it's non-nil, and Real otherwise. It lets settings
+// structs leave their Clock field unset.
+func Or(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
+
+// Since returns the time elapsed since t, according to c.
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Fake is a Clock whose time only moves forward when Sleep
+// or Advance are called. It's safe for concurrent use.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	slept   time.Duration
+	waiters []*waiter
+}
+
+type waiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+var _ Clock = (*Fake)(nil)
+
+// NewFake returns a fake clock set to now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the fake clock's current time.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+// Sleep returns immediately, advancing the fake clock by d.
+func (f *Fake) Sleep(d time.Duration) {
+	f.mu.Lock()
+	f.slept += d
+	f.mu.Unlock()
+
+	f.Advance(d)
+}
+
+// After returns a channel that receives the fake time once the
+// clock has been advanced by at least d.
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w := &waiter{
+		deadline: f.now.Add(d),
+		c:        make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		w.c <- f.now
+		return w.c
+	}
+	f.waiters = append(f.waiters, w)
+	return w.c
+}
+
+// Advance moves the fake clock forward by d, firing any
+// After channels whose deadline has passed.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+
+	sort.Slice(f.waiters, func(i, j int) bool {
+		return f.waiters[i].deadline.Before(f.waiters[j].deadline)
+	})
+
+	var pending []*waiter
+	for _, w := range f.waiters {
+		if w.deadline.After(f.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.c <- f.now
+	}
+	f.waiters = pending
+}
+
+// Slept returns the total duration passed to Sleep so far.
+func (f *Fake) Slept() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.slept
+}
+
+// Waiting returns how many After channels have yet to fire, so that
+// tests can advance the clock once code under test is waiting on it.
+func (f *Fake) Waiting() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.waiters)
+}
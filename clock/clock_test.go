@@ -0,0 +1,57 @@
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Fake(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fc := clock.NewFake(start)
+	assert.Equal(start, fc.Now())
+
+	fc.Sleep(3 * time.Second)
+	assert.Equal(3*time.Second, clock.Since(fc, start))
+	assert.Equal(3*time.Second, fc.Slept())
+
+	after := fc.After(2 * time.Second)
+	assert.Equal(1, fc.Waiting())
+	select {
+	case <-after:
+		t.Fatal("After fired too early")
+	default:
+	}
+
+	fc.Advance(1 * time.Second)
+	select {
+	case <-after:
+		t.Fatal("After fired too early")
+	default:
+	}
+
+	fc.Advance(1 * time.Second)
+	select {
+	case now := <-after:
+		assert.Equal(start.Add(5*time.Second), now)
+	default:
+		t.Fatal("After should have fired")
+	}
+	assert.Equal(0, fc.Waiting())
+
+	// Advance does not count as sleeping
+	assert.Equal(3*time.Second, fc.Slept())
+}
+
+func Test_Or(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(clock.Real, clock.Or(nil))
+
+	fc := clock.NewFake(time.Now())
+	assert.Equal(fc, clock.Or(fc))
+}
@@ -0,0 +1,87 @@
+// Command htproxy exposes remote (possibly signed, expiring) URLs as stable
+// local HTTP endpoints with Range support, so that tools that only speak
+// plain HTTP (game engines, media players, etc.) benefit from htfs's
+// retries, URL renewal, disk caching and bandwidth limiting.
+//
+// Usage:
+//
+//	htproxy [flags] name=URL name=!command...
+//
+// Each route is served at http://<listen>/<name>. For signed URLs that
+// expire, use name=!command, where command prints a fresh URL on stdout:
+// it's run again whenever upstream responds with HTTP 403 or 410.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/itchio/httpkit/rate"
+	"github.com/itchio/httpkit/timeout"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:8787", "address to listen on")
+	cacheDir := flag.String("cache-dir", "", "directory to keep fetched ranges in across runs (disabled if empty)")
+	limit := flag.Int64("limit", 0, "maximum download speed from upstream, in bytes per second (0 means unlimited)")
+	verbose := flag.Bool("verbose", false, "log htfs activity")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] name=URL name=!command...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	settings := proxySettings{
+		CacheDir: *cacheDir,
+		HTFS: &htfs.Settings{
+			Client: timeout.NewClientWithSettings(&timeout.ClientSettings{
+				DisableCompression: true,
+			}),
+		},
+	}
+	if *limit > 0 {
+		settings.Limiter = rate.New(rate.Settings{BytesPerSecond: *limit})
+	}
+	if *verbose {
+		settings.HTFS.Log = func(msg string) {
+			log.Print(msg)
+		}
+	}
+	if settings.CacheDir != "" {
+		must(os.MkdirAll(settings.CacheDir, 0755))
+	}
+
+	p := newProxy(settings)
+	for _, spec := range flag.Args() {
+		must(p.addRoute(spec))
+	}
+
+	// save cache indexes on the way out
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		must(p.Close())
+		os.Exit(0)
+	}()
+
+	log.Printf("Listening on http://%s", *listen)
+	must(http.ListenAndServe(*listen, p))
+}
+
+func must(err error) {
+	if err != nil {
+		log.Fatalf("%+v", err)
+	}
+}
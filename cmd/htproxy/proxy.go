@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/itchio/httpkit/htfs/diskcache"
+	"github.com/itchio/httpkit/rate"
+	"github.com/pkg/errors"
+)
+
+type proxySettings struct {
+	// CacheDir, if set, is where fetched ranges are kept across runs
+	CacheDir string
+	// Limiter, if set, caps how fast we download from upstream
+	Limiter *rate.Limiter
+	// HTFS is used to open remote files
+	HTFS *htfs.Settings
+}
+
+// proxy serves each route at /<name>, with Range support
+type proxy struct {
+	settings proxySettings
+	routes   map[string]*route
+}
+
+type route struct {
+	name   string
+	getURL htfs.GetURLFunc
+
+	mu     sync.Mutex
+	file   *htfs.File
+	cache  *diskcache.File
+	reader io.ReaderAt
+	size   int64
+}
+
+func newProxy(settings proxySettings) *proxy {
+	return &proxy{
+		settings: settings,
+		routes:   make(map[string]*route),
+	}
+}
+
+// addRoute parses "name=URL" or "name=!command", where command
+// prints a fresh URL on stdout every time it's run, for signed URLs
+// that expire.
+func (p *proxy) addRoute(spec string) error {
+	tokens := strings.SplitN(spec, "=", 2)
+	if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+		return errors.Errorf("invalid route %q, expected name=URL or name=!command", spec)
+	}
+	name, target := tokens[0], tokens[1]
+	if strings.Contains(name, "/") {
+		return errors.Errorf("invalid route name %q", name)
+	}
+
+	r := &route{name: name}
+	if strings.HasPrefix(target, "!") {
+		command := strings.TrimPrefix(target, "!")
+		r.getURL = func() (string, error) {
+			output, err := exec.Command("sh", "-c", command).Output()
+			if err != nil {
+				return "", errors.Wrapf(err, "while running %q", command)
+			}
+			return strings.TrimSpace(string(output)), nil
+		}
+	} else {
+		r.getURL = func() (string, error) {
+			return target, nil
+		}
+	}
+	p.routes[name] = r
+	return nil
+}
+
+// needsRenewal recognizes the usual responses to expired signed URLs
+func needsRenewal(res *http.Response, body []byte) bool {
+	return res.StatusCode == 403 || res.StatusCode == 410
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	r, ok := p.routes[strings.TrimPrefix(req.URL.Path, "/")]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	reader, size, err := p.open(r)
+	if err != nil {
+		log.Printf("[%s] %+v", r.name, err)
+		http.Error(w, fmt.Sprintf("Could not open upstream: %v", err), 502)
+		return
+	}
+
+	// each request gets its own offset
+	http.ServeContent(w, req, r.name, time.Time{}, io.NewSectionReader(reader, 0, size))
+}
+
+// open opens the route's remote file (and its disk cache) on first use
+func (p *proxy) open(r *route) (io.ReaderAt, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.reader != nil {
+		return r.reader, r.size, nil
+	}
+
+	file, err := htfs.Open(r.getURL, needsRenewal, p.settings.HTFS)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "while opening remote file")
+	}
+
+	stats, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, errors.WithStack(err)
+	}
+	size := stats.Size()
+
+	var reader io.ReaderAt = file
+	if p.settings.Limiter != nil {
+		reader = &limitedReaderAt{reader: reader, limiter: p.settings.Limiter}
+	}
+
+	if p.settings.CacheDir != "" {
+		key, ok := cacheKey(file.InitialResponse().Header, size)
+		if ok {
+			cache, err := diskcache.New(reader, size, diskcache.Settings{
+				Path: filepath.Join(p.settings.CacheDir, r.name),
+				Key:  key,
+			})
+			if err != nil {
+				file.Close()
+				return nil, 0, errors.WithStack(err)
+			}
+			r.cache = cache
+			reader = cache
+		} else {
+			log.Printf("[%s] upstream has no ETag or Last-Modified, not caching to disk", r.name)
+		}
+	}
+
+	r.file = file
+	r.reader = reader
+	r.size = size
+	return reader, size, nil
+}
+
+// cacheKey returns what tells apart versions of the upstream file, for the
+// disk cache: its ETag, or failing that its Last-Modified date, along with
+// its size. It returns false if there's neither, since we'd have no way to
+// know the file changed.
+func cacheKey(header http.Header, size int64) (string, bool) {
+	validator := header.Get("etag")
+	if validator == "" {
+		validator = header.Get("last-modified")
+	}
+	if validator == "" {
+		return "", false
+	}
+	return fmt.Sprintf("%s/%d", validator, size), true
+}
+
+// Close closes all remote files, and saves disk cache indexes
+func (p *proxy) Close() error {
+	var firstErr error
+	for _, r := range p.routes {
+		r.mu.Lock()
+		if r.cache != nil {
+			err := r.cache.Close()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if r.file != nil {
+			err := r.file.Close()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		r.cache, r.file, r.reader = nil, nil, nil
+		r.mu.Unlock()
+	}
+	return firstErr
+}
+
+type limitedReaderAt struct {
+	reader  io.ReaderAt
+	limiter *rate.Limiter
+}
+
+func (lra *limitedReaderAt) ReadAt(buf []byte, offset int64) (int, error) {
+	n, err := lra.reader.ReadAt(buf, offset)
+	if n > 0 {
+		lra.limiter.Take(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Proxy(t *testing.T) {
+	assert := assert.New(t)
+	content := []byte("aaaabbbbccccdddd")
+
+	numGET := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numGET++
+		w.Header().Set("etag", `"v1"`)
+		http.ServeContent(w, r, "file.dat", time.Time{}, bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	cacheDir, err := ioutil.TempDir("", "htproxy")
+	assert.NoError(err)
+	defer os.RemoveAll(cacheDir)
+
+	newTestProxy := func() *proxy {
+		p := newProxy(proxySettings{
+			CacheDir: cacheDir,
+			HTFS:     &htfs.Settings{},
+		})
+		assert.NoError(p.addRoute("game.pak=" + upstream.URL + "/game.pak"))
+		assert.Error(p.addRoute("nope"))
+		return p
+	}
+
+	get := func(p *proxy, path string, byteRange string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if byteRange != "" {
+			req.Header.Set("Range", byteRange)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	p := newTestProxy()
+	res := get(p, "/game.pak", "bytes=4-9")
+	assert.EqualValues(206, res.Code)
+	assert.EqualValues("bbbbcc", res.Body.String())
+	assert.EqualValues("bytes 4-9/16", res.Header().Get("Content-Range"))
+
+	res = get(p, "/game.pak", "")
+	assert.EqualValues(200, res.Code)
+	assert.EqualValues(content, res.Body.Bytes())
+
+	res = get(p, "/other.pak", "")
+	assert.EqualValues(404, res.Code)
+	assert.NoError(p.Close())
+
+	// everything is on disk now
+	p = newTestProxy()
+	numGET = 0
+	res = get(p, "/game.pak", "bytes=8-")
+	assert.EqualValues(206, res.Code)
+	assert.EqualValues("ccccdddd", res.Body.String())
+	assert.EqualValues(1, numGET, "should only make the initial request")
+	assert.NoError(p.Close())
+}
+
+func Test_CacheKey(t *testing.T) {
+	assert := assert.New(t)
+
+	header := http.Header{}
+	_, ok := cacheKey(header, 16)
+	assert.False(ok, "no validator, no cache")
+
+	header.Set("last-modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+	key, ok := cacheKey(header, 16)
+	assert.True(ok)
+	assert.EqualValues("Mon, 02 Jan 2006 15:04:05 GMT/16", key)
+
+	header.Set("etag", `"v1"`)
+	key, ok = cacheKey(header, 16)
+	assert.True(ok)
+	assert.EqualValues(`"v1"/16`, key)
+}
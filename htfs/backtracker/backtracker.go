@@ -2,6 +2,7 @@ package backtracker
 
 import (
 	"bufio"
+	"context"
 	"io"
 
 	"github.com/pkg/errors"
@@ -25,6 +26,14 @@ type Backtracker interface {
 	// Advance n bytes
 	Discard(n int64) error
 
+	// Advance n bytes, stopping early if ctx is done
+	DiscardContext(ctx context.Context, n int64) error
+
+	// Enable or disable remembering data read from upstream. While
+	// disabled, reads go straight to upstream (after serving any pending
+	// backtrack), and nothing new can be backtracked.
+	SetCaching(enabled bool)
+
 	NumCacheHits() int64
 	NumCacheMiss() int64
 
@@ -32,15 +41,35 @@ type Backtracker interface {
 	TotalBytesServed() int64
 }
 
+// DefaultBufferSize is the size of the read buffer used by New
+const DefaultBufferSize = 4096
+
+// MaxCacheSize is the largest cache a Backtracker can have, which is
+// smaller on 32-bit platforms. Bigger cache sizes are capped to it.
+const MaxCacheSize = int64(^uint(0) >> 1)
+
 // New returns a Backtracker reading from upstream
 func New(offset int64, upstream io.Reader, cacheSize int64) Backtracker {
+	return NewSize(offset, upstream, cacheSize, DefaultBufferSize)
+}
+
+// NewSize returns a Backtracker reading from upstream through
+// a buffer of bufferSize bytes
+func NewSize(offset int64, upstream io.Reader, cacheSize int64, bufferSize int) Backtracker {
+	if cacheSize > MaxCacheSize {
+		cacheSize = MaxCacheSize
+	}
+	if cacheSize < 0 {
+		cacheSize = 0
+	}
 	return &backtracker{
-		upstream:   bufio.NewReader(upstream),
+		upstream:   bufio.NewReaderSize(upstream, bufferSize),
 		discardBuf: make([]byte, 256*1024),
 		cache:      make([]byte, cacheSize),
 		cached:     0,
 		backtrack:  0,
 		offset:     offset,
+		caching:    true,
 	}
 }
 
@@ -52,6 +81,7 @@ type backtracker struct {
 	cached      int
 	backtrack   int
 	offset      int64
+	caching     bool
 
 	numCacheHits      int64
 	numCacheMiss      int64
@@ -115,13 +145,19 @@ func (bt *backtracker) Read(buf []byte) (int, error) {
 
 	bt.numCacheMiss++
 
+	if !bt.caching {
+		// whatever was cached is now behind us
+		bt.cached = 0
+		bt.writeCursor = 0
+	}
+
 	// read from upstream
 	n, err := bt.upstream.Read(buf)
 
 	if n > 0 {
 		bt.offset += int64(n)
 
-		if cachesize > 0 {
+		if bt.caching && cachesize > 0 {
 			// cache data
 			cachebytes := buf[:n]
 			if n > cachesize {
@@ -148,9 +184,18 @@ func (bt *backtracker) Read(buf []byte) (int, error) {
 }
 
 func (bt *backtracker) Discard(n int64) error {
+	return bt.DiscardContext(context.Background(), n)
+}
+
+func (bt *backtracker) DiscardContext(ctx context.Context, n int64) error {
 	discardlen := int64(len(bt.discardBuf))
 
 	for n > 0 {
+		err := ctx.Err()
+		if err != nil {
+			return errors.Wrapf(err, "in backtracker.Discard")
+		}
+
 		readlen := n
 		if readlen > discardlen {
 			readlen = discardlen
@@ -166,14 +211,19 @@ func (bt *backtracker) Discard(n int64) error {
 	return nil
 }
 
+func (bt *backtracker) SetCaching(enabled bool) {
+	bt.caching = enabled
+}
+
 func (bt *backtracker) Cached() int64 {
 	return int64(bt.cached)
 }
 
 func (bt *backtracker) Backtrack(n int64) error {
-	if int64(bt.cached) < n {
+	if n < 0 || int64(bt.cached) < n {
 		return errors.Errorf("in backtracker.Backtrack, only %d cached, can't backtrack by %d", bt.cached, n)
 	}
+	// n <= bt.cached, so it fits in an int
 	bt.backtrack = int(n)
 	return nil
 }
@@ -2,6 +2,7 @@ package backtracker_test
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -9,6 +10,7 @@ import (
 	"time"
 
 	"github.com/itchio/httpkit/htfs/backtracker"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -195,6 +197,33 @@ func Test_BackTrackerLarge(t *testing.T) {
 	assert.Contains(err.Error(), "EOF")
 }
 
+// zeroReader reads zeroes forever
+type zeroReader struct{}
+
+func (zr zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func Test_BacktrackerDiscardHuge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("discards 4GiB")
+	}
+	assert := assert.New(t)
+
+	// more than fits in an int32, or an uint32
+	n := int64(4*1024*1024*1024 + 17)
+	bt := backtracker.New(0, zeroReader{}, 16)
+	assert.NoError(bt.Discard(n))
+	assert.EqualValues(n, bt.Offset())
+
+	assert.NoError(bt.Backtrack(16))
+	assert.EqualValues(n, bt.Offset())
+	assert.Error(bt.Backtrack(-1))
+}
+
 func Test_BacktrackerOffset(t *testing.T) {
 	assert := assert.New(t)
 	bt := backtracker.New(4, bytes.NewReader([]byte{4, 5, 6, 7}), 2)
@@ -204,3 +233,46 @@ func Test_BacktrackerOffset(t *testing.T) {
 	assert.NoError(err)
 	assert.EqualValues([]byte{4, 5, 6, 7}, buf)
 }
+
+func Test_BacktrackerSetCaching(t *testing.T) {
+	assert := assert.New(t)
+	bt := backtracker.New(0, bytes.NewReader([]byte{0, 1, 2, 3, 4, 5, 6, 7}), 4)
+
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(bt, buf)
+	assert.NoError(err)
+	assert.NoError(bt.Backtrack(2))
+
+	// pending backtrack is still served
+	bt.SetCaching(false)
+	_, err = io.ReadFull(bt, buf)
+	assert.NoError(err)
+	assert.EqualValues([]byte{2, 3, 4, 5}, buf)
+	assert.EqualValues(6, bt.Offset())
+	assert.EqualValues(0, bt.Cached())
+	assert.Error(bt.Backtrack(1))
+
+	bt.SetCaching(true)
+	_, err = io.ReadFull(bt, buf[:2])
+	assert.NoError(err)
+	assert.EqualValues(2, bt.Cached())
+	assert.NoError(bt.Backtrack(2))
+	_, err = io.ReadFull(bt, buf[:2])
+	assert.NoError(err)
+	assert.EqualValues([]byte{6, 7}, buf[:2])
+}
+
+func Test_BacktrackerDiscardContext(t *testing.T) {
+	assert := assert.New(t)
+	bt := backtracker.New(0, bytes.NewReader(make([]byte, 1024*1024)), 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(bt.DiscardContext(ctx, 1024))
+	assert.EqualValues(1024, bt.Offset())
+
+	cancel()
+	err := bt.DiscardContext(ctx, 512*1024)
+	assert.Error(err)
+	assert.EqualValues(context.Canceled, errors.Cause(err))
+	assert.EqualValues(1024, bt.Offset())
+}
@@ -0,0 +1,205 @@
+package htfs
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// BlockCacheSettings configures a BlockCache
+type BlockCacheSettings struct {
+	// Size is the maximum number of bytes held by the cache.
+	// Defaults to 64MiB.
+	Size int64
+
+	// BlockSize is the granularity at which data is fetched and cached.
+	// Defaults to 64KiB.
+	BlockSize int64
+}
+
+const (
+	defaultBlockCacheSize      = 64 * 1024 * 1024
+	defaultBlockCacheBlockSize = 64 * 1024
+)
+
+// alignedBlocksKept is how many blocks a File keeps, see Settings.AlignedReadSize
+const alignedBlocksKept = 4
+
+// BlockCacheStats tracks how useful a BlockCache is
+type BlockCacheStats struct {
+	Hits   int64
+	Misses int64
+	// Size is the number of bytes currently held
+	Size int64
+}
+
+// A BlockCache keeps recently read, block-aligned ranges of remote files
+// in memory, evicting the least recently used blocks when it's full.
+// It can be shared by several Files (see Settings.BlockCache), so that
+// re-opening the same resource, or reading hot ranges like headers again,
+// doesn't refetch them. It's safe for concurrent use.
+type BlockCache struct {
+	size      int64
+	blockSize int64
+
+	mu     sync.Mutex
+	blocks map[blockKey]*list.Element
+	lru    *list.List
+	stats  BlockCacheStats
+}
+
+type blockKey struct {
+	resource string
+	index    int64
+}
+
+type cachedBlock struct {
+	key  blockKey
+	data []byte
+}
+
+// NewBlockCache returns an empty BlockCache
+func NewBlockCache(settings *BlockCacheSettings) *BlockCache {
+	if settings == nil {
+		settings = &BlockCacheSettings{}
+	}
+
+	bc := &BlockCache{
+		size:      settings.Size,
+		blockSize: settings.BlockSize,
+		blocks:    make(map[blockKey]*list.Element),
+		lru:       list.New(),
+	}
+	if bc.size <= 0 {
+		bc.size = defaultBlockCacheSize
+	}
+	if bc.blockSize <= 0 {
+		bc.blockSize = defaultBlockCacheBlockSize
+	}
+	return bc
+}
+
+// BlockSize returns the size of the blocks held by the cache
+func (bc *BlockCache) BlockSize() int64 {
+	return bc.blockSize
+}
+
+// Stats returns hit and miss counts, and the current size of the cache
+func (bc *BlockCache) Stats() BlockCacheStats {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	return bc.stats
+}
+
+func (bc *BlockCache) get(key blockKey) ([]byte, bool) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	el, ok := bc.blocks[key]
+	if !ok {
+		bc.stats.Misses++
+		return nil, false
+	}
+	bc.stats.Hits++
+	bc.lru.MoveToFront(el)
+	return el.Value.(*cachedBlock).data, true
+}
+
+func (bc *BlockCache) put(key blockKey, data []byte) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	if int64(len(data)) > bc.size {
+		return
+	}
+
+	if el, ok := bc.blocks[key]; ok {
+		// someone else fetched it concurrently
+		bc.lru.MoveToFront(el)
+		return
+	}
+
+	bc.blocks[key] = bc.lru.PushFront(&cachedBlock{key: key, data: data})
+	bc.stats.Size += int64(len(data))
+
+	for bc.stats.Size > bc.size {
+		el := bc.lru.Back()
+		cb := el.Value.(*cachedBlock)
+		bc.lru.Remove(el)
+		delete(bc.blocks, cb.key)
+		bc.stats.Size -= int64(len(cb.data))
+	}
+}
+
+// blockCacheResource returns the key under which this File's blocks
+// are cached, or an empty string if it can't be identified safely.
+func (f *File) blockCacheResource() string {
+	if f.BlockCacheKey != "" {
+		return f.BlockCacheKey
+	}
+	if f.etag != "" && f.knownSize() {
+		return fmt.Sprintf("%s/%d", f.etag, f.size)
+	}
+	return ""
+}
+
+// readAtCached is readAtWith, except reads go through the BlockCache,
+// if there is one and this File can use it, or else through the File's
+// aligned blocks, see Settings.AlignedReadSize.
+func (f *File) readAtCached(ctx context.Context, data []byte, offset int64, prio Priority) (int, error) {
+	bc, resource := f.BlockCache, f.blockCacheResource()
+	if bc == nil || resource == "" {
+		if f.alignedBlocks == nil || !f.knownSize() {
+			return f.readAtWith(ctx, data, offset, false, prio)
+		}
+		// the File's own blocks, no need to tell resources apart
+		bc, resource = f.alignedBlocks, "aligned"
+	}
+
+	totalBytesRead := 0
+	for totalBytesRead < len(data) {
+		pos := offset + int64(totalBytesRead)
+		if pos >= f.size {
+			return totalBytesRead, io.EOF
+		}
+
+		key := blockKey{resource: resource, index: pos / bc.blockSize}
+		blockStart := key.index * bc.blockSize
+
+		block, ok := bc.get(key)
+		if ok {
+			f.stats.addBlockHit()
+		} else {
+			f.stats.addBlockMiss()
+
+			blockLen := bc.blockSize
+			if blockStart+blockLen > f.size {
+				blockLen = f.size - blockStart
+			}
+			block = make([]byte, blockLen)
+			n, err := f.readAtWith(ctx, block, blockStart, false, prio)
+			if err != nil && !(err == io.EOF && int64(n) == blockLen) {
+				// serve what we can
+				if int64(n) > pos-blockStart {
+					totalBytesRead += copy(data[totalBytesRead:], block[pos-blockStart:n])
+				}
+				return totalBytesRead, err
+			}
+			bc.put(key, block)
+		}
+
+		totalBytesRead += copy(data[totalBytesRead:], block[pos-blockStart:])
+	}
+	return totalBytesRead, nil
+}
+
+func (hs *hstats) addBlockHit() {
+	hs.add(&hs.numBlockHits, 1)
+}
+
+func (hs *hstats) addBlockMiss() {
+	hs.add(&hs.numBlockMiss, 1)
+}
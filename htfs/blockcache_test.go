@@ -0,0 +1,124 @@
+package htfs_test
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_BlockCache(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbccccdd")
+
+	ctx := &fakeStorageContext{
+		etag: `"v1"`,
+	}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	bc := htfs.NewBlockCache(&htfs.BlockCacheSettings{
+		Size:      8,
+		BlockSize: 4,
+	})
+
+	settings := defaultSettings(t)
+	settings.BlockCache = bc
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+
+	buf := make([]byte, 6)
+	_, err = hf.ReadAt(buf, 2)
+	assert.NoError(err)
+	assert.Equal([]byte("aabbbb"), buf)
+	assert.EqualValues(htfs.BlockCacheStats{Misses: 2, Size: 8}, bc.Stats())
+	assert.NoError(hf.Close())
+
+	// same resource, new File: served from memory
+	hf, err = htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	numGET := ctx.numGET
+
+	_, err = hf.ReadAt(buf, 1)
+	assert.NoError(err)
+	assert.Equal([]byte("aaabbb"), buf)
+	assert.EqualValues(numGET, ctx.numGET, "should not fetch")
+	assert.EqualValues(2, bc.Stats().Hits)
+
+	// short last block, evicts the first one
+	n, err := hf.ReadAt(buf, 12)
+	assert.Equal(io.EOF, err)
+	assert.EqualValues(2, n)
+	assert.Equal([]byte("dd"), buf[:n])
+	assert.EqualValues(6, bc.Stats().Size)
+
+	_, err = hf.ReadAt(buf[:4], 0)
+	assert.NoError(err)
+	assert.Equal([]byte("aaaa"), buf[:4])
+	assert.EqualValues(4, bc.Stats().Misses)
+	assert.NoError(hf.Close())
+
+	// different version: not shared
+	ctx.etag = `"v2"`
+	hf, err = htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	_, err = hf.ReadAt(buf[:4], 0)
+	assert.NoError(err)
+	assert.EqualValues(5, bc.Stats().Misses)
+	assert.NoError(hf.Close())
+}
+
+func Test_FileAlignedReads(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	const blockSize = 256 * 1024
+	settings := defaultSettings(t)
+	// every read that isn't sequential needs its own request
+	settings.MaxDiscard = -1
+	htfs.WithAlignedReads(blockSize).Apply(settings)
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	defer hf.Close()
+
+	readAt := func(offset int64, length int) {
+		t.Helper()
+		buf := make([]byte, length)
+		_, err := hf.ReadAt(buf, offset)
+		assert.NoError(err)
+		assert.EqualValues(fakeData[offset:offset+int64(length)], buf)
+	}
+
+	// fetches start on a block boundary...
+	numGET := ctx.numGET
+	readAt(1000000, 100)
+	assert.EqualValues(numGET+1, ctx.numGET)
+	assert.EqualValues(fmt.Sprintf("bytes=%d-", 3*blockSize), ctx.lastHeader.Get("Range"))
+
+	// ...and the rest of the block is served from memory
+	readAt(1000500, 100)
+	readAt(800000, 4096)
+	assert.EqualValues(numGET+1, ctx.numGET)
+
+	readAt(3000000, 100)
+	assert.EqualValues(numGET+2, ctx.numGET)
+	assert.EqualValues(fmt.Sprintf("bytes=%d-", 11*blockSize), ctx.lastHeader.Get("Range"))
+
+	// a few blocks are kept
+	readAt(1000000, 100)
+	assert.EqualValues(numGET+2, ctx.numGET)
+
+	// reads that span blocks still work
+	readAt(4*blockSize-10, 20)
+	readAt(int64(len(fakeData))-10, 10)
+}
@@ -0,0 +1,45 @@
+package htfs
+
+import (
+	goerrors "errors"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ErrBudgetExceeded is returned by reads once a File has fetched more
+// than Settings.MaxFetchedBytes from the network. It's not retried.
+var ErrBudgetExceeded = goerrors.New("htfs.File fetched more bytes than its budget allows")
+
+// fetchBudget counts the bytes a File fetches from the network,
+// across all its conns and multi-range reads, see Settings.MaxFetchedBytes
+type fetchBudget struct {
+	// fetched needs to be 64-bit aligned
+	fetched int64
+	max     int64
+}
+
+// spend accounts for n more bytes fetched, and returns ErrBudgetExceeded
+// if that's more than the budget allows
+func (fb *fetchBudget) spend(n int64) error {
+	if fb.max <= 0 {
+		return nil
+	}
+	return fb.checkTotal(atomic.AddInt64(&fb.fetched, n))
+}
+
+// check returns ErrBudgetExceeded if the budget is already spent, so
+// no new requests are made
+func (fb *fetchBudget) check() error {
+	if fb.max <= 0 {
+		return nil
+	}
+	return fb.checkTotal(atomic.LoadInt64(&fb.fetched))
+}
+
+func (fb *fetchBudget) checkTotal(fetched int64) error {
+	if fetched > fb.max {
+		return errors.Wrapf(ErrBudgetExceeded, "fetched %d bytes, budget is %d", fetched, fb.max)
+	}
+	return nil
+}
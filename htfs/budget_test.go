@@ -0,0 +1,50 @@
+package htfs_test
+
+import (
+	"testing"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileMaxFetchedBytes(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	settings := defaultSettings(t)
+	htfs.WithMaxFetchedBytes(1024 * 1024).Apply(settings)
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	defer hf.Close()
+
+	// reads within budget work as usual
+	buf := make([]byte, 256*1024)
+	_, err = hf.ReadAt(buf, 0)
+	assert.NoError(err)
+	assert.EqualValues(fakeData[:len(buf)], buf)
+
+	// reading further fails once the budget is spent
+	var offset int64
+	for offset = int64(len(buf)); offset < int64(len(fakeData)); offset += int64(len(buf)) {
+		_, err = hf.ReadAt(buf, offset)
+		if err != nil {
+			break
+		}
+	}
+	assert.True(offset <= 1024*1024, "should fail soon after 1MiB, not at %d", offset)
+	assert.Error(err)
+	assert.Equal(htfs.ErrBudgetExceeded, errors.Cause(err))
+
+	// and there's no more requests past that
+	numGET := ctx.numGET
+	_, err = hf.ReadAt(buf, 3*1024*1024)
+	assert.Equal(htfs.ErrBudgetExceeded, errors.Cause(err))
+	assert.EqualValues(numGET, ctx.numGET)
+}
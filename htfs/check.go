@@ -0,0 +1,414 @@
+package htfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// defaultCheckSampleSize is used when CheckSettings.SampleSize isn't set
+const defaultCheckSampleSize int64 = 64 * 1024
+
+// CheckSettings configures CheckServer, the zero value is fine
+type CheckSettings struct {
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+	// Header holds extra headers for every request, like Settings.RequestHeaders
+	Header http.Header
+	// SampleSize is how many bytes ranged requests ask for, at most.
+	// Defaults to 64KiB.
+	SampleSize int64
+}
+
+// A CheckResult is the outcome of one of CheckServer's checks
+type CheckResult struct {
+	// Name is short, like "range" or "etag"
+	Name string
+	// OK is false if htfs won't work, or won't work well, with the server
+	OK bool
+	// Detail is what was observed
+	Detail string
+}
+
+// A CheckReport is what CheckServer found out about a server
+type CheckReport struct {
+	// URL is the URL that was checked, with its query string redacted
+	URL string
+	// Size is the file's size, or -1 if the server didn't say
+	Size int64
+	// ETag is the strong ETag of the first response, if any
+	ETag string
+	// Results has one entry per check, in the order they ran
+	Results []CheckResult
+}
+
+// OK returns true if every check passed
+func (cr *CheckReport) OK() bool {
+	for _, r := range cr.Results {
+		if !r.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the report for humans, one check per line
+func (cr *CheckReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "htfs server check for %s\n", cr.URL)
+	fmt.Fprintf(&sb, "size: %d, etag: %s\n", cr.Size, cr.ETag)
+	for _, r := range cr.Results {
+		status := "ok  "
+		if !r.OK {
+			status = "FAIL"
+		}
+		fmt.Fprintf(&sb, "[%s] %s: %s\n", status, r.Name, r.Detail)
+	}
+	return sb.String()
+}
+
+// CheckServer probes urlStr for the behaviors htfs depends on: Range
+// support, Content-Range headers that agree with the file's size, a
+// stable ETag (or Last-Modified) that If-Range honors, uncompressed
+// responses, and consistent data for overlapping ranges requested at
+// the same time. It's meant to vet servers and CDNs before pointing
+// htfs at them, it makes a handful of small requests.
+//
+// An error is only returned if the first request fails, or gets
+// a non-2xx response: otherwise, see CheckReport.OK.
+func CheckServer(ctx context.Context, urlStr string, settings *CheckSettings) (*CheckReport, error) {
+	if settings == nil {
+		settings = &CheckSettings{}
+	}
+	sc := &serverCheck{
+		ctx:      ctx,
+		url:      urlStr,
+		settings: settings,
+		client:   settings.Client,
+		report: &CheckReport{
+			URL:  redactURL(urlStr),
+			Size: -1,
+		},
+	}
+	if sc.client == nil {
+		sc.client = http.DefaultClient
+	}
+	sc.sampleSize = settings.SampleSize
+	if sc.sampleSize <= 0 {
+		sc.sampleSize = defaultCheckSampleSize
+	}
+
+	err := sc.checkInitial()
+	if err != nil {
+		return nil, err
+	}
+	sc.checkRanges()
+	sc.checkValidators()
+	return sc.report, nil
+}
+
+type serverCheck struct {
+	ctx        context.Context
+	url        string
+	settings   *CheckSettings
+	client     *http.Client
+	sampleSize int64
+	report     *CheckReport
+
+	// etags and lastModifieds are all the values seen, in order
+	mu            sync.Mutex
+	etags         []string
+	lastModifieds []string
+
+	// sample is the data of the first ranged request
+	sample []byte
+}
+
+// checkResponse is a response whose body was read, up to a limit
+type checkResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (sc *serverCheck) result(name string, ok bool, format string, args ...interface{}) {
+	sc.report.Results = append(sc.report.Results, CheckResult{
+		Name:   name,
+		OK:     ok,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+// get does a GET request with the given Range header (if non-empty) and
+// extra headers, and reads up to maxBody bytes of the response
+func (sc *serverCheck) get(rangeSpec string, header http.Header, maxBody int64) (*checkResponse, error) {
+	req, err := http.NewRequest("GET", sc.url, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req = req.WithContext(sc.ctx)
+	for k, vv := range sc.settings.Header {
+		for _, v := range vv {
+			req.Header.Add(k, v)
+		}
+	}
+	for k, vv := range header {
+		req.Header[k] = vv
+	}
+	req.Header.Set("Accept-Encoding", IdentityEncoding)
+	if rangeSpec != "" {
+		req.Header.Set("Range", rangeSpec)
+	}
+
+	res, err := sc.client.Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxBody))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if res.StatusCode/100 == 2 {
+		sc.mu.Lock()
+		sc.etags = append(sc.etags, res.Header.Get("ETag"))
+		sc.lastModifieds = append(sc.lastModifieds, res.Header.Get("Last-Modified"))
+		sc.mu.Unlock()
+	}
+	return &checkResponse{
+		status: res.StatusCode,
+		header: res.Header,
+		body:   body,
+	}, nil
+}
+
+// checkInitial makes the same request as htfs.Open, to find out the size
+func (sc *serverCheck) checkInitial() error {
+	res, err := sc.get("bytes=0-", nil, 0)
+	if err != nil {
+		return errors.Wrapf(err, "htfs.CheckServer (initial request)")
+	}
+	if res.status/100 != 2 {
+		return errors.Errorf("htfs.CheckServer (initial request): got HTTP %d", res.status)
+	}
+
+	sc.report.ETag = strongETag(res.header)
+	switch res.status {
+	case 206:
+		total := contentRangeTotal(res.header.Get("Content-Range"))
+		if total < 0 {
+			sc.result("initial", false, "HTTP 206 with an invalid Content-Range %q", res.header.Get("Content-Range"))
+		} else {
+			sc.report.Size = total
+			sc.result("initial", true, "HTTP 206, %d bytes", total)
+		}
+	default:
+		size, err := strconv.ParseInt(res.header.Get("Content-Length"), 10, 64)
+		if err != nil {
+			sc.result("initial", false, "HTTP %d without a Content-Length, the size is unknown", res.status)
+		} else {
+			sc.report.Size = size
+			sc.result("initial", true, "HTTP %d, %d bytes", res.status, size)
+		}
+	}
+
+	if encoding := res.header.Get("Content-Encoding"); encoding != "" && encoding != IdentityEncoding {
+		sc.result("encoding", false, "Content-Encoding %s despite Accept-Encoding %s, byte ranges won't line up", encoding, IdentityEncoding)
+	} else {
+		sc.result("encoding", true, "responses aren't compressed")
+	}
+	return nil
+}
+
+// sampleRange returns where and how much ranged requests ask for
+func (sc *serverCheck) sampleRange() (int64, int64) {
+	size := sc.report.Size
+	n := sc.sampleSize
+	if n > size/2 {
+		n = size / 2
+	}
+	if n < 1 {
+		n = 1
+	}
+	return size / 4, n
+}
+
+// checkRanges checks closed, open-ended and overlapping ranges
+func (sc *serverCheck) checkRanges() {
+	size := sc.report.Size
+	if size < 2 {
+		sc.result("range", false, "the file's size is %d, ranges can't be checked", size)
+		return
+	}
+	offset, n := sc.sampleRange()
+
+	// closed range
+	res, err := sc.get(fmt.Sprintf("bytes=%d-%d", offset, offset+n-1), nil, n+1)
+	if err != nil {
+		sc.result("range", false, "request failed: %v", err)
+		return
+	}
+	if res.status != 206 {
+		sc.result("range", false, "HTTP %d for a Range request, Range isn't supported (see Settings.SpillNoRange)", res.status)
+		return
+	}
+	contentRange := res.header.Get("Content-Range")
+	start, end, err := parseContentRange(contentRange)
+	switch {
+	case err != nil:
+		sc.result("range", false, "%v", err)
+		return
+	case start != offset || end != offset+n:
+		sc.result("range", false, "asked for bytes %d-%d, got Content-Range %q", offset, offset+n-1, contentRange)
+		return
+	case int64(len(res.body)) != n:
+		sc.result("range", false, "asked for %d bytes, got %d", n, len(res.body))
+		return
+	}
+	sc.sample = res.body
+	sc.result("range", true, "HTTP 206 for bytes %d-%d", offset, offset+n-1)
+
+	if total := contentRangeTotal(contentRange); total != size {
+		sc.result("content-range", false, "Content-Range %q disagrees with the size, %d", contentRange, size)
+	} else {
+		sc.checkOpenEnded()
+	}
+
+	sc.checkOverlapping()
+}
+
+// checkOpenEnded checks "bytes=N-", which is what htfs conns request
+func (sc *serverCheck) checkOpenEnded() {
+	size := sc.report.Size
+	_, n := sc.sampleRange()
+	offset := size - n
+
+	res, err := sc.get(fmt.Sprintf("bytes=%d-", offset), nil, n+1)
+	if err != nil {
+		sc.result("content-range", false, "request failed: %v", err)
+		return
+	}
+	contentRange := res.header.Get("Content-Range")
+	start, end, err := parseContentRange(contentRange)
+	switch {
+	case res.status != 206:
+		sc.result("content-range", false, "HTTP %d for bytes=%d-", res.status, offset)
+	case err != nil:
+		sc.result("content-range", false, "%v", err)
+	case start != offset || end != size || contentRangeTotal(contentRange) != size:
+		sc.result("content-range", false, "asked for bytes=%d- of %d bytes, got Content-Range %q", offset, size, contentRange)
+	case int64(len(res.body)) != n:
+		sc.result("content-range", false, "asked for the last %d bytes, got %d", n, len(res.body))
+	default:
+		sc.result("content-range", true, "totals match the size, open-ended ranges are honored")
+	}
+}
+
+// checkOverlapping requests two overlapping ranges at the same
+// time, and checks they agree with each other and the sample
+func (sc *serverCheck) checkOverlapping() {
+	offset, n := sc.sampleRange()
+	half := n / 2
+	type result struct {
+		res *checkResponse
+		err error
+	}
+	first := make(chan result, 1)
+	second := make(chan result, 1)
+	go func() {
+		res, err := sc.get(fmt.Sprintf("bytes=%d-%d", offset, offset+n-1), nil, n+1)
+		first <- result{res, err}
+	}()
+	go func() {
+		res, err := sc.get(fmt.Sprintf("bytes=%d-%d", offset+half, offset+half+n-1), nil, n+1)
+		second <- result{res, err}
+	}()
+	a, b := <-first, <-second
+
+	for _, r := range []result{a, b} {
+		if r.err != nil {
+			sc.result("overlapping", false, "request failed: %v", r.err)
+			return
+		}
+		if r.res.status != 206 || int64(len(r.res.body)) != n {
+			sc.result("overlapping", false, "got HTTP %d with %d bytes, for %d bytes", r.res.status, len(r.res.body), n)
+			return
+		}
+	}
+	if !bytes.Equal(a.res.body, sc.sample) {
+		sc.result("overlapping", false, "bytes %d-%d changed since the first request", offset, offset+n-1)
+		return
+	}
+	if !bytes.Equal(a.res.body[half:], b.res.body[:n-half]) {
+		sc.result("overlapping", false, "concurrent requests disagree on bytes %d-%d", offset+half, offset+n-1)
+		return
+	}
+	sc.result("overlapping", true, "concurrent overlapping ranges agree")
+}
+
+// checkValidators checks that ETag (or Last-Modified) stays the
+// same, and that If-Range honors it, since htfs validates
+// reconnects with it
+func (sc *serverCheck) checkValidators() {
+	validator := sc.report.ETag
+	kind := "ETag"
+	seen := sc.etags
+	if validator == "" {
+		kind = "Last-Modified"
+		seen = sc.lastModifieds
+		if len(seen) > 0 {
+			validator = seen[0]
+		}
+	}
+	if validator == "" {
+		sc.result("etag", false, "no strong ETag nor Last-Modified, changes to the file can't be detected")
+		return
+	}
+	for _, v := range seen {
+		if v != validator {
+			sc.result("etag", false, "%s changed between requests, from %s to %s", kind, validator, v)
+			return
+		}
+	}
+	if kind == "ETag" {
+		sc.result("etag", true, "strong ETag %s, stable across %d responses", validator, len(seen))
+	} else {
+		sc.result("etag", true, "no strong ETag, Last-Modified %s is stable across %d responses", validator, len(seen))
+	}
+
+	if sc.report.Size < 2 {
+		return
+	}
+	offset, n := sc.sampleRange()
+	header := http.Header{}
+	header.Set("If-Range", validator)
+	res, err := sc.get(fmt.Sprintf("bytes=%d-%d", offset, offset+n-1), header, n+1)
+	switch {
+	case err != nil:
+		sc.result("if-range", false, "request failed: %v", err)
+	case res.status != 206:
+		sc.result("if-range", false, "HTTP %d for If-Range %s, reconnects will fail", res.status, validator)
+	default:
+		sc.result("if-range", true, "HTTP 206 for If-Range %s", validator)
+	}
+}
+
+// contentRangeTotal returns the total of a Content-Range
+// header, or -1 if it's unknown or invalid
+func contentRangeTotal(contentRange string) int64 {
+	total, err := parseContentRangeTotal(contentRange)
+	if err != nil {
+		return -1
+	}
+	return total
+}
@@ -0,0 +1,72 @@
+package htfs_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CheckServer(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file.dat", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer good.Close()
+
+	report, err := htfs.CheckServer(context.Background(), good.URL+"/file.dat?sig=secret", nil)
+	assert.NoError(err)
+	assert.True(report.OK(), "%s", report)
+	assert.EqualValues(len(fakeData), report.Size)
+	assert.EqualValues(`"v1"`, report.ETag)
+	assert.NotContains(report.String(), "secret")
+
+	var names []string
+	for _, r := range report.Results {
+		names = append(names, r.Name)
+	}
+	assert.EqualValues([]string{"initial", "encoding", "range", "content-range", "overlapping", "etag", "if-range"}, names)
+
+	// a CDN that serves a new ETag every time
+	var numRequests int64
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, atomic.AddInt64(&numRequests, 1)))
+		http.ServeContent(w, r, "file.dat", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer flaky.Close()
+
+	report, err = htfs.CheckServer(context.Background(), flaky.URL, nil)
+	assert.NoError(err)
+	assert.False(report.OK())
+	assert.Contains(report.String(), "[FAIL] etag: ETag changed between requests")
+
+	// a server that ignores Range
+	noRange := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(fakeData)))
+		w.Write(fakeData)
+	}))
+	defer noRange.Close()
+
+	report, err = htfs.CheckServer(context.Background(), noRange.URL, &htfs.CheckSettings{SampleSize: 1024})
+	assert.NoError(err)
+	assert.False(report.OK())
+	assert.Contains(report.String(), "[FAIL] range: HTTP 200 for a Range request")
+	assert.Contains(report.String(), "[FAIL] etag: no strong ETag nor Last-Modified")
+
+	// the initial request has to work
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	_, err = htfs.CheckServer(context.Background(), missing.URL, nil)
+	assert.Error(err)
+}
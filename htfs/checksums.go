@@ -0,0 +1,198 @@
+package htfs
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	goerrors "errors"
+
+	"github.com/pkg/errors"
+)
+
+// Checksum algorithms found in Checksums
+const (
+	ChecksumMD5    = "md5"
+	ChecksumCRC32C = "crc32c"
+	ChecksumSHA256 = "sha256"
+)
+
+// Checksums maps algorithms (ChecksumMD5, etc.) to the digest of
+// the whole file, as advertised by the server.
+type Checksums map[string][]byte
+
+// ErrNoChecksums is returned by VerifyingReader when the server
+// didn't advertise any checksum we know how to compute.
+var ErrNoChecksums = goerrors.New("HTTP file has no known checksums")
+
+// ChecksumMismatchError is returned when the data read doesn't
+// match a checksum advertised by the server.
+type ChecksumMismatchError struct {
+	Algorithm string
+	Expected  []byte
+	Actual    []byte
+}
+
+func (cme *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch: expected %x, got %x", cme.Algorithm, cme.Expected, cme.Actual)
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func newChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case ChecksumMD5:
+		return md5.New()
+	case ChecksumCRC32C:
+		return crc32.New(crc32cTable)
+	case ChecksumSHA256:
+		return sha256.New()
+	}
+	return nil
+}
+
+// parseChecksums recognizes:
+//   - x-goog-hash: crc32c=<base64>, md5=<base64> (Google Cloud Storage)
+//   - x-amz-checksum-crc32c and x-amz-checksum-sha256 (Amazon S3)
+//   - Content-MD5 (RFC 1864), only if wholeBody is set, since it's
+//     the digest of the bytes sent, ie. of a range for a 206 response
+//
+// Values that aren't valid base64 are ignored.
+func parseChecksums(header http.Header, wholeBody bool) Checksums {
+	checksums := make(Checksums)
+	add := func(algorithm string, value string) {
+		digest, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(digest) == 0 {
+			return
+		}
+		checksums[algorithm] = digest
+	}
+
+	for _, line := range header[http.CanonicalHeaderKey("x-goog-hash")] {
+		for _, token := range strings.Split(line, ",") {
+			kv := strings.SplitN(strings.TrimSpace(token), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch strings.ToLower(kv[0]) {
+			case "md5":
+				add(ChecksumMD5, kv[1])
+			case "crc32c":
+				add(ChecksumCRC32C, kv[1])
+			}
+		}
+	}
+
+	if value := header.Get("x-amz-checksum-crc32c"); value != "" {
+		add(ChecksumCRC32C, value)
+	}
+	if value := header.Get("x-amz-checksum-sha256"); value != "" {
+		add(ChecksumSHA256, value)
+	}
+	if _, ok := checksums[ChecksumMD5]; !ok && wholeBody {
+		if value := header.Get("content-md5"); value != "" {
+			add(ChecksumMD5, value)
+		}
+	}
+	return checksums
+}
+
+// Checksums returns the digests of the whole file advertised by the server
+// in its initial response, if any. See VerifyingReader.
+func (f *File) Checksums() Checksums {
+	if f.opened() != nil || f.initialResponse == nil {
+		return nil
+	}
+	// HEAD responses are 200 too, and describe the whole body
+	ir := f.initialResponse
+	return parseChecksums(ir.Header, ir.StatusCode == http.StatusOK)
+}
+
+// VerifyingReader returns a reader for the whole file, from the start,
+// that computes digests as data flows through it, and compares them with
+// Checksums when reaching the end. On mismatch, Read returns a
+// *ChecksumMismatchError instead of io.EOF.
+//
+// It reads through ReadAt, so it doesn't change the File's offset. If the
+// server didn't advertise any checksum, ErrNoChecksums is returned.
+func (f *File) VerifyingReader() (io.Reader, error) {
+	if err := f.opened(); err != nil {
+		return nil, err
+	}
+	checksums := f.Checksums()
+
+	vr := &verifyingReader{
+		reader: io.NewSectionReader(f, 0, f.size),
+		hashes: make(map[string]hash.Hash),
+	}
+	var writers []io.Writer
+	for algorithm, digest := range checksums {
+		h := newChecksumHash(algorithm)
+		if h == nil {
+			continue
+		}
+		vr.hashes[algorithm] = h
+		vr.expected = append(vr.expected, expectedDigest{algorithm, digest})
+		writers = append(writers, h)
+	}
+	if len(writers) == 0 {
+		return nil, errors.WithStack(ErrNoChecksums)
+	}
+	// report mismatches in a stable order
+	sort.Slice(vr.expected, func(i, j int) bool {
+		return vr.expected[i].algorithm < vr.expected[j].algorithm
+	})
+	vr.writer = io.MultiWriter(writers...)
+	return vr, nil
+}
+
+type expectedDigest struct {
+	algorithm string
+	digest    []byte
+}
+
+type verifyingReader struct {
+	reader   io.Reader
+	writer   io.Writer
+	hashes   map[string]hash.Hash
+	expected []expectedDigest
+	err      error
+}
+
+func (vr *verifyingReader) Read(buf []byte) (int, error) {
+	if vr.err != nil {
+		return 0, vr.err
+	}
+
+	n, err := vr.reader.Read(buf)
+	vr.writer.Write(buf[:n])
+	if err == io.EOF {
+		err = vr.verify()
+	}
+	if err != nil {
+		vr.err = err
+	}
+	return n, err
+}
+
+func (vr *verifyingReader) verify() error {
+	for _, ed := range vr.expected {
+		actual := vr.hashes[ed.algorithm].Sum(nil)
+		if !bytes.Equal(actual, ed.digest) {
+			return errors.WithStack(&ChecksumMismatchError{
+				Algorithm: ed.algorithm,
+				Expected:  ed.digest,
+				Actual:    actual,
+			})
+		}
+	}
+	return io.EOF
+}
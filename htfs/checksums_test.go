@@ -0,0 +1,97 @@
+package htfs_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func checksumServer(content []byte, headers map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range headers {
+			w.Header().Add(k, v)
+		}
+		http.ServeContent(w, r, "file.dat", time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+func Test_FileChecksums(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbcccc")
+
+	md5Sum := md5.Sum(fakeData)
+	crc32c := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	crc32c.Write(fakeData)
+	crcSum := crc32c.Sum(nil)
+
+	b64 := base64.StdEncoding.EncodeToString
+	server := checksumServer(fakeData, map[string]string{
+		"x-goog-hash": "crc32c=" + b64(crcSum) + ", md5=" + b64(md5Sum[:]),
+	})
+	defer server.Close()
+
+	hf, err := htfs.Open(storageServerURL(server), noRenewal, defaultSettings(t))
+	assert.NoError(err)
+
+	checksums := hf.Checksums()
+	assert.EqualValues(md5Sum[:], checksums[htfs.ChecksumMD5])
+	assert.EqualValues(crcSum, checksums[htfs.ChecksumCRC32C])
+
+	vr, err := hf.VerifyingReader()
+	assert.NoError(err)
+	contents, err := ioutil.ReadAll(vr)
+	assert.NoError(err)
+	assert.EqualValues(fakeData, contents)
+	assert.NoError(hf.Close())
+
+	// wrong Content-MD5
+	badSum := md5.Sum([]byte("something else"))
+	server = checksumServer(fakeData, map[string]string{
+		"content-md5": b64(badSum[:]),
+	})
+	defer server.Close()
+
+	// it's only for the bytes sent in a 206 response
+	hf, err = htfs.Open(storageServerURL(server), noRenewal, defaultSettings(t))
+	assert.NoError(err)
+	assert.Empty(hf.Checksums())
+	assert.NoError(hf.Close())
+
+	headSettings := defaultSettings(t)
+	htfs.WithSizeProbe(htfs.SizeProbeHead).Apply(headSettings)
+	hf, err = htfs.Open(storageServerURL(server), noRenewal, headSettings)
+	assert.NoError(err)
+
+	vr, err = hf.VerifyingReader()
+	assert.NoError(err)
+	_, err = ioutil.ReadAll(vr)
+	assert.Error(err)
+	cme, ok := errors.Cause(err).(*htfs.ChecksumMismatchError)
+	assert.True(ok)
+	if ok {
+		assert.EqualValues(htfs.ChecksumMD5, cme.Algorithm)
+		assert.EqualValues(md5Sum[:], cme.Actual)
+	}
+	assert.NoError(hf.Close())
+
+	// no checksums
+	server = checksumServer(fakeData, nil)
+	defer server.Close()
+
+	hf, err = htfs.Open(storageServerURL(server), noRenewal, defaultSettings(t))
+	assert.NoError(err)
+	assert.Empty(hf.Checksums())
+	_, err = hf.VerifyingReader()
+	assert.True(errors.Cause(err) == htfs.ErrNoChecksums)
+	assert.NoError(hf.Close())
+}
@@ -0,0 +1,66 @@
+package htfs
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Clone returns another File for the same remote file, for concurrent
+// pipelines that would otherwise each open (and probe) it. The clone
+// starts with what the original found out: its size, name, validators,
+// current URL and pinned bytes, and shares its http.Client (and cookies)
+// and BlockCache. It has its own offset for Read and Seek, conns and
+// stats, and is closed separately. Cloning makes no request.
+//
+// opts are applied over the settings the File was opened with, for
+// example to give the clone other Labels, or a BlockCache of its own.
+// Files that spilled to disk (see Settings.SpillNoRange) can't be cloned.
+func (f *File) Clone(opts ...Option) (*File, error) {
+	if err := f.opened(); err != nil {
+		return nil, err
+	}
+	f.connsLock.Lock()
+	closed := f.closed
+	f.connsLock.Unlock()
+	if closed {
+		return nil, errors.WithStack(ErrClosed)
+	}
+	if f.spillFile != nil {
+		return nil, errors.New("htfs: can't clone a file spilled to disk")
+	}
+
+	settings := f.settings
+	settings.Client = f.client
+	settings.CookieJar = nil
+	settings.KeepCookies = false
+	for _, o := range opts {
+		o.Apply(&settings)
+	}
+
+	c := newFile(f.getURLs, f.needsRenewal, &settings)
+	f.urlMutex.Lock()
+	c.mirrors = append([]string(nil), f.mirrors...)
+	c.mirrorIndex = f.mirrorIndex
+	c.currentURL = f.currentURL
+	c.urlExpiresAt = f.urlExpiresAt
+	f.urlMutex.Unlock()
+
+	c.size = f.size
+	c.name = f.name
+	c.etag = f.etag
+	c.lastModified = f.lastModified
+	c.originHost = f.originHost
+	c.initialResponse = f.initialResponse
+
+	if !c.restorePins(&fileState{
+		PinnedHead:       f.pinnedHead,
+		PinnedTail:       f.pinnedTail,
+		PinnedTailOffset: f.pinnedTailOffset,
+	}) {
+		err := c.pin()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
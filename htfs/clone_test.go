@@ -0,0 +1,89 @@
+package htfs_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileClone(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	ctx := &fakeStorageContext{
+		etag: `"v1"`,
+	}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	bc := htfs.NewBlockCache(&htfs.BlockCacheSettings{
+		Size:      64 * 1024,
+		BlockSize: 4 * 1024,
+	})
+	settings := defaultSettings(t)
+	settings.BlockCache = bc
+	htfs.WithPin(1024, 1024).Apply(settings)
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	defer hf.Close()
+
+	_, err = hf.Seek(8000, io.SeekStart)
+	assert.NoError(err)
+	buf := make([]byte, 16)
+	_, err = io.ReadFull(hf, buf)
+	assert.NoError(err)
+
+	// cloning makes no request
+	numGET, numHEAD := ctx.numGET, ctx.numHEAD
+	clone, err := hf.Clone()
+	assert.NoError(err)
+	defer clone.Close()
+	assert.EqualValues(numGET, ctx.numGET)
+	assert.EqualValues(numHEAD, ctx.numHEAD)
+
+	stat, err := hf.Stat()
+	assert.NoError(err)
+	cloneStat, err := clone.Stat()
+	assert.NoError(err)
+	assert.EqualValues(stat.Name(), cloneStat.Name())
+	assert.EqualValues(stat.Size(), cloneStat.Size())
+
+	// the clone has its own offset, and pinned bytes and
+	// the BlockCache are shared
+	_, err = io.ReadFull(clone, buf)
+	assert.NoError(err)
+	assert.EqualValues(fakeData[:16], buf)
+	_, err = clone.ReadAt(buf, 8000)
+	assert.NoError(err)
+	assert.EqualValues(fakeData[8000:8016], buf)
+	assert.EqualValues(numGET, ctx.numGET)
+	assert.EqualValues(0, clone.NumConns())
+
+	// other reads open conns of its own
+	_, err = clone.ReadAt(buf, 2*1024*1024)
+	assert.NoError(err)
+	assert.EqualValues(fakeData[2*1024*1024:2*1024*1024+16], buf)
+	assert.EqualValues(numGET+1, ctx.numGET)
+	assert.EqualValues(1, clone.NumConns())
+
+	// options apply to the clone only
+	uncached, err := hf.Clone(htfs.WithBlockCache(nil, ""))
+	assert.NoError(err)
+	_, err = uncached.ReadAt(buf, 8000)
+	assert.NoError(err)
+	assert.EqualValues(fakeData[8000:8016], buf)
+	assert.EqualValues(numGET+2, ctx.numGET)
+
+	// they're closed separately
+	assert.NoError(uncached.Close())
+	_, err = uncached.Clone()
+	assert.Equal(htfs.ErrClosed, errors.Cause(err))
+	_, err = hf.ReadAt(buf, 3*1024*1024)
+	assert.NoError(err)
+	assert.EqualValues(fakeData[3*1024*1024:3*1024*1024+16], buf)
+}
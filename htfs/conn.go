@@ -2,75 +2,168 @@ package htfs
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
+	"github.com/itchio/httpkit/clock"
 	"github.com/itchio/httpkit/htfs/backtracker"
+	"github.com/itchio/httpkit/timeout"
 	"github.com/pkg/errors"
 )
 
 type conn struct {
 	backtracker.Backtracker
 
-	file       *File
-	id         string
-	touchedAt  time.Time
-	body       io.ReadCloser
-	reader     *bufio.Reader
-	currentURL string
+	file      *File
+	id        string
+	touchedAt time.Time
+	reused    bool
+	body      io.ReadCloser
+	reader    *bufio.Reader
+	// recorder wraps body, see flushFetched
+	recorder *fetchRecorder
+	// ctx, if set, aborts the conn's requests (and reads) when done
+	ctx context.Context
+	// stallTimeout, if non-zero, overrides Settings.StallTimeout
+	stallTimeout time.Duration
+
+	// schedHost is the host our HostScheduler slot is for, if hasSlot
+	schedHost string
+	hasSlot   bool
+
+	// url and startOffset are those of the current response
+	url         string
+	startOffset int64
+	// openedAt is when we got the current response
+	openedAt time.Time
 
 	header        http.Header
 	requestURL    *url.URL
 	statusCode    int
 	contentLength int64
+	proto         string
+	protoMajor    int
+	protoMinor    int
+	tls           *tls.ConnectionState
+
+	// sample is set while a sampled Connect is in progress
+	sample *RequestTrace
 }
 
 func (c *conn) Stale() bool {
-	return time.Since(c.touchedAt) > c.file.ConnStaleThreshold
+	return c.idleTime() > c.file.ConnStaleThreshold
+}
+
+func (c *conn) idleTime() time.Duration {
+	return clock.Since(c.file.clock, c.touchedAt)
 }
 
 // *not* thread-safe, File handles the locking
 func (c *conn) Connect(offset int64) error {
+	c.sample = c.file.sampleRequest(c.id, offset)
+	err := c.connect(offset)
+	c.file.finishSample(c.sample, err)
+	c.sample = nil
+	return err
+}
+
+func (c *conn) connect(offset int64) error {
 	hf := c.file
 
 	if c.body != nil {
-		err := c.body.Close()
+		err := c.closeBody(hf.getCurrentURL())
 		if err != nil {
 			return errors.Wrapf(err, "in conn.Connect, while closing previous body")
 		}
 
-		c.body = nil
 		c.reader = nil
 	}
+	c.reused = false
 
 	retryCtx := hf.newRetryContext()
 	renewalTries := 0
+	// mirrors tried since the last general retry
+	failovers := 0
 
-	hf.currentURL = hf.getCurrentURL()
+	// while the URL is being renewed, this is the previous one: it
+	// usually keeps working for a while, so don't wait for the renewal
+	currentURL, generation := hf.freshURL(offset)
 	for retryCtx.ShouldTry() {
-		startTime := time.Now()
-		err := c.tryConnect(offset)
+		if latestURL, latestGen := hf.getURLState(); latestGen != generation {
+			// renewed by another conn in the meantime
+			currentURL, generation = latestURL, latestGen
+		}
+
+		startTime := hf.clock.Now()
+		hf.Trace.connectStart(offset)
+		err := c.tryConnect(offset, currentURL)
+		hf.Trace.connectDone(offset, clock.Since(hf.clock, startTime), err)
 		if err != nil {
+			if rnse, ok := err.(*rangeNotSatisfiableError); ok {
+				hf.debug("connect: range not satisfiable, at end of file", "offset", offset, "size", rnse.size)
+				return io.EOF
+			}
 			if _, ok := err.(*needsRenewalError); ok {
-				renewalTries++
-				if renewalTries >= maxRenewals {
-					return errors.Wrapf(ErrTooManyRenewals, "in conn.Connect, exceeded maxRenewals")
+				c.sample.next("renew", err)
+				if _, latestGen := hf.getURLState(); latestGen != generation {
+					// renewed by another conn in the meantime,
+					// the new URL is picked up above
+					continue
 				}
-				hf.log("[%9d-%9d] (Connect) renewing on %v", offset, offset, err)
 
-				err = c.renewURLWithRetries(offset)
+				delay, numRecent := hf.renewalDelay()
+				if delay > 0 {
+					if renewalTries >= hf.MaxRenewalsPerWindow {
+						// all those renewals were ours, and none of them helped
+						return errors.Wrapf(ErrTooManyRenewals, "in conn.Connect, %d renewals in a row", renewalTries)
+					}
+					hf.info("connect: too many renewals, waiting", "offset", offset, "renewals", numRecent, "window", hf.RenewalWindow, "delay", delay)
+					ctx := hf.ctx
+					if c.ctx != nil {
+						ctx = c.ctx
+					}
+					select {
+					case <-hf.clock.After(delay):
+					case <-ctx.Done():
+						return errors.WithStack(ErrClosed)
+					}
+				}
+				renewalTries++
+				hf.info("connect: renewing", "offset", offset, "err", err)
+
+				renewStart := hf.clock.Now()
+				currentURL, generation, err = c.renewURLWithRetries(offset, generation)
+				if c.sample != nil {
+					c.sample.RenewDuration += clock.Since(hf.clock, renewStart)
+				}
 				if err != nil {
 					// if we reach this point, we've failed to generate
 					// a download URL a bunch of times in a row
 					return errors.Wrapf(err, "in conn.Connect (failed to generate URLs a few times)")
 				}
 				continue
+			} else if isMirrorError(err) && failovers+1 < hf.numMirrors() {
+				c.sample.next("failover", err)
+				failovers++
+				currentURL = hf.nextMirror()
+				hf.info("connect: trying next mirror", "offset", offset, "mirror", urlHost(currentURL), "err", err)
+				hf.stats.add(&hf.stats.failovers, 1)
+				continue
 			} else if hf.shouldRetry(err) {
-				hf.log("[%9d-%9d] (Connect) retrying %v", offset, offset, err)
+				hf.info("connect: retrying", "offset", offset, "err", err)
+				c.sample.next("retry", err)
+				if failovers > 0 {
+					// every mirror failed, start the next round with another one
+					failovers = 0
+					currentURL = hf.nextMirror()
+				}
 				retryCtx.Retry(err)
 				continue
 			} else {
@@ -78,56 +171,115 @@ func (c *conn) Connect(offset int64) error {
 			}
 		}
 
-		totalConnDuration := time.Since(startTime)
-		hf.log("[%9d-%9d] (Connect) %s", offset, offset, totalConnDuration)
-		hf.stats.connections++
-		hf.stats.connectionWait += totalConnDuration
+		totalConnDuration := clock.Since(hf.clock, startTime)
+		c.openedAt = hf.clock.Now()
+		hf.Trace.connOpened(ConnEvent{
+			ID:       c.id,
+			Host:     urlHost(c.url),
+			Offset:   offset,
+			Duration: totalConnDuration,
+		})
+		keyvals := []interface{}{"offset", offset, "duration", totalConnDuration}
+		if ids := hf.responseIDs(c.header); ids != nil {
+			keyvals = append(keyvals, "ids", formatResponseIDs(ids))
+		}
+		hf.info("connect: done", keyvals...)
+		hf.connectLatency.record(totalConnDuration)
+		hf.stats.add(&hf.stats.connections, 1)
+		hf.stats.add(&hf.stats.connectionWait, int64(totalConnDuration))
 		return nil
 	}
 
 	return errors.Wrapf(retryCtx.LastError, "in conn.Connect, exhausted retry context")
 }
 
-func (c *conn) renewURLWithRetries(offset int64) error {
+// renewURLWithRetries returns a URL to replace the one of
+// generation staleGen, and its generation
+func (c *conn) renewURLWithRetries(offset int64, staleGen int64) (string, int64, error) {
 	hf := c.file
 	renewRetryCtx := hf.newRetryContext()
 
 	for renewRetryCtx.ShouldTry() {
-		var err error
-		hf.stats.renews++
-		c.currentURL, err = hf.renewURL()
+		urlStr, generation, err := hf.renewURL(staleGen)
 		if err != nil {
 			if hf.shouldRetry(err) {
-				hf.log("[%9d-%9d] (Connect) retrying %v", offset, offset, err)
+				hf.info("renew: retrying", "offset", offset, "err", err)
 				renewRetryCtx.Retry(err)
 				continue
 			} else {
-				hf.log("[%9d-%9d] (Connect) bailing on %v", offset, offset, err)
-				return errors.Wrapf(err, "in conn.renewURLWithRetries, non-retriable error")
+				hf.warn("renew: giving up", "offset", offset, "err", err)
+				return "", staleGen, errors.Wrapf(err, "in conn.renewURLWithRetries, non-retriable error")
 			}
 		}
 
-		return nil
+		return urlStr, generation, nil
 	}
-	return errors.Wrapf(renewRetryCtx.LastError, "in conn.renewURLWithRetries, exhausted retry context")
+	return "", staleGen, errors.Wrapf(renewRetryCtx.LastError, "in conn.renewURLWithRetries, exhausted retry context")
 }
 
-func (c *conn) tryConnect(offset int64) error {
+func (c *conn) tryConnect(offset int64, urlStr string) error {
 	hf := c.file
 
-	req, err := http.NewRequest("GET", hf.currentURL, nil)
+	err := hf.budget.check()
+	if err != nil {
+		return errors.Wrapf(err, "in conn.tryConnect")
+	}
+
+	req, err := http.NewRequest("GET", urlStr, nil)
 	if err != nil {
 		return errors.Wrapf(err, "in conn.tryConnect, while creating new GET request")
 	}
 
 	byteRange := fmt.Sprintf("bytes=%d-", offset)
 	req.Header.Set("Range", byteRange)
+	validate := hf.shouldValidate(urlStr)
+	if validate && hf.etag != "" {
+		// have the server reject our request if the file was replaced
+		req.Header.Set("If-Match", hf.etag)
+	}
+	var validator string
+	if validate {
+		validator = hf.validator()
+	}
+	if validator != "" {
+		// for servers that ignore If-Match: get the whole file instead
+		// of a range if it was replaced, so we can tell
+		req.Header.Set("If-Range", validator)
+	}
+	if hf.AcceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", hf.AcceptEncoding)
+	}
+	if hf.TE != "" {
+		req.Header.Set("TE", hf.TE)
+	}
+	err = hf.prepareRequest(req)
+	if err != nil {
+		return errors.Wrapf(err, "in conn.tryConnect, while preparing GET request")
+	}
 
+	if c.ctx != nil {
+		req = req.WithContext(c.ctx)
+	}
+	hf.pace(req)
+	req = hf.traceTLS(req)
+	attempt := c.sample.startAttempt(hf, req)
 	res, err := hf.client.Do(req)
+	attempt.done(hf, res, err)
 	if err != nil {
 		return errors.Wrapf(err, "in conn.tryConnect, while doing GET request")
 	}
 
+	if validate && res.StatusCode/100 == 2 && hf.resourceChanged(res.Header) {
+		// with If-Range, that's typically a 200 with the whole new file
+		res.Body.Close()
+		return errors.Wrapf(ErrResourceChanged, "in conn.tryConnect, got HTTP %d for If-Range %s", res.StatusCode, validator)
+	}
+
+	if !validate && hf.sizeChanged(res) {
+		res.Body.Close()
+		return errors.Wrapf(ErrResourceChanged, "in conn.tryConnect, mirror %s disagrees on file size", req.Host)
+	}
+
 	if res.StatusCode == 200 && offset > 0 {
 		defer res.Body.Close()
 		se := &ServerError{
@@ -139,6 +291,28 @@ func (c *conn) tryConnect(offset int64) error {
 		return errors.Wrapf(se, "in conn.tryConnect, got HTTP 200 for non-zero offset")
 	}
 
+	if res.StatusCode == 412 && validate && hf.etag != "" {
+		res.Body.Close()
+		return errors.Wrapf(ErrResourceChanged, "in conn.tryConnect, got HTTP 412 for If-Match %s", hf.etag)
+	}
+
+	if res.StatusCode == 416 {
+		total, err := parseContentRangeTotal(res.Header.Get("content-range"))
+		if err != nil {
+			total = -1
+		}
+		if total >= 0 && hf.knownSize() && total != hf.size {
+			res.Body.Close()
+			return errors.Wrapf(ErrResourceChanged, "in conn.tryConnect, got HTTP 416 for a file of %d bytes, expected %d", total, hf.size)
+		}
+		if (total >= 0 && offset >= total) || (total < 0 && (!hf.knownSize() || offset >= hf.size)) {
+			// servers answer this way when asked for bytes
+			// at the very end of the file
+			res.Body.Close()
+			return &rangeNotSatisfiableError{size: total}
+		}
+	}
+
 	if res.StatusCode/100 != 2 {
 		defer res.Body.Close()
 
@@ -148,32 +322,64 @@ func (c *conn) tryConnect(offset int64) error {
 		}
 
 		if hf.needsRenewal(res, body) {
-			return &needsRenewalError{url: hf.currentURL}
+			return &needsRenewalError{url: urlStr}
+		}
+
+		se := &ServerError{
+			Host:        req.Host,
+			Message:     fmt.Sprintf("HTTP %d: %v", res.StatusCode, string(body)),
+			StatusCode:  res.StatusCode,
+			RetryAfter:  parseRetryAfter(res, hf.clock.Now()),
+			ResponseIDs: hf.responseIDs(res.Header),
 		}
+		return errors.Wrapf(se, "in conn.tryConnect, got HTTP non-2XX")
+	}
 
+	if encoding := res.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, IdentityEncoding) {
+		res.Body.Close()
 		se := &ServerError{
 			Host:       req.Host,
-			Message:    fmt.Sprintf("HTTP %d: %v", res.StatusCode, string(body)),
+			Message:    fmt.Sprintf("Response has Content-Encoding %s, byte ranges don't line up with the file's", encoding),
+			Code:       ServerErrorCodeContentEncoding,
 			StatusCode: res.StatusCode,
 		}
-		return errors.Wrapf(se, "in conn.tryConnect, got HTTP non-2XX")
+		return errors.Wrapf(se, "in conn.tryConnect, got compressed response")
 	}
 
-	c.Backtracker = backtracker.New(offset, res.Body, maxDiscard)
-	c.body = res.Body
+	stallTimeout := hf.StallTimeout
+	if c.stallTimeout > 0 {
+		stallTimeout = c.stallTimeout
+	}
+	resBody := timeout.NewStallBody(res.Body, stallTimeout)
+	body := &fetchRecorder{ReadCloser: resBody, budget: hf.budget, limiter: hf.limiter, start: offset, offset: offset}
+	if hf.WasteThreshold >= 0 {
+		body.waste = &hf.waste
+	}
+	c.Backtracker = backtracker.NewSize(offset, body, hf.MaxBacktrack, hf.readBufferSize())
+	c.body = resBody
+	c.recorder = body
+	c.url = urlStr
+	c.startOffset = offset
 	c.header = res.Header
 	c.requestURL = res.Request.URL
 	c.statusCode = res.StatusCode
+	c.proto = res.Proto
+	c.protoMajor = res.ProtoMajor
+	c.protoMinor = res.ProtoMinor
+	c.tls = res.TLS
 	c.contentLength = res.ContentLength
 
 	return nil
 }
 
 func (c *conn) Close() error {
-	if c.body != nil {
-		err := c.body.Close()
-		c.body = nil
+	if c.hasSlot {
+		c.hasSlot = false
+		c.file.HostScheduler.release(c.file, c.schedHost)
+	}
 
+	if c.body != nil {
+		err := c.closeBody(c.file.getCurrentURL())
 		if err != nil {
 			return errors.Wrapf(err, "in conn.Close")
 		}
@@ -181,3 +387,63 @@ func (c *conn) Close() error {
 
 	return nil
 }
+
+// maxDrainOnClose is the largest response remainder we're willing
+// to read and throw away so its connection can be re-used
+const maxDrainOnClose int64 = 64 * 1024
+
+// closeBody closes the current response body. If the next request is
+// going to the same host (even if the URL was renewed, ie. only its
+// signature changed), and there's little left to read, the rest of the
+// body is drained first, so that net/http can hand the underlying
+// TCP/TLS session to the next request instead of doing a new handshake.
+func (c *conn) closeBody(nextURL string) error {
+	if c.body == nil {
+		return nil
+	}
+
+	if sameHost(c.url, nextURL) {
+		drain := maxDrainOnClose
+		if c.contentLength >= 0 {
+			// bufio might have read some of it already,
+			// so that's an upper bound.
+			drain = c.startOffset + c.contentLength - c.Offset()
+		}
+		if drain >= 0 && drain <= maxDrainOnClose {
+			// errors don't matter here, at worst the
+			// connection isn't re-used.
+			io.CopyN(ioutil.Discard, c.body, drain+1)
+		}
+	}
+
+	err := c.body.Close()
+	c.body = nil
+	c.flushFetched()
+	c.file.Trace.connClosed(ConnEvent{
+		ID:       c.id,
+		Host:     urlHost(c.url),
+		Offset:   c.Offset(),
+		Duration: clock.Since(c.file.clock, c.openedAt),
+	})
+	return err
+}
+
+func sameHost(a string, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return ua.Scheme == ub.Scheme && ua.Host == ub.Host
+}
+
+// flushFetched reports what was read from the current response
+// to the File's waste tracker
+func (c *conn) flushFetched() {
+	if c.recorder != nil {
+		c.recorder.flush()
+	}
+}
@@ -0,0 +1,85 @@
+package htfs_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/itchio/httpkit/retrycontext"
+	"github.com/itchio/httpkit/timeout"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ retrycontext.Connectivity = (*timeout.Monitor)(nil)
+
+// fakeConnectivity is offline for the first few failures
+type fakeConnectivity struct {
+	mu         sync.Mutex
+	offlineFor int
+	waits      int
+	// if set, it never comes back online
+	forever bool
+}
+
+func (fc *fakeConnectivity) Online() bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return !fc.forever && fc.offlineFor == 0
+}
+
+func (fc *fakeConnectivity) WaitOnline(ctx context.Context) error {
+	fc.mu.Lock()
+	fc.waits++
+	forever := fc.forever
+	if !forever {
+		fc.offlineFor--
+	}
+	fc.mu.Unlock()
+
+	if forever {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func Test_FileConnectivity(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbcccc")
+
+	// more failures in a row than MaxTries
+	storageServer := fakeStorage(t, fakeData, &fakeStorageContext{
+		disruption: &storageDisruption{
+			streak: 8,
+			handler: func(w http.ResponseWriter) {
+				http.Error(w, "Service Unavailable", 503)
+			},
+		},
+	})
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	// but most of them happened while offline
+	conn := &fakeConnectivity{offlineFor: 6}
+	settings := defaultSettings(t)
+	settings.Connectivity = conn
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	assert.EqualValues(6, conn.waits)
+	assert.NoError(hf.Close())
+
+	// closing the File stops waiting
+	storageServer.Close()
+	conn = &fakeConnectivity{forever: true}
+	settings.Connectivity = conn
+	hf = htfs.OpenLazy(storageServerURL(storageServer), noRenewal, settings)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		hf.Close()
+	}()
+	_, err = hf.Stat()
+	assert.Error(err)
+}
@@ -0,0 +1,414 @@
+// Package diskcache wraps a remote file (typically an *htfs.File) so that
+// fetched byte ranges are kept in a sparse local file. Repeat reads of the
+// same ranges (re-verifying or re-patching a build, for example) are served
+// from disk, and only misses go to the network.
+package diskcache
+
+import (
+	"encoding/json"
+	goerrors "errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/itchio/httpkit/htfs/internal/intervals"
+	"github.com/pkg/errors"
+)
+
+// Settings configures a cached file
+type Settings struct {
+	// Path is where the sparse cache file is stored. An index of which
+	// ranges are present is stored next to it, in Path + ".index"
+	Path string
+
+	// Key identifies the version of the remote resource (an ETag, a build
+	// ID, etc.) If the cache on disk was written for another key, or for
+	// a file of another size, it's thrown away.
+	Key string
+
+	// Shared lets several processes (like a command-line tool and a
+	// desktop app) use the same cache at once, so a range fetched by one
+	// is available to the others without re-downloading it. Fetched ranges
+	// are recorded in the index right away, under an advisory lock on
+	// Path + ".lock", and the cache file is memory-mapped where supported.
+	// All processes must agree on Key: when it changes, the cache is reset
+	// under the feet of those still using the old one. Since they may
+	// have the cache file mapped, it's never resized: New fails with
+	// ErrSizeMismatch if it was written for a file of another size, and
+	// it must be removed (or another Path used) once no one uses it.
+	Shared bool
+
+	// Offline makes reads serve what's cached, and fail with ErrOffline
+	// instead of going to upstream for the rest, so that applications can
+	// keep doing what they can without a network connection. It can be
+	// changed later with SetOffline.
+	Offline bool
+}
+
+// ErrOffline is returned by reads of ranges that aren't cached, when
+// the File is offline, see Settings.Offline. The part of the read
+// that was cached is still returned, up to the first missing byte.
+var ErrOffline = goerrors.New("diskcache: range is not cached, and the file is offline")
+
+// ErrSizeMismatch is returned by New for shared caches whose file was
+// sized for another version of the resource, see Settings.Shared
+var ErrSizeMismatch = goerrors.New("diskcache: shared cache file is for a file of another size")
+
+// Stats tracks where served bytes came from
+type Stats struct {
+	CachedBytes  int64
+	FetchedBytes int64
+}
+
+// File is an io.ReaderAt that reads through a disk cache. It's safe
+// for concurrent use, although concurrent misses on the same range
+// may both go to the network.
+type File struct {
+	upstream  io.ReaderAt
+	size      int64
+	settings  Settings
+	cacheFile *os.File
+	// lock is Path + ".lock", for shared caches
+	lock *os.File
+	// mapped is the cache file, for shared caches on platforms that
+	// support it. It's only read while holding mu.
+	mapped []byte
+
+	mu        sync.Mutex
+	intervals *intervals.Map
+	stats     Stats
+	offline   bool
+	closed    bool
+}
+
+var _ io.ReaderAt = (*File)(nil)
+var _ io.Closer = (*File)(nil)
+
+type index struct {
+	Key       string               `json:"key"`
+	Size      int64                `json:"size"`
+	Intervals []intervals.Interval `json:"intervals"`
+}
+
+func indexPath(path string) string {
+	return path + ".index"
+}
+
+func lockPath(path string) string {
+	return path + ".lock"
+}
+
+// New returns a File that reads size bytes from upstream through the disk
+// cache described by settings, re-using what's already there if possible.
+// Closing it doesn't close upstream.
+//
+// With Settings.Offline, upstream may be nil, and size negative: it's
+// then taken from what's cached for Settings.Key, and if nothing is,
+// New fails with ErrOffline. Such a File can't go back online.
+func New(upstream io.ReaderAt, size int64, settings Settings) (*File, error) {
+	if settings.Path == "" {
+		return nil, errors.New("diskcache: no path specified")
+	}
+
+	if size < 0 {
+		if !settings.Offline {
+			return nil, errors.New("diskcache: size must be known when online")
+		}
+		idx, err := readIndex(settings.Path)
+		if err != nil || idx.Key != settings.Key {
+			return nil, errors.Wrapf(ErrOffline, "diskcache: nothing cached for key %q", settings.Key)
+		}
+		size = idx.Size
+	}
+
+	cacheFile, err := os.OpenFile(settings.Path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "diskcache: while opening cache file")
+	}
+
+	f := &File{
+		upstream:  upstream,
+		size:      size,
+		settings:  settings,
+		cacheFile: cacheFile,
+		intervals: &intervals.Map{},
+		offline:   settings.Offline,
+	}
+
+	if settings.Shared {
+		err = f.openShared()
+	} else {
+		err = f.load()
+	}
+	if err != nil {
+		f.release()
+		return nil, err
+	}
+	return f, nil
+}
+
+// load adopts the index on disk if it's for the same version of the
+// resource, or starts over, then sizes the cache file
+func (f *File) load() error {
+	stats, err := f.cacheFile.Stat()
+	if err != nil {
+		return errors.Wrap(err, "diskcache: while opening cache file")
+	}
+
+	if f.settings.Shared && stats.Size() != 0 && stats.Size() != f.size {
+		// processes that have it mapped would read another version
+		// of the resource at best, and crash with SIGBUS if it shrank
+		return errors.Wrapf(ErrSizeMismatch, "diskcache: cache file is %d bytes, want %d", stats.Size(), f.size)
+	}
+
+	idx, err := readIndex(f.settings.Path)
+	if err == nil && f.matches(idx) && stats.Size() == f.size {
+		f.intervals.Intervals = idx.Intervals
+	} else if f.settings.Shared {
+		// other processes may have the cache file mapped, so
+		// don't truncate it, only forget what's in it
+		err = f.writeIndex()
+		if err != nil {
+			return err
+		}
+	} else {
+		// stale or missing index: start over
+		err = f.cacheFile.Truncate(0)
+		if err != nil {
+			return errors.Wrap(err, "diskcache: while resetting cache file")
+		}
+	}
+
+	if stats.Size() != f.size || !f.settings.Shared {
+		// doesn't allocate anything on filesystems that support sparse files
+		err = f.cacheFile.Truncate(f.size)
+		if err != nil {
+			return errors.Wrap(err, "diskcache: while sizing cache file")
+		}
+	}
+	return nil
+}
+
+// matches returns true if idx is for the same version of the resource
+func (f *File) matches(idx *index) bool {
+	return idx.Key == f.settings.Key && idx.Size == f.size
+}
+
+// release closes everything New opened, after it failed
+func (f *File) release() {
+	if f.mapped != nil {
+		unmapFile(f.mapped)
+	}
+	if f.lock != nil {
+		f.lock.Close()
+	}
+	f.cacheFile.Close()
+}
+
+func readIndex(path string) (*index, error) {
+	contents, err := ioutil.ReadFile(indexPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &index{}
+	err = json.Unmarshal(contents, idx)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// ReadAt implements io.ReaderAt
+func (f *File) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset >= f.size {
+		return 0, io.EOF
+	}
+
+	end := offset + int64(len(buf))
+	var eof bool
+	if end > f.size {
+		end = f.size
+		eof = true
+	}
+
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return 0, errors.New("diskcache: read from closed file")
+	}
+	gaps := f.intervals.Missing(offset, end)
+	offline := f.offline
+	f.mu.Unlock()
+
+	if len(gaps) > 0 && f.settings.Shared {
+		// other processes may have fetched them
+		err := f.refresh()
+		if err != nil {
+			return 0, err
+		}
+		f.mu.Lock()
+		gaps = f.intervals.Missing(offset, end)
+		f.mu.Unlock()
+	}
+
+	if len(gaps) > 0 && (offline || f.upstream == nil) {
+		return f.readOffline(buf, offset, gaps[0])
+	}
+
+	var fetched int64
+	for _, gap := range gaps {
+		err := f.fetch(gap)
+		if err != nil {
+			return 0, err
+		}
+		fetched += gap.End - gap.Start
+	}
+
+	n, err := f.readCached(buf[:end-offset], offset)
+	if err != nil && err != io.EOF {
+		return n, errors.Wrap(err, "diskcache: while reading from cache file")
+	}
+
+	f.mu.Lock()
+	f.stats.FetchedBytes += fetched
+	f.stats.CachedBytes += int64(n) - fetched
+	f.mu.Unlock()
+
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readOffline serves the cached part of a read, up to the first gap
+func (f *File) readOffline(buf []byte, offset int64, gap intervals.Interval) (int, error) {
+	n, err := f.readCached(buf[:gap.Start-offset], offset)
+	if err != nil && err != io.EOF {
+		return n, errors.Wrap(err, "diskcache: while reading from cache file")
+	}
+
+	f.mu.Lock()
+	f.stats.CachedBytes += int64(n)
+	f.mu.Unlock()
+
+	return n, errors.Wrapf(ErrOffline, "diskcache: while reading %d-%d", gap.Start, gap.End)
+}
+
+// fetch copies iv from upstream into the cache file, then marks it present
+func (f *File) fetch(iv intervals.Interval) error {
+	buf := make([]byte, iv.End-iv.Start)
+	n, err := f.upstream.ReadAt(buf, iv.Start)
+	if err != nil && !(err == io.EOF && n == len(buf)) {
+		return errors.Wrapf(err, "diskcache: while fetching %d-%d", iv.Start, iv.End)
+	}
+
+	_, err = f.cacheFile.WriteAt(buf, iv.Start)
+	if err != nil {
+		return errors.Wrap(err, "diskcache: while writing to cache file")
+	}
+
+	if f.settings.Shared {
+		return f.commit(iv)
+	}
+
+	f.mu.Lock()
+	f.intervals.Add(iv.Start, iv.End)
+	f.mu.Unlock()
+	return nil
+}
+
+// SetOffline switches the File to offline mode or back, see
+// Settings.Offline. Files opened without an upstream stay offline.
+func (f *File) SetOffline(offline bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.offline = offline
+}
+
+// Offline returns true if reads are only served from the cache
+func (f *File) Offline() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.offline || f.upstream == nil
+}
+
+// Stats returns how many bytes were served from disk and from upstream
+func (f *File) Stats() Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.stats
+}
+
+// CachedSize returns how many bytes of the file are cached on disk
+func (f *File) CachedSize() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.intervals.Size()
+}
+
+// Close saves the index and closes the cache file. It doesn't close upstream.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	if f.mapped != nil {
+		err := unmapFile(f.mapped)
+		f.mapped = nil
+		if err != nil {
+			f.cacheFile.Close()
+			return errors.Wrap(err, "diskcache: while unmapping cache file")
+		}
+	}
+
+	// make sure data hits the disk before the index says it's there
+	err := f.cacheFile.Sync()
+	if err != nil {
+		f.cacheFile.Close()
+		return errors.Wrap(err, "diskcache: while syncing cache file")
+	}
+
+	err = f.cacheFile.Close()
+	if err != nil {
+		return errors.Wrap(err, "diskcache: while closing cache file")
+	}
+
+	if f.settings.Shared {
+		// the index is saved on every fetch
+		return f.lock.Close()
+	}
+	return f.writeIndex()
+}
+
+// writeIndex saves the index, to a temporary file that's renamed over
+// the old one, so that other processes never read half of it
+func (f *File) writeIndex() error {
+	contents, err := json.Marshal(&index{
+		Key:       f.settings.Key,
+		Size:      f.size,
+		Intervals: f.intervals.Intervals,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmpPath := indexPath(f.settings.Path) + ".tmp"
+	err = ioutil.WriteFile(tmpPath, contents, 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, indexPath(f.settings.Path))
+	}
+	if err != nil {
+		return errors.Wrap(err, "diskcache: while writing index")
+	}
+	return nil
+}
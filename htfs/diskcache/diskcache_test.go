@@ -0,0 +1,222 @@
+package diskcache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingReaderAt struct {
+	r       io.ReaderAt
+	fetched int64
+}
+
+func (cra *countingReaderAt) ReadAt(buf []byte, offset int64) (int, error) {
+	n, err := cra.r.ReadAt(buf, offset)
+	atomic.AddInt64(&cra.fetched, int64(n))
+	return n, err
+}
+
+func Test_DiskCache(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "diskcache")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(0xfeed)).Read(data)
+	upstream := &countingReaderAt{r: bytes.NewReader(data)}
+	settings := Settings{
+		Path: filepath.Join(dir, "build.cache"),
+		Key:  "etag-1",
+	}
+
+	f, err := New(upstream, int64(len(data)), settings)
+	assert.NoError(err)
+
+	read := func(f *File, offset int64, length int) {
+		t.Helper()
+		buf := make([]byte, length)
+		n, err := f.ReadAt(buf, offset)
+		if offset+int64(length) > int64(len(data)) {
+			assert.Equal(io.EOF, err)
+		} else {
+			assert.NoError(err)
+		}
+		assert.True(bytes.Equal(data[offset:offset+int64(n)], buf[:n]))
+	}
+
+	read(f, 1000, 4000)
+	assert.EqualValues(4000, upstream.fetched)
+	read(f, 2000, 1000)
+	assert.EqualValues(4000, upstream.fetched, "should be served from disk")
+	read(f, 0, 8000)
+	assert.EqualValues(8000, upstream.fetched, "should only fetch misses")
+	read(f, int64(len(data))-100, 200)
+	assert.EqualValues(8100, upstream.fetched)
+	assert.EqualValues(Stats{CachedBytes: 5000, FetchedBytes: 8100}, f.Stats())
+	assert.NoError(f.Close())
+
+	// re-opening keeps the cache
+	f, err = New(upstream, int64(len(data)), settings)
+	assert.NoError(err)
+	assert.EqualValues(8100, f.CachedSize())
+	read(f, 0, 8000)
+	assert.EqualValues(8100, upstream.fetched)
+	assert.NoError(f.Close())
+
+	// another version of the resource: start over
+	settings.Key = "etag-2"
+	f, err = New(upstream, int64(len(data)), settings)
+	assert.NoError(err)
+	assert.EqualValues(0, f.CachedSize())
+	read(f, 0, 8000)
+	assert.EqualValues(16100, upstream.fetched)
+	assert.NoError(f.Close())
+}
+
+func Test_DiskCacheOffline(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "diskcache")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(0xfeed)).Read(data)
+	upstream := &countingReaderAt{r: bytes.NewReader(data)}
+	settings := Settings{
+		Path: filepath.Join(dir, "build.cache"),
+		Key:  "etag-1",
+	}
+
+	// nothing cached yet: can't even tell the size
+	offlineSettings := settings
+	offlineSettings.Offline = true
+	_, err = New(nil, -1, offlineSettings)
+	assert.Equal(ErrOffline, errors.Cause(err))
+
+	f, err := New(upstream, int64(len(data)), settings)
+	assert.NoError(err)
+	buf := make([]byte, 4000)
+	_, err = f.ReadAt(buf, 1000)
+	assert.NoError(err)
+
+	// going offline stops fetches, but still serves the cache
+	f.SetOffline(true)
+	assert.True(f.Offline())
+	_, err = f.ReadAt(buf, 1000)
+	assert.NoError(err)
+	_, err = f.ReadAt(buf, 10000)
+	assert.Equal(ErrOffline, errors.Cause(err))
+	assert.EqualValues(4000, upstream.fetched)
+	f.SetOffline(false)
+	assert.False(f.Offline())
+	assert.NoError(f.Close())
+
+	// without an upstream, the size comes from the cache
+	f, err = New(nil, -1, offlineSettings)
+	assert.NoError(err)
+	assert.True(f.Offline())
+
+	n, err := f.ReadAt(buf, 1000)
+	assert.NoError(err)
+	assert.True(bytes.Equal(data[1000:5000], buf[:n]))
+
+	// reads that go past the cache return what's there
+	n, err = f.ReadAt(buf, 3000)
+	assert.Equal(ErrOffline, errors.Cause(err))
+	assert.EqualValues(2000, n)
+	assert.True(bytes.Equal(data[3000:5000], buf[:n]))
+
+	f.SetOffline(false)
+	_, err = f.ReadAt(buf, 10000)
+	assert.Equal(ErrOffline, errors.Cause(err), "can't go online without an upstream")
+	assert.NoError(f.Close())
+
+	// another version of the resource isn't cached
+	offlineSettings.Key = "etag-2"
+	_, err = New(nil, -1, offlineSettings)
+	assert.Equal(ErrOffline, errors.Cause(err))
+}
+
+func Test_DiskCacheShared(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "diskcache")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(0xbeef)).Read(data)
+	settings := Settings{
+		Path:   filepath.Join(dir, "build.cache"),
+		Key:    "etag-1",
+		Shared: true,
+	}
+
+	// two processes, as far as locks are concerned
+	upstreamA := &countingReaderAt{r: bytes.NewReader(data)}
+	a, err := New(upstreamA, int64(len(data)), settings)
+	assert.NoError(err)
+	upstreamB := &countingReaderAt{r: bytes.NewReader(data)}
+	b, err := New(upstreamB, int64(len(data)), settings)
+	assert.NoError(err)
+
+	read := func(f *File, offset int64, length int) {
+		t.Helper()
+		buf := make([]byte, length)
+		n, err := f.ReadAt(buf, offset)
+		if offset+int64(length) > int64(len(data)) {
+			assert.Equal(io.EOF, err)
+		} else {
+			assert.NoError(err)
+		}
+		assert.True(bytes.Equal(data[offset:offset+int64(n)], buf[:n]))
+	}
+
+	read(a, 1000, 4000)
+	assert.EqualValues(4000, upstreamA.fetched)
+	// fetched by a, available to b right away
+	read(b, 2000, 2000)
+	assert.EqualValues(0, upstreamB.fetched)
+	read(b, 0, 8000)
+	assert.EqualValues(4000, upstreamB.fetched, "should only fetch misses")
+	read(a, 0, 8000)
+	assert.EqualValues(4000, upstreamA.fetched)
+	read(b, int64(len(data))-100, 200)
+	assert.EqualValues(Stats{CachedBytes: 2000 + 4000, FetchedBytes: 4000 + 100}, b.Stats())
+
+	assert.NoError(a.Close())
+	read(b, 100*1024, 1024)
+	assert.NoError(b.Close())
+
+	// the index is up to date for later opens
+	c, err := New(upstreamA, int64(len(data)), settings)
+	assert.NoError(err)
+	assert.EqualValues(8000+100+1024, c.CachedSize())
+	assert.NoError(c.Close())
+
+	// another version of the resource: start over
+	settings.Key = "etag-2"
+	c, err = New(upstreamA, int64(len(data)), settings)
+	assert.NoError(err)
+	assert.EqualValues(0, c.CachedSize())
+
+	// of another size: the cache file isn't resized while
+	// others may have it mapped
+	settings.Key = "etag-3"
+	_, err = New(upstreamA, int64(len(data)/2), settings)
+	assert.Equal(ErrSizeMismatch, errors.Cause(err))
+	read(c, 0, 1024)
+	assert.NoError(c.Close())
+}
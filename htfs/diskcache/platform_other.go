@@ -0,0 +1,26 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly,!windows
+
+package diskcache
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func lockFile(f *os.File, exclusive bool) error {
+	return errors.New("diskcache: shared caches aren't supported on this platform")
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
+
+func mapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, nil
+}
+
+func unmapFile(mapped []byte) error {
+	return nil
+}
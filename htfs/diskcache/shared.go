@@ -0,0 +1,113 @@
+package diskcache
+
+import (
+	"io"
+	"os"
+
+	"github.com/itchio/httpkit/htfs/internal/intervals"
+	"github.com/pkg/errors"
+)
+
+// openShared loads the index while holding the lock, so that it isn't
+// reset by one process while another one is loading it, then maps the
+// cache file. See Settings.Shared.
+func (f *File) openShared() error {
+	lock, err := os.OpenFile(lockPath(f.settings.Path), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Wrap(err, "diskcache: while opening lock file")
+	}
+	f.lock = lock
+
+	err = f.withLock(true, f.load)
+	if err != nil {
+		return err
+	}
+
+	f.mapped, err = mapFile(f.cacheFile, f.size)
+	if err != nil {
+		return errors.Wrap(err, "diskcache: while mapping cache file")
+	}
+	return nil
+}
+
+// withLock calls fn while holding the advisory lock shared by all
+// processes using the cache, exclusively or not
+func (f *File) withLock(exclusive bool, fn func() error) error {
+	err := lockFile(f.lock, exclusive)
+	if err != nil {
+		return errors.Wrap(err, "diskcache: while locking")
+	}
+	defer unlockFile(f.lock)
+
+	return fn()
+}
+
+// refresh adds the ranges other processes fetched to ours
+func (f *File) refresh() error {
+	var idx *index
+	err := f.withLock(false, func() error {
+		var err error
+		idx, err = readIndex(f.settings.Path)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "diskcache: while reading index")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.merge(idx)
+	return nil
+}
+
+// commit records iv, which was just written to the cache file, in the
+// index, along with the ranges other processes fetched in the meantime
+func (f *File) commit(iv intervals.Interval) error {
+	// make sure data hits the disk before the index says it's there
+	err := f.cacheFile.Sync()
+	if err != nil {
+		return errors.Wrap(err, "diskcache: while syncing cache file")
+	}
+
+	return f.withLock(true, func() error {
+		idx, err := readIndex(f.settings.Path)
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if err == nil {
+			f.merge(idx)
+		}
+		f.intervals.Add(iv.Start, iv.End)
+		return f.writeIndex()
+	})
+}
+
+// merge adds the ranges of idx to ours, if it's for the same version
+// of the resource. It must be called while holding mu.
+func (f *File) merge(idx *index) {
+	if !f.matches(idx) {
+		return
+	}
+	for _, iv := range idx.Intervals {
+		f.intervals.Add(iv.Start, iv.End)
+	}
+}
+
+// readCached reads from the cache file, or its mapping
+func (f *File) readCached(buf []byte, offset int64) (int, error) {
+	f.mu.Lock()
+	if f.mapped != nil {
+		// Close unmaps it while holding mu
+		defer f.mu.Unlock()
+		n := copy(buf, f.mapped[offset:])
+		if n < len(buf) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	f.mu.Unlock()
+
+	return f.cacheFile.ReadAt(buf, offset)
+}
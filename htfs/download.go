@@ -0,0 +1,168 @@
+package htfs
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// DownloadSettings configures File.Download
+type DownloadSettings struct {
+	// Segments is how many ranges are downloaded in parallel, each over
+	// its own connection. It's capped by the File's MaxConns. Defaults to 4.
+	Segments int
+
+	// MinSegmentSize avoids splitting small files into tiny segments.
+	// Defaults to 1MiB.
+	MinSegmentSize int64
+
+	// ProgressListener, if set, is called with the total number of
+	// bytes downloaded so far, from any goroutine.
+	ProgressListener func(downloaded int64)
+}
+
+const (
+	defaultDownloadSegments       = 4
+	defaultDownloadMinSegmentSize = 1 * 1024 * 1024
+)
+
+type segment struct {
+	start int64
+	end   int64
+}
+
+// Download copies the whole file into w, by splitting it into segments
+// that are downloaded in parallel, which saturates fast links better than
+// a single sequential read. Each segment goes through the same retry and
+// URL renewal logic as ReadAt. If the size of the file isn't known, it's
+// downloaded sequentially.
+//
+// Cancelling ctx stops all segments. It returns the number of bytes written,
+// and the first error encountered, if any.
+func (f *File) Download(ctx context.Context, w io.WriterAt, settings *DownloadSettings) (int64, error) {
+	if err := f.opened(); err != nil {
+		return 0, err
+	}
+
+	if settings == nil {
+		settings = &DownloadSettings{}
+	}
+
+	numSegments := settings.Segments
+	if numSegments <= 0 {
+		numSegments = defaultDownloadSegments
+	}
+	if f.MaxConns > 0 && numSegments > f.MaxConns {
+		numSegments = f.MaxConns
+	}
+	minSegmentSize := settings.MinSegmentSize
+	if minSegmentSize <= 0 {
+		minSegmentSize = defaultDownloadMinSegmentSize
+	}
+
+	var segments []segment
+	if f.knownSize() {
+		segments = splitSegments(f.size, numSegments, minSegmentSize)
+	} else {
+		segments = []segment{{start: 0, end: -1}}
+	}
+	f.info("download: starting", "size", f.size, "segments", len(segments))
+
+	// also stops when the File is closed
+	ctx, cancel := f.mergeContext(ctx)
+	defer cancel()
+
+	var downloaded int64
+	var firstErr error
+	var errOnce sync.Once
+	var wg sync.WaitGroup
+
+	for _, s := range segments {
+		wg.Add(1)
+		go func(s segment) {
+			defer wg.Done()
+
+			err := f.downloadSegment(ctx, w, s, func(n int64) {
+				total := atomic.AddInt64(&downloaded, n)
+				if settings.ProgressListener != nil {
+					settings.ProgressListener(total)
+				}
+			})
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return atomic.LoadInt64(&downloaded), f.labelError(firstErr)
+	}
+	return atomic.LoadInt64(&downloaded), nil
+}
+
+func splitSegments(size int64, numSegments int, minSegmentSize int64) []segment {
+	if int64(numSegments)*minSegmentSize > size {
+		numSegments = int(size / minSegmentSize)
+		if numSegments < 1 {
+			numSegments = 1
+		}
+	}
+
+	segmentSize := size / int64(numSegments)
+	var segments []segment
+	for i := 0; i < numSegments; i++ {
+		s := segment{
+			start: int64(i) * segmentSize,
+			end:   int64(i+1) * segmentSize,
+		}
+		if i == numSegments-1 {
+			s.end = size
+		}
+		segments = append(segments, s)
+	}
+	return segments
+}
+
+// downloadSegment copies [s.start, s.end) into w, or until EOF
+// if s.end is negative.
+func (f *File) downloadSegment(ctx context.Context, w io.WriterAt, s segment, onProgress func(n int64)) error {
+	buf := make([]byte, alignCopyBufferSize(f.CopyBufferSize))
+
+	offset := s.start
+	for s.end < 0 || offset < s.end {
+		err := ctx.Err()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		readBuf := buf
+		if s.end >= 0 && s.end-offset < int64(len(readBuf)) {
+			readBuf = readBuf[:s.end-offset]
+		}
+
+		bytesRead, readErr := f.readAtWith(ctx, readBuf, offset, true, PriorityBulk)
+		if bytesRead > 0 {
+			_, err := w.WriteAt(readBuf[:bytesRead], offset)
+			if err != nil {
+				return errors.Wrapf(err, "in File.Download, while writing at %d", offset)
+			}
+			offset += int64(bytesRead)
+			onProgress(int64(bytesRead))
+		}
+
+		if readErr != nil {
+			if readErr == io.EOF && (s.end < 0 || offset >= s.end) {
+				return nil
+			}
+			return errors.Wrapf(readErr, "in File.Download, while reading at %d", offset)
+		}
+	}
+	return nil
+}
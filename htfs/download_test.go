@@ -0,0 +1,77 @@
+package htfs_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileDownload(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	settings := defaultSettings(t)
+	settings.LogLevel = 1
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+
+	out, err := ioutil.TempFile("", "htfs-download")
+	assert.NoError(err)
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	var lastProgress int64
+	n, err := hf.Download(context.Background(), out, &htfs.DownloadSettings{
+		Segments: 4,
+		ProgressListener: func(downloaded int64) {
+			atomic.StoreInt64(&lastProgress, downloaded)
+		},
+	})
+	assert.NoError(err)
+	assert.EqualValues(len(fakeData), n)
+	assert.EqualValues(len(fakeData), atomic.LoadInt64(&lastProgress))
+
+	written, err := ioutil.ReadFile(out.Name())
+	assert.NoError(err)
+	assert.True(bytes.Equal(fakeData, written))
+
+	assert.NoError(hf.Close())
+}
+
+func Test_FileDownloadCancel(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, defaultSettings(t))
+	assert.NoError(err)
+
+	out, err := ioutil.TempFile("", "htfs-download")
+	assert.NoError(err)
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = hf.Download(cctx, out, nil)
+	assert.Error(err)
+	assert.EqualValues(context.Canceled, errors.Cause(err))
+
+	assert.NoError(hf.Close())
+}
@@ -1,6 +1,14 @@
 package htfs
 
-import "fmt"
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/itchio/httpkit/retrycontext"
+)
 
 type needsRenewalError struct {
 	url string
@@ -10,6 +18,29 @@ func (nre *needsRenewalError) Error() string {
 	return "url has expired and needs renewal"
 }
 
+// rangeNotSatisfiableError is an HTTP 416 for an offset at or past the
+// end of the file, which is then size bytes long, or -1 if unknown.
+// Conns report it as io.EOF.
+type rangeNotSatisfiableError struct {
+	size int64
+}
+
+func (rnse *rangeNotSatisfiableError) Error() string {
+	return fmt.Sprintf("range not satisfiable, file is %d bytes long", rnse.size)
+}
+
+// A HeaderError is returned when a server sends a header htfs
+// needs but can't make sense of, like a malformed Content-Range
+type HeaderError struct {
+	Header string
+	Value  string
+	Reason string
+}
+
+func (he *HeaderError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %s", he.Header, he.Value, he.Reason)
+}
+
 // ServerErrorCode represents an error condition where
 // some server does not support htfs - perhaps because
 // it has no range support, or because it returned a bad HTTP status code.
@@ -23,6 +54,11 @@ const (
 	// server does not support HTTP Range Requests:
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Range_requests
 	ServerErrorCodeNoRangeSupport
+	// ServerErrorCodeContentEncoding indicates that the remote
+	// server compressed its response (with Content-Encoding) even
+	// though we asked it not to: byte ranges of the compressed
+	// response don't line up with the file's, so we can't use it.
+	ServerErrorCodeContentEncoding
 )
 
 // ServerError represents an error htfs has encountered
@@ -32,8 +68,65 @@ type ServerError struct {
 	Message    string
 	Code       ServerErrorCode
 	StatusCode int
+	// RetryAfter is how long the server asked to wait before trying
+	// again, with a 429 or 503 response, see parseRetryAfter
+	RetryAfter time.Duration
+	// ResponseIDs are the values of Settings.ResponseIDHeaders in the
+	// response, to ask the server's operators about it
+	ResponseIDs map[string]string
 }
 
+var _ retrycontext.DelayError = (*ServerError)(nil)
+
 func (se *ServerError) Error() string {
+	if len(se.ResponseIDs) > 0 {
+		return fmt.Sprintf("%s: %s (%s)", se.Host, se.Message, formatResponseIDs(se.ResponseIDs))
+	}
 	return fmt.Sprintf("%s: %s", se.Host, se.Message)
 }
+
+// RetryDelay implements retrycontext.DelayError, so that retries
+// wait for as long as the server asked, instead of backing off
+func (se *ServerError) RetryDelay() time.Duration {
+	return se.RetryAfter
+}
+
+// maxRetryAfter caps the delays servers ask for, so a
+// misconfigured one can't stall reads for hours
+const maxRetryAfter = 5 * time.Minute
+
+// parseRetryAfter returns how long a 429 or 503 response asks to wait,
+// from its Retry-After header (in seconds, or an HTTP date), or failing
+// that, from X-RateLimit-Reset (in seconds, or a Unix timestamp). It
+// returns 0 for other responses, or if neither header makes sense.
+func parseRetryAfter(res *http.Response, now time.Time) time.Duration {
+	if res.StatusCode != 429 && res.StatusCode != 503 {
+		return 0
+	}
+
+	var delay time.Duration
+	if value := strings.TrimSpace(res.Header.Get("Retry-After")); value != "" {
+		if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+			delay = time.Duration(seconds) * time.Second
+		} else if date, err := http.ParseTime(value); err == nil {
+			delay = date.Sub(now)
+		}
+	} else if value := strings.TrimSpace(res.Header.Get("X-RateLimit-Reset")); value != "" {
+		if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+			if seconds > 1000000000 {
+				// that's a timestamp, not a number of seconds
+				delay = time.Unix(seconds, 0).Sub(now)
+			} else {
+				delay = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	if delay < 0 {
+		return 0
+	}
+	if delay > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return delay
+}
@@ -0,0 +1,14 @@
+package htfs
+
+// The header parsers, for the fuzz targets in htfs_test
+var (
+	ParseContentRange          = parseContentRange
+	ParseContentRangeTotal     = parseContentRangeTotal
+	ContentDispositionFilename = contentDispositionFilename
+)
+
+// The file:// URL helpers of OpenLocal
+var (
+	LocalFileURL  = localFileURL
+	LocalFilePath = localFilePath
+)
@@ -1,67 +1,146 @@
 package htfs
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
-	"math"
-	"mime"
 	"net/http"
+	"net/http/cookiejar"
 	"net/url"
 	"os"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	goerrors "errors"
 
-	"github.com/itchio/headway/united"
-
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/clock"
+	"github.com/itchio/httpkit/htfs/backtracker"
 	"github.com/itchio/httpkit/neterr"
 	"github.com/itchio/httpkit/retrycontext"
 	"github.com/pkg/errors"
 )
 
 var forbidBacktracking = os.Getenv("HTFS_NO_BACKTRACK") == "1"
-var dumpStats = os.Getenv("HTFS_DUMP_STATS") == "1"
 
 // A GetURLFunc returns a URL we can download the resource from.
 // It's handy to have this as a function rather than a constant for signed expiring URLs
 type GetURLFunc func() (urlString string, err error)
 
+// A GetURLWithExpiryFunc is a GetURLFunc for signed URLs that know when
+// they expire, so they can be renewed before they do, see OpenWithExpiry.
+// A zero expiresAt means the URL doesn't expire.
+type GetURLWithExpiryFunc func() (urlString string, expiresAt time.Time, err error)
+
+// urlSource returns the URLs of a resource, and when they expire
+type urlSource func() (urls []string, expiresAt time.Time, err error)
+
+// withoutExpiry returns a urlSource for URLs that don't expire
+func withoutExpiry(getURLs GetURLsFunc) urlSource {
+	return func() ([]string, time.Time, error) {
+		urls, err := getURLs()
+		return urls, time.Time{}, err
+	}
+}
+
+// singleURL returns a urlSource for getURL
+func singleURL(getURL GetURLWithExpiryFunc) urlSource {
+	return func() ([]string, time.Time, error) {
+		urlStr, expiresAt, err := getURL()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return []string{urlStr}, expiresAt, nil
+	}
+}
+
 // A NeedsRenewalFunc analyzes an HTTP response and returns true if it needs to be renewed
 type NeedsRenewalFunc func(res *http.Response, body []byte) bool
 
 // A LogFunc prints debug message
 type LogFunc func(msg string)
 
-// amount we're willing to download and throw away
-const maxDiscard int64 = 1 * 1024 * 1024 // 1MB
+// A RetryDecision is what a ShouldRetryFunc makes of an error
+type RetryDecision int
+
+const (
+	// RetryDefault leaves the decision to htfs, see Settings.ShouldRetry
+	RetryDefault RetryDecision = iota
+	// RetryYes retries the request, within RetrySettings
+	RetryYes
+	// RetryNo gives up on the request, and returns the error
+	RetryNo
+)
+
+// A ShouldRetryFunc decides whether a failed request should be retried
+type ShouldRetryFunc func(err error) RetryDecision
+
+// defaultRetriableStatusCodes are used when Settings.RetriableStatusCodes
+// isn't set: Too Many Requests, Internal Server Error, Bad Gateway
+// and Service Unavailable.
+var defaultRetriableStatusCodes = []int{429, 500, 502, 503}
 
-const maxRenewals = 5
+// default amount we're willing to download and throw away,
+// see Settings.MaxDiscard
+const defaultMaxDiscard int64 = 1 * 1024 * 1024 // 1MB
+
+// defaultMaxRenewalsPerWindow and defaultRenewalWindow make up the
+// default renewal rate limit, see Settings.MaxRenewalsPerWindow
+const defaultMaxRenewalsPerWindow = 30
+const defaultRenewalWindow = time.Minute
+
+// defaultRenewBeforeExpiry is used when Settings.RenewBeforeExpiry isn't set
+const defaultRenewBeforeExpiry = 30 * time.Second
 
 // ErrNotFound is returned when the HTTP server returns 404 - it's not considered a temporary error
 var ErrNotFound = goerrors.New("HTTP file not found on server")
 
+// ErrClosed is returned when reading from a File that was closed
+var ErrClosed = goerrors.New("htfs.File is closed")
+
+// ErrResourceChanged is returned when the resource's ETag or Last-Modified
+// no longer match those we got on our initial request, ie. the remote file was
+// replaced while we were reading it (for example, a CDN-backed signed URL
+// was renewed and now points to a newer version). Reading further would
+// mix bytes from two versions, so it's not retried.
+var ErrResourceChanged = goerrors.New("HTTP file changed on server while reading")
+
 // ErrTooManyRenewals is returned when we keep calling the GetURLFunc but it
-// immediately return an errors marked as renewal-related by NeedsRenewalFunc.
+// immediately return an errors marked as renewal-related by NeedsRenewalFunc,
+// more than MaxRenewalsPerWindow times in a row within RenewalWindow.
 // This can happen when servers are misconfigured.
 var ErrTooManyRenewals = goerrors.New("Giving up, getting too many renewals. Try again later or contact support.")
 
+// hstats are updated atomically, from whichever goroutine is reading,
+// without locking. Durations are in nanoseconds.
+// This needs to be 64-bit aligned.
 type hstats struct {
-	// this needs to be 64-bit aligned
+	numBlockMiss int64
+	numBlockHits int64
+
 	fetchedBytes int64
 	cachedBytes  int64
 
 	numCacheMiss int64
 	numCacheHits int64
 
-	connectionWait time.Duration
-	connections    int
-	expired        int
-	renews         int
+	connectionWait int64
+	connections    int64
+	expired        int64
+	renews         int64
+	deadReuses     int64
+	failovers      int64
+	pacingDelays   int64
+	pacingWait     int64
+	tlsHandshakes  int64
+	tlsResumptions int64
+}
+
+func (hs *hstats) add(counter *int64, delta int64) {
+	atomic.AddInt64(counter, delta)
 }
 
 var idSeed int64 = 1
@@ -70,32 +149,122 @@ var idMutex sync.Mutex
 // File allows accessing a file served by an HTTP server as if it was local
 // (for random-access reading purposes, not writing)
 type File struct {
-	getURL        GetURLFunc
+	getURLs       urlSource
 	needsRenewal  NeedsRenewalFunc
 	client        *http.Client
 	retrySettings *retrycontext.Settings
+	// readRetrySettings are for reconnecting mid-read, see Settings.ReadRetrySettings
+	readRetrySettings *retrycontext.Settings
+	clock             clock.Clock
 
 	Log      LogFunc
 	LogLevel int
+	Logger   httpkit.Logger
+
+	labels Labels
 
 	name   string
 	size   int64
 	offset int64 // for io.ReadSeeker
 
-	ConnStaleThreshold time.Duration
-	MaxConns           int
+	ConnStaleThreshold   time.Duration
+	ReconnectAfterIdle   time.Duration
+	MaxConns             int
+	CopyBufferSize       int
+	MaxRenewalsPerWindow int
+	RenewalWindow        time.Duration
+	RenewBeforeExpiry    time.Duration
+	AcceptEncoding       string
+	TE                   string
+	MaxDiscard           int64
+	MaxBacktrack         int64
+	WasteThreshold       float64
+	WasteListener        WasteListenerFunc
+	BlockCache           *BlockCache
+	BlockCacheKey        string
+	StallTimeout         time.Duration
+	FastConnectThreshold time.Duration
+	FastMaxDiscard       int64
+	HostScheduler        *HostScheduler
+	HostPacer            *HostPacer
+	Trace                *Trace
+	TraceSampleRate      float64
+	TraceSink            TraceSink
+	SpillNoRange         bool
+	SpillDir             string
+	RequestHeaders       http.Header
+	PrepareRequest       PrepareRequestFunc
+	RetriableStatusCodes []int
+	ShouldRetry          ShouldRetryFunc
+	PinHead              int64
+	PinTail              int64
+	AlignedReadSize      int64
+	MaxFetchedBytes      int64
+	ReadPlanner          ReadPlanner
+	StreamReadAhead      int64
+	RequestIDHeader      string
+	ResponseIDHeaders    []string
+
+	metrics httpkit.Metrics
+	limiter httpkit.Limiter
+	// spillFile holds the whole file, if the server doesn't
+	// support ranges and SpillNoRange is set
+	spillFile *os.File
+	// requestID is sent in RequestIDHeader, if set
+	requestID string
+	// supportLog keeps recent log messages for SupportBundle
+	supportLog *supportLog
+	// lazy is set for Files returned by OpenLazy
+	lazy *lazyProbe
+	// pinnedHead and pinnedTail are the first and last bytes
+	// of the file, pinnedTail starts at pinnedTailOffset, see pin
+	pinnedHead       []byte
+	pinnedTail       []byte
+	pinnedTailOffset int64
+	// alignedBlocks holds the last blocks fetched, see AlignedReadSize
+	alignedBlocks *BlockCache
+	// budget counts fetched bytes, see MaxFetchedBytes
+	budget *fetchBudget
+	// settings are those the File was opened with, for Clone
+	settings Settings
 
 	closed bool
+	// ctx is done when the File is closed
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	conns     map[string]*conn
 	connsLock sync.Mutex
+	connsCond *sync.Cond
+	// number of conns currently lent out by borrowConn
+	numBorrowed int
+	// number of borrowConn calls waiting for a conn, by priority
+	waiting map[Priority]int
 
 	currentURL string
-	urlMutex   sync.Mutex
-	header     http.Header
-	requestURL *url.URL
-
-	stats *hstats
+	// urlGeneration is bumped by every renewal, so conns holding an older
+	// generation know to switch to currentURL, see getURLState
+	urlGeneration int64
+	// urlExpiresAt is when currentURL expires, if it's known
+	urlExpiresAt time.Time
+	urlMutex     sync.Mutex
+	// renewMutex is held while renewing, see renewURL
+	renewMutex sync.Mutex
+	// mirrors are the URLs returned by getURLs, currentURL is mirrors[mirrorIndex]
+	mirrors     []string
+	mirrorIndex int
+	// originHost is the host of the initial response, see shouldValidate
+	originHost string
+	renewedAt  []time.Time
+	etag       string
+	// lastModified is only used to validate reconnects if there's no etag
+	lastModified string
+
+	initialResponse *InitialResponse
+
+	stats          *hstats
+	waste          wasteTracker
+	connectLatency latencyTracker
 
 	ForbidBacktracking bool
 	DumpStats          bool
@@ -117,6 +286,7 @@ var _ io.Seeker = (*File)(nil)
 var _ io.Reader = (*File)(nil)
 var _ io.ReaderAt = (*File)(nil)
 var _ io.Closer = (*File)(nil)
+var _ io.WriterTo = (*File)(nil)
 
 // Settings allows passing additional settings to an File
 type Settings struct {
@@ -126,40 +296,369 @@ type Settings struct {
 	LogLevel           int
 	ForbidBacktracking bool
 	DumpStats          bool
+
+	// Logger, if set, receives structured log messages, with Labels
+	// as extra keyvals, and Log and LogLevel are ignored. Otherwise,
+	// they're adapted: level 1 shows connections, retries and renewals,
+	// level 2 shows every read too.
+	Logger httpkit.Logger
+
+	// ReadRetrySettings govern recovering from responses that break off
+	// mid-read: how many times a single read may reconnect, in a row,
+	// without getting any data in between. Each of those reconnects gets
+	// a full RetrySettings budget of its own, so a flaky connect phase
+	// doesn't leave reads without retries, and vice versa. Defaults to
+	// RetrySettings.
+	ReadRetrySettings *retrycontext.Settings
+
+	// Clock is used for connection staleness and retry backoff.
+	// If nil, clock.Real is used.
+	Clock clock.Clock
+
+	// ReconnectAfterIdle, if non-zero, makes File reconnect conns that have
+	// been idle for longer than that before re-using them. Some NATs and
+	// proxies silently kill idle TCP connections, so the first read on those
+	// would fail anyway.
+	ReconnectAfterIdle time.Duration
+
+	// MaxConns caps the number of connections (idle or busy) a File
+	// keeps open. When it's reached, the least recently used idle conn
+	// is closed to make room, and if all of them are busy, reads wait
+	// for one to be returned. Defaults to 8, negative means unlimited.
+	MaxConns int
+
+	// CopyBufferSize is the size of the buffer used by WriteTo.
+	// It's rounded up to a multiple of 4KiB. Defaults to 1MiB.
+	CopyBufferSize int
+
+	// Labels are included in every log line, stats dump and error
+	Labels Labels
+
+	// MaxRenewalsPerWindow and RenewalWindow limit how often the URL
+	// is renewed. When the limit is reached, renewals wait for the window
+	// to slide. If a single connection attempt renews that many times in
+	// a row, ErrTooManyRenewals is returned. Defaults to 30 per minute.
+	MaxRenewalsPerWindow int
+	RenewalWindow        time.Duration
+
+	// RenewBeforeExpiry is how long before a URL expires new connections
+	// renew it, for Files opened with OpenWithExpiry. It should cover how
+	// long connecting takes. Defaults to 30 seconds.
+	RenewBeforeExpiry time.Duration
+
+	// AcceptEncoding is sent as the Accept-Encoding header of every
+	// request. It defaults to IdentityEncoding, so that servers never
+	// compress responses, since byte ranges of a compressed response
+	// don't line up with the file's. Responses that are compressed anyway
+	// fail with a ServerError of code ServerErrorCodeContentEncoding.
+	AcceptEncoding string
+
+	// TE, if set, is sent as the TE header of every request, to negotiate
+	// transfer-codings. Note that HTTP/2 only allows "trailers".
+	TE string
+
+	// MaxDiscard is how many bytes a conn is willing to skip (by reading
+	// and throwing them away) instead of making a new request: reads further
+	// ahead than that always get a new conn. It also caps the size of each
+	// conn's read buffer. Defaults to 1MiB, negative values disable it.
+	MaxDiscard int64
+
+	// MaxBacktrack is the size of each conn's backtracking cache, so how
+	// many bytes a conn can go back instead of making a new request. It's
+	// allocated for every conn, so it's kept separate from MaxDiscard, which
+	// can be much larger. Defaults to MaxDiscard, negative values disable it.
+	MaxBacktrack int64
+
+	// WasteThreshold is the ratio of wasted bytes (discarded to skip ahead,
+	// or downloaded more than once) to served bytes above which a warning
+	// is logged, once per File. Defaults to 0.5, negative values disable it,
+	// along with tracking duplicated bytes (see File.WasteReport).
+	WasteThreshold float64
+
+	// WasteListener, if set, is called along with the warning, so that
+	// callers can report wasteful access patterns to their own metrics.
+	WasteListener WasteListenerFunc
+
+	// BlockCache, if set, serves ReadAt and Read calls from memory when
+	// possible. It can be shared by several Files. WriteTo and Download
+	// bypass it.
+	BlockCache *BlockCache
+
+	// BlockCacheKey identifies the remote resource in BlockCache, so that
+	// Files opened for the same resource share blocks. If empty, the strong
+	// ETag and size of the file are used, and if the server doesn't send an
+	// ETag, BlockCache isn't used.
+	BlockCacheKey string
+
+	// StallTimeout, if non-zero, makes reads fail with a *timeout.StallError
+	// (which is retried) when a response body doesn't deliver any data for
+	// that long, whatever the client's own timeouts are.
+	StallTimeout time.Duration
+
+	// FastConnectThreshold, if non-zero, makes conns skip at most
+	// FastMaxDiscard bytes (instead of MaxDiscard) while new requests get
+	// a response faster than that, on average. On fast networks, a new
+	// request is cheaper than throwing away hundreds of KB, whereas on
+	// high-latency links, it's the other way around. 30ms is a good start.
+	FastConnectThreshold time.Duration
+
+	// FastMaxDiscard defaults to 64KiB, see FastConnectThreshold
+	FastMaxDiscard int64
+
+	// HostScheduler, if set, balances connections to the same host
+	// between all the Files that share it.
+	HostScheduler *HostScheduler
+
+	// HostPacer, if set, spaces out the requests made to the same
+	// host by all the Files that share it, see HostPacer.
+	HostPacer *HostPacer
+
+	// Trace, if set, is called at various points of the
+	// connection machinery, see Trace
+	Trace *Trace
+
+	// TraceSink, if set, receives a RequestTrace for a random
+	// TraceSampleRate (between 0 and 1) of the requests made for
+	// ranges, including every retry, renewal and failover it took.
+	TraceSink       TraceSink
+	TraceSampleRate float64
+
+	// Metrics, if set, receives this File's Stats when it's closed,
+	// as "htfs.connections", "htfs.fetched_bytes", etc.
+	Metrics httpkit.Metrics
+
+	// Limiter, if set, caps how fast response bodies are read, across
+	// all of the File's conns. It's typically a *rate.Limiter, or a
+	// *rate.Consumer of a rate.Shared budget, and passing the same one
+	// to several Files caps their combined download speed. Prefetch
+	// only uses bytes it doesn't have to wait for, see httpkit.TryLimiter.
+	Limiter httpkit.Limiter
+
+	// SpillNoRange, if set, makes Open download the whole file to a
+	// temporary file when the server doesn't support ranges, and serve
+	// all reads from it, instead of failing with a ServerError of code
+	// ServerErrorCodeNoRangeSupport on the first read past offset 0.
+	// The temporary file is removed by Close.
+	SpillNoRange bool
+
+	// SpillDir is where SpillNoRange's temporary file goes.
+	// If empty, the system's temporary directory is used.
+	SpillDir string
+
+	// RequestHeaders are sent with every request, for example to pass
+	// an Authorization header or an API key instead of baking credentials
+	// into the URL. They can't replace the headers htfs sets itself, like
+	// Range or If-Match.
+	RequestHeaders http.Header
+
+	// PrepareRequest, if set, is called with every request right before
+	// it's sent, see PrepareRequestFunc
+	PrepareRequest PrepareRequestFunc
+
+	// CookieJar, if set, stores cookies set by responses (including
+	// redirects) and sends them with later requests, for hosts that only
+	// serve files to the session they started. It replaces Client's Jar.
+	CookieJar http.CookieJar
+
+	// KeepCookies gives the File its own CookieJar, if none is set
+	KeepCookies bool
+
+	// SupportLogSize is how many recent log messages are kept for
+	// SupportBundle. Defaults to 256, negative values disable it.
+	SupportLogSize int
+
+	// SupportLogDebug keeps debug messages for SupportBundle too, not
+	// just info and warnings. There are many of them on busy files, so
+	// it's off by default.
+	SupportLogDebug bool
+
+	// SizeProbe is how Open finds out the file's size: SizeProbeRange
+	// (the default), SizeProbeHead, or KnownSize to skip it entirely.
+	SizeProbe SizeProbe
+
+	// Connectivity, if set, suspends retries while it reports the machine
+	// as offline, and resumes them as soon as it's back online, instead of
+	// waiting out the backoff. It's typically a *timeout.Monitor shared by
+	// all Files. See retrycontext.Settings.Connectivity.
+	Connectivity retrycontext.Connectivity
+
+	// RetriableStatusCodes are the HTTP statuses that are retried, like
+	// network errors. Setting it replaces the default, 429, 500, 502 and
+	// 503, so it can include those returned by unusual proxies, like
+	// Cloudflare's 520 and 522.
+	RetriableStatusCodes []int
+
+	// ShouldRetry, if set, is asked first whether a failed request should
+	// be retried. It returns RetryYes or RetryNo to decide, or RetryDefault
+	// to let RetriableStatusCodes and the usual rules decide.
+	ShouldRetry ShouldRetryFunc
+
+	// PinHead and PinTail, if set, are how many bytes at the start
+	// and the end of the file are fetched when it's opened, and served
+	// from memory from then on. Archive formats like zip, 7z and dmg
+	// keep going back to both ends, which otherwise costs a reconnect
+	// every time. Errors fetching them are returned like the size
+	// probe's. They're ignored if the size isn't known.
+	PinHead int64
+	PinTail int64
+
+	// AlignedReadSize, if set, makes ReadAt and Read fetch whole blocks
+	// of that size, aligned on multiples of it, and serve smaller reads
+	// from the last few blocks fetched. That makes for fewer requests,
+	// for the same ranges every time, which suits CDNs that bill per
+	// request, and their caches. BlockCache, when it's used, does that
+	// with its own BlockSize instead. It's ignored if the size isn't known.
+	AlignedReadSize int64
+
+	// MaxFetchedBytes, if positive, makes reads fail with ErrBudgetExceeded
+	// once the File has fetched more than that many bytes from the network,
+	// including bytes it discarded, or read ahead of what was asked. It's
+	// a safety net against pathological access patterns (like a patcher
+	// seeking back and forth) using up a metered connection, so it should
+	// be well above the file's size.
+	MaxFetchedBytes int64
+
+	// ReadPlanner decides which conn serves each read, or whether to open
+	// a new one. It defaults to DefaultReadPlanner, which is tuned with
+	// MaxDiscard, FastConnectThreshold and ForbidBacktracking.
+	ReadPlanner ReadPlanner
+
+	// StreamReadAhead is how many bytes a Stream reads ahead of its
+	// reader, in the background. It defaults to 1MiB.
+	StreamReadAhead int64
+
+	// RequestIDHeader, if set (like "X-Request-Id"), is sent with every
+	// request, with the File's request ID as its value, so that a CDN's
+	// logs can be matched with ours. The ID is RequestID, or a random one.
+	// Unlike RequestHeaders, it's the same for all requests of a File,
+	// but differs between Files.
+	RequestIDHeader string
+
+	// RequestID is the request ID sent in RequestIDHeader. If empty,
+	// one is generated for each File, see File.RequestID.
+	RequestID string
+
+	// ResponseIDHeaders are the response headers servers identify requests
+	// with (like X-GUploader-UploadID or CF-Ray), recorded in
+	// ConnInfo.ResponseIDs, ServerError, the logs and SupportBundle. If
+	// nil, a list covering common CDNs and object stores is used, if
+	// empty, none are.
+	ResponseIDHeaders []string
 }
 
+// A PrepareRequestFunc can change a request before it's sent, for example
+// to sign it with credentials that expire. It's called for every attempt,
+// including reconnections and requests to renewed URLs. If it returns an
+// error, the attempt fails with it.
+type PrepareRequestFunc func(req *http.Request) error
+
+// IdentityEncoding is the Accept-Encoding value that asks
+// servers not to compress responses.
+const IdentityEncoding = "identity"
+
 // Open returns a new htfs.File. Note that it differs from os.Open in that it does a first request
-// to determine the remote file's size. If that fails (after retries), an error will be returned.
+// to determine the remote file's size (see Settings.SizeProbe). If that fails (after retries), an
+// error will be returned.
 func Open(getURL GetURLFunc, needsRenewal NeedsRenewalFunc, settings *Settings) (*File, error) {
+	return open(singleURL(noExpiry(getURL)), needsRenewal, settings)
+}
+
+// OpenWithExpiry is like Open, for URLs that expire at a known time:
+// new connections renew the URL a little before that (see
+// Settings.RenewBeforeExpiry), rather than after a request fails.
+// needsRenewal is still used, in case URLs expire early.
+func OpenWithExpiry(getURL GetURLWithExpiryFunc, needsRenewal NeedsRenewalFunc, settings *Settings) (*File, error) {
+	return open(singleURL(getURL), needsRenewal, settings)
+}
+
+// noExpiry returns a GetURLWithExpiryFunc for getURL
+func noExpiry(getURL GetURLFunc) GetURLWithExpiryFunc {
+	return func() (string, time.Time, error) {
+		urlStr, err := getURL()
+		return urlStr, time.Time{}, err
+	}
+}
+
+func open(getURLs urlSource, needsRenewal NeedsRenewalFunc, settings *Settings) (*File, error) {
+	f := newFile(getURLs, needsRenewal, settings)
+	err := f.probe(settings.SizeProbe)
+	if err != nil {
+		return nil, err
+	}
+	err = f.pin()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// newFile returns a File configured by settings,
+// that hasn't made any request yet
+func newFile(getURLs urlSource, needsRenewal NeedsRenewalFunc, settings *Settings) *File {
 	client := settings.Client
 	if client == nil {
 		client = http.DefaultClient
 	}
+	jar := settings.CookieJar
+	if jar == nil && settings.KeepCookies {
+		// cookiejar.New never fails without options
+		jar, _ = cookiejar.New(nil)
+	}
+	if jar != nil {
+		// don't change the caller's client, other Files may use it
+		withJar := *client
+		withJar.Jar = jar
+		client = &withJar
+	}
 
-	retryCtx := retrycontext.NewDefault()
-	if settings.RetrySettings != nil {
-		retryCtx.Settings = *settings.RetrySettings
+	clk := clock.Or(settings.Clock)
+
+	retrySettings := fileRetrySettings(settings.RetrySettings, settings, clk)
+	readRetrySettings := retrySettings
+	if settings.ReadRetrySettings != nil {
+		readRetrySettings = fileRetrySettings(settings.ReadRetrySettings, settings, clk)
 	}
 
 	f := &File{
-		getURL:        getURL,
-		retrySettings: &retryCtx.Settings,
-		needsRenewal:  needsRenewal,
-		client:        client,
-		name:          "<remote file>",
-
-		conns: make(map[string]*conn),
-		stats: &hstats{},
+		getURLs:           getURLs,
+		retrySettings:     retrySettings,
+		readRetrySettings: readRetrySettings,
+		needsRenewal:      needsRenewal,
+		client:            client,
+		clock:             clk,
+		name:              "<remote file>",
+		labels:            copyLabels(settings.Labels),
+		settings:          *settings,
+
+		conns:   make(map[string]*conn),
+		waiting: make(map[Priority]int),
+		stats:   &hstats{},
 
 		ConnStaleThreshold: defaultConnStaleThreshold,
 		LogLevel:           defaultLogLevel,
 		ForbidBacktracking: forbidBacktracking,
-		DumpStats:          dumpStats,
 		// number obtained through gut feeling
 		// may not be suitable to all workloads
-		MaxConns: 8,
+		MaxConns:             8,
+		CopyBufferSize:       defaultCopyBufferSize,
+		MaxRenewalsPerWindow: defaultMaxRenewalsPerWindow,
+		RenewalWindow:        defaultRenewalWindow,
+		RenewBeforeExpiry:    defaultRenewBeforeExpiry,
+		MaxDiscard:           defaultMaxDiscard,
+		WasteThreshold:       defaultWasteThreshold,
+	}
+	f.connsCond = sync.NewCond(&f.connsLock)
+	if settings.SupportLogSize >= 0 {
+		supportLogSize := defaultSupportLogSize
+		if settings.SupportLogSize > 0 {
+			supportLogSize = settings.SupportLogSize
+		}
+		f.supportLog = newSupportLog(supportLogSize, settings.SupportLogDebug)
 	}
+	f.ctx, f.cancel = context.WithCancel(context.Background())
 	f.Log = settings.Log
+	f.Logger = settings.Logger
 
 	if settings.LogLevel != 0 {
 		f.LogLevel = settings.LogLevel
@@ -170,65 +669,223 @@ func Open(getURL GetURLFunc, needsRenewal NeedsRenewalFunc, settings *Settings)
 	if settings.DumpStats {
 		f.DumpStats = true
 	}
+	if settings.MaxConns != 0 {
+		f.MaxConns = settings.MaxConns
+	}
+	f.ReconnectAfterIdle = settings.ReconnectAfterIdle
+	if settings.CopyBufferSize != 0 {
+		f.CopyBufferSize = settings.CopyBufferSize
+	}
+	if settings.MaxRenewalsPerWindow != 0 {
+		f.MaxRenewalsPerWindow = settings.MaxRenewalsPerWindow
+	}
+	if settings.RenewalWindow != 0 {
+		f.RenewalWindow = settings.RenewalWindow
+	}
+	if settings.RenewBeforeExpiry != 0 {
+		f.RenewBeforeExpiry = settings.RenewBeforeExpiry
+	}
+	if settings.MaxDiscard < 0 {
+		f.MaxDiscard = 0
+	} else if settings.MaxDiscard != 0 {
+		f.MaxDiscard = settings.MaxDiscard
+	}
+	f.MaxBacktrack = f.MaxDiscard
+	if settings.MaxBacktrack < 0 {
+		f.MaxBacktrack = 0
+	} else if settings.MaxBacktrack != 0 {
+		f.MaxBacktrack = settings.MaxBacktrack
+	}
+	if settings.WasteThreshold != 0 {
+		f.WasteThreshold = settings.WasteThreshold
+	}
+	f.WasteListener = settings.WasteListener
+	f.BlockCache = settings.BlockCache
+	f.BlockCacheKey = settings.BlockCacheKey
+	f.StallTimeout = settings.StallTimeout
+	f.FastConnectThreshold = settings.FastConnectThreshold
+	f.HostScheduler = settings.HostScheduler
+	f.HostPacer = settings.HostPacer
+	f.Trace = settings.Trace
+	f.TraceSink = settings.TraceSink
+	f.TraceSampleRate = settings.TraceSampleRate
+	f.metrics = settings.Metrics
+	f.limiter = settings.Limiter
+	f.FastMaxDiscard = defaultFastMaxDiscard
+	if settings.FastMaxDiscard != 0 {
+		f.FastMaxDiscard = settings.FastMaxDiscard
+	}
+	f.SpillNoRange = settings.SpillNoRange
+	f.SpillDir = settings.SpillDir
+	f.RequestHeaders = settings.RequestHeaders
+	f.PrepareRequest = settings.PrepareRequest
+	f.RetriableStatusCodes = defaultRetriableStatusCodes
+	if settings.RetriableStatusCodes != nil {
+		f.RetriableStatusCodes = settings.RetriableStatusCodes
+	}
+	f.ShouldRetry = settings.ShouldRetry
+	f.PinHead = settings.PinHead
+	f.PinTail = settings.PinTail
+	if settings.AlignedReadSize > 0 {
+		f.AlignedReadSize = settings.AlignedReadSize
+		f.alignedBlocks = NewBlockCache(&BlockCacheSettings{
+			Size:      alignedBlocksKept * settings.AlignedReadSize,
+			BlockSize: settings.AlignedReadSize,
+		})
+	}
+	f.MaxFetchedBytes = settings.MaxFetchedBytes
+	f.budget = &fetchBudget{max: settings.MaxFetchedBytes}
+	f.ReadPlanner = DefaultReadPlanner{}
+	if settings.ReadPlanner != nil {
+		f.ReadPlanner = settings.ReadPlanner
+	}
+	f.RequestIDHeader = settings.RequestIDHeader
+	if settings.RequestIDHeader != "" {
+		f.requestID = settings.RequestID
+		if f.requestID == "" {
+			f.requestID = newRequestID()
+		}
+	}
+	f.ResponseIDHeaders = defaultResponseIDHeaders
+	if settings.ResponseIDHeaders != nil {
+		f.ResponseIDHeaders = settings.ResponseIDHeaders
+	}
+	f.StreamReadAhead = defaultStreamReadAhead
+	if settings.StreamReadAhead > 0 {
+		f.StreamReadAhead = settings.StreamReadAhead
+	}
+	f.AcceptEncoding = IdentityEncoding
+	if settings.AcceptEncoding != "" {
+		f.AcceptEncoding = settings.AcceptEncoding
+	}
+	f.TE = settings.TE
+	return f
+}
 
-	urlStr, err := getURL()
+// probe gets the File's URLs, then its size, name and validators,
+// as specified by probe. Errors are labelled.
+func (f *File) probe(probe SizeProbe) error {
+	err := f.loadURLs()
 	if err != nil {
-		return nil, errors.Wrapf(normalizeError(err), "htfs.Open (getting URL)")
+		return err
 	}
-	f.currentURL = urlStr
 
-	c, err := f.borrowConn(0)
+	switch probe.kind {
+	case sizeProbeHead:
+		err = f.probeWithHead()
+		if err != nil {
+			return f.labelError(errors.Wrapf(normalizeError(err), "htfs.Open (HEAD request)"))
+		}
+		return nil
+	case sizeProbeKnown:
+		f.skipProbe(probe.size)
+		return nil
+	}
+
+	c, err := f.borrowConn(f.ctx, 0, PriorityNormal)
+	if err == io.EOF {
+		// a 416 for the first byte: the file is empty
+		f.skipProbe(0)
+		return nil
+	}
 	if err != nil {
-		return nil, errors.Wrapf(normalizeError(err), "htfs.Open (initial request)")
+		return f.labelError(errors.Wrapf(normalizeError(err), "htfs.Open (initial request)"))
+	}
+	f.initialResponse = newInitialResponse(c)
+	f.etag = strongETag(c.header)
+	f.lastModified = c.header.Get("last-modified")
+	f.originHost = urlHost(c.url)
+
+	if c.statusCode == 200 && f.SpillNoRange {
+		// we asked for a range, and got the whole file
+		err = f.spillToDisk(c)
+		if err != nil {
+			f.returnConn(c)
+			f.Close()
+			return f.labelError(errors.Wrapf(normalizeError(err), "htfs.Open (spilling to disk)"))
+		}
 	}
-	f.header = c.header
 
 	err = f.returnConn(c)
 	if err != nil {
-		return nil, errors.Wrapf(normalizeError(err), "htfs.Open (return conn after initial request)")
+		return f.labelError(errors.Wrapf(normalizeError(err), "htfs.Open (return conn after initial request)"))
 	}
 
-	f.requestURL = c.requestURL
-
 	if c.statusCode == 206 {
-		rangeHeader := c.header.Get("content-range")
-		rangeTokens := strings.Split(rangeHeader, "/")
-		totalBytesStr := rangeTokens[len(rangeTokens)-1]
-		f.size, err = strconv.ParseInt(totalBytesStr, 10, 64)
+		f.size, err = parseContentRangeTotal(c.header.Get("content-range"))
 		if err != nil {
-			return nil, errors.Wrapf(normalizeError(err), "Could not parse file size")
+			return f.labelError(errors.Wrapf(normalizeError(err), "Could not parse file size"))
 		}
-	} else if c.statusCode == 200 {
+	} else if c.statusCode == 200 && f.spillFile == nil {
 		f.size = c.contentLength
 	}
 
-	// we have to use requestURL because we want the URL after
-	// redirect (for hosts like sourceforge)
-	pathTokens := strings.Split(f.requestURL.Path, "/")
-	f.name = pathTokens[len(pathTokens)-1]
+	f.setName(c.requestURL, c.header)
+	return nil
+}
 
-	dispHeader := c.header.Get("content-disposition")
-	if dispHeader != "" {
-		_, mimeParams, err := mime.ParseMediaType(dispHeader)
-		if err == nil {
-			filename := mimeParams["filename"]
-			if filename != "" {
-				f.name = filename
-			}
-		}
+// loadURLs gets the File's first URLs. Errors are labelled.
+func (f *File) loadURLs() error {
+	urls, expiresAt, err := f.getURLs()
+	if err == nil && len(urls) == 0 {
+		err = ErrNoURLs
 	}
+	if err != nil {
+		return f.labelError(errors.Wrapf(normalizeError(err), "htfs.Open (getting URL)"))
+	}
+	f.urlMutex.Lock()
+	f.mirrors = urls
+	f.currentURL = urls[0]
+	f.urlExpiresAt = expiresAt
+	f.urlMutex.Unlock()
+	return nil
+}
 
-	return f, nil
+// fileRetrySettings returns a copy of rs (or of the defaults,
+// if nil), with the File-wide clock and connectivity
+func fileRetrySettings(rs *retrycontext.Settings, settings *Settings, clk clock.Clock) *retrycontext.Settings {
+	retryCtx := retrycontext.NewDefault()
+	if rs != nil {
+		retryCtx.Settings = *rs
+	}
+	if retryCtx.Settings.Clock == nil {
+		retryCtx.Settings.Clock = clk
+	}
+	if settings.Connectivity != nil {
+		retryCtx.Settings.Connectivity = settings.Connectivity
+	}
+	return &retryCtx.Settings
 }
 
 func (f *File) newRetryContext() *retrycontext.Context {
+	return f.newRetryContextWith(f.retrySettings)
+}
+
+// newReadRetryContext returns a retry context for reconnecting
+// mid-read, see Settings.ReadRetrySettings
+func (f *File) newReadRetryContext() *retrycontext.Context {
+	return f.newRetryContextWith(f.readRetrySettings)
+}
+
+func (f *File) newRetryContextWith(settings *retrycontext.Settings) *retrycontext.Context {
 	retryCtx := retrycontext.NewDefault()
-	if f.retrySettings != nil {
-		retryCtx.Settings = *f.retrySettings
+	if settings != nil {
+		retryCtx.Settings = *settings
+	}
+	if retryCtx.Settings.Context == nil {
+		// don't wait for connectivity after Close
+		retryCtx.Settings.Context = f.ctx
 	}
 	return retryCtx
 }
 
+// CookieJar returns the cookie jar used for all of this File's requests,
+// if any (see Settings.CookieJar), so that other requests to the same host
+// can be part of the same session.
+func (f *File) CookieJar() http.CookieJar {
+	return f.client.Jar
+}
+
 // NumConns returns the number of connections currently used by the File
 // to serve ReadAt calls
 func (f *File) NumConns() int {
@@ -238,109 +895,282 @@ func (f *File) NumConns() int {
 	return len(f.conns)
 }
 
-func (f *File) borrowConn(offset int64) (*conn, error) {
+// borrowConn returns a conn that's ready to read at offset, either from
+// the pool or a new one. If all conns are busy, it waits behind borrows
+// of a higher priority than prio.
+func (f *File) borrowConn(ctx context.Context, offset int64, prio Priority) (*conn, error) {
 	f.connsLock.Lock()
 	defer f.connsLock.Unlock()
 
-	if f.knownSize() && offset >= f.size {
-		return nil, io.EOF
-	}
-
-	var bestConn string
-	var bestDiff int64 = math.MaxInt64
-
-	var bestBackConn string
-	var bestBackDiff int64 = math.MaxInt64
-
-	for _, c := range f.conns {
-		if c.Stale() {
-			f.stats.expired++
-			err := f.closeConn(c)
-			if err != nil {
-				return nil, err
-			}
-			continue
+	waiting := false
+	stopWaiting := func() {
+		if waiting {
+			waiting = false
+			f.waiting[prio]--
+			// lower priority borrows may have been holding back for us
+			f.connsCond.Broadcast()
 		}
+	}
+	defer stopWaiting()
 
-		diff := offset - c.Offset()
-		if diff < 0 && -diff < maxDiscard && -diff <= c.Cached() {
-			if -diff < bestBackDiff {
-				bestBackConn = c.id
-				bestBackDiff = -diff
-			}
+	for {
+		if f.closed {
+			return nil, errors.WithStack(ErrClosed)
 		}
 
-		if diff >= 0 && diff < maxDiscard {
-			if diff < bestDiff {
-				bestConn = c.id
-				bestDiff = diff
-			}
+		if f.knownSize() && offset >= f.size {
+			return nil, io.EOF
 		}
-	}
-
-	if bestConn != "" {
-		// re-use!
-		c := f.conns[bestConn]
-		delete(f.conns, bestConn)
 
-		// clear backtrack if any
-		c.Backtrack(0)
+		if !f.outranked(prio) {
+			c, diff, reconnect, stale := f.pickConn(offset)
+			if c != nil || len(stale) > 0 {
+				if c != nil {
+					f.numBorrowed++
+				}
 
-		// discard if needed
-		if bestDiff > 0 {
-			f.log2("[%9d-%9d] (Borrow) %d --> %d (%s)", offset, offset, c.Offset(), c.Offset()+bestDiff, c.id)
+				// discarding, reconnecting and draining all do I/O:
+				// meanwhile, other reads can borrow and return conns.
+				f.connsLock.Unlock()
+				closeErr := closeConns(stale)
+				var err error
+				if c != nil {
+					err = f.prepareConn(ctx, c, offset, diff, reconnect)
+				}
+				f.connsLock.Lock()
 
-			err := c.Discard(bestDiff)
-			if err != nil {
-				if f.shouldRetry(err) {
-					f.log2("[%9d-] (Borrow) discard failed, reconnecting", offset)
-					err = c.Connect(offset)
-					if err != nil {
-						return nil, err
+				if c == nil {
+					if closeErr != nil {
+						return nil, closeErr
 					}
-				} else {
+					continue
+				}
+				if err == nil && f.closed {
+					err = errors.WithStack(ErrClosed)
+				}
+				if err != nil {
+					f.numBorrowed--
+					f.connsCond.Broadcast()
+					c.Close()
 					return nil, err
 				}
+				return c, nil
 			}
-		}
 
-		return c, nil
-	}
-
-	if !f.ForbidBacktracking && bestBackConn != "" {
-		// re-use!
-		c := f.conns[bestBackConn]
-		delete(f.conns, bestBackConn)
+			if f.MaxConns <= 0 || len(f.conns)+f.numBorrowed < f.MaxConns {
+				break
+			}
 
-		f.log2("[%9d-%9d] (Borrow) %d <-- %d (%s)", offset, offset, c.Offset()-bestBackDiff, c.Offset(), c.id)
+			if len(f.conns) > 0 {
+				// make room by closing the least recently used idle conn,
+				// which can drain its body: don't hold the lock meanwhile
+				lru := f.leastRecentlyUsedConn()
+				f.detachConn(lru)
+				f.connsLock.Unlock()
+				err := lru.Close()
+				f.connsLock.Lock()
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
 
-		// backtrack as needed
-		err := c.Backtrack(bestBackDiff)
-		if err != nil {
-			return nil, errors.WithStack(err)
+		// all conns are busy (or promised to a more urgent read),
+		// wait for one to be returned, then see if it's usable
+		if !waiting {
+			waiting = true
+			f.waiting[prio]++
 		}
+		f.debug("borrow: all conns busy, waiting", "offset", offset, "busy", f.numBorrowed, "priority", prio)
+		f.connsCond.Wait()
+	}
+	stopWaiting()
 
-		return c, nil
+	// counts against MaxConns while we wait for the scheduler
+	f.numBorrowed++
+	host, err := f.acquireHostSlot(ctx, prio)
+	if err != nil {
+		f.numBorrowed--
+		f.connsCond.Broadcast()
+		return nil, err
 	}
 
 	// provision a new reader
-	f.log("[%9d-%9d] (Borrow) new connection", offset, offset)
+	f.info("borrow: new connection", "offset", offset)
 
 	id := generateID()
 	c := &conn{
 		file:      f,
 		id:        fmt.Sprintf("reader-%d", id),
-		touchedAt: time.Now(),
+		touchedAt: f.clock.Now(),
+		schedHost: host,
+		hasSlot:   f.HostScheduler != nil,
+	}
+
+	if f.closed {
+		// closed while we were waiting
+		f.numBorrowed--
+		c.Close()
+		return nil, errors.WithStack(ErrClosed)
 	}
 
-	err := c.Connect(offset)
+	// connecting can take a while, especially if the URL needs renewing:
+	// meanwhile, other reads can keep using the conns we already have.
+	f.connsLock.Unlock()
+	err = c.Connect(offset)
+	f.connsLock.Lock()
 	if err != nil {
+		f.numBorrowed--
+		f.connsCond.Broadcast()
+		c.Close()
 		return nil, err
 	}
 
+	if f.closed {
+		// closed while we were connecting
+		f.numBorrowed--
+		c.Close()
+		return nil, errors.WithStack(ErrClosed)
+	}
+
 	return c, nil
 }
 
+// pickConn takes the idle conn Settings.ReadPlanner picks to serve reads
+// at offset after discarding (diff > 0) or backtracking (diff < 0), out of
+// the pool, if it picks one. Stale conns it finds are taken out too, for
+// the caller to close. It must be called with connsLock held, and doesn't
+// do any I/O, see prepareConn.
+func (f *File) pickConn(offset int64) (c *conn, diff int64, reconnect bool, stale []*conn) {
+	req := ReadPlanRequest{
+		Offset:         offset,
+		MaxDiscard:     f.discardLimit(),
+		AllowBacktrack: !f.ForbidBacktracking,
+	}
+
+	for _, c := range f.conns {
+		if c.Stale() {
+			f.stats.add(&f.stats.expired, 1)
+			f.detachConn(c)
+			stale = append(stale, c)
+			continue
+		}
+		req.Conns = append(req.Conns, f.connInfo(c))
+	}
+	if len(req.Conns) == 0 {
+		return nil, 0, false, stale
+	}
+
+	plan := f.ReadPlanner.PlanRead(req)
+	c = f.conns[plan.ConnID]
+	if c == nil {
+		if plan.ConnID != "" {
+			f.debug("borrow: planner picked unknown conn", "conn", plan.ConnID)
+		}
+		return nil, 0, false, stale
+	}
+	delete(f.conns, plan.ConnID)
+
+	// diff stays an int64 all the way to DiscardContext
+	// and Backtrack, whatever the platform's int size is
+	diff = offset - c.Offset()
+	if diff < 0 && (f.ForbidBacktracking || -diff > c.Cached()) {
+		reconnect = true
+	}
+	return c, diff, plan.Reconnect || reconnect, stale
+}
+
+// prepareConn gets c, returned by pickConn, ready to read at offset.
+// It's called without connsLock held, since it may discard data or
+// reconnect. Discarding stops early if ctx is done.
+func (f *File) prepareConn(ctx context.Context, c *conn, offset int64, diff int64, reconnect bool) error {
+	if diff >= 0 {
+		// clear backtrack if any
+		c.Backtrack(0)
+	}
+
+	if reconnect {
+		f.debug("borrow: reconnecting as planned", "offset", offset, "from", c.Offset(), "conn", c.id)
+		c.Backtrack(0)
+		return c.Connect(offset)
+	}
+
+	if f.idleTooLong(c) {
+		f.debug("borrow: idle for too long, reconnecting", "offset", offset, "idle", c.idleTime(), "conn", c.id)
+		c.Backtrack(0)
+		return c.Connect(offset)
+	}
+
+	c.reused = true
+	ev := ConnEvent{
+		ID:       c.id,
+		Host:     urlHost(c.url),
+		Offset:   offset,
+		Duration: c.idleTime(),
+	}
+	if diff >= 0 {
+		ev.Discarded = diff
+	} else {
+		ev.Backtracked = -diff
+	}
+	f.Trace.connReused(ev)
+
+	if diff < 0 {
+		f.debug("borrow: backtracking", "offset", offset, "from", c.Offset(), "backtrack", -diff, "conn", c.id)
+
+		// backtrack as needed
+		err := c.Backtrack(-diff)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+
+	// discard if needed
+	if diff > 0 {
+		f.debug("borrow: discarding", "offset", offset, "from", c.Offset(), "discard", diff, "conn", c.id)
+
+		f.waste.discarded(diff)
+		err := c.DiscardContext(ctx, diff)
+		if err != nil {
+			if f.shouldRetry(err) {
+				f.debug("borrow: discard failed, reconnecting", "offset", offset, "err", err)
+				return c.Connect(offset)
+			}
+			// we don't know where it's at anymore
+			return err
+		}
+	}
+
+	return nil
+}
+
+// leastRecentlyUsedConn returns the idle conn that was returned
+// the longest time ago. There must be at least one.
+func (f *File) leastRecentlyUsedConn() *conn {
+	var lru *conn
+	for _, c := range f.conns {
+		if lru == nil || c.touchedAt.Before(lru.touchedAt) {
+			lru = c
+		}
+	}
+	return lru
+}
+
+// readBufferSize returns the size of a conn's read buffer, which
+// shouldn't be bigger than what we're willing to throw away.
+func (f *File) readBufferSize() int {
+	if f.MaxDiscard < backtracker.DefaultBufferSize {
+		return int(f.MaxDiscard)
+	}
+	return backtracker.DefaultBufferSize
+}
+
+func (f *File) idleTooLong(c *conn) bool {
+	return f.ReconnectAfterIdle > 0 && c.idleTime() > f.ReconnectAfterIdle
+}
+
 type agedConn struct {
 	id  string
 	age time.Duration
@@ -348,29 +1178,51 @@ type agedConn struct {
 
 func (f *File) returnConn(c *conn) error {
 	f.connsLock.Lock()
-	defer f.connsLock.Unlock()
+	toClose := f.returnConnLocked(c)
+	f.connsLock.Unlock()
+
+	// closing can drain bodies, other reads shouldn't wait for it
+	return closeConns(toClose)
+}
+
+// returnConnLocked puts c back in the pool, and returns the conns to close:
+// c itself if it can't be kept, or the oldest idle conns if there are too
+// many. It must be called with connsLock held, and doesn't do any I/O.
+func (f *File) returnConnLocked(c *conn) []*conn {
+	f.numBorrowed--
+	c.flushFetched()
+	if f.closed {
+		return []*conn{c}
+	}
+
+	if c.hasSlot && f.HostScheduler.shouldYield(f, c.schedHost) {
+		f.debug("return: yielding conn to another File", "offset", c.Offset(), "conn", c.id)
+		f.connsCond.Broadcast()
+		return []*conn{c}
+	}
 
-	c.touchedAt = time.Now()
+	c.touchedAt = f.clock.Now()
 	f.conns[c.id] = c
+	// wake everyone up, so that waiters can sort out who goes first
+	f.connsCond.Broadcast()
 
-	if len(f.conns)*2 > f.MaxConns*3 {
+	var victims []*conn
+	if f.MaxConns > 0 && len(f.conns)*2 > f.MaxConns*3 {
 		var agedConns []agedConn
 		for id, c := range f.conns {
-			agedConns = append(agedConns, agedConn{id: id, age: time.Since(c.touchedAt)})
+			agedConns = append(agedConns, agedConn{id: id, age: clock.Since(f.clock, c.touchedAt)})
 		}
 		sort.Slice(agedConns, func(i, j int) bool {
 			return agedConns[i].age < agedConns[j].age
 		})
 
-		victims := agedConns[f.MaxConns:]
-		for _, ac := range victims {
-			err := f.closeConn(f.conns[ac.id])
-			if err != nil {
-
-			}
+		for _, ac := range agedConns[f.MaxConns:] {
+			victim := f.conns[ac.id]
+			f.detachConn(victim)
+			victims = append(victims, victim)
 		}
 	}
-	return nil
+	return victims
 }
 
 func (f *File) getCurrentURL() string {
@@ -380,22 +1232,120 @@ func (f *File) getCurrentURL() string {
 	return f.currentURL
 }
 
-func (f *File) renewURL() (string, error) {
+// getURLState returns the current URL along with its generation. Conns
+// remember the generation they connect with: if it changed by the time
+// they retry, another conn renewed the URL, and they switch to the new
+// one instead of finding out it expired with a failed request of their
+// own. Renewals that return the same URL still bump the generation.
+func (f *File) getURLState() (string, int64) {
 	f.urlMutex.Lock()
 	defer f.urlMutex.Unlock()
 
-	urlStr, err := f.getURL()
+	return f.currentURL, f.urlGeneration
+}
+
+// renewURL returns a URL to replace the one of generation staleGen, and
+// its generation. Only one renewal happens at a time, and if the URL was
+// already renewed while waiting for it, the replacement is returned.
+// urlMutex isn't held while getURLs runs, so that other conns can keep
+// connecting to the stale URL in the meantime.
+func (f *File) renewURL(staleGen int64) (string, int64, error) {
+	f.renewMutex.Lock()
+	defer f.renewMutex.Unlock()
+
+	if latestURL, latestGen := f.getURLState(); latestGen != staleGen {
+		return latestURL, latestGen, nil
+	}
+
+	f.stats.add(&f.stats.renews, 1)
+
+	f.Trace.renewStart()
+	urls, expiresAt, err := f.getURLs()
+	if err == nil && len(urls) == 0 {
+		err = ErrNoURLs
+	}
+	f.Trace.renewDone(err)
 	if err != nil {
-		return "", err
+		return "", staleGen, err
 	}
 
+	f.urlMutex.Lock()
+	defer f.urlMutex.Unlock()
+
+	// stick to the mirror that worked last, if it's still there
+	f.mirrors = urls
+	if f.mirrorIndex >= len(urls) {
+		f.mirrorIndex = 0
+	}
+	urlStr := urls[f.mirrorIndex]
+
+	f.renewedAt = append(f.renewedAt, f.clock.Now())
+	if !sameHost(f.currentURL, urlStr) {
+		f.info("Renewed URL points to a different host, connections won't be re-used")
+	}
 	f.currentURL = urlStr
-	return f.currentURL, nil
+	f.urlGeneration++
+	f.urlExpiresAt = expiresAt
+	return f.currentURL, f.urlGeneration, nil
+}
+
+// freshURL returns the current URL, renewing it first if it expires
+// within RenewBeforeExpiry, which spares a request bound to fail. If the
+// renewal fails, or too many happened recently, the current URL is
+// returned anyway: it might still work, and if it doesn't, the failed
+// request renews it the usual way.
+func (f *File) freshURL(offset int64) (string, int64) {
+	f.urlMutex.Lock()
+	currentURL := f.currentURL
+	generation := f.urlGeneration
+	expiresAt := f.urlExpiresAt
+	f.urlMutex.Unlock()
+
+	if expiresAt.IsZero() || f.clock.Now().Before(expiresAt.Add(-f.RenewBeforeExpiry)) {
+		return currentURL, generation
+	}
+	if delay, _ := f.renewalDelay(); delay > 0 {
+		return currentURL, generation
+	}
+
+	f.debug("renewing URL before it expires", "offset", offset, "expiresAt", expiresAt)
+	urlStr, newGen, err := f.renewURL(generation)
+	if err != nil {
+		f.warn("renewing URL before it expires failed", "offset", offset, "err", err)
+		return currentURL, generation
+	}
+	return urlStr, newGen
+}
+
+// renewalDelay returns how long to wait before renewing the URL again,
+// so we stay under MaxRenewalsPerWindow, and how many renewals happened
+// within the window.
+func (f *File) renewalDelay() (time.Duration, int) {
+	f.urlMutex.Lock()
+	defer f.urlMutex.Unlock()
+
+	now := f.clock.Now()
+	cutoff := now.Add(-f.RenewalWindow)
+	for len(f.renewedAt) > 0 && !f.renewedAt[0].After(cutoff) {
+		f.renewedAt = f.renewedAt[1:]
+	}
+
+	numRecent := len(f.renewedAt)
+	if numRecent < f.MaxRenewalsPerWindow {
+		return 0, numRecent
+	}
+
+	// wait until enough renewals leave the window
+	oldest := f.renewedAt[numRecent-f.MaxRenewalsPerWindow]
+	return oldest.Add(f.RenewalWindow).Sub(now), numRecent
 }
 
 // Stat returns an os.FileInfo for this particular file. Only the Size()
 // method is useful, the rest is default values.
 func (f *File) Stat() (os.FileInfo, error) {
+	if err := f.opened(); err != nil {
+		return nil, err
+	}
 	return &FileInfo{f}, nil
 }
 
@@ -404,6 +1354,10 @@ func (f *File) Stat() (os.FileInfo, error) {
 // If an invalid offset is given, it will be truncated to a valid one, between
 // [0,size).
 func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if err := f.opened(); err != nil {
+		return f.offset, err
+	}
+
 	var newOffset int64
 
 	switch whence {
@@ -430,17 +1384,55 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f *File) Read(buf []byte) (int, error) {
+	if err := f.opened(); err != nil {
+		return 0, err
+	}
+
 	initialOffset := f.offset
 	bytesRead, err := f.readAt(buf, f.offset)
 	f.offset += int64(bytesRead)
 
-	if f.LogLevel >= 2 {
-		bytesWanted := int64(len(buf))
-		start := initialOffset
-		end := initialOffset + bytesWanted
-		f.log2("[%9d-%9d] (Read) %d/%d %v", start, end, bytesRead, bytesWanted, err)
+	if l := f.logger(); l.Enabled(httpkit.LevelDebug) {
+		f.debug("read", "offset", initialOffset, "wanted", len(buf), "read", bytesRead, "err", err)
+	}
+	return bytesRead, f.labelError(err)
+}
+
+// WriteTo copies the rest of the file (from the current read offset) to w.
+// It's used by io.Copy, and uses a single large buffer (see CopyBufferSize)
+// so that big sequential copies to disk don't end up doing lots of small reads
+// and writes. Data is streamed straight from the response body, bypassing
+// the backtracking cache.
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	if err := f.opened(); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, alignCopyBufferSize(f.CopyBufferSize))
+
+	var written int64
+	for {
+		bytesRead, readErr := f.readAtWith(f.ctx, buf, f.offset, true, PriorityBulk)
+		f.offset += int64(bytesRead)
+
+		if bytesRead > 0 {
+			bytesWritten, err := w.Write(buf[:bytesRead])
+			written += int64(bytesWritten)
+			if err != nil {
+				return written, f.labelError(err)
+			}
+			if bytesWritten != bytesRead {
+				return written, io.ErrShortWrite
+			}
+		}
+
+		if readErr != nil {
+			if readErr == io.EOF {
+				return written, nil
+			}
+			return written, f.labelError(readErr)
+		}
 	}
-	return bytesRead, err
 }
 
 // ReadAt reads len(buf) byte from the remote file at offset.
@@ -448,48 +1440,106 @@ func (f *File) Read(buf []byte) (int, error) {
 // network errors or timeouts, it will retry with truncated exponential backoff
 // according to RetrySettings
 func (f *File) ReadAt(buf []byte, offset int64) (int, error) {
-	bytesRead, err := f.readAt(buf, offset)
+	return f.ReadAtContext(context.Background(), buf, offset)
+}
 
-	if f.LogLevel >= 2 {
-		bytesWanted := int64(len(buf))
-		start := offset
-		end := offset + bytesWanted
-
-		var readDesc string
-		if bytesWanted == int64(bytesRead) {
-			readDesc = "full"
-		} else if bytesRead == 0 {
-			readDesc = fmt.Sprintf("partial (%d of %d)", bytesRead, bytesWanted)
-		} else {
-			readDesc = "zero"
-		}
-		if err != nil {
-			readDesc += fmt.Sprintf(", with err %v", err)
+// ReadAtContext is ReadAt, except discarding data to get to offset
+// stops early if ctx is done.
+func (f *File) ReadAtContext(ctx context.Context, buf []byte, offset int64) (int, error) {
+	return f.readAtContext(ctx, buf, offset, PriorityNormal)
+}
+
+func (f *File) readAtContext(ctx context.Context, buf []byte, offset int64, prio Priority) (int, error) {
+	if err := f.opened(); err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := f.mergeContext(ctx)
+	defer cancel()
+	bytesRead, err := f.readAtPinned(ctx, buf, offset, prio)
+
+	if l := f.logger(); l.Enabled(httpkit.LevelDebug) {
+		f.debug("readAt", "offset", offset, "wanted", len(buf), "read", bytesRead, "err", err)
+	}
+	return bytesRead, f.labelError(err)
+}
+
+// mergeContext returns a context that's done when either ctx is,
+// or the File is closed.
+func (f *File) mergeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx.Done() == nil {
+		// never cancelled, no need for an extra goroutine
+		return f.ctx, func() {}
+	}
+
+	merged, cancel := context.WithCancel(ctx)
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-f.ctx.Done():
+			cancel()
+		case <-merged.Done():
+		case <-stop:
 		}
-		f.log2("[%9d-%9d] (ReadAt) %s", start, end, readDesc)
+	}()
+	var stopOnce sync.Once
+	return merged, func() {
+		stopOnce.Do(func() { close(stop) })
+		cancel()
 	}
-	return bytesRead, err
 }
 
 func (f *File) readAt(data []byte, offset int64) (int, error) {
+	return f.readAtPinned(f.ctx, data, offset, PriorityNormal)
+}
+
+// readAtWith is readAt, except when streaming is true, data goes straight
+// from the response body into data, without being copied into the conn's
+// backtracking cache. That's only worth it for large sequential reads.
+// ctx must be done when the File is closed, see mergeContext.
+// prio is passed to borrowConn.
+func (f *File) readAtWith(ctx context.Context, data []byte, offset int64, streaming bool, prio Priority) (int, error) {
 	buflen := len(data)
 	if buflen == 0 {
 		return 0, nil
 	}
 
-	c, err := f.borrowConn(offset)
+	if f.spillFile != nil {
+		return f.readAtSpill(data, offset)
+	}
+
+	c, err := f.borrowConn(ctx, offset, prio)
 	if err != nil {
 		return 0, err
 	}
 	// TODO: this swallows returnConn errors
 	defer f.returnConn(c)
+	if streaming {
+		// runs before returnConn
+		defer c.SetCaching(true)
+	}
 
 	totalBytesRead := 0
+	// only created if the response breaks off, and started over
+	// whenever a reconnect gets us some data
+	var readRetryCtx *retrycontext.Context
+	reconnectedAt := 0
+	defer func() {
+		c.flushFetched()
+		f.waste.served(int64(totalBytesRead))
+		f.checkWaste()
+	}()
 	bytesToRead := len(data)
 
 	for totalBytesRead < bytesToRead {
+		if streaming {
+			// on every iteration, since Connect resets it
+			c.SetCaching(false)
+		}
 		bytesRead, err := c.Read(data[totalBytesRead:])
 		totalBytesRead += bytesRead
+		reused := c.reused
+		c.reused = false
 
 		if err != nil {
 			// so, EOF can indicate connection reset sometimes
@@ -503,6 +1553,20 @@ func (f *File) readAt(data []byte, offset int64) (int, error) {
 					return totalBytesRead, io.EOF
 				}
 			}
+			f.Trace.readError(c.Offset(), err)
+
+			if reused && bytesRead == 0 && isDeadConnError(err) {
+				// the conn sat in our pool and got killed while idle
+				// (by a NAT, a proxy, etc.) - that's not the server's fault,
+				// so reconnect without treating it as a failure.
+				f.info("read: re-used conn was dead, reconnecting", "offset", c.Offset(), "conn", c.id, "err", err)
+				f.stats.add(&f.stats.deadReuses, 1)
+				err = c.Connect(c.Offset())
+				if err != nil {
+					return totalBytesRead, err
+				}
+				continue
+			}
 
 			if f.shouldRetry(err) {
 				// for servers that don't support range requests
@@ -510,7 +1574,17 @@ func (f *File) readAt(data []byte, offset int64) (int, error) {
 				// this will retry a bunch of times before returning
 				// EOF, which is less than ideal, but in my defense,
 				// screw those servers.
-				f.log("Got %s, retrying", err.Error())
+				if readRetryCtx == nil || totalBytesRead > reconnectedAt {
+					readRetryCtx = f.newReadRetryContext()
+				} else {
+					// the last reconnect didn't get us anywhere
+					readRetryCtx.Retry(err)
+				}
+				if !readRetryCtx.ShouldTry() {
+					return totalBytesRead, errors.Wrapf(err, "in File.readAt, exhausted read retry context")
+				}
+				f.info("read: unexpected EOF, retrying", "offset", c.Offset(), "err", err)
+				reconnectedAt = totalBytesRead
 				err = c.Connect(c.Offset())
 				if err != nil {
 					return totalBytesRead, err
@@ -525,6 +1599,17 @@ func (f *File) readAt(data []byte, offset int64) (int, error) {
 }
 
 func (f *File) shouldRetry(err error) bool {
+	if f.ShouldRetry != nil {
+		switch f.ShouldRetry(err) {
+		case RetryYes:
+			f.info("Retrying", "err", err)
+			return true
+		case RetryNo:
+			f.info("Not retrying", "err", err)
+			return false
+		}
+	}
+
 	if errors.Cause(err) == io.EOF {
 		// *do* retry EOF, because apparently it's used interchangeably with
 		// 'connection reset' in golang, see https://github.com/itchio/butler/issues/167
@@ -537,24 +1622,32 @@ func (f *File) shouldRetry(err error) bool {
 			return false
 		}
 
-		f.log("Retrying: %v", err)
+		f.info("Retrying", "err", err)
 		return true
 	}
 
 	if se, ok := errors.Cause(err).(*ServerError); ok {
-		switch se.StatusCode {
-		case 429: /* Too Many Requests */
-			return true
-		case 500: /* Internal Server Error */
-			return true
-		case 502: /* Bad Gateway */
-			return true
-		case 503: /* Service Unavailable */
-			return true
+		for _, code := range f.RetriableStatusCodes {
+			if se.StatusCode == code {
+				return true
+			}
 		}
 	}
 
-	f.log("Bailing on error: %v", err)
+	f.info("Not retrying", "err", err)
+	return false
+}
+
+// isDeadConnError returns true for errors that typically happen
+// when reading from a TCP connection that was closed while idle.
+func isDeadConnError(err error) bool {
+	if errors.Cause(err) == io.EOF {
+		return true
+	}
+
+	if neterr.IsNetworkError(err) {
+		return !strings.Contains(fmt.Sprintf("%v", err), "simulated offline")
+	}
 	return false
 }
 
@@ -591,19 +1684,39 @@ func (f *File) Reset() error {
 }
 
 func (f *File) closeConn(c *conn) error {
-	delete(f.conns, c.id)
+	f.detachConn(c)
+	return c.Close()
+}
 
-	if f.DumpStats {
-		f.stats.numCacheHits += c.NumCacheHits()
-		f.stats.numCacheMiss += c.NumCacheMiss()
-		f.stats.cachedBytes += c.CachedBytesServed()
-		f.stats.fetchedBytes += c.TotalBytesServed()
+// closeConns closes conns that were taken out of the pool,
+// and returns the first error
+func closeConns(conns []*conn) error {
+	var firstErr error
+	for _, c := range conns {
+		err := c.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	return c.Close()
+	return firstErr
+}
+
+// detachConn takes c out of the pool, and accounts for its stats.
+// It must be called with connsLock held.
+func (f *File) detachConn(c *conn) {
+	delete(f.conns, c.id)
+
+	f.stats.add(&f.stats.numCacheHits, c.NumCacheHits())
+	f.stats.add(&f.stats.numCacheMiss, c.NumCacheMiss())
+	f.stats.add(&f.stats.cachedBytes, c.CachedBytesServed())
+	f.stats.add(&f.stats.fetchedBytes, c.TotalBytesServed())
 }
 
 // Close closes all connections to the distant http server used by this File
 func (f *File) Close() error {
+	// stop any ongoing discards and connects first
+	f.cancel()
+
 	f.connsLock.Lock()
 	defer f.connsLock.Unlock()
 
@@ -616,72 +1729,180 @@ func (f *File) Close() error {
 		return errors.Wrap(err, "in File.Close")
 	}
 
-	if f.DumpStats {
-		fetchedBytes := f.stats.fetchedBytes
+	err = f.closeSpill()
+	if err != nil {
+		return errors.Wrap(err, "in File.Close")
+	}
 
-		log.Printf("====== htfs stats for %s", f.name)
-		log.Printf("= conns: %d total, %d expired, %d renews, wait %s", f.stats.connections, f.stats.expired, f.stats.renews, f.stats.connectionWait)
-		size := f.size
-		perc := 0.0
-		percCached := 0.0
-		if size != 0 {
-			perc = float64(fetchedBytes) / float64(size) * 100.0
+	if f.DumpStats || f.metrics != nil {
+		s := f.statsLocked()
+		if f.DumpStats {
+			f.dumpStats(s)
 		}
-		totalServedBytes := fetchedBytes
-		percCached = float64(f.stats.cachedBytes) / float64(totalServedBytes) * 100.0
-
-		log.Printf("= fetched: %s / %s (%.2f%%)", united.FormatBytes(fetchedBytes), united.FormatBytes(size), perc)
-		log.Printf("= served from cache: %s (%.2f%% of all served bytes)", united.FormatBytes(f.stats.cachedBytes), percCached)
-
-		totalReads := f.stats.numCacheHits + f.stats.numCacheMiss
-		if totalReads == 0 {
-			totalReads = -1 // avoid NaN hit rate
+		if f.metrics != nil {
+			f.reportMetrics(s)
 		}
-		hitRate := float64(f.stats.numCacheHits) / float64(totalReads) * 100.0
-		log.Printf("= cache hit rate: %.2f%% (out of %d reads)", hitRate, totalReads)
-		log.Printf("========================================")
 	}
 
 	f.closed = true
+	// wake up anyone waiting in borrowConn
+	f.connsCond.Broadcast()
 
 	return nil
 }
 
+// defaultCopyBufferSize is the size of the buffer WriteTo uses,
+// if CopyBufferSize isn't set
+const defaultCopyBufferSize = 1024 * 1024
+
+// copyBufferAlignment matches the page size of most platforms
+const copyBufferAlignment = 4 * 1024
+
+func alignCopyBufferSize(size int) int {
+	if size <= 0 {
+		size = defaultCopyBufferSize
+	}
+	return (size + copyBufferAlignment - 1) / copyBufferAlignment * copyBufferAlignment
+}
+
 func (f *File) knownSize() bool {
 	return f.size > 0
 }
 
-func (f *File) log(format string, args ...interface{}) {
+// logger returns Logger, or adapts Log and LogLevel: level 1
+// shows info messages, level 2 and above shows debug messages too.
+func (f *File) logger() httpkit.Logger {
+	if f.Logger != nil {
+		return f.Logger
+	}
 	if f.Log == nil {
-		return
+		return httpkit.FuncLogger(nil, httpkit.LevelWarn)
 	}
 
-	f.Log(fmt.Sprintf(format, args...))
+	minLevel := httpkit.LevelInfo
+	if f.LogLevel >= 2 {
+		minLevel = httpkit.LevelDebug
+	}
+	return httpkit.FuncLogger(f.labeledLog, minLevel)
 }
 
-func (f *File) log2(format string, args ...interface{}) {
-	if f.LogLevel < 2 {
-		return
+// labeledLog prefixes LogFunc lines with labels, Loggers get them as keyvals
+func (f *File) labeledLog(msg string) {
+	if len(f.labels) > 0 {
+		msg = fmt.Sprintf("[%s] %s", f.labels, msg)
 	}
+	f.Log(msg)
+}
 
-	if f.Log == nil {
-		return
+func (f *File) debug(msg string, keyvals ...interface{}) {
+	f.record(httpkit.LevelDebug, msg, keyvals)
+	if l := f.logger(); l.Enabled(httpkit.LevelDebug) {
+		l.Debug(msg, f.withLabels(keyvals)...)
+	}
+}
+
+func (f *File) info(msg string, keyvals ...interface{}) {
+	f.record(httpkit.LevelInfo, msg, keyvals)
+	if l := f.logger(); l.Enabled(httpkit.LevelInfo) {
+		l.Info(msg, f.withLabels(keyvals)...)
+	}
+}
+
+func (f *File) warn(msg string, keyvals ...interface{}) {
+	f.record(httpkit.LevelWarn, msg, keyvals)
+	if l := f.logger(); l.Enabled(httpkit.LevelWarn) {
+		l.Warn(msg, f.withLabels(keyvals)...)
 	}
+}
 
-	f.Log(fmt.Sprintf(format, args...))
+func (f *File) withLabels(keyvals []interface{}) []interface{} {
+	if f.Logger == nil || len(f.labels) == 0 {
+		return keyvals
+	}
+	for _, k := range f.labels.keys() {
+		keyvals = append(keyvals, k, f.labels[k])
+	}
+	return keyvals
 }
 
 // GetHeader returns the header the server responded
-// with on our initial request. It may contain checksums
-// which could be used for integrity checking.
+// with on our initial request.
+//
+// Deprecated: use InitialResponse().Header
 func (f *File) GetHeader() http.Header {
-	return f.header
+	if f.initialResponse == nil {
+		return nil
+	}
+	return f.initialResponse.Header
 }
 
 // GetRequestURL returns the first good URL File
 // made a request to.
+//
+// Deprecated: use InitialResponse().URL
 func (f *File) GetRequestURL() *url.URL {
-	return f.requestURL
+	if f.initialResponse == nil {
+		return nil
+	}
+	return f.initialResponse.URL
+}
+
+// validator returns what to send as If-Range, so that servers
+// respond with the whole (new) file instead of a range if it changed.
+func (f *File) validator() string {
+	if f.etag != "" {
+		return f.etag
+	}
+	return f.lastModified
+}
+
+// prepareRequest adds RequestHeaders and RequestIDHeader to req, except
+// those it already has, then calls PrepareRequest
+func (f *File) prepareRequest(req *http.Request) error {
+	for key, values := range f.RequestHeaders {
+		if req.Header.Get(key) != "" {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if f.RequestIDHeader != "" && req.Header.Get(f.RequestIDHeader) == "" {
+		req.Header.Set(f.RequestIDHeader, f.requestID)
+	}
+
+	if f.PrepareRequest != nil {
+		err := f.PrepareRequest(req)
+		if err != nil {
+			return errors.Wrap(err, "in PrepareRequest")
+		}
+	}
+	return nil
+}
+
+// resourceChanged returns true if header describes another version
+// of the file than the one we got on our initial request.
+func (f *File) resourceChanged(header http.Header) bool {
+	if f.etag != "" {
+		etag := strongETag(header)
+		return etag != "" && etag != f.etag
+	}
+	if f.lastModified != "" {
+		lastModified := header.Get("last-modified")
+		return lastModified != "" && lastModified != f.lastModified
+	}
+	return false
+}
+
+// strongETag returns the ETag from header if it's a strong one, or
+// an empty string. Weak ETags never match an If-Match precondition,
+// so there's no point in sending them.
+func strongETag(header http.Header) string {
+	etag := header.Get("etag")
+	if strings.HasPrefix(etag, "W/") {
+		return ""
+	}
+	return etag
 }
 
 func generateID() int64 {
@@ -2,18 +2,26 @@ package htfs_test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/clock"
 	"github.com/itchio/httpkit/htfs"
 	"github.com/itchio/httpkit/neterr"
 
@@ -47,7 +55,7 @@ func defaultSettings(t *testing.T) *htfs.Settings {
 		Client: http.DefaultClient,
 		RetrySettings: &retrycontext.Settings{
 			MaxTries: 5,
-			NoSleep:  true,
+			Clock:    clock.NewFake(time.Now()),
 		},
 		Log: func(msg string) {
 			t.Helper()
@@ -217,6 +225,55 @@ func Test_File503(t *testing.T) {
 	assert.Error(err)
 }
 
+func Test_FileRetryAfter(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbb")
+
+	fc := clock.NewFake(time.Now())
+	fixed := func(value string) func() string {
+		return func() string { return value }
+	}
+	headers := []struct {
+		name     string
+		value    func() string
+		expected time.Duration
+	}{
+		{"Retry-After", fixed("30"), 30 * time.Second},
+		{"Retry-After", func() string { return fc.Now().Add(time.Minute).UTC().Format(http.TimeFormat) }, time.Minute},
+		{"X-RateLimit-Reset", fixed("20"), 20 * time.Second},
+		{"X-RateLimit-Reset", func() string { return fmt.Sprintf("%d", fc.Now().Add(45*time.Second).Unix()) }, 45 * time.Second},
+		// capped
+		{"Retry-After", fixed("86400"), 5 * time.Minute},
+	}
+
+	for _, h := range headers {
+		h := h
+		storageServer := fakeStorage(t, fakeData, &fakeStorageContext{
+			disruption: &storageDisruption{
+				streak: 1,
+				handler: func(w http.ResponseWriter) {
+					w.Header().Set(h.name, h.value())
+					http.Error(w, "Slow down", 429)
+				},
+			},
+		})
+		defer storageServer.Close()
+		defer storageServer.CloseClientConnections()
+
+		start := fc.Slept()
+		settings := defaultSettings(t)
+		settings.Clock = fc
+		settings.RetrySettings.Clock = fc
+		_, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+		assert.NoError(err)
+
+		// plus up to 1s of jitter, HTTP dates only have a 1s precision
+		slept := fc.Slept() - start
+		assert.True(slept > h.expected-time.Second && slept < h.expected+time.Second,
+			"%s should have slept about %s, slept %s", h.name, h.expected, slept)
+	}
+}
+
 type codeDisruption struct {
 	code    int
 	message string
@@ -282,6 +339,110 @@ func Test_FileCodeDisruptions(t *testing.T) {
 	}()
 }
 
+func Test_FileRetriableStatusCodes(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbb")
+
+	open := func(code int, options ...htfs.Option) error {
+		storageServer := fakeStorage(t, fakeData, &fakeStorageContext{
+			disruption: &storageDisruption{
+				streak: 3,
+				handler: func(w http.ResponseWriter) {
+					http.Error(w, "Origin is unreachable", code)
+				},
+			},
+		})
+		defer storageServer.Close()
+		defer storageServer.CloseClientConnections()
+
+		settings := defaultSettings(t)
+		for _, o := range options {
+			o.Apply(settings)
+		}
+		f, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+		if err == nil {
+			f.Close()
+		}
+		return err
+	}
+
+	// not retried by default
+	assert.Error(open(522))
+
+	// retried when listed, and the list replaces the default
+	assert.NoError(open(522, htfs.WithRetriableStatusCodes(520, 522)))
+	assert.Error(open(503, htfs.WithRetriableStatusCodes(520, 522)))
+
+	// ShouldRetry decides first
+	var seen []int
+	shouldRetry := func(err error) htfs.RetryDecision {
+		se, ok := errors.Cause(err).(*htfs.ServerError)
+		if !ok {
+			return htfs.RetryDefault
+		}
+		seen = append(seen, se.StatusCode)
+		switch se.StatusCode {
+		case 599:
+			return htfs.RetryYes
+		case 503:
+			return htfs.RetryNo
+		}
+		return htfs.RetryDefault
+	}
+	assert.NoError(open(599, htfs.WithShouldRetry(shouldRetry)))
+	assert.Error(open(503, htfs.WithShouldRetry(shouldRetry)))
+	assert.NoError(open(500, htfs.WithShouldRetry(shouldRetry)))
+	assert.EqualValues([]int{599, 599, 599, 503, 500, 500, 500}, seen)
+}
+
+func Test_FileRangeNotSatisfiable(t *testing.T) {
+	assert := assert.New(t)
+
+	serve := func(content []byte, contentRange bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") == fmt.Sprintf("bytes=%d-", len(content)) {
+				if contentRange {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(content)))
+				}
+				w.WriteHeader(416)
+				return
+			}
+			http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(content))
+		}))
+	}
+
+	for _, contentRange := range []bool{true, false} {
+		// empty files are answered with a 416 right away
+		server := serve(nil, contentRange)
+		f, err := htfs.Open(storageServerURL(server), noRenewal, defaultSettings(t))
+		assert.NoError(err)
+		if err == nil {
+			stat, err := f.Stat()
+			assert.NoError(err)
+			assert.EqualValues(0, stat.Size())
+
+			_, err = f.ReadAt(make([]byte, 4), 0)
+			assert.Equal(io.EOF, err)
+			assert.NoError(f.Close())
+		}
+		server.Close()
+	}
+
+	// a 416 tells the file is shorter than we thought
+	fakeData := []byte("aaaabbbb")
+	server := serve(fakeData, true)
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	htfs.WithSizeProbe(htfs.KnownSize(12)).Apply(settings)
+	f, err := htfs.Open(storageServerURL(server), noRenewal, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	_, err = f.ReadAt(make([]byte, 2), 10)
+	assert.Equal(htfs.ErrResourceChanged, errors.Cause(err))
+}
+
 func Test_FileURLRenewal(t *testing.T) {
 	assert := assert.New(t)
 	fakeData := make([]byte, 16)
@@ -376,6 +537,156 @@ func Test_FileURLRenewal(t *testing.T) {
 	assert.EqualValues(2, renewalsDone, "number of renewals done")
 }
 
+func Test_FileRenewalRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := make([]byte, 16)
+
+	ctx := &fakeStorageContext{
+		requiredT: 1,
+	}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	getURL := func() (string, error) {
+		return fmt.Sprintf("%s?t=%d", storageServer.URL, ctx.requiredT), nil
+	}
+	needsRenewal := func(res *http.Response, body []byte) bool {
+		return res.StatusCode == 400
+	}
+
+	fc := clock.NewFake(time.Now())
+	settings := defaultSettings(t)
+	settings.Clock = fc
+	settings.ForbidBacktracking = true
+	settings.MaxRenewalsPerWindow = 3
+	settings.RenewalWindow = time.Minute
+
+	// moves the clock along whenever a renewal is waiting on it
+	var paused int32
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				if atomic.LoadInt32(&paused) == 0 && fc.Waiting() > 0 {
+					fc.Advance(time.Second)
+				}
+			}
+		}
+	}()
+
+	hf, err := htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+
+	// renewing more than 3 times a minute is fine, as long
+	// as each renewal gets us a working URL: we just wait
+	start := fc.Now()
+	readBuf := make([]byte, 1)
+	for off := int64(15); off >= 10; off-- {
+		ctx.requiredT++
+		_, err = hf.ReadAt(readBuf, off)
+		assert.NoError(err)
+	}
+	waited := clock.Since(fc, start)
+	assert.True(waited > 0, "should have waited for the renewal window to slide")
+	assert.True(waited <= 2*time.Minute)
+
+	// closing the file stops the wait
+	atomic.StoreInt32(&paused, 1)
+	fc.Advance(settings.RenewalWindow)
+	for off := int64(9); off >= 7; off-- {
+		ctx.requiredT++
+		_, err = hf.ReadAt(readBuf, off)
+		assert.NoError(err)
+	}
+	ctx.requiredT++
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := hf.ReadAt(readBuf, 6)
+		readErr <- err
+	}()
+	for fc.Waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.NoError(hf.Close())
+	assert.True(errors.Cause(<-readErr) == htfs.ErrClosed)
+
+	// a URL that never works is a renewal storm
+	getURL = func() (string, error) {
+		return fmt.Sprintf("%s?t=0", storageServer.URL), nil
+	}
+	hf2, err := htfs.Open(getURL, needsRenewal, settings)
+	assert.Error(err)
+	assert.Nil(hf2)
+	assert.True(errors.Cause(err) == htfs.ErrTooManyRenewals)
+}
+
+func Test_FileRenewBeforeExpiry(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := make([]byte, 16)
+
+	ctx := &fakeStorageContext{
+		requiredT: 1,
+	}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	fc := clock.NewFake(time.Now())
+	renewals := 0
+	getURL := func() (string, time.Time, error) {
+		renewals++
+		return fmt.Sprintf("%s?t=%d", storageServer.URL, ctx.requiredT), fc.Now().Add(time.Minute), nil
+	}
+	renewalsAdvertised := 0
+	needsRenewal := func(res *http.Response, body []byte) bool {
+		if res.StatusCode == 400 {
+			renewalsAdvertised++
+			return true
+		}
+		return false
+	}
+
+	settings := defaultSettings(t)
+	settings.Clock = fc
+	settings.ForbidBacktracking = true
+	settings.RenewBeforeExpiry = 10 * time.Second
+
+	hf, err := htfs.OpenWithExpiry(getURL, needsRenewal, settings)
+	assert.NoError(err)
+	assert.EqualValues(1, renewals)
+
+	// far from expiry: the URL is kept
+	readBuf := make([]byte, 1)
+	fc.Advance(30 * time.Second)
+	_, err = hf.ReadAt(readBuf, 8)
+	assert.NoError(err)
+	assert.EqualValues(1, renewals)
+
+	// about to expire: renewed before the request, which doesn't fail
+	fc.Advance(25 * time.Second)
+	ctx.requiredT++
+	numGET := ctx.numGET
+	_, err = hf.ReadAt(readBuf, 4)
+	assert.NoError(err)
+	assert.EqualValues(2, renewals)
+	assert.EqualValues(0, renewalsAdvertised)
+	assert.EqualValues(numGET+1, ctx.numGET)
+
+	// expired early: renewed after the failed request, as usual
+	ctx.requiredT++
+	_, err = hf.ReadAt(readBuf, 0)
+	assert.NoError(err)
+	assert.EqualValues(3, renewals)
+	assert.EqualValues(1, renewalsAdvertised)
+
+	assert.NoError(hf.Close())
+}
+
 var _bigFakeData []byte
 
 // returns 4MB's worth of random data
@@ -579,100 +890,1394 @@ func Test_UnexpectedEOF(t *testing.T) {
 	assert.NoError(err)
 }
 
-////////////////////////
-// fake storage
-////////////////////////
+func Test_FileParallelDiscard(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
 
-const expiredURLMessage = "Signed URL Expired"
+	// responses from the start of the file stall after a while
+	release := make(chan struct{})
+	storageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(fakeData)-1, len(fakeData)))
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(fakeData)-start))
+		w.WriteHeader(http.StatusPartialContent)
+
+		body := fakeData[start:]
+		if start == 0 {
+			w.Write(body[:64*1024])
+			w.(http.Flusher).Flush()
+			<-release
+			body = body[64*1024:]
+		}
+		w.Write(body)
+	}))
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+	var releaseOnce sync.Once
+	unstall := func() {
+		releaseOnce.Do(func() { close(release) })
+	}
+	// or closing the server would wait for the handler forever
+	defer unstall()
 
-type fakeStorageContext struct {
-	delay                  time.Duration
-	simulateNoRangeSupport bool
-	simulateNotFound       bool
-	simulateOtherStatus    int
-	numUnexpectedEOF       int
-	requiredT              int64
-	numGET                 int
-	numHEAD                int
-	disruption             *storageDisruption
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, defaultSettings(t))
+	assert.NoError(err)
+
+	// re-uses the initial conn, and gets stuck discarding
+	discarded := make(chan error, 1)
+	go func() {
+		_, err := hf.ReadAt(make([]byte, 1024), 512*1024)
+		discarded <- err
+	}()
+
+	// doesn't wait for it
+	buf := make([]byte, 1024)
+	read := make(chan error, 1)
+	go func() {
+		_, err := hf.ReadAt(buf, 3*1024*1024)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		assert.NoError(err)
+		assert.EqualValues(fakeData[3*1024*1024:3*1024*1024+1024], buf)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read was blocked by another read's discard")
+	}
+
+	unstall()
+	assert.NoError(<-discarded)
+	assert.NoError(hf.Close())
 }
 
-type disruptionHandlerFunc func(w http.ResponseWriter)
+func Test_FileReadRetryBudget(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbcccc")
+
+	// every response promises the whole range, then breaks off
+	var numGET int32
+	storageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numGET, 1)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(fakeData)-1, len(fakeData)))
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(fakeData)))
+		w.WriteHeader(http.StatusPartialContent)
+	}))
+	defer storageServer.Close()
 
-type storageDisruption struct {
-	// how many errors to return in a row before succeeding
-	streak int
+	settings := defaultSettings(t)
+	settings.ReadRetrySettings = &retrycontext.Settings{
+		MaxTries: 2,
+		Clock:    settings.RetrySettings.Clock,
+	}
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	assert.EqualValues(1, atomic.LoadInt32(&numGET))
 
-	// what to do when the disruption happens
-	handler disruptionHandlerFunc
+	// connecting works every time, but reads run out of retries: the
+	// initial conn looks dead, which doesn't count, then the two
+	// fruitless reconnects do
+	_, err = hf.ReadAt(make([]byte, 4), 0)
+	assert.Error(err)
+	assert.Contains(err.Error(), "exhausted read retry context")
+	assert.EqualValues(4, atomic.LoadInt32(&numGET))
 
-	// internal
-	counter int
+	assert.NoError(hf.Close())
 }
 
-func fakeStorage(t *testing.T, content []byte, ctx *fakeStorageContext) *httptest.Server {
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if ctx.simulateNotFound {
-			w.WriteHeader(404)
-			return
-		}
+func Test_FileContentChanged(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbb")
 
-		if ctx.simulateOtherStatus != 0 {
-			w.WriteHeader(ctx.simulateOtherStatus)
-			return
-		}
+	ctx := &fakeStorageContext{
+		etag: `"v1"`,
+	}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
 
-		disrupt := ctx.disruption
-		if disrupt != nil {
-			if disrupt.counter < disrupt.streak {
-				disrupt.handler(w)
-				disrupt.counter++
-				return
-			}
-			disrupt.counter = 0
-		}
+	hf, err := newSimple(t, storageServer.URL)
+	assert.NoError(err)
+	hf.ForbidBacktracking = true
 
-		hasExpired := false
+	buf := make([]byte, 4)
+	_, err = hf.ReadAt(buf, 4)
+	assert.NoError(err)
+	assert.Equal([]byte("bbbb"), buf)
 
-		if ctx.requiredT > 0 {
-			t := r.URL.Query().Get("t")
-			if t != "" {
-				tVal, err := strconv.ParseInt(t, 10, 64)
-				if err == nil {
-					if tVal < ctx.requiredT {
-						hasExpired = true
-					}
-				}
-			}
-		}
+	ctx.etag = `"v2"`
+	numGET := ctx.numGET
 
-		if r.Method == "HEAD" {
-			ctx.numHEAD++
-			if hasExpired {
-				http.Error(w, expiredURLMessage, 400)
-				return
-			}
+	_, err = hf.ReadAt(buf, 0)
+	assert.Error(err)
+	assert.True(errors.Cause(err) == htfs.ErrResourceChanged)
+	assert.EqualValues(numGET+1, ctx.numGET, "should not retry on 412")
+}
 
-			w.Header().Set("content-length", fmt.Sprintf("%d", len(content)))
-			w.WriteHeader(200)
-			return
-		}
+func Test_FileResourceChanged(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbb")
 
-		if r.Method != "GET" {
-			http.Error(w, "Invalid method", 400)
-			return
+	for _, validator := range []string{"etag", "last-modified"} {
+		ctx := &fakeStorageContext{}
+		if validator == "etag" {
+			ctx.etag = `"v1"`
+			ctx.ignoreIfMatch = true
+		} else {
+			ctx.lastModified = "Wed, 21 Oct 2015 07:28:00 GMT"
 		}
+		storageServer := fakeStorage(t, fakeData, ctx)
 
-		ctx.numGET++
-		if hasExpired {
-			http.Error(w, expiredURLMessage, 400)
-			return
+		hf, err := newSimple(t, storageServer.URL)
+		assert.NoError(err)
+		hf.ForbidBacktracking = true
+
+		buf := make([]byte, 4)
+		_, err = hf.ReadAt(buf, 4)
+		assert.NoError(err)
+		assert.Equal([]byte("bbbb"), buf)
+
+		var sentValidator string
+		if validator == "etag" {
+			sentValidator = ctx.etag
+			ctx.etag = `"v2"`
+		} else {
+			sentValidator = ctx.lastModified
+			ctx.lastModified = "Thu, 22 Oct 2015 07:28:00 GMT"
 		}
+		numGET := ctx.numGET
 
-		time.Sleep(ctx.delay)
+		_, err = hf.ReadAt(buf, 2)
+		assert.EqualValues(sentValidator, ctx.lastHeader.Get("If-Range"), validator)
+		assert.Error(err, validator)
+		assert.True(errors.Cause(err) == htfs.ErrResourceChanged, validator)
+		assert.EqualValues(numGET+1, ctx.numGET, "should not retry")
 
-		w.Header().Set("content-type", "application/octet-stream")
-		rangeHeader := r.Header.Get("Range")
+		storageServer.CloseClientConnections()
+		storageServer.Close()
+	}
+}
+
+func Test_FileReconnectAfterIdle(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbcccc")
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	fc := clock.NewFake(time.Now())
+	settings := defaultSettings(t)
+	settings.Clock = fc
+	settings.ReconnectAfterIdle = 2 * time.Second
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+
+	buf := make([]byte, 4)
+	_, err = hf.ReadAt(buf, 0)
+	assert.NoError(err)
+	numGET := ctx.numGET
+
+	fc.Advance(1 * time.Second)
+	_, err = hf.ReadAt(buf, 4)
+	assert.NoError(err)
+	assert.EqualValues(numGET, ctx.numGET, "should re-use conn")
+
+	fc.Advance(3 * time.Second)
+	_, err = hf.ReadAt(buf, 8)
+	assert.NoError(err)
+	assert.Equal([]byte("cccc"), buf)
+	assert.EqualValues(numGET+1, ctx.numGET, "should reconnect idle conn")
+	assert.Equal(1, hf.NumConns())
+
+	assert.NoError(hf.Close())
+}
+
+func Test_FileDeadReuse(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var numGET int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && atomic.AddInt64(&numGET, 1) == 1 {
+			// the first response sends a bit, then sits there
+			w.Header().Set("content-length", strconv.Itoa(len(fakeData)))
+			w.WriteHeader(200)
+			w.Write(fakeData[:4096])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, "file.dat", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	fc := clock.NewFake(time.Now())
+	settings := defaultSettings(t)
+	settings.Clock = fc
+
+	hf, err := htfs.Open(func() (string, error) { return server.URL, nil }, noRenewal, settings)
+	assert.NoError(err)
+
+	buf := make([]byte, 4096)
+	_, err = hf.ReadAt(buf, 0)
+	assert.NoError(err)
+
+	// killed while idle in the pool
+	server.CloseClientConnections()
+	start := fc.Now()
+
+	_, err = hf.ReadAt(buf, 4096)
+	assert.NoError(err)
+	assert.True(bytes.Equal(fakeData[4096:8192], buf))
+	assert.EqualValues(2, atomic.LoadInt64(&numGET))
+	assert.EqualValues(1, hf.Stats().DeadReuses)
+	// not a failure: no retries, no backoff
+	assert.EqualValues(0, fc.Slept())
+	assert.EqualValues(start, fc.Now())
+
+	assert.NoError(hf.Close())
+}
+
+func Test_FileRenewalReusesSession(t *testing.T) {
+	assert := assert.New(t)
+	// big enough that it isn't all buffered after the first read,
+	// small enough to be drained.
+	fakeData := bytes.Repeat([]byte("aaaabbbbcccc"), 2048)
+
+	ctx := &fakeStorageContext{
+		requiredT: 1,
+	}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	var numDials int64
+	dialer := &net.Dialer{}
+	transport := &http.Transport{
+		DialContext: func(c context.Context, network string, addr string) (net.Conn, error) {
+			atomic.AddInt64(&numDials, 1)
+			return dialer.DialContext(c, network, addr)
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	getURL := func() (string, error) {
+		return fmt.Sprintf("%s/file?t=%d", storageServer.URL, ctx.requiredT), nil
+	}
+	needsRenewal := func(res *http.Response, body []byte) bool {
+		return res.StatusCode == 400
+	}
+
+	fc := clock.NewFake(time.Now())
+	settings := defaultSettings(t)
+	settings.Client = &http.Client{Transport: transport}
+	settings.Clock = fc
+	settings.ReconnectAfterIdle = 2 * time.Second
+
+	hf, err := htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+
+	buf := make([]byte, 4)
+	_, err = hf.ReadAt(buf, 0)
+	assert.NoError(err)
+
+	// only the signature changes, the host stays the same
+	ctx.requiredT = 2
+	fc.Advance(3 * time.Second)
+	_, err = hf.ReadAt(buf, 8)
+	assert.NoError(err)
+	assert.Equal([]byte("cccc"), buf)
+	assert.EqualValues(3, ctx.numGET, "expected expired GET then renewed GET")
+	assert.EqualValues(1, atomic.LoadInt64(&numDials), "should re-use TCP connection")
+
+	assert.NoError(hf.Close())
+}
+
+func Test_FileStaleWhileRenew(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbccccdddd")
+
+	var expired int32
+	storageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stale := r.URL.Query().Get("v") != "2"
+		if stale && atomic.LoadInt32(&expired) == 1 && r.Header.Get("Range") == "bytes=12-" {
+			http.Error(w, "Signature expired", 403)
+			return
+		}
+		http.ServeContent(w, r, "file.dat", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer storageServer.Close()
+
+	var numURLs int32
+	renewStarted := make(chan struct{})
+	release := make(chan struct{})
+	getURL := func() (string, error) {
+		if atomic.AddInt32(&numURLs, 1) == 1 {
+			return storageServer.URL + "/file?v=1", nil
+		}
+		close(renewStarted)
+		<-release
+		return storageServer.URL + "/file?v=2", nil
+	}
+	needsRenewal := func(res *http.Response, body []byte) bool {
+		return res.StatusCode == 403
+	}
+
+	settings := defaultSettings(t)
+	settings.MaxDiscard = -1
+	settings.ForbidBacktracking = true
+	hf, err := htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+
+	atomic.StoreInt32(&expired, 1)
+	renewDone := make(chan error, 1)
+	go func() {
+		_, err := hf.ReadAt(make([]byte, 4), 12)
+		renewDone <- err
+	}()
+	<-renewStarted
+
+	// while that renews, reads go on: on the conn we already
+	// have, and on a new conn to the previous URL
+	for _, offset := range []int64{0, 8} {
+		readDone := make(chan error, 1)
+		buf := make([]byte, 4)
+		go func() {
+			_, err := hf.ReadAt(buf, offset)
+			readDone <- err
+		}()
+		select {
+		case err := <-readDone:
+			assert.NoError(err)
+			assert.EqualValues(fakeData[offset:offset+4], buf)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("read at %d was blocked by the renewal", offset)
+		}
+	}
+
+	close(release)
+	assert.NoError(<-renewDone)
+	assert.EqualValues(2, atomic.LoadInt32(&numURLs))
+	assert.EqualValues(1, hf.Stats().Renewals)
+
+	assert.NoError(hf.Close())
+}
+
+func Test_FileRenewalSharedByConns(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbccccdddd")
+
+	// the URL never changes, renewing refreshes the session
+	// it's signed with, server-side
+	var valid int32 = 1
+	var numRejected int32
+	bothRejected := make(chan struct{})
+	storageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&valid) == 0 {
+			if atomic.AddInt32(&numRejected, 1) == 2 {
+				close(bothRejected)
+			}
+			select {
+			case <-bothRejected:
+			case <-time.After(5 * time.Second):
+			}
+			http.Error(w, "Session expired", 403)
+			return
+		}
+		http.ServeContent(w, r, "file.dat", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer storageServer.Close()
+
+	var numURLs int32
+	getURL := func() (string, error) {
+		atomic.AddInt32(&numURLs, 1)
+		atomic.StoreInt32(&valid, 1)
+		return storageServer.URL + "/file", nil
+	}
+	needsRenewal := func(res *http.Response, body []byte) bool {
+		return res.StatusCode == 403
+	}
+
+	settings := defaultSettings(t)
+	settings.MaxDiscard = -1
+	settings.ForbidBacktracking = true
+	hf, err := htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+
+	// both conns find out the session expired, only one
+	// renews it, the other picks up the renewal
+	atomic.StoreInt32(&valid, 0)
+	var wg sync.WaitGroup
+	for _, offset := range []int64{4, 12} {
+		offset := offset
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 4)
+			_, err := hf.ReadAt(buf, offset)
+			assert.NoError(err)
+			assert.EqualValues(fakeData[offset:offset+4], buf)
+		}()
+	}
+	wg.Wait()
+
+	assert.EqualValues(2, atomic.LoadInt32(&numRejected))
+	assert.EqualValues(2, atomic.LoadInt32(&numURLs))
+	assert.EqualValues(1, hf.Stats().Renewals)
+
+	assert.NoError(hf.Close())
+}
+
+func Test_FileEncodingHeaders(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbcccc")
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	settings := defaultSettings(t)
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	assert.EqualValues("identity", ctx.lastHeader.Get("Accept-Encoding"))
+	assert.EqualValues("", ctx.lastHeader.Get("TE"))
+	assert.NoError(hf.Close())
+
+	settings.AcceptEncoding = htfs.IdentityEncoding
+	settings.TE = "trailers"
+	hf, err = htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	assert.EqualValues("identity", ctx.lastHeader.Get("Accept-Encoding"))
+	assert.EqualValues("trailers", ctx.lastHeader.Get("TE"))
+	assert.NoError(hf.Close())
+}
+
+func Test_FileRequestHeaders(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbcccc")
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	numPrepared := 0
+	settings := defaultSettings(t)
+	settings.MaxDiscard = -1
+	settings.RequestHeaders = http.Header{
+		"Authorization": []string{"Bearer hunter2"},
+		// can't break ranges
+		"Range": []string{"bytes=0-0"},
+	}
+	settings.PrepareRequest = func(req *http.Request) error {
+		numPrepared++
+		req.Header.Set("X-Request-Number", fmt.Sprintf("%d", numPrepared))
+		return nil
+	}
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	assert.EqualValues("Bearer hunter2", ctx.lastHeader.Get("Authorization"))
+	assert.EqualValues("1", ctx.lastHeader.Get("X-Request-Number"))
+
+	// reconnections too
+	buf := make([]byte, 4)
+	_, err = hf.ReadAt(buf, 8)
+	assert.NoError(err)
+	assert.EqualValues("cccc", string(buf))
+	assert.EqualValues("Bearer hunter2", ctx.lastHeader.Get("Authorization"))
+	assert.EqualValues("bytes=8-", ctx.lastHeader.Get("Range"))
+	assert.EqualValues("2", ctx.lastHeader.Get("X-Request-Number"))
+	assert.NoError(hf.Close())
+
+	settings.PrepareRequest = func(req *http.Request) error {
+		return errors.New("no credentials")
+	}
+	_, err = htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.Error(err)
+	assert.Contains(err.Error(), "no credentials")
+}
+
+func Test_FileCookies(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbcccc")
+
+	// like file lockers: the download link starts a session, and
+	// only hands out one per visitor
+	sessionStarted := false
+	storageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, cookieErr := r.Cookie("session")
+		switch r.URL.Path {
+		case "/download":
+			if cookieErr != nil {
+				if sessionStarted {
+					http.Error(w, "Session already started", 403)
+					return
+				}
+				sessionStarted = true
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3cr3t", Path: "/"})
+			}
+			http.Redirect(w, r, "/file", http.StatusFound)
+		case "/file":
+			if cookieErr != nil {
+				http.Error(w, "No session", 403)
+				return
+			}
+			http.ServeContent(w, r, "file.dat", time.Time{}, bytes.NewReader(fakeData))
+		}
+	}))
+	defer storageServer.Close()
+
+	getURL := func() (string, error) {
+		return storageServer.URL + "/download", nil
+	}
+
+	settings := defaultSettings(t)
+	settings.MaxDiscard = -1
+	settings.KeepCookies = true
+	hf, err := htfs.Open(getURL, noRenewal, settings)
+	assert.NoError(err)
+	assert.Nil(http.DefaultClient.Jar, "must not change the caller's client")
+
+	buf := make([]byte, 4)
+	_, err = hf.ReadAt(buf, 8)
+	assert.NoError(err)
+	assert.EqualValues("cccc", string(buf))
+
+	u, err := url.Parse(storageServer.URL)
+	assert.NoError(err)
+	assert.Len(hf.CookieJar().Cookies(u), 1)
+	assert.NoError(hf.Close())
+
+	// without cookies, the second request fails
+	sessionStarted = false
+	settings.KeepCookies = false
+	hf, err = htfs.Open(getURL, noRenewal, settings)
+	assert.Error(err)
+}
+
+func Test_FileContentEncoding(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbcccc")
+
+	// some servers compress no matter what we ask for
+	storageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		http.ServeContent(w, r, "file.dat", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer storageServer.Close()
+
+	_, err := htfs.Open(storageServerURL(storageServer), noRenewal, defaultSettings(t))
+	assert.Error(err)
+	se, ok := errors.Cause(err).(*htfs.ServerError)
+	if assert.True(ok, "should be a ServerError") {
+		assert.EqualValues(htfs.ServerErrorCodeContentEncoding, se.Code)
+		assert.EqualValues(206, se.StatusCode)
+	}
+}
+
+func Test_FileMaxDiscard(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbcccc")
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	settings := defaultSettings(t)
+	settings.MaxDiscard = 2
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+
+	buf := make([]byte, 4)
+	_, err = hf.ReadAt(buf, 0)
+	assert.NoError(err)
+	numGET := ctx.numGET
+
+	// 1 byte away: discard
+	_, err = hf.ReadAt(buf, 5)
+	assert.NoError(err)
+	assert.EqualValues(numGET, ctx.numGET, "should discard")
+
+	// 8 bytes back: too far
+	_, err = hf.ReadAt(buf, 1)
+	assert.NoError(err)
+	assert.Equal([]byte("aaab"), buf)
+	assert.EqualValues(numGET+1, ctx.numGET, "should make new request")
+
+	assert.NoError(hf.Close())
+}
+
+func Test_FileMaxBacktrack(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbccccdddd")
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	settings := defaultSettings(t)
+	settings.MaxDiscard = 1024
+	settings.MaxBacktrack = 4
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+
+	buf := make([]byte, 4)
+	_, err = hf.ReadAt(buf, 0)
+	assert.NoError(err)
+	numGET := ctx.numGET
+
+	// way ahead, but less than MaxDiscard: discard
+	_, err = hf.ReadAt(buf, 8)
+	assert.NoError(err)
+	assert.EqualValues(numGET, ctx.numGET, "should discard")
+
+	// 4 bytes back: cached
+	_, err = hf.ReadAt(buf, 8)
+	assert.NoError(err)
+	assert.Equal([]byte("cccc"), buf)
+	assert.EqualValues(numGET, ctx.numGET, "should backtrack")
+
+	// 8 bytes back: more than MaxBacktrack
+	_, err = hf.ReadAt(buf, 4)
+	assert.NoError(err)
+	assert.Equal([]byte("bbbb"), buf)
+	assert.EqualValues(numGET+1, ctx.numGET, "should make new request")
+
+	assert.NoError(hf.Close())
+}
+
+func Test_FileFastConnectThreshold(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbccccdddd")
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	for _, threshold := range []time.Duration{0, time.Minute} {
+		settings := defaultSettings(t)
+		settings.FastConnectThreshold = threshold
+		settings.FastMaxDiscard = 2
+		hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+		assert.NoError(err)
+
+		_, ok := hf.ConnectLatency()
+		assert.True(ok, "initial request should be measured")
+
+		buf := make([]byte, 4)
+		_, err = hf.ReadAt(buf, 0)
+		assert.NoError(err)
+		numGET := ctx.numGET
+
+		// 3 bytes away
+		_, err = hf.ReadAt(buf, 7)
+		assert.NoError(err)
+		assert.Equal([]byte("bccc"), buf)
+		if threshold == 0 {
+			assert.EqualValues(numGET, ctx.numGET, "should discard")
+		} else {
+			assert.EqualValues(numGET+1, ctx.numGET, "should make new request on fast network")
+		}
+
+		assert.NoError(hf.Close())
+	}
+}
+
+func Test_FileStats(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbccccdddd")
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, defaultSettings(t))
+	assert.NoError(err)
+
+	s := hf.Stats()
+	assert.EqualValues(1, s.Connections)
+	assert.EqualValues(0, s.CacheHitRate())
+
+	buf := make([]byte, 4)
+	_, err = hf.ReadAt(buf, 8)
+	assert.NoError(err)
+	// backtrack
+	_, err = hf.ReadAt(buf, 10)
+	assert.NoError(err)
+	_, err = hf.ReadAt(buf, 8)
+	assert.NoError(err)
+
+	s = hf.Stats()
+	assert.EqualValues(1, s.Connections)
+	// 12 read, plus 8 discarded to get to the first read
+	assert.EqualValues(20, s.FetchedBytes)
+	// 2 then 4 bytes backtracked
+	assert.EqualValues(6, s.CachedBytes)
+	assert.True(s.CacheHits > 0)
+	assert.NoError(hf.Close())
+
+	// still there after Close
+	assert.EqualValues(s.FetchedBytes, hf.Stats().FetchedBytes)
+}
+
+func Test_FileStatsConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	storageServer := fakeStorage(t, fakeData, &fakeStorageContext{})
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, defaultSettings(t))
+	assert.NoError(err)
+
+	// meant to be run with -race: stats are updated by readers
+	// while they're being read
+	stop := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				hf.Stats()
+				hf.DescribeConns()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := make([]byte, 4096)
+			for j := 0; j < 16; j++ {
+				offset := int64((i*16+j)*4096*7) % int64(len(fakeData)-len(buf))
+				_, err := hf.ReadAt(buf, offset)
+				assert.NoError(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	<-polled
+
+	s := hf.Stats()
+	assert.True(s.Connections > 0)
+	assert.True(s.FetchedBytes >= 8*16*4096)
+	assert.NoError(hf.Close())
+}
+
+func Test_FileTrace(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbccccdddd")
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	var events []string
+	var lifecycle []string
+	var reuses []htfs.ConnEvent
+	settings := defaultSettings(t)
+	settings.Trace = &htfs.Trace{
+		ConnectStart: func(offset int64) {
+			events = append(events, fmt.Sprintf("connect %d", offset))
+		},
+		ConnectDone: func(offset int64, duration time.Duration, err error) {
+			events = append(events, fmt.Sprintf("connected %d (%v)", offset, err))
+		},
+		ReadError: func(offset int64, err error) {
+			events = append(events, fmt.Sprintf("read error at %d", offset))
+		},
+		ConnReused: func(ev htfs.ConnEvent) {
+			reuses = append(reuses, ev)
+		},
+		ConnOpened: func(ev htfs.ConnEvent) {
+			lifecycle = append(lifecycle, fmt.Sprintf("open %s at %d", ev.Host, ev.Offset))
+		},
+		ConnClosed: func(ev htfs.ConnEvent) {
+			lifecycle = append(lifecycle, fmt.Sprintf("close %s at %d", ev.Host, ev.Offset))
+		},
+	}
+	host := strings.TrimPrefix(storageServer.URL, "http://")
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	assert.EqualValues([]string{"connect 0", "connected 0 (<nil>)"}, events)
+
+	buf := make([]byte, 4)
+	_, err = hf.ReadAt(buf, 4)
+	assert.NoError(err)
+	_, err = hf.ReadAt(buf, 6)
+	assert.NoError(err)
+	id := reuses[0].ID
+	assert.EqualValues([]htfs.ConnEvent{
+		{ID: id, Host: host, Offset: 4, Discarded: 4, Duration: reuses[0].Duration},
+		{ID: id, Host: host, Offset: 6, Backtracked: 2, Duration: reuses[1].Duration},
+	}, reuses)
+
+	// body cut short, then retried
+	events = nil
+	ctx.numUnexpectedEOF = 1
+	hf.ForbidBacktracking = true
+	buf = make([]byte, 12)
+	_, err = hf.ReadAt(buf, 0)
+	assert.NoError(err)
+	assert.Equal([]byte("aaaabbbbcccc"), buf)
+	assert.EqualValues([]string{
+		"connect 0", "connected 0 (<nil>)",
+		"read error at 8",
+		"connect 8", "connected 8 (<nil>)",
+	}, events)
+
+	assert.NoError(hf.Close())
+	// the second conn reconnects after the read error,
+	// then Close closes both, in no particular order
+	sort.Strings(lifecycle[4:])
+	assert.EqualValues([]string{
+		"open " + host + " at 0",
+		"open " + host + " at 0",
+		"close " + host + " at 8",
+		"open " + host + " at 8",
+		"close " + host + " at 10",
+		"close " + host + " at 12",
+	}, lifecycle)
+}
+
+func Test_FileWaste(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+	size := int64(len(fakeData))
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	var reports []htfs.WasteReport
+	settings := defaultSettings(t)
+	settings.ForbidBacktracking = true
+	settings.WasteThreshold = 0.4
+	settings.WasteListener = func(report htfs.WasteReport) {
+		reports = append(reports, report)
+	}
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+
+	// reads that end at EOF may return io.EOF
+	readAll := func() {
+		buf := make([]byte, size)
+		_, err := hf.ReadAt(buf, 0)
+		if err != io.EOF {
+			assert.NoError(err)
+		}
+	}
+
+	readAll()
+	assert.EqualValues(size, hf.WasteReport().ServedBytes)
+	assert.Empty(reports, "nothing wasted yet")
+
+	// can't backtrack, so everything is fetched a second time
+	readAll()
+
+	wr := hf.WasteReport()
+	assert.EqualValues(2*size, wr.ServedBytes)
+	assert.True(wr.DuplicatedBytes >= size)
+	assert.Len(reports, 1)
+
+	// only warns once
+	readAll()
+	assert.Len(reports, 1)
+
+	assert.NoError(hf.Close())
+}
+
+func Test_FileInitialResponse(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbcccc")
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, defaultSettings(t))
+	assert.NoError(err)
+
+	ir := hf.InitialResponse()
+	assert.EqualValues(206, ir.StatusCode)
+	assert.EqualValues("HTTP/1.1", ir.Proto)
+	assert.EqualValues(storageServer.URL, "http://"+ir.URL.Host)
+	assert.EqualValues("0-11/12", ir.Header.Get("content-range"))
+	assert.Nil(ir.TLS)
+	assert.NoError(hf.Close())
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.dat", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer tlsServer.Close()
+
+	settings := defaultSettings(t)
+	settings.Client = tlsServer.Client()
+	hf, err = htfs.Open(storageServerURL(tlsServer), noRenewal, settings)
+	assert.NoError(err)
+
+	ir = hf.InitialResponse()
+	assert.NotNil(ir.TLS)
+	assert.NotEmpty(ir.TLS.PeerCertificates)
+	stat, err := hf.Stat()
+	assert.NoError(err)
+	assert.EqualValues(12, stat.Size())
+	assert.NoError(hf.Close())
+}
+
+// bodyCountingTransport keeps track of how many response
+// bodies are open at the same time
+type bodyCountingTransport struct {
+	base http.RoundTripper
+
+	mu   sync.Mutex
+	open int
+	peak int
+}
+
+func (bct *bodyCountingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := bct.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	bct.mu.Lock()
+	bct.open++
+	if bct.open > bct.peak {
+		bct.peak = bct.open
+	}
+	bct.mu.Unlock()
+
+	res.Body = &countedBody{ReadCloser: res.Body, transport: bct}
+	return res, nil
+}
+
+type countedBody struct {
+	io.ReadCloser
+	transport *bodyCountingTransport
+	closeOnce sync.Once
+}
+
+func (cb *countedBody) Close() error {
+	cb.closeOnce.Do(func() {
+		cb.transport.mu.Lock()
+		cb.transport.open--
+		cb.transport.mu.Unlock()
+	})
+	return cb.ReadCloser.Close()
+}
+
+func Test_FileMaxConns(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	transport := &bodyCountingTransport{base: http.DefaultTransport}
+	settings := defaultSettings(t)
+	settings.Client = &http.Client{Transport: transport}
+	settings.MaxConns = 2
+	settings.MaxDiscard = 1024
+	settings.LogLevel = 1
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+
+	numWorkers := 8
+	chunkSize := len(fakeData) / numWorkers
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start := i * chunkSize
+			buf := make([]byte, 4096)
+			for off := start; off+len(buf) <= start+chunkSize; off += len(buf) * 8 {
+				_, err := hf.ReadAt(buf, int64(off))
+				assert.NoError(err)
+				assert.True(bytes.Equal(fakeData[off:off+len(buf)], buf))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.True(hf.NumConns() <= 2)
+	transport.mu.Lock()
+	assert.True(transport.peak <= 2, "peak open bodies: %d", transport.peak)
+	transport.mu.Unlock()
+
+	assert.NoError(hf.Close())
+
+	_, err = hf.ReadAt(make([]byte, 4), 0)
+	assert.Error(err)
+	assert.EqualValues(htfs.ErrClosed, errors.Cause(err))
+}
+
+func Test_FilePrefetch(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, defaultSettings(t))
+	assert.NoError(err)
+	assert.EqualValues(1, ctx.numGET)
+
+	offset := int64(2 * 1024 * 1024)
+	assert.NoError(<-hf.Prefetch(offset, 64*1024))
+	assert.EqualValues(2, ctx.numGET)
+
+	buf := make([]byte, 64*1024)
+	_, err = hf.ReadAt(buf, offset)
+	assert.NoError(err)
+	assert.True(bytes.Equal(fakeData[offset:offset+int64(len(buf))], buf))
+	assert.EqualValues(2, ctx.numGET, "should be served from cache")
+
+	// past the end, nothing to do
+	assert.NoError(<-hf.Prefetch(int64(len(fakeData)), 1024))
+
+	assert.NoError(hf.Close())
+}
+
+func Test_FileReadAtContext(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, defaultSettings(t))
+	assert.NoError(err)
+
+	// reaching that offset requires discarding from the initial conn
+	offset := int64(512 * 1024)
+	buf := make([]byte, 4)
+
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = hf.ReadAtContext(cctx, buf, offset)
+	assert.Error(err)
+	assert.EqualValues(context.Canceled, errors.Cause(err))
+
+	_, err = hf.ReadAtContext(context.Background(), buf, offset)
+	assert.NoError(err)
+	assert.EqualValues(fakeData[offset:offset+4], buf)
+
+	assert.NoError(hf.Close())
+}
+
+func Test_FileWriteTo(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	storageServer := fakeStorage(t, fakeData, &fakeStorageContext{})
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	hf, err := newSimple(t, storageServer.URL)
+	assert.NoError(err)
+	hf.CopyBufferSize = 300 * 1024
+
+	dest, err := ioutil.TempFile("", "htfs-writeto")
+	assert.NoError(err)
+	defer os.Remove(dest.Name())
+	defer dest.Close()
+
+	skipped := int64(1234)
+	_, err = hf.Seek(skipped, io.SeekStart)
+	assert.NoError(err)
+
+	written, err := io.Copy(dest, hf)
+	assert.NoError(err)
+	assert.EqualValues(int64(len(fakeData))-skipped, written)
+
+	copied, err := ioutil.ReadFile(dest.Name())
+	assert.NoError(err)
+	assert.True(bytes.Equal(fakeData[skipped:], copied))
+
+	assert.NoError(hf.Close())
+}
+
+func Test_FileLabels(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbb")
+
+	ctx := &fakeStorageContext{
+		etag: `"v1"`,
+	}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	var logLines []string
+	settings := defaultSettings(t)
+	settings.Labels = htfs.Labels{
+		"game":  "187770",
+		"build": "6996",
+	}
+	settings.Log = func(msg string) {
+		logLines = append(logLines, msg)
+	}
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	assert.EqualValues("build=6996 game=187770", hf.Labels().String())
+	hf.ForbidBacktracking = true
+
+	_, err = hf.ReadAt(make([]byte, 4), 4)
+	assert.NoError(err)
+
+	// force a new connection that fails
+	ctx.etag = `"v2"`
+	_, err = hf.ReadAt(make([]byte, 4), 0)
+	assert.Error(err)
+	assert.True(errors.Cause(err) == htfs.ErrResourceChanged)
+	assert.Contains(err.Error(), "[build=6996 game=187770]")
+
+	assert.NotEmpty(logLines)
+	for _, line := range logLines {
+		assert.True(strings.HasPrefix(line, "[build=6996 game=187770] "), line)
+	}
+}
+
+type recordedLog struct {
+	level   httpkit.Level
+	msg     string
+	keyvals []interface{}
+}
+
+type recordingLogger struct {
+	mu       sync.Mutex
+	minLevel httpkit.Level
+	logs     []recordedLog
+}
+
+func (rl *recordingLogger) Enabled(level httpkit.Level) bool {
+	return level >= rl.minLevel
+}
+
+func (rl *recordingLogger) record(level httpkit.Level, msg string, keyvals []interface{}) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.logs = append(rl.logs, recordedLog{level, msg, keyvals})
+}
+
+func (rl *recordingLogger) Debug(msg string, keyvals ...interface{}) {
+	rl.record(httpkit.LevelDebug, msg, keyvals)
+}
+
+func (rl *recordingLogger) Info(msg string, keyvals ...interface{}) {
+	rl.record(httpkit.LevelInfo, msg, keyvals)
+}
+
+func (rl *recordingLogger) Warn(msg string, keyvals ...interface{}) {
+	rl.record(httpkit.LevelWarn, msg, keyvals)
+}
+
+func Test_FileLogger(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbccccdddd")
+
+	storageServer := fakeStorage(t, fakeData, &fakeStorageContext{})
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	logger := &recordingLogger{minLevel: httpkit.LevelInfo}
+	settings := defaultSettings(t)
+	settings.Labels = htfs.Labels{"game": "187770"}
+	settings.Log = func(msg string) {
+		t.Errorf("Log shouldn't be used when Logger is set, got %q", msg)
+	}
+	settings.Logger = logger
+	settings.DumpStats = true
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+
+	_, err = hf.ReadAt(make([]byte, 4), 4)
+	assert.NoError(err)
+	assert.NoError(hf.Close())
+
+	assert.NotEmpty(logger.logs)
+	for _, l := range logger.logs {
+		assert.True(l.level >= httpkit.LevelInfo, "debug messages should be skipped")
+		n := len(l.keyvals)
+		assert.True(n >= 2)
+		assert.EqualValues([]interface{}{"game", "187770"}, l.keyvals[n-2:], "labels should be keyvals")
+	}
+	assert.EqualValues("borrow: new connection", logger.logs[0].msg)
+	assert.EqualValues([]interface{}{"offset", int64(0), "game", "187770"}, logger.logs[0].keyvals)
+
+	// DumpStats goes through the Logger too
+	var statsLogs []string
+	for _, l := range logger.logs {
+		if strings.HasPrefix(l.msg, "stats: ") {
+			statsLogs = append(statsLogs, l.msg)
+		}
+	}
+	assert.Contains(statsLogs, "stats: conns")
+	assert.Contains(statsLogs, "stats: bytes")
+}
+
+func storageServerURL(server *httptest.Server) htfs.GetURLFunc {
+	return func() (string, error) {
+		return server.URL, nil
+	}
+}
+
+func noRenewal(res *http.Response, body []byte) bool {
+	return false
+}
+
+////////////////////////
+// fake storage
+////////////////////////
+
+const expiredURLMessage = "Signed URL Expired"
+
+type fakeStorageContext struct {
+	delay                  time.Duration
+	simulateNoRangeSupport bool
+	simulateNotFound       bool
+	simulateOtherStatus    int
+	numUnexpectedEOF       int
+	etag                   string
+	lastModified           string
+	ignoreIfMatch          bool
+	requiredT              int64
+	numGET                 int
+	lastHeader             http.Header
+	numHEAD                int
+	disruption             *storageDisruption
+
+	// mu guards the counters, for concurrent requests
+	mu sync.Mutex
+}
+
+type disruptionHandlerFunc func(w http.ResponseWriter)
+
+type storageDisruption struct {
+	// how many errors to return in a row before succeeding
+	streak int
+
+	// what to do when the disruption happens
+	handler disruptionHandlerFunc
+
+	// internal
+	counter int
+}
+
+func fakeStorage(t *testing.T, content []byte, ctx *fakeStorageContext) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ctx.simulateNotFound {
+			w.WriteHeader(404)
+			return
+		}
+
+		if ctx.simulateOtherStatus != 0 {
+			w.WriteHeader(ctx.simulateOtherStatus)
+			return
+		}
+
+		disrupt := ctx.disruption
+		if disrupt != nil {
+			if disrupt.counter < disrupt.streak {
+				disrupt.handler(w)
+				disrupt.counter++
+				return
+			}
+			disrupt.counter = 0
+		}
+
+		hasExpired := false
+
+		if ctx.requiredT > 0 {
+			t := r.URL.Query().Get("t")
+			if t != "" {
+				tVal, err := strconv.ParseInt(t, 10, 64)
+				if err == nil {
+					if tVal < ctx.requiredT {
+						hasExpired = true
+					}
+				}
+			}
+		}
+
+		if r.Method == "HEAD" {
+			ctx.mu.Lock()
+			ctx.numHEAD++
+			ctx.mu.Unlock()
+			if hasExpired {
+				http.Error(w, expiredURLMessage, 400)
+				return
+			}
+
+			w.Header().Set("content-length", fmt.Sprintf("%d", len(content)))
+			w.WriteHeader(200)
+			return
+		}
+
+		if r.Method != "GET" {
+			http.Error(w, "Invalid method", 400)
+			return
+		}
+
+		ctx.mu.Lock()
+		ctx.numGET++
+		ctx.lastHeader = r.Header
+		ctx.mu.Unlock()
+		if hasExpired {
+			http.Error(w, expiredURLMessage, 400)
+			return
+		}
+
+		time.Sleep(ctx.delay)
+
+		if ctx.etag != "" {
+			ifMatch := r.Header.Get("If-Match")
+			if ifMatch != "" && ifMatch != ctx.etag && !ctx.ignoreIfMatch {
+				http.Error(w, "Precondition Failed", 412)
+				return
+			}
+			w.Header().Set("etag", ctx.etag)
+		}
+
+		if ctx.lastModified != "" {
+			w.Header().Set("last-modified", ctx.lastModified)
+		}
+
+		w.Header().Set("content-type", "application/octet-stream")
+		rangeHeader := r.Header.Get("Range")
+		ifRange := r.Header.Get("If-Range")
+		if ifRange != "" && ifRange != ctx.etag && ifRange != ctx.lastModified {
+			// changed: send the whole thing
+			rangeHeader = ""
+		}
 
 		start := int64(0)
 		end := int64(len(content)) - 1
@@ -1,6 +1,7 @@
 package htfs
 
 import (
+	"net/http"
 	"os"
 	"time"
 )
@@ -35,3 +36,34 @@ func (hfi *FileInfo) IsDir() bool {
 func (hfi *FileInfo) Sys() interface{} {
 	return nil
 }
+
+// namedFileInfo is a File's info under another name, for FS and
+// HTTPFileSystem, with the modification time the server gave
+type namedFileInfo struct {
+	os.FileInfo
+	name    string
+	modTime time.Time
+}
+
+func (nfi *namedFileInfo) Name() string {
+	return nfi.name
+}
+
+func (nfi *namedFileInfo) ModTime() time.Time {
+	return nfi.modTime
+}
+
+// namedStat is Stat, with name as the file's name
+func (f *File) namedStat(name string) (os.FileInfo, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	info := &namedFileInfo{FileInfo: stat, name: name}
+	if header := f.GetHeader(); header != nil {
+		// if the server doesn't say, it's left zero, so that
+		// it's the same for every call
+		info.modTime, _ = http.ParseTime(header.Get("Last-Modified"))
+	}
+	return info, nil
+}
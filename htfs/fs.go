@@ -0,0 +1,219 @@
+//go:build go1.16
+// +build go1.16
+
+package htfs
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FS is an fs.FS whose files are remote, so they can be passed to any code
+// that accepts one: zip readers, template loaders, http.FS, etc. Each name
+// maps to a GetURLFunc, and directories are implied by the names, like
+// "textures/" for "textures/wall.png". Every Open opens a new File, with
+// the same needsRenewal and settings.
+type FS struct {
+	entries      map[string]GetURLFunc
+	needsRenewal NeedsRenewalFunc
+	settings     *Settings
+
+	// dirs maps directory names ("." for the root) to
+	// the names of their children, sorted
+	dirs map[string][]string
+}
+
+var _ fs.FS = (*FS)(nil)
+var _ fs.ReadDirFS = (*FS)(nil)
+var _ fs.File = (*File)(nil)
+
+// NewFS returns an FS over entries, whose keys must be valid
+// fs paths (see fs.ValidPath). entries is copied.
+func NewFS(entries map[string]GetURLFunc, needsRenewal NeedsRenewalFunc, settings *Settings) (*FS, error) {
+	fsys := &FS{
+		entries:      make(map[string]GetURLFunc, len(entries)),
+		needsRenewal: needsRenewal,
+		settings:     settings,
+		dirs:         map[string][]string{".": nil},
+	}
+
+	for name, getURL := range entries {
+		if !fs.ValidPath(name) || name == "." {
+			return nil, errors.Errorf("htfs.NewFS: invalid name %q", name)
+		}
+		fsys.entries[name] = getURL
+	}
+
+	children := make(map[string]map[string]bool)
+	for name := range fsys.entries {
+		for child := name; child != "."; child = path.Dir(child) {
+			parent := path.Dir(child)
+			if _, ok := fsys.entries[parent]; ok {
+				return nil, errors.Errorf("htfs.NewFS: %q is both a file and a directory", parent)
+			}
+			if children[parent] == nil {
+				children[parent] = make(map[string]bool)
+			}
+			children[parent][path.Base(child)] = true
+		}
+	}
+	for dir, names := range children {
+		var sorted []string
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		fsys.dirs[dir] = sorted
+	}
+
+	return fsys, nil
+}
+
+// Open opens the named file, making its initial request, or the
+// named directory. Errors are *fs.PathError, and files the server
+// doesn't have are reported as fs.ErrNotExist.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if getURL, ok := fsys.entries[name]; ok {
+		f, err := Open(getURL, fsys.needsRenewal, fsys.settings)
+		if err != nil {
+			if errors.Cause(err) == ErrNotFound {
+				err = fs.ErrNotExist
+			}
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &fsFile{File: f, name: path.Base(name)}, nil
+	}
+
+	if _, ok := fsys.dirs[name]; ok {
+		return &fsDir{fsys: fsys, name: name}, nil
+	}
+
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// ReadDir returns the entries of the named directory, sorted by name.
+// It doesn't make any request.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	children, ok := fsys.dirs[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, child := range children {
+		entries = append(entries, &fsDirEntry{fsys: fsys, name: path.Join(name, child)})
+	}
+	return entries, nil
+}
+
+// fsFile is a File named after its FS entry,
+// rather than after the server's response
+type fsFile struct {
+	*File
+	name string
+}
+
+func (ff *fsFile) Stat() (fs.FileInfo, error) {
+	return ff.File.namedStat(ff.name)
+}
+
+// fsDir is an open directory of an FS
+type fsDir struct {
+	fsys *FS
+	name string
+	// read is how many entries ReadDir returned so far
+	read int
+}
+
+var _ fs.ReadDirFile = (*fsDir)(nil)
+
+func (d *fsDir) Stat() (fs.FileInfo, error) {
+	return &fsDirInfo{name: path.Base(d.name)}, nil
+}
+
+func (d *fsDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *fsDir) Close() error {
+	return nil
+}
+
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := d.fsys.ReadDir(d.name)
+	if err != nil {
+		return nil, err
+	}
+	entries = entries[d.read:]
+	if n <= 0 {
+		d.read += len(entries)
+		return entries, nil
+	}
+	if len(entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(entries) {
+		n = len(entries)
+	}
+	d.read += n
+	return entries[:n], nil
+}
+
+type fsDirInfo struct {
+	name string
+}
+
+func (di *fsDirInfo) Name() string       { return di.name }
+func (di *fsDirInfo) Size() int64        { return 0 }
+func (di *fsDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (di *fsDirInfo) ModTime() time.Time { return time.Time{} }
+func (di *fsDirInfo) IsDir() bool        { return true }
+func (di *fsDirInfo) Sys() interface{}   { return nil }
+
+// fsDirEntry is a child of an FS directory
+type fsDirEntry struct {
+	fsys *FS
+	name string
+}
+
+func (de *fsDirEntry) Name() string {
+	return path.Base(de.name)
+}
+
+func (de *fsDirEntry) IsDir() bool {
+	_, ok := de.fsys.dirs[de.name]
+	return ok
+}
+
+func (de *fsDirEntry) Type() fs.FileMode {
+	if de.IsDir() {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+// Info opens files to find out their size, so it makes a request
+func (de *fsDirEntry) Info() (fs.FileInfo, error) {
+	if de.IsDir() {
+		return &fsDirInfo{name: de.Name()}, nil
+	}
+
+	f, err := de.fsys.Open(de.name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
@@ -0,0 +1,71 @@
+//go:build go1.16
+// +build go1.16
+
+package htfs_test
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FS(t *testing.T) {
+	assert := assert.New(t)
+
+	readme := []byte("read me")
+	wall := []byte("not really a png")
+	readmeServer := fakeStorage(t, readme, &fakeStorageContext{})
+	defer readmeServer.Close()
+	defer readmeServer.CloseClientConnections()
+	wallServer := fakeStorage(t, wall, &fakeStorageContext{})
+	defer wallServer.Close()
+	defer wallServer.CloseClientConnections()
+	missingServer := fakeStorage(t, nil, &fakeStorageContext{simulateNotFound: true})
+	defer missingServer.Close()
+
+	fsys, err := htfs.NewFS(map[string]htfs.GetURLFunc{
+		"README.txt":             storageServerURL(readmeServer),
+		"textures/wall/main.png": storageServerURL(wallServer),
+	}, noRenewal, defaultSettings(t))
+	assert.NoError(err)
+
+	assert.NoError(fstest.TestFS(fsys, "README.txt", "textures/wall/main.png"))
+
+	contents, err := fs.ReadFile(fsys, "textures/wall/main.png")
+	assert.NoError(err)
+	assert.EqualValues(wall, contents)
+
+	entries, err := fs.ReadDir(fsys, ".")
+	assert.NoError(err)
+	if assert.Len(entries, 2) {
+		assert.EqualValues("README.txt", entries[0].Name())
+		assert.False(entries[0].IsDir())
+		assert.EqualValues("textures", entries[1].Name())
+		assert.True(entries[1].IsDir())
+	}
+
+	_, err = fsys.Open("nope.txt")
+	assert.True(errors.Is(err, fs.ErrNotExist))
+
+	missing, err := htfs.NewFS(map[string]htfs.GetURLFunc{
+		"gone.txt": storageServerURL(missingServer),
+	}, noRenewal, defaultSettings(t))
+	assert.NoError(err)
+	_, err = missing.Open("gone.txt")
+	assert.True(errors.Is(err, fs.ErrNotExist))
+
+	_, err = htfs.NewFS(map[string]htfs.GetURLFunc{
+		"a":   storageServerURL(readmeServer),
+		"a/b": storageServerURL(readmeServer),
+	}, noRenewal, defaultSettings(t))
+	assert.Error(err)
+
+	_, err = htfs.NewFS(map[string]htfs.GetURLFunc{
+		"../escape": storageServerURL(readmeServer),
+	}, noRenewal, defaultSettings(t))
+	assert.Error(err)
+}
@@ -0,0 +1,112 @@
+//go:build go1.18
+// +build go1.18
+
+package htfs_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// contentRangeSeeds are Content-Range values servers send, and
+// some they shouldn't
+var contentRangeSeeds = []string{
+	"bytes 0-99/1000",
+	"bytes 100-199/*",
+	"bytes */1000",
+	"bytes 0-0/1",
+	"bytes 5-4/10",
+	"bytes -",
+	"bytes 1-",
+	"bytes 0-9223372036854775807/9223372036854775807",
+	"bytes 0-99/1000/2000",
+	"0-99/1000",
+	"",
+	"/",
+}
+
+// contentDispositionSeeds are Content-Disposition values servers send,
+// and some they shouldn't
+var contentDispositionSeeds = []string{
+	`attachment; filename="game.zip"`,
+	`attachment; filename*=UTF-8''%E6%B8%B8%E6%88%8F.zip`,
+	`inline`,
+	`attachment; filename="../../.bashrc"`,
+	`attachment; filename="C:\\Windows\\evil.dll"`,
+	`attachment; filename=".."`,
+	`attachment; filename=`,
+	`;;;`,
+	``,
+}
+
+func assertHeaderError(t *testing.T, err error) {
+	t.Helper()
+	if _, ok := errors.Cause(err).(*htfs.HeaderError); !ok {
+		t.Fatalf("expected a *htfs.HeaderError, got %#v", err)
+	}
+}
+
+func Test_HeaderParsers(t *testing.T) {
+	assert := assert.New(t)
+
+	start, end, err := htfs.ParseContentRange("bytes 100-199/1000")
+	assert.NoError(err)
+	assert.EqualValues(100, start)
+	assert.EqualValues(200, end)
+
+	total, err := htfs.ParseContentRangeTotal("bytes */1000")
+	assert.NoError(err)
+	assert.EqualValues(1000, total)
+
+	_, _, err = htfs.ParseContentRange("bytes 0-9223372036854775807/*")
+	assertHeaderError(t, err)
+	_, err = htfs.ParseContentRangeTotal("bytes 0-99/*")
+	assertHeaderError(t, err)
+
+	name, err := htfs.ContentDispositionFilename(`attachment; filename="../../.bashrc"`)
+	assert.NoError(err)
+	assert.EqualValues(".bashrc", name)
+	_, err = htfs.ContentDispositionFilename(`attachment; filename=".."`)
+	assertHeaderError(t, err)
+}
+
+func FuzzParseContentRange(f *testing.F) {
+	for _, seed := range contentRangeSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, contentRange string) {
+		start, end, err := htfs.ParseContentRange(contentRange)
+		if err != nil {
+			assertHeaderError(t, err)
+		} else if start < 0 || end <= start {
+			t.Fatalf("%q parsed into invalid range %d-%d", contentRange, start, end)
+		}
+
+		total, err := htfs.ParseContentRangeTotal(contentRange)
+		if err != nil {
+			assertHeaderError(t, err)
+		} else if total < 0 {
+			t.Fatalf("%q parsed into negative total %d", contentRange, total)
+		}
+	})
+}
+
+func FuzzContentDispositionFilename(f *testing.F) {
+	for _, seed := range contentDispositionSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		filename, err := htfs.ContentDispositionFilename(value)
+		if err != nil {
+			assertHeaderError(t, err)
+			return
+		}
+		if strings.ContainsAny(filename, "/\\") || filename == "." || filename == ".." {
+			t.Fatalf("%q gave unsafe filename %q", value, filename)
+		}
+	})
+}
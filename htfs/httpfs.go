@@ -0,0 +1,189 @@
+package htfs
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// A ResolveFunc returns the GetURLFunc for a name requested from an
+// HTTPFileSystem, like "/builds/1234.zip", or an error that satisfies
+// os.IsNotExist for names it doesn't know about.
+type ResolveFunc func(name string) (GetURLFunc, error)
+
+// HTTPFileSystem is an http.FileSystem over remote files, so that an
+// http.FileServer can serve them, range requests included, as a small
+// caching proxy. Each name is opened once, on first use, and the File is
+// shared by all requests for it, which keeps its connections, backtracking
+// caches and URL renewals. Files stay open until Close.
+// It's safe for concurrent use.
+type HTTPFileSystem struct {
+	resolve      ResolveFunc
+	needsRenewal NeedsRenewalFunc
+	settings     *Settings
+
+	mu     sync.Mutex
+	files  map[string]*httpFSEntry
+	closed bool
+}
+
+// httpFSEntry is a File being opened, or opened
+type httpFSEntry struct {
+	ready chan struct{}
+	file  *File
+	err   error
+}
+
+var _ http.FileSystem = (*HTTPFileSystem)(nil)
+
+// NewHTTPFileSystem returns an HTTPFileSystem that opens files resolved
+// by resolve, with needsRenewal and settings.
+func NewHTTPFileSystem(resolve ResolveFunc, needsRenewal NeedsRenewalFunc, settings *Settings) *HTTPFileSystem {
+	return &HTTPFileSystem{
+		resolve:      resolve,
+		needsRenewal: needsRenewal,
+		settings:     settings,
+		files:        make(map[string]*httpFSEntry),
+	}
+}
+
+// Open returns a handle on the named file, with its own read offset.
+// Files the server doesn't have are reported as os.ErrNotExist, so
+// http.FileServer answers 404. Failed opens aren't cached.
+func (hfs *HTTPFileSystem) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+
+	hfs.mu.Lock()
+	if hfs.closed {
+		hfs.mu.Unlock()
+		return nil, errors.Errorf("htfs.HTTPFileSystem: opening %s: closed", name)
+	}
+	entry, ok := hfs.files[name]
+	if !ok {
+		entry = &httpFSEntry{ready: make(chan struct{})}
+		hfs.files[name] = entry
+		hfs.mu.Unlock()
+
+		entry.file, entry.err = hfs.open(name)
+		if entry.err != nil {
+			hfs.mu.Lock()
+			delete(hfs.files, name)
+			hfs.mu.Unlock()
+		}
+		close(entry.ready)
+	} else {
+		hfs.mu.Unlock()
+		<-entry.ready
+	}
+
+	if entry.err != nil {
+		return nil, entry.err
+	}
+	return &httpFile{file: entry.file, name: path.Base(name)}, nil
+}
+
+func (hfs *HTTPFileSystem) open(name string) (*File, error) {
+	getURL, err := hfs.resolve(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, errors.Wrapf(err, "htfs.HTTPFileSystem: resolving %s", name)
+	}
+
+	f, err := Open(getURL, hfs.needsRenewal, hfs.settings)
+	if err != nil {
+		if errors.Cause(err) == ErrNotFound {
+			return nil, os.ErrNotExist
+		}
+		return nil, errors.Wrapf(err, "htfs.HTTPFileSystem: opening %s", name)
+	}
+	return f, nil
+}
+
+// NumFiles returns how many Files are open
+func (hfs *HTTPFileSystem) NumFiles() int {
+	hfs.mu.Lock()
+	defer hfs.mu.Unlock()
+
+	return len(hfs.files)
+}
+
+// Close closes all the Files, handles on them stop working.
+// Later calls to Open fail.
+func (hfs *HTTPFileSystem) Close() error {
+	hfs.mu.Lock()
+	hfs.closed = true
+	files := hfs.files
+	hfs.files = make(map[string]*httpFSEntry)
+	hfs.mu.Unlock()
+
+	var firstErr error
+	for _, entry := range files {
+		<-entry.ready
+		if entry.file == nil {
+			continue
+		}
+		err := entry.file.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// httpFile is a handle on a shared File
+type httpFile struct {
+	file   *File
+	name   string
+	offset int64
+}
+
+var _ http.File = (*httpFile)(nil)
+
+func (hf *httpFile) Read(p []byte) (int, error) {
+	n, err := hf.file.ReadAt(p, hf.offset)
+	hf.offset += int64(n)
+	return n, err
+}
+
+func (hf *httpFile) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = hf.offset + offset
+	case io.SeekEnd:
+		stat, err := hf.file.Stat()
+		if err != nil {
+			return hf.offset, err
+		}
+		newOffset = stat.Size() + offset
+	default:
+		return hf.offset, errors.Errorf("invalid whence value %d", whence)
+	}
+
+	if newOffset < 0 {
+		return hf.offset, errors.Errorf("tried to seek to negative offset %d", newOffset)
+	}
+	hf.offset = newOffset
+	return newOffset, nil
+}
+
+func (hf *httpFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.Errorf("%s is not a directory", hf.name)
+}
+
+func (hf *httpFile) Stat() (os.FileInfo, error) {
+	return hf.file.namedStat(hf.name)
+}
+
+// Close leaves the File open for other requests, see HTTPFileSystem.Close
+func (hf *httpFile) Close() error {
+	return nil
+}
@@ -0,0 +1,66 @@
+package htfs_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HTTPFileSystem(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	resolve := func(name string) (htfs.GetURLFunc, error) {
+		if name != "/builds/1234.zip" {
+			return nil, os.ErrNotExist
+		}
+		return storageServerURL(storageServer), nil
+	}
+	hfs := htfs.NewHTTPFileSystem(resolve, noRenewal, defaultSettings(t))
+	defer hfs.Close()
+
+	proxy := httptest.NewServer(http.FileServer(hfs))
+	defer proxy.Close()
+
+	get := func(path string, start, end int) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", proxy.URL+path, nil)
+		assert.NoError(err)
+		if end > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		assert.NoError(err)
+		return res, body
+	}
+
+	// forward ranges are served from the same connection
+	for _, start := range []int{1024, 4096, 64 * 1024} {
+		res, body := get("/builds/1234.zip", start, start+99)
+		assert.EqualValues(http.StatusPartialContent, res.StatusCode)
+		assert.EqualValues(fakeData[start:start+100], body)
+	}
+	assert.EqualValues(1, hfs.NumFiles())
+	assert.EqualValues(1, ctx.numGET)
+
+	res, _ := get("/builds/5678.zip", 0, 0)
+	assert.EqualValues(http.StatusNotFound, res.StatusCode)
+	assert.EqualValues(1, hfs.NumFiles())
+
+	assert.NoError(hfs.Close())
+	_, err := hfs.Open("/builds/1234.zip")
+	assert.Error(err)
+}
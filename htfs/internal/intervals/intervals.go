@@ -0,0 +1,109 @@
+// Package intervals keeps track of which byte ranges of a file are present.
+package intervals
+
+import "sort"
+
+// Interval is a half-open byte range [Start, End)
+type Interval struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// Map is a sorted set of non-overlapping, non-adjacent intervals.
+// It's not safe for concurrent use.
+type Map struct {
+	Intervals []Interval
+}
+
+// Add marks [start, end) as present, merging with neighbors
+func (im *Map) Add(start int64, end int64) {
+	if start >= end {
+		return
+	}
+
+	// first interval that ends at or after start (could touch)
+	i := sort.Search(len(im.Intervals), func(i int) bool {
+		return im.Intervals[i].End >= start
+	})
+	// first interval that starts after end (can't touch)
+	j := sort.Search(len(im.Intervals), func(j int) bool {
+		return im.Intervals[j].Start > end
+	})
+
+	if i == j {
+		// touches nothing: insert it
+		im.Intervals = append(im.Intervals, Interval{})
+		copy(im.Intervals[i+1:], im.Intervals[i:])
+		im.Intervals[i] = Interval{Start: start, End: end}
+		return
+	}
+
+	// merge with intervals i through j-1, in place
+	merged := Interval{Start: start, End: end}
+	if im.Intervals[i].Start < merged.Start {
+		merged.Start = im.Intervals[i].Start
+	}
+	if im.Intervals[j-1].End > merged.End {
+		merged.End = im.Intervals[j-1].End
+	}
+	im.Intervals[i] = merged
+	im.Intervals = append(im.Intervals[:i+1], im.Intervals[j:]...)
+}
+
+// Covered returns how many bytes of [start, end) are present
+func (im *Map) Covered(start int64, end int64) int64 {
+	var covered int64
+	i := sort.Search(len(im.Intervals), func(i int) bool {
+		return im.Intervals[i].End > start
+	})
+	for ; i < len(im.Intervals); i++ {
+		iv := im.Intervals[i]
+		if iv.Start >= end {
+			break
+		}
+		lo, hi := iv.Start, iv.End
+		if lo < start {
+			lo = start
+		}
+		if hi > end {
+			hi = end
+		}
+		covered += hi - lo
+	}
+	return covered
+}
+
+// Missing returns the parts of [start, end) that aren't present
+func (im *Map) Missing(start int64, end int64) []Interval {
+	var gaps []Interval
+
+	cursor := start
+	i := sort.Search(len(im.Intervals), func(i int) bool {
+		return im.Intervals[i].End > start
+	})
+	for ; i < len(im.Intervals) && cursor < end; i++ {
+		iv := im.Intervals[i]
+		if iv.Start >= end {
+			break
+		}
+		if iv.Start > cursor {
+			gaps = append(gaps, Interval{Start: cursor, End: iv.Start})
+		}
+		if iv.End > cursor {
+			cursor = iv.End
+		}
+	}
+	if cursor < end {
+		gaps = append(gaps, Interval{Start: cursor, End: end})
+	}
+	return gaps
+}
+
+// Size returns the number of bytes present
+func (im *Map) Size() int64 {
+	var total int64
+	for _, iv := range im.Intervals {
+		total += iv.End - iv.Start
+	}
+	return total
+}
@@ -0,0 +1,37 @@
+package intervals_test
+
+import (
+	"testing"
+
+	"github.com/itchio/httpkit/htfs/internal/intervals"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Map(t *testing.T) {
+	assert := assert.New(t)
+
+	im := &intervals.Map{}
+	im.Add(10, 20)
+	im.Add(30, 40)
+	assert.EqualValues([]intervals.Interval{{0, 10}, {20, 30}, {40, 50}}, im.Missing(0, 50))
+	assert.Empty(im.Missing(12, 18))
+
+	// adjacent intervals are merged
+	im.Add(20, 25)
+	assert.EqualValues([]intervals.Interval{{10, 25}, {30, 40}}, im.Intervals)
+
+	// spanning several
+	im.Add(5, 35)
+	assert.EqualValues([]intervals.Interval{{5, 40}}, im.Intervals)
+	assert.EqualValues(35, im.Size())
+
+	// inserted in order
+	im.Add(60, 70)
+	im.Add(0, 2)
+	im.Add(50, 55)
+	assert.EqualValues([]intervals.Interval{{0, 2}, {5, 40}, {50, 55}, {60, 70}}, im.Intervals)
+
+	assert.EqualValues(0, im.Covered(2, 5))
+	assert.EqualValues(1+35+5+5, im.Covered(1, 65))
+	assert.EqualValues(im.Size(), im.Covered(0, 100))
+}
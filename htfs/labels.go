@@ -0,0 +1,59 @@
+package htfs
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Labels are user-defined key/value pairs (game ID, build ID, etc.)
+// attached to a File. They're included in its log lines, stats,
+// and in the errors it returns, so that activity can be attributed
+// when many Files are open at once.
+type Labels map[string]string
+
+// String formats labels as "key1=value1 key2=value2", sorted by key.
+func (l Labels) String() string {
+	var tokens []string
+	for _, k := range l.keys() {
+		tokens = append(tokens, fmt.Sprintf("%s=%s", k, l[k]))
+	}
+	return strings.Join(tokens, " ")
+}
+
+func (l Labels) keys() []string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func copyLabels(l Labels) Labels {
+	if l == nil {
+		return nil
+	}
+	res := make(Labels, len(l))
+	for k, v := range l {
+		res[k] = v
+	}
+	return res
+}
+
+// Labels returns the labels this File was opened with.
+func (f *File) Labels() Labels {
+	return f.labels
+}
+
+// labelError wraps err with the File's labels, if any. io.EOF is
+// returned as-is, since callers compare against it.
+func (f *File) labelError(err error) error {
+	if err == nil || err == io.EOF || len(f.labels) == 0 {
+		return err
+	}
+	return errors.Wrapf(err, "htfs [%s]", f.labels)
+}
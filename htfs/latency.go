@@ -0,0 +1,59 @@
+package htfs
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultFastMaxDiscard is used when FastConnectThreshold is set,
+// but FastMaxDiscard isn't
+const defaultFastMaxDiscard int64 = 64 * 1024
+
+// latencyTracker keeps a moving average of how long it takes
+// to get response headers for a new request
+type latencyTracker struct {
+	mu      sync.Mutex
+	average time.Duration
+	samples int
+}
+
+func (lt *latencyTracker) record(d time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	if lt.samples == 0 {
+		lt.average = d
+	} else {
+		// recent samples weigh more, networks change
+		lt.average += (d - lt.average) / 4
+	}
+	lt.samples++
+}
+
+func (lt *latencyTracker) get() (time.Duration, bool) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	return lt.average, lt.samples > 0
+}
+
+// ConnectLatency returns the moving average of how long new requests
+// took to get a response, and false if none were made yet.
+func (f *File) ConnectLatency() (time.Duration, bool) {
+	return f.connectLatency.get()
+}
+
+// discardLimit returns how many bytes a conn may skip to get to an offset,
+// rather than making a new request. On fast networks, a new request is
+// cheaper than reading and throwing away a lot of data.
+func (f *File) discardLimit() int64 {
+	if f.FastConnectThreshold <= 0 || f.FastMaxDiscard >= f.MaxDiscard {
+		return f.MaxDiscard
+	}
+
+	latency, ok := f.connectLatency.get()
+	if ok && latency < f.FastConnectThreshold {
+		return f.FastMaxDiscard
+	}
+	return f.MaxDiscard
+}
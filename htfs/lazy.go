@@ -0,0 +1,38 @@
+package htfs
+
+import "sync"
+
+// lazyProbe is the initial request of a File returned by OpenLazy
+type lazyProbe struct {
+	once  sync.Once
+	probe SizeProbe
+	err   error
+}
+
+// OpenLazy is like Open, except the initial request (including the call
+// to getURL) is only made on the first Read, ReadAt, Seek, Stat, etc.
+// For code that opens many remote files but only touches some of them.
+//
+// If the initial request fails, every later call fails with the same
+// error. Until it's made, the File's name and size are unknown, and
+// InitialResponse returns nil.
+func OpenLazy(getURL GetURLFunc, needsRenewal NeedsRenewalFunc, settings *Settings) *File {
+	f := newFile(singleURL(noExpiry(getURL)), needsRenewal, settings)
+	f.lazy = &lazyProbe{probe: settings.SizeProbe}
+	return f
+}
+
+// opened makes the initial request of Files returned by OpenLazy,
+// if it wasn't made yet, and returns its error
+func (f *File) opened() error {
+	if f.lazy == nil {
+		return nil
+	}
+	f.lazy.once.Do(func() {
+		f.lazy.err = f.probe(f.lazy.probe)
+		if f.lazy.err == nil {
+			f.lazy.err = f.pin()
+		}
+	})
+	return f.lazy.err
+}
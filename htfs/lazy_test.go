@@ -0,0 +1,61 @@
+package htfs_test
+
+import (
+	"testing"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileOpenLazy(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	numGetURL := 0
+	getURL := func() (string, error) {
+		numGetURL++
+		return storageServer.URL, nil
+	}
+
+	hf := htfs.OpenLazy(getURL, noRenewal, defaultSettings(t))
+	assert.EqualValues(0, numGetURL)
+	assert.EqualValues(0, ctx.numGET)
+	assert.Nil(hf.InitialResponse())
+
+	stat, err := hf.Stat()
+	assert.NoError(err)
+	assert.EqualValues(len(fakeData), stat.Size())
+	assert.EqualValues(1, numGetURL)
+	assert.EqualValues(1, ctx.numGET)
+	assert.NotNil(hf.InitialResponse())
+
+	// the initial request's conn is used for the first read
+	b := make([]byte, 4)
+	_, err = hf.ReadAt(b, 12)
+	assert.NoError(err)
+	assert.EqualValues(fakeData[12:16], b)
+	assert.EqualValues(1, numGetURL)
+	assert.EqualValues(1, ctx.numGET)
+	assert.NoError(hf.Close())
+
+	// never used, never requested
+	hf = htfs.OpenLazy(getURL, noRenewal, defaultSettings(t))
+	assert.NoError(hf.Close())
+	assert.EqualValues(1, numGetURL)
+
+	// errors stick
+	ctx.simulateNotFound = true
+	hf = htfs.OpenLazy(getURL, noRenewal, defaultSettings(t))
+	_, err = hf.ReadAt(b, 12)
+	assert.True(errors.Cause(err) == htfs.ErrNotFound)
+	_, err = hf.Stat()
+	assert.True(errors.Cause(err) == htfs.ErrNotFound)
+	assert.EqualValues(2, numGetURL)
+	assert.NoError(hf.Close())
+}
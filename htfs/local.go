@@ -0,0 +1,269 @@
+package htfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itchio/httpkit/clock"
+	"github.com/pkg/errors"
+)
+
+// LocalSettings configures OpenLocal
+type LocalSettings struct {
+	// Latency is added to every request, before responding
+	Latency time.Duration
+
+	// ExpireAfter, if non-zero, makes URLs expire after that many
+	// requests, to exercise the renewal logic
+	ExpireAfter int
+}
+
+const localExpiredMessage = "Local URL expired"
+
+// OpenLocal returns a File that reads the local file at path (or file:// URL)
+// through the same machinery as Open, so that code written against htfs can
+// be exercised in offline or test environments. Ranges, renewals (see
+// LocalSettings.ExpireAfter) and latency are simulated by a LocalTransport,
+// which replaces settings.Client.
+func OpenLocal(path string, localSettings *LocalSettings, settings *Settings) (*File, error) {
+	if localSettings == nil {
+		localSettings = &LocalSettings{}
+	}
+
+	fileURL, err := localFileURL(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "in htfs.OpenLocal")
+	}
+
+	lt := &LocalTransport{
+		Latency:     localSettings.Latency,
+		ExpireAfter: localSettings.ExpireAfter,
+		Clock:       settings.Clock,
+	}
+
+	s := *settings
+	s.Client = &http.Client{Transport: lt}
+	return Open(lt.URLFunc(fileURL), lt.NeedsRenewal, &s)
+}
+
+func localFileURL(path string) (string, error) {
+	if strings.HasPrefix(path, "file://") {
+		return path, nil
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	slashPath := filepath.ToSlash(absPath)
+	if filepath.VolumeName(absPath) != "" && !strings.HasPrefix(slashPath, "/") {
+		// file:///C:/x, since in file://C:/x, C: would be the host
+		slashPath = "/" + slashPath
+	}
+	u := &url.URL{Scheme: "file", Path: slashPath}
+	return u.String(), nil
+}
+
+// localFilePath returns the local path a file:// URL points to
+func localFilePath(u *url.URL) string {
+	p := u.Path
+	if strings.HasPrefix(p, "/") && filepath.VolumeName(filepath.FromSlash(p[1:])) != "" {
+		// "/C:/x", see localFileURL
+		p = p[1:]
+	}
+	return filepath.FromSlash(p)
+}
+
+// LocalTransport is an http.RoundTripper that serves GET requests
+// for file:// URLs, with support for "bytes=a-b" and "bytes=a-" ranges.
+// Use its URLFunc and NeedsRenewal with Open to simulate expiring URLs.
+type LocalTransport struct {
+	// Latency is added to every request, before responding
+	Latency time.Duration
+	// ExpireAfter, if non-zero, makes URLs returned by URLFunc
+	// expire after that many requests
+	ExpireAfter int
+	// Clock is used to simulate latency. If nil, clock.Real is used.
+	Clock clock.Clock
+
+	mu         sync.Mutex
+	generation int64
+	uses       int
+}
+
+var _ http.RoundTripper = (*LocalTransport)(nil)
+
+// URLFunc returns a GetURLFunc that hands out a fresh
+// URL for fileURL every time it's called.
+func (lt *LocalTransport) URLFunc(fileURL string) GetURLFunc {
+	return func() (string, error) {
+		u, err := url.Parse(fileURL)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+
+		lt.mu.Lock()
+		lt.generation++
+		lt.uses = 0
+		generation := lt.generation
+		lt.mu.Unlock()
+
+		q := u.Query()
+		q.Set("g", strconv.FormatInt(generation, 10))
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+}
+
+// NeedsRenewal recognizes expired URL responses from LocalTransport
+func (lt *LocalTransport) NeedsRenewal(res *http.Response, body []byte) bool {
+	return res.StatusCode == 403 && string(body) == localExpiredMessage
+}
+
+// RoundTrip implements http.RoundTripper
+func (lt *LocalTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "file" {
+		return nil, errors.Errorf("LocalTransport: unsupported scheme %q", req.URL.Scheme)
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return lt.respond(req, 405, "Invalid method"), nil
+	}
+
+	if lt.Latency > 0 {
+		clock.Or(lt.Clock).Sleep(lt.Latency)
+	}
+
+	if lt.expired(req.URL) {
+		return lt.respond(req, 403, localExpiredMessage), nil
+	}
+
+	f, err := os.Open(localFilePath(req.URL))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return lt.respond(req, 404, "Not found"), nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	stats, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.WithStack(err)
+	}
+	size := stats.Size()
+
+	start, end := int64(0), size-1
+	rangeHeader := req.Header.Get("Range")
+	if rangeHeader != "" {
+		start, end, err = parseRange(rangeHeader)
+		if err != nil {
+			f.Close()
+			return lt.respond(req, 400, err.Error()), nil
+		}
+		if end < 0 || end >= size {
+			end = size - 1
+		}
+		if start >= size || start > end {
+			f.Close()
+			res := lt.respond(req, 416, "Requested range not satisfiable")
+			res.Header.Set("content-range", fmt.Sprintf("bytes */%d", size))
+			return res, nil
+		}
+	}
+
+	length := end - start + 1
+	res := lt.respond(req, 200, "")
+	res.ContentLength = length
+	res.Header.Set("content-length", fmt.Sprintf("%d", length))
+	if rangeHeader != "" {
+		res.StatusCode = 206
+		res.Status = "206 Partial Content"
+		res.Header.Set("content-range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+
+	if req.Method == "HEAD" {
+		f.Close()
+		return res, nil
+	}
+
+	res.Body = &localBody{
+		Reader: io.NewSectionReader(f, start, length),
+		Closer: f,
+	}
+	return res, nil
+}
+
+func (lt *LocalTransport) expired(u *url.URL) bool {
+	g := u.Query().Get("g")
+	if g == "" {
+		// not one of ours, never expires
+		return false
+	}
+
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	if g != strconv.FormatInt(lt.generation, 10) {
+		return true
+	}
+	if lt.ExpireAfter > 0 && lt.uses >= lt.ExpireAfter {
+		return true
+	}
+	lt.uses++
+	return false
+}
+
+func (lt *LocalTransport) respond(req *http.Request, statusCode int, body string) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(body))),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// parseRange parses a "bytes=start-end" or "bytes=start-" range header.
+// end is inclusive, and -1 if the range is open-ended.
+func parseRange(rangeHeader string) (int64, int64, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(rangeHeader, prefix) {
+		return 0, 0, errors.Errorf("unsupported range %q", rangeHeader)
+	}
+	bounds := strings.SplitN(strings.TrimPrefix(rangeHeader, prefix), "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, errors.Errorf("unsupported range %q", rangeHeader)
+	}
+
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid range start %q", bounds[0])
+	}
+	if bounds[1] == "" {
+		return start, -1, nil
+	}
+	end, err := strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid range end %q", bounds[1])
+	}
+	return start, end, nil
+}
+
+type localBody struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,144 @@
+package htfs_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/clock"
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_OpenLocal(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "htfs-local")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	fakeData := []byte("aaaabbbbcccc")
+	path := filepath.Join(dir, "local.dat")
+	assert.NoError(ioutil.WriteFile(path, fakeData, 0644))
+
+	fc := clock.NewFake(time.Now())
+	start := fc.Now()
+	settings := defaultSettings(t)
+	settings.Clock = fc
+	settings.ForbidBacktracking = true
+
+	hf, err := htfs.OpenLocal(path, &htfs.LocalSettings{
+		Latency:     50 * time.Millisecond,
+		ExpireAfter: 1,
+	}, settings)
+	assert.NoError(err)
+
+	stat, err := hf.Stat()
+	assert.NoError(err)
+	assert.EqualValues(len(fakeData), stat.Size())
+	assert.EqualValues("local.dat", stat.Name())
+
+	buf := make([]byte, 4)
+	for _, offset := range []int64{8, 0, 4} {
+		_, err = hf.ReadAt(buf, offset)
+		assert.NoError(err)
+		assert.Equal(fakeData[offset:offset+4], buf)
+	}
+	// initial request, then going back to 0 needed
+	// a new request, which needed a renewal
+	assert.EqualValues(3*50*time.Millisecond, clock.Since(fc, start))
+	assert.NoError(hf.Close())
+
+	_, err = htfs.OpenLocal(filepath.Join(dir, "missing.dat"), nil, settings)
+	assert.Error(err)
+	assert.EqualValues(htfs.ErrNotFound, errors.Cause(err))
+}
+
+func Test_LocalTransportRanges(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "htfs-local")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	fakeData := []byte("aaaabbbbcccc")
+	path := filepath.Join(dir, "local.dat")
+	assert.NoError(ioutil.WriteFile(path, fakeData, 0644))
+
+	client := &http.Client{Transport: &htfs.LocalTransport{}}
+	fileURL := (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+
+	get := func(byteRange string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", fileURL, nil)
+		assert.NoError(err)
+		req.Header.Set("Range", byteRange)
+		res, err := client.Do(req)
+		assert.NoError(err)
+		body, err := ioutil.ReadAll(res.Body)
+		assert.NoError(err)
+		assert.NoError(res.Body.Close())
+		return res, string(body)
+	}
+
+	res, body := get("bytes=4-7")
+	assert.EqualValues(206, res.StatusCode)
+	assert.EqualValues("bbbb", body)
+	assert.EqualValues("bytes 4-7/12", res.Header.Get("content-range"))
+
+	res, body = get("bytes=8-")
+	assert.EqualValues(206, res.StatusCode)
+	assert.EqualValues("cccc", body)
+	assert.EqualValues("bytes 8-11/12", res.Header.Get("content-range"))
+
+	// the end is clamped to the size
+	res, body = get("bytes=10-99")
+	assert.EqualValues(206, res.StatusCode)
+	assert.EqualValues("cc", body)
+	assert.EqualValues("bytes 10-11/12", res.Header.Get("content-range"))
+
+	res, _ = get("bytes=12-")
+	assert.EqualValues(416, res.StatusCode)
+	assert.EqualValues("bytes */12", res.Header.Get("content-range"))
+
+	res, _ = get("bytes=7-4")
+	assert.EqualValues(416, res.StatusCode)
+
+	res, _ = get("bytes=-4")
+	assert.EqualValues(400, res.StatusCode)
+}
+
+func Test_LocalFileURL(t *testing.T) {
+	assert := assert.New(t)
+
+	paths := []string{filepath.Join(os.TempDir(), "some dir", "game #1.zip")}
+	if runtime.GOOS == "windows" {
+		paths = append(paths, `C:\games\game.zip`, `D:\`)
+	}
+
+	for _, path := range paths {
+		fileURL, err := htfs.LocalFileURL(path)
+		assert.NoError(err)
+		u, err := url.Parse(fileURL)
+		assert.NoError(err)
+		assert.EqualValues("file", u.Scheme)
+		assert.EqualValues("", u.Host, "%s shouldn't have a host", fileURL)
+		assert.EqualValues(path, htfs.LocalFilePath(u))
+	}
+
+	if runtime.GOOS == "windows" {
+		fileURL, err := htfs.LocalFileURL(`C:\games\game.zip`)
+		assert.NoError(err)
+		assert.EqualValues("file:///C:/games/game.zip", fileURL)
+	}
+
+	// file:// URLs are taken as-is
+	fileURL, err := htfs.LocalFileURL("file:///tmp/game.zip")
+	assert.NoError(err)
+	assert.EqualValues("file:///tmp/game.zip", fileURL)
+}
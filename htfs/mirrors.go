@@ -0,0 +1,93 @@
+package htfs
+
+import (
+	goerrors "errors"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/itchio/httpkit/neterr"
+	"github.com/pkg/errors"
+)
+
+// A GetURLsFunc returns several URLs the resource can be downloaded from
+// (mirrors), in order of preference.
+type GetURLsFunc func() (urls []string, err error)
+
+// ErrNoURLs is returned when a GetURLsFunc returns an empty list
+var ErrNoURLs = goerrors.New("no URLs to download the resource from")
+
+// OpenMirrors is like Open, but for resources available from several
+// URLs. When a request fails with a network or server error, the next
+// mirror is tried right away, and general retries (with backoff) only
+// kick in once every mirror has failed. The File sticks to whichever
+// mirror worked last, including across renewals.
+//
+// Mirrors typically don't agree on ETags and Last-Modified, so those are
+// only checked against the mirror the initial request was served from.
+// Responses from other mirrors must agree on the file's size instead.
+func OpenMirrors(getURLs GetURLsFunc, needsRenewal NeedsRenewalFunc, settings *Settings) (*File, error) {
+	return open(withoutExpiry(getURLs), needsRenewal, settings)
+}
+
+func (f *File) numMirrors() int {
+	f.urlMutex.Lock()
+	defer f.urlMutex.Unlock()
+
+	return len(f.mirrors)
+}
+
+// nextMirror switches to the mirror after the current one, and returns its URL
+func (f *File) nextMirror() string {
+	f.urlMutex.Lock()
+	defer f.urlMutex.Unlock()
+
+	f.mirrorIndex = (f.mirrorIndex + 1) % len(f.mirrors)
+	f.currentURL = f.mirrors[f.mirrorIndex]
+	return f.currentURL
+}
+
+// isMirrorError returns true if err might not happen on another mirror
+func isMirrorError(err error) bool {
+	if errors.Cause(err) == io.EOF || neterr.IsNetworkError(err) {
+		return true
+	}
+	_, ok := errors.Cause(err).(*ServerError)
+	return ok
+}
+
+// shouldValidate returns true if responses from urlStr can be checked
+// against the initial response's ETag or Last-Modified
+func (f *File) shouldValidate(urlStr string) bool {
+	if f.originHost == "" || f.numMirrors() < 2 {
+		return true
+	}
+	return urlHost(urlStr) == f.originHost
+}
+
+// sizeChanged returns true if a response from another mirror doesn't
+// agree on the file's size
+func (f *File) sizeChanged(res *http.Response) bool {
+	if f.size <= 0 {
+		return false
+	}
+
+	var total int64 = -1
+	if res.StatusCode == 206 {
+		parsed, err := parseContentRangeTotal(res.Header.Get("content-range"))
+		if err == nil {
+			total = parsed
+		}
+	} else if res.StatusCode == 200 {
+		total = res.ContentLength
+	}
+	return total >= 0 && total != f.size
+}
+
+func urlHost(urlStr string) string {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
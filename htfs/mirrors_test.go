@@ -0,0 +1,112 @@
+package htfs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/clock"
+	"github.com/itchio/httpkit/htfs"
+	"github.com/itchio/httpkit/retrycontext"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileMirrors(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbccccdddd")
+
+	ctxA := &fakeStorageContext{simulateOtherStatus: 503}
+	mirrorA := fakeStorage(t, fakeData, ctxA)
+	defer mirrorA.Close()
+
+	ctxB := &fakeStorageContext{etag: `"b"`}
+	mirrorB := fakeStorage(t, fakeData, ctxB)
+	defer mirrorB.Close()
+
+	ctxC := &fakeStorageContext{etag: `"c"`}
+	mirrorC := fakeStorage(t, fakeData, ctxC)
+	defer mirrorC.Close()
+
+	getURLs := func() ([]string, error) {
+		return []string{mirrorA.URL, mirrorB.URL, mirrorC.URL}, nil
+	}
+
+	fc := clock.NewFake(time.Now())
+	settings := defaultSettings(t)
+	settings.RetrySettings = &retrycontext.Settings{
+		MaxTries: 2,
+		Clock:    fc,
+	}
+	settings.ForbidBacktracking = true
+
+	hf, err := htfs.OpenMirrors(getURLs, noRenewal, settings)
+	assert.NoError(err)
+	assert.EqualValues(1, hf.Stats().Failovers, "A is down, B should serve the initial request")
+	assert.EqualValues(0, fc.Slept(), "failing over shouldn't back off")
+
+	buf := make([]byte, 4)
+	_, err = hf.ReadAt(buf, 4)
+	assert.NoError(err)
+	assert.EqualValues("bbbb", string(buf))
+
+	// B goes down too, C has another ETag but that's fine for a mirror
+	ctxB.simulateOtherStatus = 503
+	_, err = hf.ReadAt(buf, 0)
+	assert.NoError(err)
+	assert.EqualValues("aaaa", string(buf))
+	assert.EqualValues(2, hf.Stats().Failovers)
+	assert.EqualValues(0, fc.Slept())
+
+	// C is remembered as healthy
+	numGET := ctxC.numGET
+	_, err = hf.ReadAt(buf, 0)
+	assert.NoError(err)
+	assert.EqualValues(2, hf.Stats().Failovers)
+	assert.EqualValues(numGET+1, ctxC.numGET)
+
+	// when all of them are down, general retries kick in
+	ctxC.simulateOtherStatus = 503
+	_, err = hf.ReadAt(buf, 0)
+	assert.Error(err)
+	assert.True(fc.Slept() > 0)
+
+	assert.NoError(hf.Close())
+}
+
+func Test_FileMirrorsSize(t *testing.T) {
+	assert := assert.New(t)
+
+	ctxA := &fakeStorageContext{}
+	mirrorA := fakeStorage(t, []byte("aaaabbbbccccdddd"), ctxA)
+	defer mirrorA.Close()
+
+	// an outdated mirror
+	mirrorB := fakeStorage(t, []byte("aaaabbbb"), &fakeStorageContext{})
+	defer mirrorB.Close()
+
+	getURLs := func() ([]string, error) {
+		return []string{mirrorA.URL, mirrorB.URL}, nil
+	}
+
+	settings := defaultSettings(t)
+	settings.ForbidBacktracking = true
+	hf, err := htfs.OpenMirrors(getURLs, noRenewal, settings)
+	assert.NoError(err)
+
+	buf := make([]byte, 4)
+	_, err = hf.ReadAt(buf, 4)
+	assert.NoError(err)
+
+	ctxA.simulateOtherStatus = 503
+	_, err = hf.ReadAt(buf, 0)
+	assert.Error(err)
+	assert.True(errors.Cause(err) == htfs.ErrResourceChanged)
+
+	_, err = htfs.OpenMirrors(func() ([]string, error) {
+		return nil, nil
+	}, noRenewal, settings)
+	assert.Error(err)
+	assert.True(errors.Cause(err) == htfs.ErrNoURLs)
+
+	assert.NoError(hf.Close())
+}
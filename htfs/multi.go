@@ -0,0 +1,300 @@
+package htfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/itchio/httpkit"
+	"github.com/pkg/errors"
+)
+
+// A Range is a part of the file to read with ReadMulti:
+// Buf is filled with the len(Buf) bytes at Offset.
+type Range struct {
+	Offset int64
+	Buf    []byte
+}
+
+// maxRangesPerRequest keeps Range headers short enough for
+// servers and proxies that limit header sizes
+const maxRangesPerRequest = 32
+
+type span struct {
+	start int64
+	end   int64
+}
+
+// ReadMulti fills the Buf of every range, like calling ReadAt for each of
+// them, except that it asks for many ranges in a single request, which
+// servers answer with a multipart/byteranges response. That's a lot faster
+// for small, scattered reads, like when applying a patch.
+//
+// These requests aren't retried: ranges that couldn't be read that way
+// (for example, if the server doesn't support multiple ranges) are read
+// with ReadAt instead. Like ReadAt, it returns io.EOF if a range goes past
+// the end of the file.
+func (f *File) ReadMulti(ranges []Range) error {
+	return f.ReadMultiContext(context.Background(), ranges)
+}
+
+// ReadMultiContext is ReadMulti, except it stops early if ctx is done.
+func (f *File) ReadMultiContext(ctx context.Context, ranges []Range) error {
+	if err := f.opened(); err != nil {
+		return err
+	}
+
+	ctx, cancel := f.mergeContext(ctx)
+	defer cancel()
+
+	filled := make([]int64, len(ranges))
+	if f.spillFile == nil {
+		spans := f.planSpans(ranges)
+		for len(spans) > 0 {
+			batch := spans
+			if len(batch) > maxRangesPerRequest {
+				batch = batch[:maxRangesPerRequest]
+			}
+			spans = spans[len(batch):]
+
+			err := f.readSpans(ctx, batch, ranges, filled)
+			if err != nil {
+				if ctx.Err() != nil {
+					return f.labelError(errors.WithStack(ctx.Err()))
+				}
+				f.info("multi: falling back to single reads", "ranges", len(batch), "err", err)
+			}
+		}
+	}
+
+	for i, r := range ranges {
+		if filled[i] == int64(len(r.Buf)) {
+			continue
+		}
+		n, err := f.readAtPinned(ctx, r.Buf, r.Offset, PriorityNormal)
+		if err == io.EOF && n == len(r.Buf) {
+			err = nil
+		}
+		if err != nil {
+			return f.labelError(err)
+		}
+	}
+	return nil
+}
+
+// planSpans returns the spans to request for ranges, sorted, with
+// overlapping and adjacent ranges merged. Ranges that go past the end
+// of the file are left to ReadAt.
+func (f *File) planSpans(ranges []Range) []span {
+	var spans []span
+	for _, r := range ranges {
+		end := r.Offset + int64(len(r.Buf))
+		if len(r.Buf) == 0 || r.Offset < 0 || (f.knownSize() && end > f.size) {
+			continue
+		}
+		spans = append(spans, span{start: r.Offset, end: end})
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+
+	var merged []span
+	for _, s := range spans {
+		if len(merged) > 0 && s.start <= merged[len(merged)-1].end {
+			last := &merged[len(merged)-1]
+			if s.end > last.end {
+				last.end = s.end
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// readSpans does a single request for all spans, and copies what it
+// gets into ranges, adding the number of bytes copied to filled.
+func (f *File) readSpans(ctx context.Context, spans []span, ranges []Range, filled []int64) error {
+	err := f.budget.check()
+	if err != nil {
+		return errors.Wrap(err, "in File.readSpans")
+	}
+
+	urlStr, _ := f.freshURL(spans[0].start)
+	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		return errors.Wrap(err, "in File.readSpans, while creating new GET request")
+	}
+	req = req.WithContext(ctx)
+
+	var specs []string
+	for _, s := range spans {
+		specs = append(specs, fmt.Sprintf("%d-%d", s.start, s.end-1))
+	}
+	req.Header.Set("Range", "bytes="+strings.Join(specs, ","))
+	validate := f.shouldValidate(urlStr)
+	if validate {
+		if validator := f.validator(); validator != "" {
+			req.Header.Set("If-Range", validator)
+		}
+	}
+	req.Header.Set("Accept-Encoding", f.AcceptEncoding)
+	if f.TE != "" {
+		req.Header.Set("TE", f.TE)
+	}
+	err = f.prepareRequest(req)
+	if err != nil {
+		return errors.Wrap(err, "in File.readSpans, while preparing GET request")
+	}
+
+	f.pace(req)
+	req = f.traceTLS(req)
+	res, err := f.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "in File.readSpans, while doing GET request")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 206 {
+		return errors.Errorf("in File.readSpans, got HTTP %d", res.StatusCode)
+	}
+	if validate && f.resourceChanged(res.Header) {
+		return errors.Wrap(ErrResourceChanged, "in File.readSpans")
+	}
+	if encoding := res.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, IdentityEncoding) {
+		return errors.Errorf("in File.readSpans, got Content-Encoding %s", encoding)
+	}
+
+	var body io.Reader = res.Body
+	if f.limiter != nil {
+		body = &limitedReader{Reader: body, limiter: f.limiter}
+	}
+
+	// the server may merge ranges, but shouldn't send more than that
+	outer := span{start: spans[0].start, end: spans[len(spans)-1].end}
+
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		// the server merged all our ranges into one
+		return f.fillRanges(body, res.Header.Get("Content-Range"), outer, ranges, filled)
+	}
+
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "in File.readSpans, while reading multipart response")
+		}
+
+		err = f.fillRanges(part, part.Header.Get("Content-Range"), outer, ranges, filled)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// fillRanges reads the part of the file described by contentRange from r,
+// and copies it into the ranges it overlaps. The part must be within outer.
+func (f *File) fillRanges(r io.Reader, contentRange string, outer span, ranges []Range, filled []int64) error {
+	start, end, err := parseContentRange(contentRange)
+	if err != nil {
+		return err
+	}
+	if start < outer.start || end > outer.end {
+		return errors.Errorf("in File.fillRanges, got unexpected range %s", contentRange)
+	}
+
+	data := make([]byte, end-start)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return errors.Wrapf(err, "in File.fillRanges, while reading bytes %d-%d", start, end-1)
+	}
+
+	f.stats.add(&f.stats.fetchedBytes, int64(len(data)))
+	err = f.budget.spend(int64(len(data)))
+	if err != nil {
+		return errors.Wrap(err, "in File.fillRanges")
+	}
+
+	for i, rg := range ranges {
+		lo := rg.Offset
+		if lo < start {
+			lo = start
+		}
+		hi := rg.Offset + int64(len(rg.Buf))
+		if hi > end {
+			hi = end
+		}
+		if lo < hi {
+			copy(rg.Buf[lo-rg.Offset:], data[lo-start:hi-start])
+			filled[i] += hi - lo
+		}
+	}
+	return nil
+}
+
+// parseContentRange parses "bytes 100-199/1000" into 100, 200.
+// Malformed values get a *HeaderError.
+func parseContentRange(contentRange string) (int64, int64, error) {
+	invalid := func(reason string) error {
+		return errors.WithStack(&HeaderError{Header: "Content-Range", Value: contentRange, Reason: reason})
+	}
+
+	spec := strings.TrimPrefix(contentRange, "bytes ")
+	if spec == contentRange {
+		return 0, 0, invalid("expected bytes unit")
+	}
+	slashTokens := strings.SplitN(spec, "/", 2)
+	dashTokens := strings.SplitN(slashTokens[0], "-", 2)
+	if len(dashTokens) != 2 {
+		return 0, 0, invalid("expected first-last")
+	}
+
+	start, err := strconv.ParseInt(dashTokens[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, invalid("invalid first byte")
+	}
+	last, err := strconv.ParseInt(dashTokens[1], 10, 64)
+	if err != nil || last < start || last == math.MaxInt64 {
+		return 0, 0, invalid("invalid last byte")
+	}
+	return start, last + 1, nil
+}
+
+// parseContentRangeTotal parses "bytes 100-199/1000", or "bytes */1000"
+// into 1000. Malformed values, and unknown totals, get a *HeaderError.
+func parseContentRangeTotal(contentRange string) (int64, error) {
+	tokens := strings.Split(contentRange, "/")
+	if len(tokens) != 2 {
+		return 0, errors.WithStack(&HeaderError{Header: "Content-Range", Value: contentRange, Reason: "expected range/total"})
+	}
+	total, err := strconv.ParseInt(tokens[1], 10, 64)
+	if err != nil || total < 0 {
+		return 0, errors.WithStack(&HeaderError{Header: "Content-Range", Value: contentRange, Reason: "invalid total"})
+	}
+	return total, nil
+}
+
+// limitedReader takes bytes it reads from limiter
+type limitedReader struct {
+	io.Reader
+	limiter httpkit.Limiter
+}
+
+func (lr *limitedReader) Read(buf []byte) (int, error) {
+	n, err := lr.Reader.Read(buf)
+	if n > 0 {
+		lr.limiter.Take(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,86 @@
+package htfs_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func multiRanges(offsets ...int64) []htfs.Range {
+	var ranges []htfs.Range
+	for _, offset := range offsets {
+		ranges = append(ranges, htfs.Range{Offset: offset, Buf: make([]byte, 4)})
+	}
+	return ranges
+}
+
+func checkRanges(t *testing.T, fakeData []byte, ranges []htfs.Range) {
+	t.Helper()
+	for _, r := range ranges {
+		assert.EqualValues(t, fakeData[r.Offset:r.Offset+int64(len(r.Buf))], r.Buf, "at offset %d", r.Offset)
+	}
+}
+
+func Test_FileReadMulti(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var numGET int64
+	storageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&numGET, 1)
+		http.ServeContent(w, r, "file.dat", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer storageServer.Close()
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, defaultSettings(t))
+	assert.NoError(err)
+	assert.EqualValues(1, atomic.LoadInt64(&numGET))
+
+	// scattered, out of order, overlapping and adjacent
+	ranges := multiRanges(3*1024*1024, 12, 1024*1024, 14, 16, 2*1024*1024+7)
+	assert.NoError(hf.ReadMulti(ranges))
+	checkRanges(t, fakeData, ranges)
+	assert.EqualValues(2, atomic.LoadInt64(&numGET), "should take a single request")
+
+	// a single range is fine too
+	ranges = multiRanges(1234)
+	assert.NoError(hf.ReadMulti(ranges))
+	checkRanges(t, fakeData, ranges)
+
+	// past the end
+	size := int64(len(fakeData))
+	ranges = multiRanges(20, size-2)
+	err = hf.ReadMulti(ranges)
+	assert.True(errors.Cause(err) == io.EOF)
+	assert.EqualValues(fakeData[20:24], ranges[0].Buf)
+
+	assert.NoError(hf.Close())
+}
+
+func Test_FileReadMultiFallback(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	// only supports single ranges
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, defaultSettings(t))
+	assert.NoError(err)
+
+	ranges := multiRanges(3*1024*1024, 12, 1024*1024)
+	assert.NoError(hf.ReadMulti(ranges))
+	checkRanges(t, fakeData, ranges)
+
+	assert.NoError(hf.Close())
+}
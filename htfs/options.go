@@ -0,0 +1,489 @@
+package htfs
+
+import (
+	"net/http"
+
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/retrycontext"
+)
+
+// Option configures Settings, see NewSettings and OpenWithOptions
+type Option interface {
+	Apply(s *Settings)
+}
+
+// NewSettings returns Settings with opts applied, in order
+func NewSettings(opts ...Option) *Settings {
+	s := &Settings{}
+	for _, o := range opts {
+		o.Apply(s)
+	}
+	return s
+}
+
+// OpenWithOptions is like Open, but takes options instead of Settings
+func OpenWithOptions(getURL GetURLFunc, needsRenewal NeedsRenewalFunc, opts ...Option) (*File, error) {
+	return Open(getURL, needsRenewal, NewSettings(opts...))
+}
+
+// ---------
+
+type clientOption struct {
+	client *http.Client
+}
+
+// WithClient specifies the HTTP client used for all requests.
+// The default is http.DefaultClient.
+func WithClient(client *http.Client) Option {
+	return &clientOption{
+		client: client,
+	}
+}
+
+func (o *clientOption) Apply(s *Settings) {
+	s.Client = o.client
+}
+
+// ---------
+
+type retrySettingsOption struct {
+	retrySettings *retrycontext.Settings
+}
+
+// WithRetrySettings specifies how failed requests are retried
+func WithRetrySettings(retrySettings *retrycontext.Settings) Option {
+	return &retrySettingsOption{
+		retrySettings: retrySettings,
+	}
+}
+
+func (o *retrySettingsOption) Apply(s *Settings) {
+	s.RetrySettings = o.retrySettings
+}
+
+// ---------
+
+type readRetrySettingsOption struct {
+	readRetrySettings *retrycontext.Settings
+}
+
+// WithReadRetrySettings specifies how often reads reconnect when
+// responses break off, see Settings.ReadRetrySettings
+func WithReadRetrySettings(readRetrySettings *retrycontext.Settings) Option {
+	return &readRetrySettingsOption{
+		readRetrySettings: readRetrySettings,
+	}
+}
+
+func (o *readRetrySettingsOption) Apply(s *Settings) {
+	s.ReadRetrySettings = o.readRetrySettings
+}
+
+// ---------
+
+type maxConnsOption struct {
+	maxConns int
+}
+
+// WithMaxConns caps the number of connections a File keeps open,
+// see Settings.MaxConns
+func WithMaxConns(maxConns int) Option {
+	return &maxConnsOption{
+		maxConns: maxConns,
+	}
+}
+
+func (o *maxConnsOption) Apply(s *Settings) {
+	s.MaxConns = o.maxConns
+}
+
+// ---------
+
+type limiterOption struct {
+	limiter httpkit.Limiter
+}
+
+// WithLimiter caps how fast response bodies are read,
+// see Settings.Limiter
+func WithLimiter(limiter httpkit.Limiter) Option {
+	return &limiterOption{
+		limiter: limiter,
+	}
+}
+
+func (o *limiterOption) Apply(s *Settings) {
+	s.Limiter = o.limiter
+}
+
+// ---------
+
+type hostPacerOption struct {
+	hostPacer *HostPacer
+}
+
+// WithHostPacer spaces out requests made to the same host,
+// see Settings.HostPacer
+func WithHostPacer(hostPacer *HostPacer) Option {
+	return &hostPacerOption{
+		hostPacer: hostPacer,
+	}
+}
+
+func (o *hostPacerOption) Apply(s *Settings) {
+	s.HostPacer = o.hostPacer
+}
+
+// ---------
+
+type labelsOption struct {
+	labels Labels
+}
+
+// WithLabels specifies labels to include in every log line,
+// stats dump and error
+func WithLabels(labels Labels) Option {
+	return &labelsOption{
+		labels: labels,
+	}
+}
+
+func (o *labelsOption) Apply(s *Settings) {
+	s.Labels = o.labels
+}
+
+// ---------
+
+type requestHeadersOption struct {
+	header http.Header
+}
+
+// WithRequestHeaders specifies headers to send with every request,
+// see Settings.RequestHeaders
+func WithRequestHeaders(header http.Header) Option {
+	return &requestHeadersOption{
+		header: header,
+	}
+}
+
+func (o *requestHeadersOption) Apply(s *Settings) {
+	s.RequestHeaders = o.header
+}
+
+// ---------
+
+type prepareRequestOption struct {
+	prepareRequest PrepareRequestFunc
+}
+
+// WithPrepareRequest specifies a function that can change every
+// request before it's sent, see Settings.PrepareRequest
+func WithPrepareRequest(prepareRequest PrepareRequestFunc) Option {
+	return &prepareRequestOption{
+		prepareRequest: prepareRequest,
+	}
+}
+
+func (o *prepareRequestOption) Apply(s *Settings) {
+	s.PrepareRequest = o.prepareRequest
+}
+
+// ---------
+
+type cookieJarOption struct {
+	jar http.CookieJar
+}
+
+// WithCookieJar specifies a cookie jar for all requests, see
+// Settings.CookieJar. Pass nil to give the File its own jar.
+func WithCookieJar(jar http.CookieJar) Option {
+	return &cookieJarOption{
+		jar: jar,
+	}
+}
+
+func (o *cookieJarOption) Apply(s *Settings) {
+	s.CookieJar = o.jar
+	s.KeepCookies = true
+}
+
+// ---------
+
+type traceSamplingOption struct {
+	sampleRate float64
+	sink       TraceSink
+}
+
+// WithTraceSampling sends a RequestTrace for a random sampleRate
+// (between 0 and 1) of requests to sink, see Settings.TraceSink
+func WithTraceSampling(sampleRate float64, sink TraceSink) Option {
+	return &traceSamplingOption{
+		sampleRate: sampleRate,
+		sink:       sink,
+	}
+}
+
+func (o *traceSamplingOption) Apply(s *Settings) {
+	s.TraceSampleRate = o.sampleRate
+	s.TraceSink = o.sink
+}
+
+// ---------
+
+type sizeProbeOption struct {
+	probe SizeProbe
+}
+
+// WithSizeProbe sets how Open finds out the file's size,
+// see Settings.SizeProbe
+func WithSizeProbe(probe SizeProbe) Option {
+	return &sizeProbeOption{
+		probe: probe,
+	}
+}
+
+func (o *sizeProbeOption) Apply(s *Settings) {
+	s.SizeProbe = o.probe
+}
+
+// ---------
+
+type connectivityOption struct {
+	connectivity retrycontext.Connectivity
+}
+
+// WithConnectivity suspends retries while the machine is offline,
+// see Settings.Connectivity
+func WithConnectivity(connectivity retrycontext.Connectivity) Option {
+	return &connectivityOption{
+		connectivity: connectivity,
+	}
+}
+
+func (o *connectivityOption) Apply(s *Settings) {
+	s.Connectivity = o.connectivity
+}
+
+// ---------
+
+type retriableStatusCodesOption struct {
+	codes []int
+}
+
+// WithRetriableStatusCodes sets which HTTP statuses are retried,
+// see Settings.RetriableStatusCodes
+func WithRetriableStatusCodes(codes ...int) Option {
+	return &retriableStatusCodesOption{
+		codes: codes,
+	}
+}
+
+func (o *retriableStatusCodesOption) Apply(s *Settings) {
+	s.RetriableStatusCodes = o.codes
+}
+
+// ---------
+
+type shouldRetryOption struct {
+	shouldRetry ShouldRetryFunc
+}
+
+// WithShouldRetry decides which errors are retried, see Settings.ShouldRetry
+func WithShouldRetry(shouldRetry ShouldRetryFunc) Option {
+	return &shouldRetryOption{
+		shouldRetry: shouldRetry,
+	}
+}
+
+func (o *shouldRetryOption) Apply(s *Settings) {
+	s.ShouldRetry = o.shouldRetry
+}
+
+// ---------
+
+type pinOption struct {
+	head int64
+	tail int64
+}
+
+// WithPin keeps the first head and last tail bytes of the file in
+// memory, see Settings.PinHead
+func WithPin(head int64, tail int64) Option {
+	return &pinOption{
+		head: head,
+		tail: tail,
+	}
+}
+
+func (o *pinOption) Apply(s *Settings) {
+	s.PinHead = o.head
+	s.PinTail = o.tail
+}
+
+// ---------
+
+type alignedReadsOption struct {
+	blockSize int64
+}
+
+// WithAlignedReads fetches whole blocks of blockSize bytes, see
+// Settings.AlignedReadSize
+func WithAlignedReads(blockSize int64) Option {
+	return &alignedReadsOption{
+		blockSize: blockSize,
+	}
+}
+
+func (o *alignedReadsOption) Apply(s *Settings) {
+	s.AlignedReadSize = o.blockSize
+}
+
+// ---------
+
+type maxFetchedBytesOption struct {
+	maxFetchedBytes int64
+}
+
+// WithMaxFetchedBytes makes reads fail with ErrBudgetExceeded once
+// the File has fetched more than that, see Settings.MaxFetchedBytes
+func WithMaxFetchedBytes(maxFetchedBytes int64) Option {
+	return &maxFetchedBytesOption{
+		maxFetchedBytes: maxFetchedBytes,
+	}
+}
+
+func (o *maxFetchedBytesOption) Apply(s *Settings) {
+	s.MaxFetchedBytes = o.maxFetchedBytes
+}
+
+// ---------
+
+type readPlannerOption struct {
+	planner ReadPlanner
+}
+
+// WithReadPlanner decides which conn serves each read with planner,
+// see Settings.ReadPlanner
+func WithReadPlanner(planner ReadPlanner) Option {
+	return &readPlannerOption{
+		planner: planner,
+	}
+}
+
+func (o *readPlannerOption) Apply(s *Settings) {
+	s.ReadPlanner = o.planner
+}
+
+// ---------
+
+type streamReadAheadOption struct {
+	readAhead int64
+}
+
+// WithStreamReadAhead makes Streams read up to readAhead bytes ahead
+// of their reader, see Settings.StreamReadAhead
+func WithStreamReadAhead(readAhead int64) Option {
+	return &streamReadAheadOption{
+		readAhead: readAhead,
+	}
+}
+
+func (o *streamReadAheadOption) Apply(s *Settings) {
+	s.StreamReadAhead = o.readAhead
+}
+
+// ---------
+
+type blockCacheOption struct {
+	cache *BlockCache
+	key   string
+}
+
+// WithBlockCache serves reads from cache when possible, or not at all if
+// it's nil, see Settings.BlockCache and Settings.BlockCacheKey
+func WithBlockCache(cache *BlockCache, key string) Option {
+	return &blockCacheOption{
+		cache: cache,
+		key:   key,
+	}
+}
+
+func (o *blockCacheOption) Apply(s *Settings) {
+	s.BlockCache = o.cache
+	s.BlockCacheKey = o.key
+}
+
+// ---------
+
+type requestIDOption struct {
+	header string
+	id     string
+}
+
+// WithRequestID sends id with every request in header, or a random ID
+// generated for each File if id is empty, see Settings.RequestIDHeader
+func WithRequestID(header string, id string) Option {
+	return &requestIDOption{
+		header: header,
+		id:     id,
+	}
+}
+
+func (o *requestIDOption) Apply(s *Settings) {
+	s.RequestIDHeader = o.header
+	s.RequestID = o.id
+}
+
+// ---------
+
+type responseIDHeadersOption struct {
+	headers []string
+}
+
+// WithResponseIDHeaders records headers of responses in ConnInfo.ResponseIDs,
+// instead of the default ones, or none if there are no headers. See
+// Settings.ResponseIDHeaders.
+func WithResponseIDHeaders(headers ...string) Option {
+	if headers == nil {
+		headers = []string{}
+	}
+	return &responseIDHeadersOption{
+		headers: headers,
+	}
+}
+
+func (o *responseIDHeadersOption) Apply(s *Settings) {
+	s.ResponseIDHeaders = o.headers
+}
+
+// ---------
+
+type commonOption struct {
+	common httpkit.CommonOptions
+}
+
+// WithCommon applies options shared by all httpkit subsystems:
+// Logger, Log, Metrics, Clock and Limiter. Nil fields are left alone.
+func WithCommon(common httpkit.CommonOptions) Option {
+	return &commonOption{
+		common: common,
+	}
+}
+
+func (o *commonOption) Apply(s *Settings) {
+	c := o.common
+	if c.Logger != nil {
+		s.Logger = c.Logger
+	}
+	if c.Log != nil {
+		s.Log = LogFunc(c.Log)
+	}
+	if c.Metrics != nil {
+		s.Metrics = c.Metrics
+	}
+	if c.Clock != nil {
+		s.Clock = c.Clock
+	}
+	if c.Limiter != nil {
+		s.Limiter = c.Limiter
+	}
+}
@@ -0,0 +1,169 @@
+package htfs_test
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/clock"
+	"github.com/itchio/httpkit/htfs"
+	"github.com/itchio/httpkit/rate"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMetrics struct {
+	mu       sync.Mutex
+	counters map[string]int64
+}
+
+func (fm *fakeMetrics) Add(name string, delta int64) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.counters[name] += delta
+}
+
+type fakeLimiter struct {
+	mu    sync.Mutex
+	taken int64
+}
+
+func (fl *fakeLimiter) Take(n int64) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	fl.taken += n
+}
+
+func Test_OpenWithOptions(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbccccdddd")
+
+	storageServer := fakeStorage(t, fakeData, &fakeStorageContext{})
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	getURL := func() (string, error) {
+		return storageServer.URL, nil
+	}
+	needsRenewal := func(res *http.Response, body []byte) bool {
+		return false
+	}
+
+	var logged []string
+	metrics := &fakeMetrics{counters: make(map[string]int64)}
+	limiter := &fakeLimiter{}
+
+	hf, err := htfs.OpenWithOptions(getURL, needsRenewal,
+		htfs.WithClient(http.DefaultClient),
+		htfs.WithMaxConns(1),
+		htfs.WithCommon(httpkit.CommonOptions{
+			Log: func(msg string) {
+				logged = append(logged, msg)
+			},
+			Metrics: metrics,
+			Limiter: limiter,
+		}),
+	)
+	assert.NoError(err)
+
+	buf := make([]byte, 8)
+	_, err = hf.ReadAt(buf, 8)
+	assert.NoError(err)
+	assert.EqualValues("ccccdddd", string(buf))
+
+	assert.NoError(hf.Close())
+
+	assert.NotEmpty(logged)
+	assert.EqualValues(len(fakeData), limiter.taken)
+	assert.EqualValues(1, metrics.counters["htfs.connections"])
+	assert.EqualValues(len(fakeData), metrics.counters["htfs.fetched_bytes"])
+}
+
+func Test_FileRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	storageServer := fakeStorage(t, fakeData, &fakeStorageContext{})
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	const bytesPerSecond = 1024 * 1024
+	fc := clock.NewFake(time.Now())
+	limiter := rate.New(rate.Settings{
+		BytesPerSecond: bytesPerSecond,
+		Burst:          1024,
+		Clock:          fc,
+	})
+
+	// one cap for both Files
+	var files []*htfs.File
+	for i := 0; i < 2; i++ {
+		settings := htfs.NewSettings(htfs.WithLimiter(limiter))
+		settings.RetrySettings = defaultSettings(t).RetrySettings
+		hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+		assert.NoError(err)
+		files = append(files, hf)
+	}
+
+	var fetched int64
+	for i, hf := range files {
+		buf := make([]byte, 512*1024)
+		_, err := hf.ReadAt(buf, int64(i)*1024*1024)
+		assert.NoError(err)
+		assert.NoError(hf.Close())
+		fetched += hf.Stats().FetchedBytes
+	}
+
+	expected := time.Duration(float64(fetched-1024) / bytesPerSecond * float64(time.Second))
+	assert.InDelta(float64(expected), float64(fc.Slept()), float64(time.Millisecond))
+}
+
+func Test_FilePrefetchSpareBandwidth(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	storageServer := fakeStorage(t, fakeData, &fakeStorageContext{})
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	const bytesPerSecond = 1024 * 1024
+	fc := clock.NewFake(time.Now())
+	limiter := rate.New(rate.Settings{
+		BytesPerSecond: bytesPerSecond,
+		Burst:          64 * 1024,
+		Clock:          fc,
+	})
+
+	settings := htfs.NewSettings(htfs.WithLimiter(limiter))
+	settings.RetrySettings = defaultSettings(t).RetrySettings
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+
+	// the link is busy: there's nothing to spare, and
+	// foreground reads wait for every byte they get
+	limiter.Take(64 * 1024)
+
+	done := hf.Prefetch(2*1024*1024, 1024*1024)
+	buf := make([]byte, 512*1024)
+	_, err = hf.ReadAt(buf, 0)
+	assert.NoError(err)
+	assert.NoError(<-done)
+
+	// the foreground read only waited for its own bytes
+	// (and at most a read buffer's worth past them)
+	maxSlept := time.Duration(float64(len(buf)+4096) / bytesPerSecond * float64(time.Second))
+	assert.True(fc.Slept() <= maxSlept, "slept %s, expected at most %s", fc.Slept(), maxSlept)
+	assert.NoError(hf.Close())
+	assert.True(hf.Stats().FetchedBytes <= int64(len(buf)+4096), "prefetch shouldn't have read anything")
+
+	// with bandwidth to spare, it does read ahead, without waiting
+	hf, err = htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	fc.Advance(time.Second)
+	slept := fc.Slept()
+	assert.NoError(<-hf.Prefetch(2*1024*1024, 1024*1024))
+	assert.EqualValues(slept, fc.Slept())
+	assert.NoError(hf.Close())
+	assert.True(hf.Stats().FetchedBytes >= 16*1024)
+}
@@ -0,0 +1,119 @@
+package htfs
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/itchio/httpkit/clock"
+	"github.com/itchio/httpkit/rate"
+)
+
+// PacingSettings configures a HostPacer, see NewHostPacer
+type PacingSettings struct {
+	// MinInterval, if non-zero, is the shortest time between
+	// two requests to the same host
+	MinInterval time.Duration
+	// MaxPerMinute, if non-zero, caps the requests made to the same
+	// host: up to MaxPerMinute at once, then evenly spread out.
+	MaxPerMinute int
+	// Jitter, between 0 and 1, randomly lengthens waits, see rate.Settings.Jitter
+	Jitter float64
+	// Clock is used to wait. If nil, clock.Real is used.
+	Clock clock.Clock
+}
+
+// A HostPacer spaces out the requests several Files (see Settings.HostPacer)
+// make to the same host. Some CDNs take many requests for different ranges
+// of the same file, in rapid succession, for abuse, and start answering 403.
+// Every request for a range counts, including retries.
+// It's safe for concurrent use.
+type HostPacer struct {
+	settings PacingSettings
+	clock    clock.Clock
+
+	mu    sync.Mutex
+	hosts map[string]*hostPace
+}
+
+// hostPace holds the limiters of a host, where tokens are
+// microseconds for interval, and seconds for perMinute
+type hostPace struct {
+	interval  *rate.Limiter
+	perMinute *rate.Limiter
+}
+
+// NewHostPacer returns a HostPacer that enforces both of
+// settings' policies, whichever is stricter.
+func NewHostPacer(settings PacingSettings) *HostPacer {
+	return &HostPacer{
+		settings: settings,
+		clock:    clock.Or(settings.Clock),
+		hosts:    make(map[string]*hostPace),
+	}
+}
+
+func (hp *HostPacer) host(host string) *hostPace {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	h, ok := hp.hosts[host]
+	if !ok {
+		h = &hostPace{}
+		if hp.settings.MinInterval > 0 {
+			h.interval = rate.New(rate.Settings{
+				BytesPerSecond: int64(time.Second / time.Microsecond),
+				Burst:          hp.intervalCost(),
+				Jitter:         hp.settings.Jitter,
+				Clock:          hp.clock,
+			})
+		}
+		if hp.settings.MaxPerMinute > 0 {
+			h.perMinute = rate.New(rate.Settings{
+				BytesPerSecond: int64(hp.settings.MaxPerMinute),
+				Burst:          int64(hp.settings.MaxPerMinute) * 60,
+				Jitter:         hp.settings.Jitter,
+				Clock:          hp.clock,
+			})
+		}
+		hp.hosts[host] = h
+	}
+	return h
+}
+
+func (hp *HostPacer) intervalCost() int64 {
+	cost := int64(hp.settings.MinInterval / time.Microsecond)
+	if cost < 1 {
+		cost = 1
+	}
+	return cost
+}
+
+// wait blocks until a request may be sent to host,
+// and returns how long that took
+func (hp *HostPacer) wait(host string) time.Duration {
+	h := hp.host(host)
+	start := hp.clock.Now()
+	if h.perMinute != nil {
+		h.perMinute.Take(60)
+	}
+	if h.interval != nil {
+		h.interval.Take(hp.intervalCost())
+	}
+	return clock.Since(hp.clock, start)
+}
+
+// pace waits until req may be sent, if a HostPacer is set
+func (f *File) pace(req *http.Request) {
+	if f.HostPacer == nil {
+		return
+	}
+
+	waited := f.HostPacer.wait(req.URL.Host)
+	if waited <= 0 {
+		return
+	}
+	f.debug("pacing: waited before request", "host", req.URL.Host, "wait", waited)
+	f.stats.add(&f.stats.pacingDelays, 1)
+	f.stats.add(&f.stats.pacingWait, int64(waited))
+}
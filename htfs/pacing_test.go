@@ -0,0 +1,80 @@
+package htfs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/clock"
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileHostPacer(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	fc := clock.NewFake(time.Now())
+	pacer := htfs.NewHostPacer(htfs.PacingSettings{
+		MinInterval: time.Second,
+		Clock:       fc,
+	})
+
+	// one pace for both Files, since they're on the same host
+	var files []*htfs.File
+	for i := 0; i < 2; i++ {
+		settings := htfs.NewSettings(htfs.WithHostPacer(pacer))
+		settings.RetrySettings = defaultSettings(t).RetrySettings
+		hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+		assert.NoError(err)
+		files = append(files, hf)
+	}
+
+	delays := 0
+	for _, hf := range files {
+		for _, offset := range []int64{3 * 1024 * 1024, 1024 * 1024} {
+			_, err := hf.ReadAt(make([]byte, 1024), offset)
+			assert.NoError(err)
+		}
+		s := hf.Stats()
+		delays += s.PacingDelays
+		assert.NoError(hf.Close())
+	}
+
+	numRequests := int(ctx.numGET)
+	assert.True(numRequests > 2, "expected several requests, got %d", numRequests)
+	// only the first request went through right away
+	assert.EqualValues(numRequests-1, delays)
+	assert.EqualValues(time.Duration(numRequests-1)*time.Second, fc.Slept())
+}
+
+func Test_HostPacerPerMinute(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeData := []byte("aaaabbbbcccc")
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	fc := clock.NewFake(time.Now())
+	pacer := htfs.NewHostPacer(htfs.PacingSettings{
+		MaxPerMinute: 2,
+		Clock:        fc,
+	})
+
+	for i := 0; i < 3; i++ {
+		settings := defaultSettings(t)
+		settings.HostPacer = pacer
+		hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+		assert.NoError(err)
+		assert.NoError(hf.Close())
+	}
+
+	// two at once, then one every 30 seconds
+	assert.EqualValues(30*time.Second, fc.Slept())
+}
@@ -0,0 +1,103 @@
+package htfs
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// pin fetches the first PinHead and last PinTail bytes of the file, so
+// they're served from memory from then on. Archive formats read both ends
+// over and over (signatures at the start, directories at the end), and
+// going back and forth between them costs a reconnect every time.
+// Errors are labelled.
+func (f *File) pin() error {
+	if f.PinHead <= 0 && f.PinTail <= 0 {
+		return nil
+	}
+	if f.spillFile != nil {
+		// everything is served from disk already
+		return nil
+	}
+	if !f.knownSize() {
+		f.info("pin: size unknown, not pinning")
+		return nil
+	}
+
+	headLen := f.PinHead
+	if headLen > f.size {
+		headLen = f.size
+	}
+	if headLen > 0 {
+		head := make([]byte, headLen)
+		_, err := f.readFull(head, 0)
+		if err != nil {
+			return f.labelError(errors.Wrap(normalizeError(err), "htfs.Open (pinning head)"))
+		}
+		f.pinnedHead = head
+	}
+
+	tailOffset := f.size - f.PinTail
+	if tailOffset < headLen {
+		// don't pin the same bytes twice
+		tailOffset = headLen
+	}
+	if f.PinTail > 0 && tailOffset < f.size {
+		tail := make([]byte, f.size-tailOffset)
+		_, err := f.readFull(tail, tailOffset)
+		if err != nil {
+			return f.labelError(errors.Wrap(normalizeError(err), "htfs.Open (pinning tail)"))
+		}
+		f.pinnedTail = tail
+		f.pinnedTailOffset = tailOffset
+	}
+
+	f.debug("pin: pinned", "head", len(f.pinnedHead), "tail", len(f.pinnedTail))
+	return nil
+}
+
+// readFull fills buf from offset, over the network
+func (f *File) readFull(buf []byte, offset int64) (int, error) {
+	n, err := f.readAtWith(f.ctx, buf, offset, false, PriorityNormal)
+	if err == io.EOF && n == len(buf) {
+		err = nil
+	}
+	return n, err
+}
+
+// readAtPinned is readAtCached, except the pinned head and tail
+// are served from memory, see pin
+func (f *File) readAtPinned(ctx context.Context, data []byte, offset int64, prio Priority) (int, error) {
+	if f.pinnedHead == nil && f.pinnedTail == nil {
+		return f.readAtCached(ctx, data, offset, prio)
+	}
+
+	headLen := int64(len(f.pinnedHead))
+	totalBytesRead := 0
+	for totalBytesRead < len(data) {
+		pos := offset + int64(totalBytesRead)
+		switch {
+		case pos < headLen:
+			totalBytesRead += copy(data[totalBytesRead:], f.pinnedHead[pos:])
+		case f.pinnedTail != nil && pos >= f.pinnedTailOffset:
+			i := pos - f.pinnedTailOffset
+			if i >= int64(len(f.pinnedTail)) {
+				return totalBytesRead, io.EOF
+			}
+			totalBytesRead += copy(data[totalBytesRead:], f.pinnedTail[i:])
+		default:
+			// in between, read up to the tail
+			end := len(data)
+			if f.pinnedTail != nil && offset+int64(end) > f.pinnedTailOffset {
+				end = int(f.pinnedTailOffset - offset)
+			}
+			n, err := f.readAtCached(ctx, data[totalBytesRead:end], pos, prio)
+			totalBytesRead += n
+			if err != nil {
+				return totalBytesRead, err
+			}
+		}
+	}
+	return totalBytesRead, nil
+}
@@ -0,0 +1,82 @@
+package htfs_test
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FilePin(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+	size := int64(len(fakeData))
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	settings := defaultSettings(t)
+	htfs.WithPin(64*1024, 128*1024).Apply(settings)
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	defer hf.Close()
+	numGET := ctx.numGET
+
+	readAt := func(offset int64, length int) {
+		t.Helper()
+		buf := make([]byte, length)
+		n, err := hf.ReadAt(buf, offset)
+		if offset+int64(length) > size {
+			assert.Equal(io.EOF, err)
+		} else {
+			assert.NoError(err)
+		}
+		assert.EqualValues(fakeData[offset:offset+int64(n)], buf[:n])
+	}
+
+	// going back and forth between both ends doesn't reconnect
+	for i := 0; i < 10; i++ {
+		readAt(size-22, 22)
+		readAt(0, 4)
+		readAt(size-100*1024, 4096)
+		readAt(60*1024, 4096)
+	}
+	readAt(size-1024, 2048)
+	assert.EqualValues(numGET, ctx.numGET, "should be served from memory")
+
+	// the middle is read as usual, up to the tail
+	readAt(size-256*1024, 256*1024)
+	readAt(32*1024, 512*1024)
+	assert.True(ctx.numGET > numGET)
+
+	// lazy Files pin on first read
+	ctx.numGET = 0
+	lf := htfs.OpenLazy(storageServerURL(storageServer), noRenewal, settings)
+	defer lf.Close()
+	assert.EqualValues(0, ctx.numGET)
+	buf := make([]byte, 16)
+	_, err = lf.ReadAt(buf, size-16)
+	assert.NoError(err)
+	assert.EqualValues(fakeData[size-16:], buf)
+	numGET = ctx.numGET
+	_, err = lf.ReadAt(buf, 0)
+	assert.NoError(err)
+	assert.EqualValues(fakeData[:16], buf)
+	assert.EqualValues(numGET, ctx.numGET)
+
+	// small files are pinned whole
+	small := []byte("a small file")
+	smallServer := fakeStorage(t, small, &fakeStorageContext{})
+	defer smallServer.Close()
+	sf, err := htfs.Open(storageServerURL(smallServer), noRenewal, settings)
+	assert.NoError(err)
+	defer sf.Close()
+	all, err := ioutil.ReadAll(io.NewSectionReader(sf, 0, int64(len(small))))
+	assert.NoError(err)
+	assert.EqualValues(small, all)
+}
@@ -0,0 +1,80 @@
+package htfs
+
+// A ReadPlanner decides how a File serves a read: from which of its idle
+// conns, skipping ahead or backtracking as needed, or from a new one.
+// The default, DefaultReadPlanner, suits most access patterns, but some
+// are better served otherwise: archive extraction may want to skip
+// further ahead than usual rather than reconnect, and video scrubbing
+// may want to reconnect rather than skip at all. See Settings.ReadPlanner.
+//
+// PlanRead is called with the File's conns lock held, so it must be
+// quick, and must not call back into the File.
+type ReadPlanner interface {
+	PlanRead(req ReadPlanRequest) ReadPlan
+}
+
+// ReadPlanRequest is what a ReadPlanner knows about a read
+type ReadPlanRequest struct {
+	// Offset is where the read starts
+	Offset int64
+	// MaxDiscard is how many bytes DefaultReadPlanner lets a conn skip to
+	// get to Offset, see Settings.MaxDiscard and FastConnectThreshold
+	MaxDiscard int64
+	// AllowBacktrack is false if Settings.ForbidBacktracking is set
+	AllowBacktrack bool
+	// Conns are the File's idle conns, stale ones left out
+	Conns []ConnInfo
+}
+
+// ReadPlan is a ReadPlanner's decision
+type ReadPlan struct {
+	// ConnID is the conn to serve the read from, or empty to open a new
+	// one. If it's behind Offset, the bytes in between are skipped,
+	// however many there are. If it's ahead of Offset, it backtracks, if
+	// backtracking is allowed and it has enough bytes cached, and it
+	// reconnects otherwise.
+	ConnID string
+	// Reconnect makes the conn reconnect at Offset rather than skip
+	// or backtrack, which saves opening a new one when the File has
+	// as many as it can, see Settings.MaxConns.
+	Reconnect bool
+}
+
+// DefaultReadPlanner picks the conn that's closest behind the offset,
+// if it's less than MaxDiscard bytes behind, or failing that, the conn
+// closest ahead of it that can backtrack to it, if allowed. Otherwise,
+// it opens a new conn.
+type DefaultReadPlanner struct{}
+
+var _ ReadPlanner = DefaultReadPlanner{}
+
+// PlanRead implements ReadPlanner
+func (DefaultReadPlanner) PlanRead(req ReadPlanRequest) ReadPlan {
+	var bestConn, bestBackConn string
+	var bestDiff, bestBackDiff int64
+
+	for _, c := range req.Conns {
+		diff := req.Offset - c.Offset
+		if diff >= 0 && diff < req.MaxDiscard {
+			if bestConn == "" || diff < bestDiff {
+				bestConn = c.ID
+				bestDiff = diff
+			}
+		}
+
+		if diff < 0 && -diff <= c.CachedBytes {
+			if bestBackConn == "" || -diff < bestBackDiff {
+				bestBackConn = c.ID
+				bestBackDiff = -diff
+			}
+		}
+	}
+
+	if bestConn != "" {
+		return ReadPlan{ConnID: bestConn}
+	}
+	if req.AllowBacktrack && bestBackConn != "" {
+		return ReadPlan{ConnID: bestBackConn}
+	}
+	return ReadPlan{}
+}
@@ -0,0 +1,95 @@
+package htfs_test
+
+import (
+	"testing"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DefaultReadPlanner(t *testing.T) {
+	assert := assert.New(t)
+	planner := htfs.DefaultReadPlanner{}
+
+	conns := []htfs.ConnInfo{
+		{ID: "a", Offset: 1000, CachedBytes: 500},
+		{ID: "b", Offset: 5000, CachedBytes: 500},
+	}
+	plan := func(offset int64, allowBacktrack bool) htfs.ReadPlan {
+		return planner.PlanRead(htfs.ReadPlanRequest{
+			Offset:         offset,
+			MaxDiscard:     2000,
+			AllowBacktrack: allowBacktrack,
+			Conns:          conns,
+		})
+	}
+
+	assert.EqualValues(htfs.ReadPlan{ConnID: "a"}, plan(1000, true))
+	assert.EqualValues(htfs.ReadPlan{ConnID: "a"}, plan(2500, true), "skips ahead")
+	assert.EqualValues(htfs.ReadPlan{ConnID: "b"}, plan(5500, true), "closest behind")
+	assert.EqualValues(htfs.ReadPlan{ConnID: "b"}, plan(4800, true), "backtracks")
+	assert.EqualValues(htfs.ReadPlan{}, plan(4800, false), "backtracking isn't allowed")
+	assert.EqualValues(htfs.ReadPlan{}, plan(3500, true), "too far from both")
+	assert.EqualValues(htfs.ReadPlan{}, plan(100, true), "too far back")
+}
+
+// scrubbingPlanner never skips ahead: it reconnects its only conn
+type scrubbingPlanner struct {
+	plans int
+}
+
+func (sp *scrubbingPlanner) PlanRead(req htfs.ReadPlanRequest) htfs.ReadPlan {
+	sp.plans++
+	for _, c := range req.Conns {
+		if c.Offset == req.Offset {
+			return htfs.ReadPlan{ConnID: c.ID}
+		}
+	}
+	if len(req.Conns) > 0 {
+		return htfs.ReadPlan{ConnID: req.Conns[0].ID, Reconnect: true}
+	}
+	return htfs.ReadPlan{}
+}
+
+func Test_FileReadPlanner(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	planner := &scrubbingPlanner{}
+	settings := defaultSettings(t)
+	htfs.WithReadPlanner(planner).Apply(settings)
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	defer hf.Close()
+
+	buf := make([]byte, 16)
+	readAt := func(offset int64) {
+		t.Helper()
+		_, err := hf.ReadAt(buf, offset)
+		assert.NoError(err)
+		assert.EqualValues(fakeData[offset:offset+16], buf)
+	}
+
+	readAt(0)
+	numGET := ctx.numGET
+
+	// reading right where the conn is at reuses it
+	readAt(16)
+	assert.EqualValues(numGET, ctx.numGET)
+
+	// anywhere else, it's reconnected rather than skipped ahead,
+	// or backtracked, and no other conn is opened
+	for _, offset := range []int64{64, 1024, 8, 2 * 1024 * 1024} {
+		readAt(offset)
+		numGET++
+		assert.EqualValues(numGET, ctx.numGET)
+		assert.EqualValues(1, hf.NumConns())
+	}
+	assert.True(planner.plans >= 5)
+}
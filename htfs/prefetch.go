@@ -0,0 +1,82 @@
+package htfs
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Prefetch hints that [offset, offset+length) is about to be read. A conn is
+// warmed up at offset in the background, and up to MaxBacktrack bytes are read
+// into its backtracking cache, so that the next ReadAt in that range doesn't
+// pay for a round-trip. If backtracking is forbidden, the conn is only warmed up.
+//
+// With a Limiter, reading ahead only uses bytes it can get without waiting
+// (see httpkit.TryLimiter), and stops when there are none to spare, so that
+// it never delays other reads. If the Limiter can't TryTake, the conn is
+// only warmed up.
+//
+// The returned channel receives the prefetch's outcome, but callers
+// are free to ignore it: errors are also logged.
+func (f *File) Prefetch(offset int64, length int64) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		err := f.prefetch(offset, length)
+		if err != nil {
+			f.warn("prefetch: failed", "offset", offset, "length", length, "err", err)
+		}
+		done <- f.labelError(err)
+		close(done)
+	}()
+	return done
+}
+
+func (f *File) prefetch(offset int64, length int64) error {
+	if err := f.opened(); err != nil {
+		return err
+	}
+
+	if f.spillFile != nil {
+		// everything is local already
+		return nil
+	}
+
+	c, err := f.borrowConn(f.ctx, offset, PriorityBulk)
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	defer f.returnConn(c)
+
+	if f.ForbidBacktracking {
+		return nil
+	}
+
+	if length > f.MaxBacktrack {
+		length = f.MaxBacktrack
+	}
+	if f.knownSize() && offset+length > f.size {
+		length = f.size - offset
+	}
+	if length <= 0 {
+		return nil
+	}
+
+	f.debug("prefetch: reading ahead", "offset", offset, "length", length, "conn", c.id)
+	// only use bandwidth foreground reads leave unused
+	c.recorder.spareOnly = true
+	defer func() {
+		c.recorder.spareOnly = false
+	}()
+	err = c.DiscardContext(f.ctx, length)
+	if err != nil {
+		if errors.Cause(err) == errNoSpareBandwidth {
+			f.debug("prefetch: no spare bandwidth, stopping", "offset", c.Offset(), "conn", c.id)
+			return nil
+		}
+		return errors.Wrapf(err, "in File.Prefetch")
+	}
+	return nil
+}
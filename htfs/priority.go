@@ -0,0 +1,38 @@
+package htfs
+
+import (
+	"context"
+)
+
+// Priority orders reads that are waiting for a connection, when a File
+// has as many as it may open (see Settings.MaxConns and HostScheduler):
+// as long as a read is waiting, reads of a lower priority wait behind it.
+type Priority int
+
+const (
+	// PriorityBulk is for reads nobody is waiting on yet, like
+	// Prefetch, Download and WriteTo
+	PriorityBulk Priority = -1
+	// PriorityNormal is the priority of ReadAt and Read
+	PriorityNormal Priority = 0
+	// PriorityInteractive is for reads a user is waiting on, like
+	// thumbnails or lookups in an archive's directory
+	PriorityInteractive Priority = 1
+)
+
+// ReadAtWithPriority is ReadAt, except that if all connections are busy,
+// it gets the next one before reads of a lower priority.
+func (f *File) ReadAtWithPriority(buf []byte, offset int64, prio Priority) (int, error) {
+	return f.readAtContext(context.Background(), buf, offset, prio)
+}
+
+// outranked returns true if a read of a higher priority than prio is
+// waiting for a connection. It must be called with connsLock held.
+func (f *File) outranked(prio Priority) bool {
+	for p, n := range f.waiting {
+		if p > prio && n > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package htfs_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileReadPriority(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbccccdddd")
+
+	var rangesLock sync.Mutex
+	var ranges []string
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	storageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		byteRange := r.Header.Get("Range")
+		rangesLock.Lock()
+		ranges = append(ranges, byteRange)
+		rangesLock.Unlock()
+		if byteRange == "bytes=4-" {
+			close(blocked)
+			<-release
+		}
+		http.ServeContent(w, r, "file.dat", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer storageServer.Close()
+
+	logger := &recordingLogger{minLevel: httpkit.LevelDebug}
+	settings := defaultSettings(t)
+	settings.Logger = logger
+	settings.MaxConns = 1
+	settings.MaxDiscard = -1
+	settings.ForbidBacktracking = true
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+
+	waitingFor := func(prio htfs.Priority) {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			logger.mu.Lock()
+			for _, l := range logger.logs {
+				if l.msg == "borrow: all conns busy, waiting" && l.keyvals[len(l.keyvals)-1] == prio {
+					logger.mu.Unlock()
+					return
+				}
+			}
+			logger.mu.Unlock()
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("read of priority %d never waited for a conn", prio)
+	}
+
+	read := func(offset int64, prio htfs.Priority) chan error {
+		done := make(chan error, 1)
+		go func() {
+			buf := make([]byte, 4)
+			_, err := hf.ReadAtWithPriority(buf, offset, prio)
+			if err == nil && !bytes.Equal(buf, fakeData[offset:offset+4]) {
+				t.Errorf("wrong data at %d: %q", offset, buf)
+			}
+			done <- err
+		}()
+		return done
+	}
+
+	// hog the only conn
+	first := read(4, htfs.PriorityNormal)
+	<-blocked
+
+	bulk := read(8, htfs.PriorityBulk)
+	waitingFor(htfs.PriorityBulk)
+	interactive := read(12, htfs.PriorityInteractive)
+	waitingFor(htfs.PriorityInteractive)
+
+	close(release)
+	assert.NoError(<-first)
+	assert.NoError(<-interactive)
+	assert.NoError(<-bulk)
+
+	// the bulk read could have re-used the first read's conn,
+	// but the interactive one went first
+	assert.EqualValues([]string{"bytes=0-", "bytes=4-", "bytes=12-", "bytes=8-"}, ranges)
+
+	assert.NoError(hf.Close())
+}
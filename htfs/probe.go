@@ -0,0 +1,193 @@
+package htfs
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A SizeProbe is how Open finds out the remote file's size,
+// see Settings.SizeProbe. The zero value is SizeProbeRange.
+type SizeProbe struct {
+	kind sizeProbeKind
+	size int64
+}
+
+type sizeProbeKind int
+
+const (
+	sizeProbeRange sizeProbeKind = iota
+	sizeProbeHead
+	sizeProbeKnown
+)
+
+var (
+	// SizeProbeRange makes Open do a GET request with a Range header,
+	// whose connection is then used for the first reads. It's the default.
+	SizeProbeRange = SizeProbe{kind: sizeProbeRange}
+
+	// SizeProbeHead makes Open do a HEAD request instead, for endpoints
+	// that bill per GET. The first read makes a new request. SpillNoRange
+	// doesn't apply, since a HEAD request doesn't tell if ranges work.
+	// Responses to HEAD requests have no body, so NeedsRenewalFunc is
+	// passed a nil one.
+	SizeProbeHead = SizeProbe{kind: sizeProbeHead}
+)
+
+// KnownSize makes Open skip the probe, for callers that already know
+// the file's size, so that no request is made until the first read.
+// The file's name comes from its URL, and since there's no ETag or
+// Last-Modified to compare against, a replaced file is only noticed if
+// its size changed. InitialResponse returns nil.
+func KnownSize(size int64) SizeProbe {
+	return SizeProbe{kind: sizeProbeKnown, size: size}
+}
+
+// probeWithHead sets the File's size, name and validators
+// from a HEAD request
+func (f *File) probeWithHead() error {
+	retryCtx := f.newRetryContext()
+	renewalTries := 0
+	failovers := 0
+
+	urlStr, generation := f.getURLState()
+	for retryCtx.ShouldTry() {
+		res, err := f.tryHead(urlStr)
+		if err != nil {
+			if _, ok := err.(*needsRenewalError); ok {
+				if renewalTries >= f.MaxRenewalsPerWindow {
+					return errors.Wrapf(ErrTooManyRenewals, "in File.probeWithHead, %d renewals in a row", renewalTries)
+				}
+				renewalTries++
+				f.info("probe: renewing", "err", err)
+
+				urlStr, generation, err = f.renewURL(generation)
+				if err != nil {
+					if f.shouldRetry(err) {
+						retryCtx.Retry(err)
+						continue
+					}
+					return errors.Wrapf(err, "in File.probeWithHead, while renewing URL")
+				}
+				continue
+			} else if isMirrorError(err) && failovers+1 < f.numMirrors() {
+				failovers++
+				urlStr = f.nextMirror()
+				f.info("probe: trying next mirror", "mirror", urlHost(urlStr), "err", err)
+				continue
+			} else if f.shouldRetry(err) {
+				f.info("probe: retrying", "err", err)
+				retryCtx.Retry(err)
+				continue
+			}
+			return errors.Wrapf(err, "in File.probeWithHead, non-retriable error")
+		}
+
+		if res.ContentLength < 0 {
+			return errors.Errorf("in File.probeWithHead, server didn't send a Content-Length")
+		}
+		f.initialResponse = &InitialResponse{
+			StatusCode: res.StatusCode,
+			Header:     cloneHeader(res.Header),
+			URL:        res.Request.URL,
+			Proto:      res.Proto,
+			ProtoMajor: res.ProtoMajor,
+			ProtoMinor: res.ProtoMinor,
+			TLS:        newTLSState(res.TLS),
+		}
+		f.etag = strongETag(res.Header)
+		f.lastModified = res.Header.Get("last-modified")
+		f.originHost = urlHost(urlStr)
+		f.size = res.ContentLength
+		f.setName(res.Request.URL, res.Header)
+		return nil
+	}
+	return errors.Wrapf(retryCtx.LastError, "in File.probeWithHead, exhausted retry context")
+}
+
+func (f *File) tryHead(urlStr string) (*http.Response, error) {
+	req, err := http.NewRequest("HEAD", urlStr, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "in File.tryHead, while creating new HEAD request")
+	}
+	req = req.WithContext(f.ctx)
+	if f.AcceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", f.AcceptEncoding)
+	}
+	err = f.prepareRequest(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "in File.tryHead, while preparing HEAD request")
+	}
+
+	f.pace(req)
+	req = f.traceTLS(req)
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "in File.tryHead, while doing HEAD request")
+	}
+	res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		if f.needsRenewal(res, nil) {
+			return nil, &needsRenewalError{url: urlStr}
+		}
+		se := &ServerError{
+			Host:       req.Host,
+			Message:    fmt.Sprintf("HTTP %d", res.StatusCode),
+			StatusCode: res.StatusCode,
+			RetryAfter: parseRetryAfter(res, f.clock.Now()),
+		}
+		return nil, errors.Wrapf(se, "in File.tryHead, got HTTP non-2XX")
+	}
+	return res, nil
+}
+
+// skipProbe sets what we can know about the File without a request
+func (f *File) skipProbe(size int64) {
+	urlStr := f.getCurrentURL()
+	f.size = size
+	f.originHost = urlHost(urlStr)
+	if u, err := url.Parse(urlStr); err == nil {
+		f.setName(u, nil)
+	}
+}
+
+// setName uses the last path element of requestURL, which should be
+// the URL after redirects (for hosts like sourceforge), unless header
+// has a Content-Disposition with a filename.
+func (f *File) setName(requestURL *url.URL, header http.Header) {
+	pathTokens := strings.Split(requestURL.Path, "/")
+	f.name = pathTokens[len(pathTokens)-1]
+
+	dispHeader := header.Get("content-disposition")
+	if dispHeader != "" {
+		filename, err := contentDispositionFilename(dispHeader)
+		if err == nil && filename != "" {
+			f.name = filename
+		}
+	}
+}
+
+// contentDispositionFilename returns the filename parameter of a
+// Content-Disposition header, or "" if it has none. Servers don't get
+// to pick directories: only the last path element is kept, and names
+// like ".." are rejected. Malformed values get a *HeaderError.
+func contentDispositionFilename(value string) (string, error) {
+	_, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return "", errors.WithStack(&HeaderError{Header: "Content-Disposition", Value: value, Reason: err.Error()})
+	}
+
+	filename := params["filename"]
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+	if filename == "." || filename == ".." {
+		return "", errors.WithStack(&HeaderError{Header: "Content-Disposition", Value: value, Reason: "invalid filename"})
+	}
+	return filename, nil
+}
@@ -0,0 +1,58 @@
+package htfs_test
+
+import (
+	"testing"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileSizeProbe(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	readSome := func(hf *htfs.File) {
+		stat, err := hf.Stat()
+		assert.NoError(err)
+		assert.EqualValues(len(fakeData), stat.Size())
+
+		b := make([]byte, 4)
+		_, err = hf.ReadAt(b, 1024*1024)
+		assert.NoError(err)
+		assert.EqualValues(fakeData[1024*1024:1024*1024+4], b)
+		assert.NoError(hf.Close())
+	}
+
+	settings := defaultSettings(t)
+	settings.SizeProbe = htfs.SizeProbeHead
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	assert.EqualValues(1, ctx.numHEAD)
+	assert.EqualValues(0, ctx.numGET)
+	assert.EqualValues(200, hf.InitialResponse().StatusCode)
+	readSome(hf)
+	assert.EqualValues(1, ctx.numGET)
+
+	ctx.numHEAD = 0
+	ctx.numGET = 0
+	settings.SizeProbe = htfs.KnownSize(int64(len(fakeData)))
+	hf, err = htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	assert.EqualValues(0, ctx.numHEAD)
+	assert.EqualValues(0, ctx.numGET)
+	assert.Nil(hf.InitialResponse())
+	readSome(hf)
+	assert.EqualValues(1, ctx.numGET)
+
+	ctx.simulateNotFound = true
+	settings.SizeProbe = htfs.SizeProbeHead
+	_, err = htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.Error(err)
+	assert.True(errors.Cause(err) == htfs.ErrNotFound)
+}
@@ -0,0 +1,189 @@
+package htfs
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// A Registry lets components of a process that open the same resource
+// at the same time, like a build being both verified and patched, share
+// one File rather than each sizing it and keeping connections of their
+// own. Resources are identified by a key the caller picks, like a build
+// ID: concurrent opens of the same key wait for the first one, and get a
+// handle on its File. The File is closed along with the last handle.
+// It's safe for concurrent use.
+type Registry struct {
+	mu      sync.Mutex
+	entries map[string]*registryEntry
+}
+
+// registryEntry is a File being opened, or opened, and its handles
+type registryEntry struct {
+	ready chan struct{}
+	file  *File
+	err   error
+	refs  int
+}
+
+// An OpenFunc opens the File for a key of a Registry, for example
+// by calling OpenMirrors or OpenWithExpiry
+type OpenFunc func() (*File, error)
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		entries: make(map[string]*registryEntry),
+	}
+}
+
+// Open returns a handle on the File for key, opening it with getURL,
+// needsRenewal and settings unless it's already open. See OpenWith.
+func (r *Registry) Open(key string, getURL GetURLFunc, needsRenewal NeedsRenewalFunc, settings *Settings) (*SharedFile, error) {
+	return r.OpenWith(key, func() (*File, error) {
+		return Open(getURL, needsRenewal, settings)
+	})
+}
+
+// OpenWith returns a handle on the File for key, calling open unless
+// it's already open, or being opened. If that fails, everyone waiting
+// on it gets the error, and the next call tries again.
+func (r *Registry) OpenWith(key string, open OpenFunc) (*SharedFile, error) {
+	r.mu.Lock()
+	entry, ok := r.entries[key]
+	if ok {
+		entry.refs++
+		r.mu.Unlock()
+		<-entry.ready
+	} else {
+		entry = &registryEntry{ready: make(chan struct{}), refs: 1}
+		r.entries[key] = entry
+		r.mu.Unlock()
+
+		entry.file, entry.err = open()
+		if entry.err != nil {
+			r.mu.Lock()
+			delete(r.entries, key)
+			r.mu.Unlock()
+		}
+		close(entry.ready)
+	}
+
+	if entry.err != nil {
+		return nil, entry.err
+	}
+	return &SharedFile{registry: r, key: key, entry: entry}, nil
+}
+
+// NumFiles returns how many Files are open, or being opened
+func (r *Registry) NumFiles() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.entries)
+}
+
+// release drops a handle on entry, and returns true if it was the last one
+func (r *Registry) release(key string, entry *registryEntry) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry.refs--
+	if entry.refs > 0 {
+		return false
+	}
+	if r.entries[key] == entry {
+		delete(r.entries, key)
+	}
+	return true
+}
+
+// A SharedFile is a handle on a File from a Registry. It has its own
+// offset for Read and Seek, and closing it only closes the File if
+// it's the last handle.
+type SharedFile struct {
+	registry *Registry
+	key      string
+	entry    *registryEntry
+
+	mu     sync.Mutex
+	offset int64
+	closed bool
+}
+
+var _ io.ReadSeeker = (*SharedFile)(nil)
+var _ io.ReaderAt = (*SharedFile)(nil)
+var _ io.Closer = (*SharedFile)(nil)
+
+// File returns the shared File, for everything else it does. Closing
+// it directly closes it for all handles, use SharedFile.Close instead.
+func (sf *SharedFile) File() *File {
+	return sf.entry.file
+}
+
+// ReadAt reads from the shared File, see File.ReadAt
+func (sf *SharedFile) ReadAt(buf []byte, offset int64) (int, error) {
+	return sf.entry.file.ReadAt(buf, offset)
+}
+
+// Read reads from the handle's offset, and advances it
+func (sf *SharedFile) Read(buf []byte) (int, error) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	n, err := sf.entry.file.ReadAt(buf, sf.offset)
+	sf.offset += int64(n)
+	return n, err
+}
+
+// Seek sets the handle's offset, it doesn't affect other handles
+func (sf *SharedFile) Seek(offset int64, whence int) (int64, error) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = sf.offset + offset
+	case io.SeekEnd:
+		stat, err := sf.entry.file.Stat()
+		if err != nil {
+			return sf.offset, err
+		}
+		newOffset = stat.Size() + offset
+	default:
+		return sf.offset, errors.Errorf("invalid whence value %d", whence)
+	}
+
+	if newOffset < 0 {
+		return sf.offset, errors.Errorf("tried to seek to negative offset %d", newOffset)
+	}
+	sf.offset = newOffset
+	return newOffset, nil
+}
+
+// Stat returns the shared File's info, see File.Stat
+func (sf *SharedFile) Stat() (os.FileInfo, error) {
+	return sf.entry.file.Stat()
+}
+
+// Close releases the handle, and closes the File if no other handle
+// is open. Closing a handle twice does nothing.
+func (sf *SharedFile) Close() error {
+	sf.mu.Lock()
+	if sf.closed {
+		sf.mu.Unlock()
+		return nil
+	}
+	sf.closed = true
+	sf.mu.Unlock()
+
+	if !sf.registry.release(sf.key, sf.entry) {
+		return nil
+	}
+	return sf.entry.file.Close()
+}
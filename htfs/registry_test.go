@@ -0,0 +1,97 @@
+package htfs_test
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Registry(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	storageServer := fakeStorage(t, fakeData, &fakeStorageContext{})
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	r := htfs.NewRegistry()
+
+	var numOpens int64
+	release := make(chan struct{})
+	open := func() (*htfs.File, error) {
+		atomic.AddInt64(&numOpens, 1)
+		<-release
+		return htfs.Open(storageServerURL(storageServer), noRenewal, defaultSettings(t))
+	}
+
+	// concurrent opens of the same key share one File
+	const numHandles = 8
+	handles := make([]*htfs.SharedFile, numHandles)
+	var wg sync.WaitGroup
+	for i := range handles {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sf, err := r.OpenWith("build-1234", open)
+			assert.NoError(err)
+			handles[i] = sf
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.EqualValues(1, numOpens)
+	assert.EqualValues(1, r.NumFiles())
+	for _, sf := range handles {
+		assert.True(sf.File() == handles[0].File())
+	}
+
+	// each handle has its own offset
+	_, err := handles[0].Seek(1024, io.SeekStart)
+	assert.NoError(err)
+	buf := make([]byte, 16)
+	_, err = io.ReadFull(handles[0], buf)
+	assert.NoError(err)
+	assert.EqualValues(fakeData[1024:1040], buf)
+	_, err = io.ReadFull(handles[1], buf)
+	assert.NoError(err)
+	assert.EqualValues(fakeData[:16], buf)
+
+	// the File stays open until the last handle is closed
+	for _, sf := range handles[1:] {
+		assert.NoError(sf.Close())
+		assert.NoError(sf.Close())
+	}
+	assert.EqualValues(1, r.NumFiles())
+	all, err := ioutil.ReadAll(handles[0])
+	assert.NoError(err)
+	assert.EqualValues(fakeData[1040:], all)
+
+	assert.NoError(handles[0].Close())
+	assert.EqualValues(0, r.NumFiles())
+	_, err = handles[0].File().ReadAt(buf, 0)
+	assert.Error(err)
+
+	// later opens get a new File
+	sf, err := r.Open("build-1234", storageServerURL(storageServer), noRenewal, defaultSettings(t))
+	assert.NoError(err)
+	assert.EqualValues(1, numOpens)
+	assert.False(sf.File() == handles[0].File())
+	assert.NoError(sf.Close())
+
+	// failed opens aren't kept
+	errNoBuild := errors.New("no such build")
+	_, err = r.OpenWith("build-5678", func() (*htfs.File, error) {
+		return nil, errNoBuild
+	})
+	assert.Equal(errNoBuild, err)
+	assert.EqualValues(0, r.NumFiles())
+}
@@ -0,0 +1,56 @@
+package htfs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// defaultResponseIDHeaders are recorded in ConnInfo.ResponseIDs if
+// Settings.ResponseIDHeaders isn't set. They're what common CDNs and
+// object stores identify requests with, in their logs.
+var defaultResponseIDHeaders = []string{
+	"X-GUploader-UploadID",
+	"X-Amz-Request-Id",
+	"X-Amz-Id-2",
+	"X-Amz-Cf-Id",
+	"CF-Ray",
+	"X-Served-By",
+	"X-Request-Id",
+}
+
+// newRequestID returns a random ID for a File's requests,
+// see Settings.RequestIDHeader
+func newRequestID() string {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		// unique within the process is still better than nothing
+		return fmt.Sprintf("htfs-%d", generateID())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// RequestID returns the ID sent with every request of the File, or an
+// empty string if Settings.RequestIDHeader isn't set
+func (f *File) RequestID() string {
+	return f.requestID
+}
+
+// responseIDs returns the values of ResponseIDHeaders in header,
+// or nil if there are none
+func (f *File) responseIDs(header http.Header) map[string]string {
+	var ids map[string]string
+	for _, name := range f.ResponseIDHeaders {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		if ids == nil {
+			ids = make(map[string]string)
+		}
+		ids[name] = value
+	}
+	return ids
+}
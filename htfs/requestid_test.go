@@ -0,0 +1,98 @@
+package htfs_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileRequestIDs(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.Header.Get("X-Request-Id")]++
+		mu.Unlock()
+
+		w.Header().Set("X-GUploader-UploadID", "upload-"+r.Method)
+		if r.URL.Path == "/forbidden" {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		http.ServeContent(w, r, "file.dat", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+	defer server.CloseClientConnections()
+	getURL := func(path string) htfs.GetURLFunc {
+		return func() (string, error) { return server.URL + path, nil }
+	}
+
+	open := func(options ...htfs.Option) *htfs.File {
+		t.Helper()
+		settings := defaultSettings(t)
+		for _, o := range options {
+			o.Apply(settings)
+		}
+		hf, err := htfs.Open(getURL("/file.dat"), noRenewal, settings)
+		assert.NoError(err)
+		_, err = hf.ReadAt(make([]byte, 16), 1024)
+		assert.NoError(err)
+		return hf
+	}
+
+	hf1 := open(htfs.WithRequestID("X-Request-Id", ""))
+	defer hf1.Close()
+	hf2 := open(htfs.WithRequestID("X-Request-Id", ""))
+	defer hf2.Close()
+	hf3 := open(htfs.WithRequestID("X-Request-Id", "support-ticket-1234"))
+	defer hf3.Close()
+	hf4 := open()
+	defer hf4.Close()
+
+	// every request of a File has its ID, and IDs differ between Files
+	assert.NotEmpty(hf1.RequestID())
+	assert.NotEqual(hf1.RequestID(), hf2.RequestID())
+	assert.EqualValues("support-ticket-1234", hf3.RequestID())
+	assert.Empty(hf4.RequestID())
+	mu.Lock()
+	assert.Len(seen, 4)
+	for _, hf := range []*htfs.File{hf1, hf2, hf3, hf4} {
+		assert.True(seen[hf.RequestID()] > 0)
+	}
+	mu.Unlock()
+
+	// response IDs are recorded
+	conns := hf1.DescribeConns()
+	assert.NotEmpty(conns)
+	for _, c := range conns {
+		assert.EqualValues(map[string]string{"X-GUploader-UploadID": "upload-GET"}, c.ResponseIDs)
+	}
+
+	// or not, if asked
+	hf5 := open(htfs.WithResponseIDHeaders())
+	defer hf5.Close()
+	for _, c := range hf5.DescribeConns() {
+		assert.Empty(c.ResponseIDs)
+	}
+
+	// and they're part of server errors
+	_, err := htfs.Open(getURL("/forbidden"), noRenewal, defaultSettings(t))
+	assert.Error(err)
+	se, ok := errors.Cause(err).(*htfs.ServerError)
+	assert.True(ok, "should be a ServerError")
+	if ok {
+		assert.EqualValues(403, se.StatusCode)
+		assert.EqualValues("upload-GET", se.ResponseIDs["X-GUploader-UploadID"])
+		assert.Contains(se.Error(), "X-GUploader-UploadID=upload-GET")
+	}
+}
@@ -0,0 +1,81 @@
+package htfs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/url"
+)
+
+// InitialResponse describes how the server responded to the
+// first request File made, in Open.
+type InitialResponse struct {
+	// StatusCode is 200 or 206
+	StatusCode int
+	// Header may contain checksums, see File.Checksums
+	Header http.Header
+	// URL is the first good URL File made a request to, ie. after redirects
+	URL *url.URL
+	// Proto is "HTTP/1.1" or "HTTP/2.0"
+	Proto      string
+	ProtoMajor int
+	ProtoMinor int
+	// TLS is nil for plain HTTP
+	TLS *TLSState
+}
+
+// TLSState is a snapshot of the parts of tls.ConnectionState
+// that are useful for diagnostics.
+type TLSState struct {
+	Version            uint16
+	CipherSuite        uint16
+	NegotiatedProtocol string
+	ServerName         string
+	DidResume          bool
+	PeerCertificates   []*x509.Certificate
+}
+
+func newTLSState(cs *tls.ConnectionState) *TLSState {
+	if cs == nil {
+		return nil
+	}
+	return &TLSState{
+		Version:            cs.Version,
+		CipherSuite:        cs.CipherSuite,
+		NegotiatedProtocol: cs.NegotiatedProtocol,
+		ServerName:         cs.ServerName,
+		DidResume:          cs.DidResume,
+		PeerCertificates:   append([]*x509.Certificate(nil), cs.PeerCertificates...),
+	}
+}
+
+// cloneHeader returns a deep copy of h, like http.Header.Clone,
+// which needs Go 1.13
+func cloneHeader(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+	res := make(http.Header, len(h))
+	for k, v := range h {
+		res[k] = append([]string(nil), v...)
+	}
+	return res
+}
+
+func newInitialResponse(c *conn) *InitialResponse {
+	return &InitialResponse{
+		StatusCode: c.statusCode,
+		Header:     cloneHeader(c.header),
+		URL:        c.requestURL,
+		Proto:      c.proto,
+		ProtoMajor: c.protoMajor,
+		ProtoMinor: c.protoMinor,
+		TLS:        newTLSState(c.tls),
+	}
+}
+
+// InitialResponse returns a snapshot of the server's response to
+// our initial request, for diagnostics and content negotiation.
+func (f *File) InitialResponse() *InitialResponse {
+	return f.initialResponse
+}
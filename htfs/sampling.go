@@ -0,0 +1,118 @@
+package htfs
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// A RequestTrace is a detailed record of one (sampled) attempt at getting
+// a response for a range: every request it took, with timings, headers,
+// and what was done about failures. See Settings.TraceSink.
+type RequestTrace struct {
+	// Labels are those of the File
+	Labels Labels
+	// ConnID identifies the conn in log messages
+	ConnID string
+	// Offset is where the range starts
+	Offset int64
+	Start  time.Time
+	// Duration includes renewals and retry backoffs
+	Duration time.Duration
+	// RenewDuration is how long was spent waiting for new URLs
+	RenewDuration time.Duration
+	// Attempts has one entry per request, in order
+	Attempts []*AttemptTrace
+	// Err is the final outcome, nil if we got a response
+	Err error
+}
+
+// An AttemptTrace is a single request of a RequestTrace. Header values
+// that may hold credentials are redacted, and so are query strings.
+type AttemptTrace struct {
+	// URL is redacted, see File.SupportBundle
+	URL   string
+	Start time.Time
+	// Duration is until the response headers arrived, or the request failed
+	Duration       time.Duration
+	RequestHeader  http.Header
+	StatusCode     int
+	Proto          string
+	ResponseHeader http.Header
+	Err            error
+	// Next is what was done after a failure: "renew", "failover"
+	// or "retry", empty if that was the last attempt
+	Next string
+}
+
+// A TraceSink receives sampled RequestTraces. It's called from the
+// goroutine that made the requests, so it should hand them off quickly.
+type TraceSink func(trace *RequestTrace)
+
+// sampleRequest returns a new RequestTrace if this one is to be sampled,
+// see Settings.TraceSampleRate
+func (f *File) sampleRequest(connID string, offset int64) *RequestTrace {
+	if f.TraceSink == nil || f.TraceSampleRate <= 0 {
+		return nil
+	}
+	if f.TraceSampleRate < 1 && rand.Float64() >= f.TraceSampleRate {
+		return nil
+	}
+	return &RequestTrace{
+		Labels: f.labels,
+		ConnID: connID,
+		Offset: offset,
+		Start:  f.clock.Now(),
+	}
+}
+
+// startAttempt records a new request, rt may be nil
+func (rt *RequestTrace) startAttempt(f *File, req *http.Request) *AttemptTrace {
+	if rt == nil {
+		return nil
+	}
+	at := &AttemptTrace{
+		URL:           redactURL(req.URL.String()),
+		Start:         f.clock.Now(),
+		RequestHeader: redactedHeader(req.Header),
+	}
+	rt.Attempts = append(rt.Attempts, at)
+	return at
+}
+
+// done records the response or error of a request, at may be nil
+func (at *AttemptTrace) done(f *File, res *http.Response, err error) {
+	if at == nil {
+		return
+	}
+	at.Duration = f.clock.Now().Sub(at.Start)
+	at.Err = err
+	if res != nil {
+		at.StatusCode = res.StatusCode
+		at.Proto = res.Proto
+		at.ResponseHeader = redactedHeader(res.Header)
+	}
+}
+
+// next records what's done about the last attempt's failure, rt may be nil
+func (rt *RequestTrace) next(action string, err error) {
+	if rt == nil || len(rt.Attempts) == 0 {
+		return
+	}
+	at := rt.Attempts[len(rt.Attempts)-1]
+	at.Next = action
+	if at.Err == nil {
+		// the request went through, but its response didn't do
+		at.Err = err
+	}
+}
+
+// finishSample sends rt to the sink, rt may be nil
+func (f *File) finishSample(rt *RequestTrace, err error) {
+	if rt == nil {
+		return
+	}
+	rt.Duration = f.clock.Now().Sub(rt.Start)
+	rt.Err = err
+	f.TraceSink(rt)
+}
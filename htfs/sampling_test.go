@@ -0,0 +1,72 @@
+package htfs_test
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileTraceSampling(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbcccc")
+
+	storageServer := fakeStorage(t, fakeData, &fakeStorageContext{
+		disruption: &storageDisruption{
+			streak: 2,
+			handler: func(w http.ResponseWriter) {
+				http.Error(w, "Service Unavailable", 503)
+			},
+		},
+	})
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	var mu sync.Mutex
+	var traces []*htfs.RequestTrace
+	sink := func(trace *htfs.RequestTrace) {
+		mu.Lock()
+		defer mu.Unlock()
+		traces = append(traces, trace)
+	}
+
+	settings := defaultSettings(t)
+	settings.RequestHeaders = http.Header{"Authorization": []string{"Bearer s3cr3t"}}
+	settings.TraceSink = sink
+	settings.TraceSampleRate = 1
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	assert.NoError(hf.Close())
+
+	mu.Lock()
+	assert.EqualValues(1, len(traces))
+	trace := traces[0]
+	mu.Unlock()
+
+	assert.NoError(trace.Err)
+	assert.EqualValues(0, trace.Offset)
+	assert.EqualValues(3, len(trace.Attempts))
+	for i, at := range trace.Attempts {
+		assert.EqualValues("bytes=0-", at.RequestHeader.Get("Range"))
+		assert.EqualValues("REDACTED", at.RequestHeader.Get("Authorization"))
+		if i < 2 {
+			assert.EqualValues(503, at.StatusCode)
+			assert.EqualValues("retry", at.Next)
+			assert.Error(at.Err)
+		} else {
+			assert.EqualValues(206, at.StatusCode)
+			assert.EqualValues("", at.Next)
+			assert.NoError(at.Err)
+		}
+	}
+
+	// not sampled
+	traces = nil
+	settings.TraceSampleRate = 0
+	hf, err = htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	assert.NoError(hf.Close())
+	assert.EqualValues(0, len(traces))
+}
@@ -0,0 +1,221 @@
+package htfs
+
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const defaultMaxConnsPerHost = 8
+
+// A HostScheduler caps the number of connections several Files (see
+// Settings.HostScheduler) keep open to the same host, and balances them:
+// when the cap is reached, the next slot goes to the most urgent read
+// (see Priority), then to the waiting File that holds the fewest, and
+// Files holding more than others give up idle connections. That way, one huge download (even with parallel segments,
+// see File.Download) doesn't starve small reads from sibling Files.
+// It's safe for concurrent use.
+type HostScheduler struct {
+	maxConnsPerHost int
+
+	mu    sync.Mutex
+	hosts map[string]*hostState
+}
+
+type hostState struct {
+	inUse   int
+	holders map[*File]int
+	waiters []*hostWaiter
+}
+
+type hostWaiter struct {
+	file  *File
+	prio  Priority
+	ready chan struct{}
+}
+
+// NewHostScheduler returns a scheduler that allows up to maxConnsPerHost
+// connections per host. Zero or negative values mean 8.
+func NewHostScheduler(maxConnsPerHost int) *HostScheduler {
+	if maxConnsPerHost <= 0 {
+		maxConnsPerHost = defaultMaxConnsPerHost
+	}
+	return &HostScheduler{
+		maxConnsPerHost: maxConnsPerHost,
+		hosts:           make(map[string]*hostState),
+	}
+}
+
+// NumConns returns the number of connections currently open to host
+func (hs *HostScheduler) NumConns(host string) int {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	if h, ok := hs.hosts[host]; ok {
+		return h.inUse
+	}
+	return 0
+}
+
+func (hs *HostScheduler) host(host string) *hostState {
+	h, ok := hs.hosts[host]
+	if !ok {
+		h = &hostState{holders: make(map[*File]int)}
+		hs.hosts[host] = h
+	}
+	return h
+}
+
+// acquire blocks until f may open a new connection to host, for a read
+// of priority prio, or ctx is done.
+func (hs *HostScheduler) acquire(ctx context.Context, f *File, host string, prio Priority) error {
+	hs.mu.Lock()
+	h := hs.host(host)
+	if h.inUse < hs.maxConnsPerHost && len(h.waiters) == 0 {
+		h.inUse++
+		h.holders[f]++
+		hs.mu.Unlock()
+		return nil
+	}
+
+	w := &hostWaiter{file: f, prio: prio, ready: make(chan struct{})}
+	h.waiters = append(h.waiters, w)
+
+	// ask whoever has the most to give one back, if it's idle
+	var greediest *File
+	for holder, n := range h.holders {
+		if greediest == nil || n > h.holders[greediest] {
+			greediest = holder
+		}
+	}
+	hs.mu.Unlock()
+
+	if greediest != nil {
+		go greediest.releaseIdleConn(host)
+	}
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		hs.mu.Lock()
+		for i, ww := range h.waiters {
+			if ww == w {
+				h.waiters = append(h.waiters[:i], h.waiters[i+1:]...)
+				hs.mu.Unlock()
+				return errors.WithStack(ctx.Err())
+			}
+		}
+		hs.mu.Unlock()
+
+		// we were handed a slot in the meantime
+		hs.release(f, host)
+		return errors.WithStack(ctx.Err())
+	}
+}
+
+// release gives a slot back, and hands it to the most urgent waiter,
+// or if there's a tie, to the waiting File that holds the fewest
+// connections to host.
+func (hs *HostScheduler) release(f *File, host string) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	h := hs.host(host)
+	h.inUse--
+	h.holders[f]--
+	if h.holders[f] <= 0 {
+		delete(h.holders, f)
+	}
+
+	if len(h.waiters) == 0 {
+		if h.inUse == 0 {
+			delete(hs.hosts, host)
+		}
+		return
+	}
+
+	best := 0
+	for i, w := range h.waiters {
+		bw := h.waiters[best]
+		if w.prio > bw.prio || (w.prio == bw.prio && h.holders[w.file] < h.holders[bw.file]) {
+			best = i
+		}
+	}
+	w := h.waiters[best]
+	h.waiters = append(h.waiters[:best], h.waiters[best+1:]...)
+	h.inUse++
+	h.holders[w.file]++
+	close(w.ready)
+}
+
+// shouldYield returns true if f holds more connections to host
+// than a File that's waiting for one.
+func (hs *HostScheduler) shouldYield(f *File, host string) bool {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	h, ok := hs.hosts[host]
+	if !ok {
+		return false
+	}
+	for _, w := range h.waiters {
+		if h.holders[w.file] < h.holders[f] {
+			return true
+		}
+	}
+	return false
+}
+
+func hostOf(urlStr string) string {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// acquireHostSlot waits for HostScheduler to allow a new connection
+// for a read of priority prio, if there's one. It must be called with connsLock held, which is
+// released while waiting. It returns the host the slot is for.
+func (f *File) acquireHostSlot(ctx context.Context, prio Priority) (string, error) {
+	if f.HostScheduler == nil {
+		return "", nil
+	}
+
+	host := hostOf(f.getCurrentURL())
+	f.connsLock.Unlock()
+	err := f.HostScheduler.acquire(ctx, f, host, prio)
+	f.connsLock.Lock()
+	if err != nil {
+		return "", err
+	}
+	return host, nil
+}
+
+// releaseIdleConn closes our least recently used idle conn to host,
+// if we have one, so its slot can go to another File.
+func (f *File) releaseIdleConn(host string) {
+	f.connsLock.Lock()
+	var lru *conn
+	for _, c := range f.conns {
+		if c.schedHost != host || !c.hasSlot {
+			continue
+		}
+		if lru == nil || c.touchedAt.Before(lru.touchedAt) {
+			lru = c
+		}
+	}
+	if lru == nil {
+		f.connsLock.Unlock()
+		return
+	}
+	f.debug("schedule: yielding idle conn to another File", "offset", lru.Offset(), "conn", lru.id)
+	f.detachConn(lru)
+	f.connsLock.Unlock()
+
+	// closing can drain its body, don't hold the lock meanwhile
+	lru.Close()
+}
@@ -0,0 +1,69 @@
+package htfs_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HostScheduler(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbccccdddd")
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	u, err := url.Parse(storageServer.URL)
+	assert.NoError(err)
+	host := u.Host
+
+	sched := htfs.NewHostScheduler(2)
+	open := func() *htfs.File {
+		settings := defaultSettings(t)
+		settings.HostScheduler = sched
+		settings.MaxDiscard = 2
+		settings.ForbidBacktracking = true
+		hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+		assert.NoError(err)
+		return hf
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		buf := make([]byte, 4)
+
+		// big reader takes both slots
+		a := open()
+		_, err := a.ReadAt(buf, 12)
+		assert.NoError(err)
+		assert.EqualValues(2, a.NumConns())
+		assert.EqualValues(2, sched.NumConns(host))
+
+		// small reader gets one of them back
+		b := open()
+		assert.EqualValues(1, a.NumConns())
+		assert.EqualValues(2, sched.NumConns(host))
+
+		_, err = b.ReadAt(buf, 8)
+		assert.NoError(err)
+		assert.Equal([]byte("cccc"), buf)
+		assert.EqualValues(2, sched.NumConns(host))
+
+		assert.NoError(a.Close())
+		assert.NoError(b.Close())
+		assert.EqualValues(0, sched.NumConns(host))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock: Files never got a connection")
+	}
+}
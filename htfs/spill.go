@@ -0,0 +1,95 @@
+package htfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// spillToDisk copies the whole response c is reading from (which must be
+// at offset 0) to a temporary file in SpillDir, so that reads can be served
+// from it. If the body gets cut off, it starts over.
+func (f *File) spillToDisk(c *conn) error {
+	tmp, err := ioutil.TempFile(f.SpillDir, "htfs-spill-")
+	if err != nil {
+		return errors.Wrap(err, "in File.spillToDisk, while creating temporary file")
+	}
+
+	f.info("spill: server doesn't support ranges, downloading whole file", "path", tmp.Name(), "size", c.contentLength)
+
+	written, err := f.trySpillWithRetries(tmp, c)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	f.spillFile = tmp
+	f.size = written
+	return nil
+}
+
+func (f *File) trySpillWithRetries(tmp *os.File, c *conn) (int64, error) {
+	retryCtx := f.newRetryContext()
+
+	for retryCtx.ShouldTry() {
+		if retryCtx.Tries > 0 {
+			_, err := tmp.Seek(0, io.SeekStart)
+			if err == nil {
+				err = tmp.Truncate(0)
+			}
+			if err != nil {
+				return 0, errors.Wrap(err, "in File.spillToDisk, while starting over")
+			}
+
+			err = c.Connect(0)
+			if err != nil {
+				return 0, errors.Wrap(err, "in File.spillToDisk, while reconnecting")
+			}
+		}
+
+		written, err := io.Copy(tmp, c)
+		if err == nil && c.contentLength >= 0 && written != c.contentLength {
+			// the body ended early, without an error to show for it
+			err = errors.Wrapf(io.ErrUnexpectedEOF, "got %d bytes out of %d", written, c.contentLength)
+		}
+		if err != nil {
+			if f.shouldRetry(err) {
+				f.info("spill: retrying", "written", written, "err", err)
+				retryCtx.Retry(err)
+				continue
+			}
+			return 0, errors.Wrap(err, "in File.spillToDisk, non-retriable error")
+		}
+		return written, nil
+	}
+	return 0, errors.Wrap(retryCtx.LastError, "in File.spillToDisk, exhausted retry context")
+}
+
+// readAtSpill serves reads from the file spillToDisk wrote
+func (f *File) readAtSpill(data []byte, offset int64) (int, error) {
+	n, err := f.spillFile.ReadAt(data, offset)
+	if pe, ok := err.(*os.PathError); ok && pe.Err == os.ErrClosed {
+		return n, errors.WithStack(ErrClosed)
+	}
+	return n, err
+}
+
+// closeSpill closes and removes the file spillToDisk wrote, if any
+func (f *File) closeSpill() error {
+	if f.spillFile == nil {
+		return nil
+	}
+
+	err := f.spillFile.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = os.Remove(f.spillFile.Name())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package htfs_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileSpillNoRange(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	ctx := &fakeStorageContext{
+		simulateNoRangeSupport: true,
+	}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	dir, err := ioutil.TempDir("", "htfs-spill")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	settings := defaultSettings(t)
+	settings.SpillNoRange = true
+	settings.SpillDir = dir
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	stat, err := hf.Stat()
+	assert.NoError(err)
+	assert.EqualValues(len(fakeData), stat.Size())
+
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(err)
+	assert.EqualValues(1, len(entries))
+
+	b := make([]byte, 4)
+	for _, offset := range []int64{3 * 1024 * 1024, 12, 1024 * 1024} {
+		_, err = hf.ReadAt(b, offset)
+		assert.NoError(err)
+		assert.EqualValues(fakeData[offset:offset+4], b)
+	}
+
+	_, err = hf.Seek(0, 0)
+	assert.NoError(err)
+	var buf bytes.Buffer
+	_, err = hf.WriteTo(&buf)
+	assert.NoError(err)
+	assert.True(bytes.Equal(fakeData, buf.Bytes()))
+
+	// everything came from the first request
+	assert.EqualValues(1, ctx.numGET)
+
+	assert.NoError(hf.Close())
+
+	entries, err = ioutil.ReadDir(dir)
+	assert.NoError(err)
+	assert.EqualValues(0, len(entries), "Close should remove the temporary file")
+
+	_, err = hf.ReadAt(b, 12)
+	assert.Error(err)
+}
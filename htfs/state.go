@@ -0,0 +1,135 @@
+package htfs
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// fileStateVersion is bumped when fileState changes in ways
+// older versions of htfs can't make sense of
+const fileStateVersion = 1
+
+// fileState is what SaveState persists, and Resume restores
+type fileState struct {
+	Version      int    `json:"version"`
+	Size         int64  `json:"size"`
+	Name         string `json:"name"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	OriginHost   string `json:"originHost,omitempty"`
+
+	PinnedHead       []byte `json:"pinnedHead,omitempty"`
+	PinnedTail       []byte `json:"pinnedTail,omitempty"`
+	PinnedTailOffset int64  `json:"pinnedTailOffset,omitempty"`
+}
+
+// SaveState returns what Resume needs to open the same remote file again
+// without a size probe: its size, name and validators, and its pinned
+// head and tail (see Settings.PinHead). Since the validators are kept,
+// Files resumed after the file changed on the server fail reads with
+// ErrResourceChanged, and BlockCache entries stay valid across resumes.
+//
+// Files that spilled to disk (see Settings.SpillNoRange) can't be resumed.
+func (f *File) SaveState() ([]byte, error) {
+	if err := f.opened(); err != nil {
+		return nil, err
+	}
+	if f.spillFile != nil {
+		return nil, errors.New("htfs: can't save the state of a file spilled to disk")
+	}
+	if !f.knownSize() {
+		return nil, errors.New("htfs: can't save the state of a file of unknown size")
+	}
+
+	state, err := json.Marshal(&fileState{
+		Version:          fileStateVersion,
+		Size:             f.size,
+		Name:             f.name,
+		ETag:             f.etag,
+		LastModified:     f.lastModified,
+		OriginHost:       f.originHost,
+		PinnedHead:       f.pinnedHead,
+		PinnedTail:       f.pinnedTail,
+		PinnedTailOffset: f.pinnedTailOffset,
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return state, nil
+}
+
+// Resume opens a remote file from the state saved by File.SaveState,
+// for example when a long-running install restarts. It gets a URL, but
+// doesn't make any request: the first read does. Pinned bytes are
+// restored if settings pin as much as when the state was saved, and
+// fetched again otherwise. settings.SizeProbe is ignored.
+func Resume(state []byte, getURL GetURLFunc, needsRenewal NeedsRenewalFunc, settings *Settings) (*File, error) {
+	saved := &fileState{}
+	err := json.Unmarshal(state, saved)
+	if err != nil {
+		return nil, errors.Wrap(err, "htfs.Resume, while parsing state")
+	}
+	if saved.Version != fileStateVersion {
+		return nil, errors.Errorf("htfs.Resume: unsupported state version %d", saved.Version)
+	}
+	if saved.Size <= 0 {
+		return nil, errors.Errorf("htfs.Resume: invalid size %d", saved.Size)
+	}
+
+	f := newFile(singleURL(noExpiry(getURL)), needsRenewal, settings)
+	err = f.loadURLs()
+	if err != nil {
+		return nil, err
+	}
+	f.size = saved.Size
+	f.name = saved.Name
+	f.etag = saved.ETag
+	f.lastModified = saved.LastModified
+	f.originHost = saved.OriginHost
+
+	if !f.restorePins(saved) {
+		err = f.pin()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// restorePins adopts the pinned head and tail of saved, if they're what
+// pin would fetch with the File's settings, and returns true if so
+func (f *File) restorePins(saved *fileState) bool {
+	headLen := f.PinHead
+	if headLen > f.size {
+		headLen = f.size
+	}
+	if headLen < 0 {
+		headLen = 0
+	}
+	if int64(len(saved.PinnedHead)) != headLen {
+		return false
+	}
+
+	var tailLen int64
+	tailOffset := f.size - f.PinTail
+	if tailOffset < headLen {
+		tailOffset = headLen
+	}
+	if f.PinTail > 0 && tailOffset < f.size {
+		tailLen = f.size - tailOffset
+	}
+	if int64(len(saved.PinnedTail)) != tailLen || (tailLen > 0 && saved.PinnedTailOffset != tailOffset) {
+		return false
+	}
+
+	if headLen > 0 {
+		f.pinnedHead = saved.PinnedHead
+	}
+	if tailLen > 0 {
+		f.pinnedTail = saved.PinnedTail
+		f.pinnedTailOffset = tailOffset
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package htfs_test
+
+import (
+	"testing"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileResume(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+	size := int64(len(fakeData))
+
+	ctx := &fakeStorageContext{etag: `"v1"`}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	settings := defaultSettings(t)
+	htfs.WithPin(1024, 4096).Apply(settings)
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	hfStat, err := hf.Stat()
+	assert.NoError(err)
+	state, err := hf.SaveState()
+	assert.NoError(err)
+	assert.NoError(hf.Close())
+
+	// resuming doesn't make any request, not even for pinned bytes
+	numGET := ctx.numGET
+	rf, err := htfs.Resume(state, storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	defer rf.Close()
+	assert.EqualValues(numGET, ctx.numGET)
+	assert.EqualValues(0, ctx.numHEAD)
+
+	stat, err := rf.Stat()
+	assert.NoError(err)
+	assert.EqualValues(size, stat.Size())
+	assert.EqualValues(hfStat.Name(), stat.Name())
+
+	buf := make([]byte, 1024)
+	_, err = rf.ReadAt(buf, size-1024)
+	assert.NoError(err)
+	assert.EqualValues(fakeData[size-1024:], buf)
+	assert.EqualValues(numGET, ctx.numGET, "pinned tail should be restored")
+
+	// the first request checks the file didn't change
+	_, err = rf.ReadAt(buf, 1024*1024)
+	assert.NoError(err)
+	assert.EqualValues(fakeData[1024*1024:1024*1024+1024], buf)
+	assert.EqualValues(`"v1"`, ctx.lastHeader.Get("If-Match"))
+
+	// and it's noticed if it did
+	ctx.etag = `"v2"`
+	stale, err := htfs.Resume(state, storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	defer stale.Close()
+	_, err = stale.ReadAt(buf, 2*1024*1024)
+	assert.Equal(htfs.ErrResourceChanged, errors.Cause(err))
+
+	// pinning more than when the state was saved fetches the pins again
+	ctx.etag = `"v1"`
+	numGET = ctx.numGET
+	htfs.WithPin(2048, 4096).Apply(settings)
+	rf2, err := htfs.Resume(state, storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	defer rf2.Close()
+	assert.True(ctx.numGET > numGET)
+
+	_, err = htfs.Resume([]byte("{}"), storageServerURL(storageServer), noRenewal, settings)
+	assert.Error(err)
+}
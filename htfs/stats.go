@@ -0,0 +1,161 @@
+package htfs
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/itchio/headway/united"
+)
+
+// Stats describes how a File has been reading from the server so far,
+// so programs can report it in their own telemetry. Conns that are busy
+// serving a read are only accounted for once they're returned.
+// Counters are updated atomically but independently, so while reads
+// are going on, related ones (like Connections and ConnectionWait)
+// may be one update apart.
+type Stats struct {
+	// Connections is the number of requests made (not counting retries)
+	Connections int
+	// ConnectionWait is the total time spent waiting for responses
+	ConnectionWait time.Duration
+	// Expired is the number of idle conns closed because they were stale
+	Expired int
+	// Renewals is the number of times the URL was renewed
+	Renewals int
+	// DeadReuses is the number of idle conns found dead when re-used
+	DeadReuses int
+	// Failovers is the number of times a request was retried on another
+	// mirror, see OpenMirrors
+	Failovers int
+	// PacingDelays is the number of requests held back by Settings.HostPacer,
+	// and PacingWait the total time they waited
+	PacingDelays int
+	PacingWait   time.Duration
+	// TLSHandshakes is the number of TLS handshakes requests led to, and
+	// TLSResumptions how many of them resumed an earlier session rather
+	// than doing a full handshake. Few resumptions when reconnects are
+	// frequent mean the client's session cache is disabled or too small,
+	// see timeout.ClientSettings.TLSSessionCacheSize. crypto/tls doesn't
+	// send 0-RTT early data, so there's nothing to count for it.
+	TLSHandshakes  int
+	TLSResumptions int
+
+	// FetchedBytes is the number of bytes conns went through, whether
+	// they were read, discarded, or served again from their cache
+	FetchedBytes int64
+	// CachedBytes is the part of FetchedBytes served from backtracking caches
+	CachedBytes int64
+	// CacheHits and CacheMisses count reads served (or not) from
+	// backtracking caches
+	CacheHits   int64
+	CacheMisses int64
+
+	// BlockCacheHits and BlockCacheMisses count blocks served (or not)
+	// from Settings.BlockCache
+	BlockCacheHits   int64
+	BlockCacheMisses int64
+}
+
+// CacheHitRate returns the ratio of reads served from backtracking
+// caches, between 0 and 1.
+func (s Stats) CacheHitRate() float64 {
+	totalReads := s.CacheHits + s.CacheMisses
+	if totalReads == 0 {
+		return 0
+	}
+	return float64(s.CacheHits) / float64(totalReads)
+}
+
+// Stats returns a snapshot of this File's statistics
+func (f *File) Stats() Stats {
+	f.connsLock.Lock()
+	defer f.connsLock.Unlock()
+
+	return f.statsLocked()
+}
+
+// statsLocked must be called with connsLock held
+func (f *File) statsLocked() Stats {
+	hs := f.stats
+	s := Stats{
+		Connections:      int(atomic.LoadInt64(&hs.connections)),
+		ConnectionWait:   time.Duration(atomic.LoadInt64(&hs.connectionWait)),
+		Expired:          int(atomic.LoadInt64(&hs.expired)),
+		Renewals:         int(atomic.LoadInt64(&hs.renews)),
+		DeadReuses:       int(atomic.LoadInt64(&hs.deadReuses)),
+		Failovers:        int(atomic.LoadInt64(&hs.failovers)),
+		PacingDelays:     int(atomic.LoadInt64(&hs.pacingDelays)),
+		PacingWait:       time.Duration(atomic.LoadInt64(&hs.pacingWait)),
+		TLSHandshakes:    int(atomic.LoadInt64(&hs.tlsHandshakes)),
+		TLSResumptions:   int(atomic.LoadInt64(&hs.tlsResumptions)),
+		FetchedBytes:     atomic.LoadInt64(&hs.fetchedBytes),
+		CachedBytes:      atomic.LoadInt64(&hs.cachedBytes),
+		CacheHits:        atomic.LoadInt64(&hs.numCacheHits),
+		CacheMisses:      atomic.LoadInt64(&hs.numCacheMiss),
+		BlockCacheHits:   atomic.LoadInt64(&hs.numBlockHits),
+		BlockCacheMisses: atomic.LoadInt64(&hs.numBlockMiss),
+	}
+
+	// idle conns haven't been accounted for yet
+	for _, c := range f.conns {
+		s.FetchedBytes += c.TotalBytesServed()
+		s.CachedBytes += c.CachedBytesServed()
+		s.CacheHits += c.NumCacheHits()
+		s.CacheMisses += c.NumCacheMiss()
+	}
+	return s
+}
+
+// dumpStats logs s at info level, through the File's Logger,
+// see Settings.DumpStats
+func (f *File) dumpStats(s Stats) {
+	size := f.size
+	perc := 0.0
+	percCached := 0.0
+	if size != 0 {
+		perc = float64(s.FetchedBytes) / float64(size) * 100.0
+	}
+	if s.FetchedBytes != 0 {
+		percCached = float64(s.CachedBytes) / float64(s.FetchedBytes) * 100.0
+	}
+
+	f.info("stats: conns", "name", f.name,
+		"total", s.Connections, "expired", s.Expired, "renewals", s.Renewals,
+		"dead_reuses", s.DeadReuses, "failovers", s.Failovers, "wait", s.ConnectionWait)
+	f.info("stats: bytes", "name", f.name,
+		"fetched", united.FormatBytes(s.FetchedBytes), "size", united.FormatBytes(size),
+		"fetched_ratio", fmt.Sprintf("%.2f%%", perc),
+		"cached", united.FormatBytes(s.CachedBytes), "cached_ratio", fmt.Sprintf("%.2f%%", percCached),
+		"cache_hit_rate", fmt.Sprintf("%.2f%%", s.CacheHitRate()*100.0), "reads", s.CacheHits+s.CacheMisses)
+	if f.HostPacer != nil {
+		f.info("stats: pacing", "name", f.name, "delayed", s.PacingDelays, "wait", s.PacingWait)
+	}
+	if s.TLSHandshakes > 0 {
+		f.info("stats: tls", "name", f.name, "handshakes", s.TLSHandshakes, "resumed", s.TLSResumptions)
+	}
+	if f.BlockCache != nil {
+		f.info("stats: block cache", "name", f.name, "hits", s.BlockCacheHits, "misses", s.BlockCacheMisses)
+	}
+	wr := f.waste.snapshot()
+	f.info("stats: waste", "name", f.name,
+		"discarded", united.FormatBytes(wr.DiscardedBytes), "duplicated", united.FormatBytes(wr.DuplicatedBytes),
+		"ratio", fmt.Sprintf("%.2f%%", wr.Ratio()*100.0))
+}
+
+func (f *File) reportMetrics(s Stats) {
+	f.metrics.Add("htfs.connections", int64(s.Connections))
+	f.metrics.Add("htfs.connection_wait_ms", int64(s.ConnectionWait/time.Millisecond))
+	f.metrics.Add("htfs.expired", int64(s.Expired))
+	f.metrics.Add("htfs.renewals", int64(s.Renewals))
+	f.metrics.Add("htfs.dead_reuses", int64(s.DeadReuses))
+	f.metrics.Add("htfs.failovers", int64(s.Failovers))
+	f.metrics.Add("htfs.pacing_delays", int64(s.PacingDelays))
+	f.metrics.Add("htfs.pacing_wait_ms", int64(s.PacingWait/time.Millisecond))
+	f.metrics.Add("htfs.tls_handshakes", int64(s.TLSHandshakes))
+	f.metrics.Add("htfs.tls_resumptions", int64(s.TLSResumptions))
+	f.metrics.Add("htfs.fetched_bytes", s.FetchedBytes)
+	f.metrics.Add("htfs.cached_bytes", s.CachedBytes)
+	f.metrics.Add("htfs.block_cache_hits", s.BlockCacheHits)
+	f.metrics.Add("htfs.block_cache_misses", s.BlockCacheMisses)
+}
@@ -0,0 +1,283 @@
+package htfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/itchio/httpkit/retrycontext"
+	"github.com/itchio/httpkit/timeout"
+	"github.com/pkg/errors"
+)
+
+// defaultStreamReadAhead is how much a Stream reads ahead of
+// its reader, see Settings.StreamReadAhead
+const defaultStreamReadAhead int64 = 1024 * 1024
+
+// streamChunkSize is how much a Stream reads from its conn at a time
+const streamChunkSize = 64 * 1024
+
+// defaultStreamStallTimeout is how long a Stream waits for data before
+// reconnecting, if Settings.StallTimeout isn't set
+const defaultStreamStallTimeout = 30 * time.Second
+
+// Stream returns a reader of the file from offset to the end, for long
+// sequential reads like media playback. It has a conn of its own, outside
+// of the pool ReadAt uses (and of MaxConns), which reads up to
+// StreamReadAhead bytes ahead in the background. If that conn doesn't
+// deliver any data for StallTimeout (30 seconds if unset), or breaks off,
+// it reconnects where it left off, with ReadRetrySettings.
+//
+// Pinned bytes and the BlockCache aren't used. Closing the File stops all
+// its streams, which must still be closed.
+func (f *File) Stream(offset int64) io.ReadCloser {
+	ctx, cancel := context.WithCancel(f.ctx)
+	s := &stream{
+		file:   f,
+		ctx:    ctx,
+		cancel: cancel,
+		offset: offset,
+		chunks: make(chan []byte, f.streamWindow()),
+		free:   make(chan []byte, f.streamWindow()+1),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// streamWindow returns how many chunks a Stream reads ahead
+func (f *File) streamWindow() int {
+	window := int(f.StreamReadAhead / streamChunkSize)
+	if window < 1 {
+		window = 1
+	}
+	return window
+}
+
+type stream struct {
+	file   *File
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// offset is where the next chunk starts, it's only
+	// used by run
+	offset int64
+	chunks chan []byte
+	// free holds chunk buffers Read is done with, for run to reuse
+	free chan []byte
+	// err is why run stopped, set before chunks is closed
+	err  error
+	done chan struct{}
+
+	// current is what's left of the chunk being read,
+	// chunk is all of it
+	current []byte
+	chunk   []byte
+}
+
+var _ io.ReadCloser = (*stream)(nil)
+
+// Read implements io.Reader
+func (s *stream) Read(buf []byte) (int, error) {
+	if s.ctx.Err() != nil {
+		return 0, errors.WithStack(ErrClosed)
+	}
+
+	if len(s.current) == 0 {
+		if s.chunk != nil {
+			s.recycle(s.chunk)
+			s.chunk = nil
+		}
+		select {
+		case chunk, ok := <-s.chunks:
+			if !ok {
+				return 0, s.err
+			}
+			s.chunk = chunk
+			s.current = chunk
+		case <-s.ctx.Done():
+			return 0, errors.WithStack(ErrClosed)
+		}
+	}
+
+	n := copy(buf, s.current)
+	s.current = s.current[n:]
+	return n, nil
+}
+
+// Close stops the stream, and closes its conn
+func (s *stream) Close() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// newChunk returns a buffer Read is done with, or a new one
+func (s *stream) newChunk() []byte {
+	select {
+	case buf := <-s.free:
+		return buf
+	default:
+		return make([]byte, streamChunkSize)
+	}
+}
+
+// recycle hands chunk back to run, unless enough buffers are waiting
+func (s *stream) recycle(chunk []byte) {
+	select {
+	case s.free <- chunk[:cap(chunk)]:
+	default:
+	}
+}
+
+// send hands the first n bytes of buf to Read
+func (s *stream) send(buf []byte, n int) error {
+	s.offset += int64(n)
+	select {
+	case s.chunks <- buf[:n]:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// run reads chunks from the stream's conn until the end of the file,
+// an error, or the stream is closed
+func (s *stream) run() {
+	defer close(s.done)
+	defer close(s.chunks)
+
+	err := s.copyChunks()
+	if errors.Cause(err) == io.EOF {
+		err = io.EOF
+	} else if s.ctx.Err() != nil {
+		err = errors.WithStack(ErrClosed)
+	}
+	s.err = err
+}
+
+func (s *stream) copyChunks() error {
+	f := s.file
+	if err := f.opened(); err != nil {
+		return err
+	}
+	if f.knownSize() && s.offset >= f.size {
+		return io.EOF
+	}
+	if f.spillFile != nil {
+		return s.copySpill()
+	}
+
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.stats.add(&f.stats.fetchedBytes, c.TotalBytesServed())
+		c.Close()
+	}()
+
+	// only created if the response breaks off, and started over
+	// whenever a reconnect gets us some data
+	var retryCtx *retrycontext.Context
+	var reconnectedAt int64 = -1
+
+	for {
+		buf := s.newChunk()
+		n, err := c.Read(buf)
+		if n > 0 {
+			if sendErr := s.send(buf, n); sendErr != nil {
+				return sendErr
+			}
+		} else {
+			s.recycle(buf)
+		}
+		if err == nil {
+			continue
+		}
+
+		if s.ctx.Err() != nil {
+			return s.ctx.Err()
+		}
+		if errors.Cause(err) == io.EOF && f.knownSize() && s.offset >= f.size {
+			return io.EOF
+		}
+
+		if _, ok := errors.Cause(err).(*timeout.StallError); ok {
+			f.info("stream: stalled, reconnecting", "offset", s.offset, "conn", c.id, "timeout", c.stallTimeout)
+		} else if !f.shouldRetry(err) {
+			return err
+		}
+
+		if retryCtx == nil || s.offset > reconnectedAt {
+			retryCtx = f.newReadRetryContext()
+		} else {
+			// the last reconnect didn't get us anywhere
+			retryCtx.Retry(err)
+		}
+		if !retryCtx.ShouldTry() {
+			return errors.Wrapf(err, "in File.Stream, exhausted read retry context")
+		}
+		reconnectedAt = s.offset
+		err = c.Connect(s.offset)
+		if err != nil {
+			return err
+		}
+		c.SetCaching(false)
+	}
+}
+
+// connect opens the stream's conn at its offset, with a
+// HostScheduler slot of its own, if needed
+func (s *stream) connect() (*conn, error) {
+	f := s.file
+
+	f.connsLock.Lock()
+	host, err := f.acquireHostSlot(s.ctx, PriorityBulk)
+	f.connsLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	stallTimeout := f.StallTimeout
+	if stallTimeout <= 0 {
+		stallTimeout = defaultStreamStallTimeout
+	}
+
+	f.info("stream: new connection", "offset", s.offset)
+	c := &conn{
+		file:      f,
+		id:        fmt.Sprintf("stream-%d", generateID()),
+		touchedAt: f.clock.Now(),
+		schedHost: host,
+		hasSlot:   f.HostScheduler != nil,
+		// closing the stream aborts its requests, and reads
+		ctx:          s.ctx,
+		stallTimeout: stallTimeout,
+	}
+	err = c.Connect(s.offset)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	// nothing is read twice, no need to keep it around
+	c.SetCaching(false)
+	return c, nil
+}
+
+// copySpill reads chunks from the file spilled to disk
+func (s *stream) copySpill() error {
+	for {
+		buf := s.newChunk()
+		n, err := s.file.readAtSpill(buf, s.offset)
+		if n > 0 {
+			if sendErr := s.send(buf, n); sendErr != nil {
+				return sendErr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package htfs_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileStream(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	settings := defaultSettings(t)
+	htfs.WithStreamReadAhead(256 * 1024).Apply(settings)
+
+	hf, err := htfs.Open(storageServerURL(storageServer), noRenewal, settings)
+	assert.NoError(err)
+	defer hf.Close()
+
+	numGET := ctx.numGET
+	numConns := hf.NumConns()
+	offset := int64(123456)
+	s := hf.Stream(offset)
+	readData, err := ioutil.ReadAll(s)
+	assert.NoError(err)
+	assert.True(bytes.Equal(fakeData[offset:], readData))
+	assert.NoError(s.Close())
+
+	// one request, and the pool wasn't touched
+	assert.EqualValues(numGET+1, ctx.numGET)
+	assert.EqualValues(numConns, hf.NumConns())
+
+	// past the end
+	s = hf.Stream(int64(len(fakeData)))
+	_, err = s.Read(make([]byte, 16))
+	assert.Equal(io.EOF, err)
+	assert.NoError(s.Close())
+
+	// closing mid-stream
+	s = hf.Stream(0)
+	buf := make([]byte, 1024)
+	_, err = io.ReadFull(s, buf)
+	assert.NoError(err)
+	assert.EqualValues(fakeData[:1024], buf)
+	assert.NoError(s.Close())
+	_, err = s.Read(buf)
+	assert.Equal(htfs.ErrClosed, errors.Cause(err))
+}
+
+func Test_FileStreamStall(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var numGET int64
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && atomic.AddInt64(&numGET, 1) == 1 {
+			// the first response stops halfway through
+			w.Header().Set("content-length", strconv.Itoa(len(fakeData)))
+			w.WriteHeader(200)
+			w.Write(fakeData[:1024*1024])
+			w.(http.Flusher).Flush()
+			<-release
+			return
+		}
+		http.ServeContent(w, r, "file.dat", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+	defer server.CloseClientConnections()
+	defer close(release)
+
+	settings := defaultSettings(t)
+	settings.StallTimeout = 200 * time.Millisecond
+
+	hf, err := htfs.Open(func() (string, error) { return server.URL, nil }, noRenewal, settings)
+	assert.NoError(err)
+	defer hf.Close()
+
+	s := hf.Stream(0)
+	readData, err := ioutil.ReadAll(s)
+	assert.NoError(err)
+	assert.True(bytes.Equal(fakeData, readData))
+	assert.NoError(s.Close())
+	assert.EqualValues(2, atomic.LoadInt64(&numGET))
+}
@@ -0,0 +1,303 @@
+package htfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/clock"
+	"github.com/pkg/errors"
+)
+
+// defaultSupportLogSize is how many log messages a File keeps
+// for SupportBundle, if Settings.SupportLogSize isn't set
+const defaultSupportLogSize = 256
+
+type supportEntry struct {
+	time    time.Time
+	level   httpkit.Level
+	msg     string
+	keyvals []interface{}
+}
+
+// supportLog is a ring buffer of the last messages a File logged,
+// whether or not a Logger was set.
+type supportLog struct {
+	// debug is whether to keep debug messages, see Settings.SupportLogDebug
+	debug bool
+
+	mu      sync.Mutex
+	entries []supportEntry
+	next    int
+	full    bool
+}
+
+func newSupportLog(size int, debug bool) *supportLog {
+	return &supportLog{debug: debug, entries: make([]supportEntry, size)}
+}
+
+func (sl *supportLog) add(e supportEntry) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	sl.entries[sl.next] = e
+	sl.next++
+	if sl.next == len(sl.entries) {
+		sl.next = 0
+		sl.full = true
+	}
+}
+
+// snapshot returns the entries, oldest first
+func (sl *supportLog) snapshot() []supportEntry {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if !sl.full {
+		return append([]supportEntry(nil), sl.entries[:sl.next]...)
+	}
+	res := append([]supportEntry(nil), sl.entries[sl.next:]...)
+	return append(res, sl.entries[:sl.next]...)
+}
+
+func (f *File) record(level httpkit.Level, msg string, keyvals []interface{}) {
+	if f.supportLog == nil {
+		return
+	}
+	if level == httpkit.LevelDebug && !f.supportLog.debug {
+		return
+	}
+	f.supportLog.add(supportEntry{
+		time:    f.clock.Now(),
+		level:   level,
+		msg:     msg,
+		keyvals: keyvals,
+	})
+}
+
+// SupportBundle returns a gzip-compressed text report of this File's
+// state, for applications to attach to support tickets: its stats, idle
+// connections, the headers of the initial response, and the last log
+// messages (see Settings.SupportLogSize and SupportLogDebug). Query
+// strings (which often hold signatures) and headers that may hold
+// credentials are redacted.
+func (f *File) SupportBundle() ([]byte, error) {
+	var sb strings.Builder
+	line := func(format string, args ...interface{}) {
+		sb.WriteString(redactURLs(fmt.Sprintf(format, args...)))
+		sb.WriteByte('\n')
+	}
+
+	line("htfs support bundle, generated %s", f.clock.Now().Format(time.RFC3339))
+	line("name: %s", f.name)
+	line("size: %d", f.size)
+	if len(f.labels) > 0 {
+		line("labels: %s", f.labels)
+	}
+	line("url: %s", redactURL(f.getCurrentURL()))
+	if f.requestID != "" {
+		line("request id: %s", f.requestID)
+	}
+	if n := f.numMirrors(); n > 1 {
+		line("mirrors: %d", n)
+	}
+
+	f.connsLock.Lock()
+	s := f.statsLocked()
+	closed := f.closed
+	numBorrowed := f.numBorrowed
+	conns := f.describeConnsLocked()
+	f.connsLock.Unlock()
+
+	line("")
+	line("== stats")
+	line("%s", httpkit.FormatKeyvals("conns",
+		"total", s.Connections, "wait", s.ConnectionWait, "expired", s.Expired,
+		"renewals", s.Renewals, "dead_reuses", s.DeadReuses, "failovers", s.Failovers))
+	line("%s", httpkit.FormatKeyvals("bytes",
+		"fetched", s.FetchedBytes, "cached", s.CachedBytes,
+		"cache_hits", s.CacheHits, "cache_misses", s.CacheMisses,
+		"block_cache_hits", s.BlockCacheHits, "block_cache_misses", s.BlockCacheMisses))
+	wr := f.waste.snapshot()
+	line("%s", httpkit.FormatKeyvals("waste",
+		"discarded", wr.DiscardedBytes, "duplicated", wr.DuplicatedBytes))
+
+	line("")
+	line("== conns (closed=%v, busy=%d)", closed, numBorrowed)
+	for _, c := range conns {
+		line("%s offset=%d cached=%d idle=%s stale=%v url=%s ids=[%s]",
+			c.ID, c.Offset, c.CachedBytes, c.Idle, c.Stale, c.URL, formatResponseIDs(c.ResponseIDs))
+	}
+
+	if ir := f.initialResponse; ir != nil {
+		line("")
+		line("== initial response")
+		line("%s %d", ir.Proto, ir.StatusCode)
+		for _, kv := range redactHeader(ir.Header) {
+			line("%s", kv)
+		}
+	}
+
+	if f.supportLog != nil {
+		line("")
+		line("== logs")
+		for _, e := range f.supportLog.snapshot() {
+			line("%s %s %s", e.time.Format(time.RFC3339Nano), e.level, httpkit.FormatKeyvals(e.msg, e.keyvals...))
+		}
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte(sb.String()))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ConnInfo describes one of a File's idle conns, see File.DescribeConns
+type ConnInfo struct {
+	// ID identifies the conn in log messages
+	ID string
+	// Offset is where the next read from the conn starts
+	Offset int64
+	// CachedBytes is how much the conn could backtrack without
+	// reconnecting, up to Settings.MaxBacktrack
+	CachedBytes int64
+	// Idle is how long the conn hasn't been used for
+	Idle time.Duration
+	// Stale is true if the conn will be closed rather than
+	// reused, see Settings.ConnStaleThreshold
+	Stale bool
+	// Age is how long ago the conn's current response arrived
+	Age time.Duration
+	// URL is the one the current response is for, redacted
+	// like in SupportBundle
+	URL string
+	// TLSResumed is true if the conn's TLS session was resumed
+	// rather than set up with a full handshake
+	TLSResumed bool
+	// ResponseIDs are the values of Settings.ResponseIDHeaders in the
+	// conn's current response, by header name, to ask a CDN about it
+	ResponseIDs map[string]string
+}
+
+// DescribeConns returns a snapshot of the File's idle conns, sorted by ID,
+// to find out why a File opens more connections than expected. Conns that
+// are busy serving a read aren't included, like in NumConns.
+func (f *File) DescribeConns() []ConnInfo {
+	f.connsLock.Lock()
+	defer f.connsLock.Unlock()
+
+	return f.describeConnsLocked()
+}
+
+func (f *File) describeConnsLocked() []ConnInfo {
+	var infos []ConnInfo
+	for _, c := range f.conns {
+		infos = append(infos, f.connInfo(c))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+func (f *File) connInfo(c *conn) ConnInfo {
+	return ConnInfo{
+		ID:          c.id,
+		Offset:      c.Offset(),
+		CachedBytes: c.Cached(),
+		Idle:        c.idleTime(),
+		Stale:       c.Stale(),
+		Age:         clock.Since(f.clock, c.openedAt),
+		URL:         redactURL(c.url),
+		TLSResumed:  c.tls != nil && c.tls.DidResume,
+		ResponseIDs: f.responseIDs(c.header),
+	}
+}
+
+// formatResponseIDs returns ids as name=value pairs, sorted
+func formatResponseIDs(ids map[string]string) string {
+	var pairs []string
+	for name, value := range ids {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// sensitiveHeaderWords are parts of header names whose
+// values SupportBundle redacts
+var sensitiveHeaderWords = []string{"auth", "cookie", "token", "key", "secret", "signature", "session"}
+
+func isSensitiveHeader(name string) bool {
+	lowerName := strings.ToLower(name)
+	for _, word := range sensitiveHeaderWords {
+		if strings.Contains(lowerName, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHeader returns header's lines, sorted, with values
+// that may hold credentials replaced
+func redactHeader(header http.Header) []string {
+	var lines []string
+	for name, values := range redactedHeader(header) {
+		for _, value := range values {
+			lines = append(lines, fmt.Sprintf("%s: %s", name, value))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// redactedHeader returns a copy of header, with values
+// that may hold credentials replaced
+func redactedHeader(header http.Header) http.Header {
+	res := make(http.Header, len(header))
+	for name, values := range header {
+		if isSensitiveHeader(name) {
+			res[name] = []string{"REDACTED"}
+			continue
+		}
+		res[name] = append([]string(nil), values...)
+	}
+	return res
+}
+
+// redactURL strips credentials and the query string from urlStr
+func redactURL(urlStr string) string {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	u.User = nil
+	if u.RawQuery != "" {
+		u.RawQuery = "REDACTED"
+	}
+	u.Fragment = ""
+	return u.String()
+}
+
+var urlQueryRegexp = regexp.MustCompile(`(\b[a-z]+://[^\s?"]+)\?[^\s"]*`)
+
+// redactURLs strips query strings from all the URLs in s,
+// like the ones in *url.Error messages
+func redactURLs(s string) string {
+	return urlQueryRegexp.ReplaceAllString(s, "$1?REDACTED")
+}
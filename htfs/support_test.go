@@ -0,0 +1,94 @@
+package htfs_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileSupportBundle(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbbcccc")
+
+	storageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=s3cr3t")
+		w.Header().Set("X-Served-By", "cache-42")
+		http.ServeContent(w, r, "file.dat", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer storageServer.Close()
+
+	getURL := func() (string, error) {
+		return storageServer.URL + "/file.dat?signature=s3cr3t", nil
+	}
+
+	settings := defaultSettings(t)
+	settings.Log = nil
+	settings.Labels = htfs.Labels{"game": "187770"}
+	settings.SupportLogSize = 4
+	settings.SupportLogDebug = true
+	hf, err := htfs.Open(getURL, noRenewal, settings)
+	assert.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		_, err = hf.ReadAt(make([]byte, 4), 4)
+		assert.NoError(err)
+	}
+
+	conns := hf.DescribeConns()
+	if assert.Len(conns, 1) {
+		c := conns[0]
+		assert.EqualValues(8, c.Offset)
+		assert.EqualValues(8, c.CachedBytes)
+		assert.False(c.Stale)
+		assert.Contains(c.URL, "file.dat?REDACTED")
+	}
+
+	bundle, err := hf.SupportBundle()
+	assert.NoError(err)
+
+	zr, err := gzip.NewReader(bytes.NewReader(bundle))
+	assert.NoError(err)
+	contents, err := ioutil.ReadAll(zr)
+	assert.NoError(err)
+	report := string(contents)
+	t.Logf("%s", report)
+
+	assert.Contains(report, "labels: game=187770")
+	assert.Contains(report, "== stats")
+	assert.Contains(report, "X-Served-By: cache-42")
+	assert.Contains(report, "Set-Cookie: REDACTED")
+	assert.Contains(report, "file.dat?REDACTED")
+	assert.Contains(report, "offset=8 cached=8")
+	assert.NotContains(report, "s3cr3t")
+	// even without a Logger, debug messages are kept, if asked
+	assert.Contains(report, "debug borrow: backtracking offset=4")
+	// but only the last few
+	assert.EqualValues(4, bytes.Count(contents[bytes.Index(contents, []byte("== logs")):], []byte("\n"))-1)
+
+	assert.NoError(hf.Close())
+
+	// by default, only info and warnings are kept
+	settings.SupportLogDebug = false
+	hf, err = htfs.Open(getURL, noRenewal, settings)
+	assert.NoError(err)
+	_, err = hf.ReadAt(make([]byte, 4), 4)
+	assert.NoError(err)
+
+	bundle, err = hf.SupportBundle()
+	assert.NoError(err)
+	zr, err = gzip.NewReader(bytes.NewReader(bundle))
+	assert.NoError(err)
+	contents, err = ioutil.ReadAll(zr)
+	assert.NoError(err)
+	assert.Contains(string(contents), "info connect: done")
+	assert.NotContains(string(contents), "debug ")
+
+	assert.NoError(hf.Close())
+}
@@ -0,0 +1,24 @@
+package htfs
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+)
+
+// traceTLS counts the TLS handshakes req leads to, and how many of them
+// resumed a session, see Stats.TLSHandshakes
+func (f *File) traceTLS(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			f.stats.add(&f.stats.tlsHandshakes, 1)
+			if state.DidResume {
+				f.stats.add(&f.stats.tlsResumptions, 1)
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
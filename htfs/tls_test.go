@@ -0,0 +1,49 @@
+package htfs_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileTLSResumption(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// every request needs a new connection, and a new handshake
+		w.Header().Set("Connection", "close")
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	client := server.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+
+	settings := defaultSettings(t)
+	settings.Client = client
+	getURL := func() (string, error) { return server.URL, nil }
+
+	hf, err := htfs.Open(getURL, noRenewal, settings)
+	assert.NoError(err)
+	defer hf.Close()
+
+	buf := make([]byte, 4)
+	// reading backwards means a new connection for every read
+	for _, offset := range []int64{3 * 1024 * 1024, 1024 * 1024, 0} {
+		_, err = hf.ReadAt(buf, offset)
+		assert.NoError(err)
+		assert.EqualValues(fakeData[offset:offset+4], buf)
+	}
+
+	stats := hf.Stats()
+	assert.True(stats.TLSHandshakes >= 2)
+	assert.True(stats.TLSResumptions >= 1)
+	assert.True(stats.TLSResumptions < stats.TLSHandshakes, "the first handshake can't be resumed")
+}
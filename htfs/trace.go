@@ -0,0 +1,102 @@
+package htfs
+
+import "time"
+
+// Trace is a set of hooks into a File's connection machinery, like
+// httptrace.ClientTrace is for net/http, so that callers can attach spans
+// or debugging instead of parsing log lines. Any of them may be nil.
+// They're called synchronously, from whichever goroutine is reading,
+// sometimes while internal locks are held: they must not call the File.
+type Trace struct {
+	// ConnectStart is called before each request for a range starting at offset
+	ConnectStart func(offset int64)
+	// ConnectDone is called after each request, with its outcome
+	ConnectDone func(offset int64, duration time.Duration, err error)
+
+	// RenewStart is called before asking for a new URL
+	RenewStart func()
+	// RenewDone is called after asking for a new URL, with its outcome
+	RenewDone func(err error)
+
+	// ReadError is called when reading from a response body fails,
+	// before deciding whether to retry.
+	ReadError func(offset int64, err error)
+
+	// ConnOpened is called when a conn gets a response, ConnReused when
+	// an idle conn is used for a read, and ConnClosed when a conn is done
+	// with its response, either because it's closed, or because it
+	// reconnects at another offset. Together, they tell how many conns
+	// are open to which host, for UIs to show.
+	ConnOpened func(ev ConnEvent)
+	ConnReused func(ev ConnEvent)
+	ConnClosed func(ev ConnEvent)
+}
+
+// ConnEvent describes a conn that was opened, reused or closed
+type ConnEvent struct {
+	// ID identifies the conn in log messages
+	ID string
+	// Host is that of the URL the conn's response came from
+	Host string
+	// Offset is where the response starts when opened, where the read
+	// starts when reused, and where the conn got to when closed
+	Offset int64
+	// Duration is how long it took to connect when opened (including
+	// retries), how long the conn sat in the pool when reused, and how
+	// long it was open when closed
+	Duration time.Duration
+	// Discarded is how many bytes were skipped to get to Offset,
+	// when reused
+	Discarded int64
+	// Backtracked is how many bytes were served again from cache to
+	// get to Offset, when reused
+	Backtracked int64
+}
+
+func (t *Trace) connectStart(offset int64) {
+	if t != nil && t.ConnectStart != nil {
+		t.ConnectStart(offset)
+	}
+}
+
+func (t *Trace) connectDone(offset int64, duration time.Duration, err error) {
+	if t != nil && t.ConnectDone != nil {
+		t.ConnectDone(offset, duration, err)
+	}
+}
+
+func (t *Trace) renewStart() {
+	if t != nil && t.RenewStart != nil {
+		t.RenewStart()
+	}
+}
+
+func (t *Trace) renewDone(err error) {
+	if t != nil && t.RenewDone != nil {
+		t.RenewDone(err)
+	}
+}
+
+func (t *Trace) readError(offset int64, err error) {
+	if t != nil && t.ReadError != nil {
+		t.ReadError(offset, err)
+	}
+}
+
+func (t *Trace) connOpened(ev ConnEvent) {
+	if t != nil && t.ConnOpened != nil {
+		t.ConnOpened(ev)
+	}
+}
+
+func (t *Trace) connClosed(ev ConnEvent) {
+	if t != nil && t.ConnClosed != nil {
+		t.ConnClosed(ev)
+	}
+}
+
+func (t *Trace) connReused(ev ConnEvent) {
+	if t != nil && t.ConnReused != nil {
+		t.ConnReused(ev)
+	}
+}
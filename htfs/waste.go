@@ -0,0 +1,183 @@
+package htfs
+
+import (
+	goerrors "errors"
+	"io"
+	"sync"
+
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/htfs/internal/intervals"
+	"github.com/pkg/errors"
+)
+
+// defaultWasteThreshold is the ratio of wasted to served bytes
+// above which we warn, see Settings.WasteThreshold
+const defaultWasteThreshold = 0.5
+
+// minWasteSample is how many bytes must have been served before we
+// judge, so that a few early seeks don't trigger a warning.
+const minWasteSample = 4 * 1024 * 1024
+
+// WasteReport describes how many bytes a File fetched for nothing.
+type WasteReport struct {
+	// ServedBytes were returned to callers
+	ServedBytes int64
+	// DiscardedBytes were downloaded and thrown away to move a conn forward
+	DiscardedBytes int64
+	// DuplicatedBytes were downloaded more than once
+	DuplicatedBytes int64
+}
+
+// Ratio returns wasted (discarded + duplicated) bytes over served bytes
+func (wr WasteReport) Ratio() float64 {
+	if wr.ServedBytes == 0 {
+		return 0
+	}
+	return float64(wr.DiscardedBytes+wr.DuplicatedBytes) / float64(wr.ServedBytes)
+}
+
+// A WasteListenerFunc is called when a File wastes too many bytes,
+// see Settings.WasteThreshold
+type WasteListenerFunc func(report WasteReport)
+
+type wasteTracker struct {
+	mu      sync.Mutex
+	report  WasteReport
+	fetched intervals.Map
+	warned  bool
+}
+
+func (wt *wasteTracker) served(n int64) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+
+	wt.report.ServedBytes += n
+}
+
+func (wt *wasteTracker) discarded(n int64) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+
+	wt.report.DiscardedBytes += n
+}
+
+func (wt *wasteTracker) fetchedRange(start int64, end int64) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+
+	wt.report.DuplicatedBytes += wt.fetched.Covered(start, end)
+	wt.fetched.Add(start, end)
+}
+
+// check returns the report if it's the first time it crosses threshold
+func (wt *wasteTracker) check(threshold float64) (WasteReport, bool) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+
+	if wt.warned || threshold <= 0 || wt.report.ServedBytes < minWasteSample {
+		return WasteReport{}, false
+	}
+	if wt.report.Ratio() < threshold {
+		return WasteReport{}, false
+	}
+	wt.warned = true
+	return wt.report, true
+}
+
+func (wt *wasteTracker) snapshot() WasteReport {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+
+	return wt.report
+}
+
+// WasteReport returns how many bytes this File served, discarded and
+// downloaded more than once so far.
+func (f *File) WasteReport() WasteReport {
+	return f.waste.snapshot()
+}
+
+// checkWaste warns once per File if too many bytes are being wasted.
+func (f *File) checkWaste() {
+	report, ok := f.waste.check(f.WasteThreshold)
+	if !ok {
+		return
+	}
+
+	var advice string
+	if report.DiscardedBytes > report.DuplicatedBytes {
+		advice = "Reads skip around a lot, consider lowering MaxDiscard, or raising MaxConns"
+	} else {
+		advice = "The same ranges are fetched repeatedly, consider raising MaxBacktrack, allowing backtracking, or using htfs/diskcache"
+	}
+	f.warn("Wasting bytes",
+		"served", report.ServedBytes,
+		"discarded", report.DiscardedBytes,
+		"duplicated", report.DuplicatedBytes,
+		"ratio", report.Ratio(),
+		"advice", advice)
+
+	if f.WasteListener != nil {
+		f.WasteListener(report)
+	}
+}
+
+// fetchRecorder records which range is read from a response body, and
+// applies Settings.Limiter. The range is only reported to waste (which
+// is nil if WasteThreshold is negative) by flush, so that reads from
+// different conns don't contend on it.
+type fetchRecorder struct {
+	io.ReadCloser
+	waste   *wasteTracker
+	budget  *fetchBudget
+	limiter httpkit.Limiter
+	// spareOnly makes reads take bytes from limiter before reading,
+	// with TryTake, and fail with errNoSpareBandwidth instead of
+	// waiting, see File.Prefetch
+	spareOnly bool
+	// [start, offset) was read but not reported yet
+	start  int64
+	offset int64
+}
+
+// spareReadSize is the most a spareOnly fetchRecorder reads at a time,
+// since it takes bytes from the limiter before knowing how many it'll get
+const spareReadSize = 16 * 1024
+
+// errNoSpareBandwidth is returned by spareOnly fetchRecorders when the
+// limiter has no bytes to spare right now
+var errNoSpareBandwidth = goerrors.New("no spare bandwidth")
+
+func (fr *fetchRecorder) Read(buf []byte) (int, error) {
+	prepaid := false
+	if fr.spareOnly && fr.limiter != nil {
+		if len(buf) > spareReadSize {
+			buf = buf[:spareReadSize]
+		}
+		tl, ok := fr.limiter.(httpkit.TryLimiter)
+		if !ok || !tl.TryTake(int64(len(buf))) {
+			return 0, errors.WithStack(errNoSpareBandwidth)
+		}
+		prepaid = true
+	}
+
+	n, err := fr.ReadCloser.Read(buf)
+	if n > 0 {
+		fr.offset += int64(n)
+		if fr.limiter != nil && !prepaid {
+			fr.limiter.Take(int64(n))
+		}
+		if budgetErr := fr.budget.spend(int64(n)); budgetErr != nil {
+			return n, budgetErr
+		}
+	}
+	return n, err
+}
+
+// flush reports what was read since the last flush
+func (fr *fetchRecorder) flush() {
+	if fr.waste != nil && fr.offset > fr.start {
+		fr.waste.fetchedRange(fr.start, fr.offset)
+	}
+	fr.start = fr.offset
+}
@@ -0,0 +1,153 @@
+// Package zipfile reads zip archives straight from remote files (typically
+// an *htfs.File). The end of the file, where the central directory is, is
+// fetched with a single request up front, instead of the many small reads
+// archive/zip would do, and entries are read with range reads at their
+// offset, so only the entries that are opened are downloaded.
+package zipfile
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+)
+
+// Settings configures a remote zip Reader
+type Settings struct {
+	// TailSize is how many bytes, from the end of the file, are fetched
+	// up front. If the central directory doesn't fit in them, the rest is
+	// read as needed. Defaults to 256KiB, negative values disable it.
+	TailSize int64
+}
+
+// defaultTailSize fits the central directory of a few thousand entries,
+// plus the longest possible archive comment
+const defaultTailSize int64 = 256 * 1024
+
+// Reader is a zip.Reader over a remote file
+type Reader struct {
+	*zip.Reader
+
+	tail *tailReaderAt
+}
+
+// Open reads the central directory of the zip archive in f. Closing
+// f is up to the caller, once they're done with the Reader.
+func Open(f *htfs.File, settings Settings) (*Reader, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "zipfile: while getting size")
+	}
+	return New(f, stat.Size(), settings)
+}
+
+// New reads the central directory of the zip archive made of the
+// size bytes of r, see Open
+func New(r io.ReaderAt, size int64, settings Settings) (*Reader, error) {
+	tailSize := settings.TailSize
+	if tailSize == 0 {
+		tailSize = defaultTailSize
+	}
+	if tailSize < 0 {
+		tailSize = 0
+	}
+	if tailSize > size {
+		tailSize = size
+	}
+
+	tail := &tailReaderAt{
+		upstream: r,
+		offset:   size - tailSize,
+		data:     make([]byte, tailSize),
+	}
+	_, err := r.ReadAt(tail.data, tail.offset)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "zipfile: while fetching central directory")
+	}
+
+	zr, err := zip.NewReader(tail, size)
+	if err != nil {
+		return nil, errors.Wrap(err, "zipfile: while reading central directory")
+	}
+	return &Reader{
+		Reader: zr,
+		tail:   tail,
+	}, nil
+}
+
+// Entry returns the entry named name, or an error that satisfies
+// os.IsNotExist
+func (r *Reader) Entry(name string) (*zip.File, error) {
+	for _, zf := range r.File {
+		if zf.Name == name {
+			return zf, nil
+		}
+	}
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+}
+
+// OpenEntry returns a reader for the decompressed contents of the
+// entry named name. Its checksum is verified when reaching EOF.
+func (r *Reader) OpenEntry(name string) (io.ReadCloser, error) {
+	zf, err := r.Entry(name)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, errors.Wrapf(err, "zipfile: while opening %s", name)
+	}
+	return rc, nil
+}
+
+// EntryRange returns where the compressed data of zf is, in the
+// remote file, for example to Prefetch it.
+func (r *Reader) EntryRange(zf *zip.File) (offset int64, length int64, err error) {
+	offset, err = zf.DataOffset()
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "zipfile: while locating %s", zf.Name)
+	}
+	return offset, int64(zf.CompressedSize64), nil
+}
+
+// TailSize returns how many bytes were fetched up front, see Settings.TailSize
+func (r *Reader) TailSize() int64 {
+	return int64(len(r.tail.data))
+}
+
+// tailReaderAt serves reads of the last bytes of upstream from memory
+type tailReaderAt struct {
+	upstream io.ReaderAt
+	offset   int64
+	data     []byte
+}
+
+var _ io.ReaderAt = (*tailReaderAt)(nil)
+
+func (tr *tailReaderAt) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset < tr.offset {
+		// starts before the tail, read that part from upstream
+		n := len(buf)
+		if offset+int64(n) > tr.offset {
+			n = int(tr.offset - offset)
+		}
+		read, err := tr.upstream.ReadAt(buf[:n], offset)
+		if err != nil || read == len(buf) {
+			return read, err
+		}
+		m, err := tr.ReadAt(buf[read:], offset+int64(read))
+		return read + m, err
+	}
+
+	i := offset - tr.offset
+	if i >= int64(len(tr.data)) {
+		return 0, io.EOF
+	}
+	n := copy(buf, tr.data[i:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
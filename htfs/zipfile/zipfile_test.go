@@ -0,0 +1,122 @@
+package zipfile
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ZipFile(t *testing.T) {
+	assert := assert.New(t)
+
+	// enough entries for a central directory archive/zip
+	// would read in several chunks
+	contents := make(map[string][]byte)
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	rng := rand.New(rand.NewSource(0xf00d))
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("data/file-%03d.txt", i)
+		data := bytes.Repeat([]byte(name), 1+rng.Intn(200))
+		method := zip.Deflate
+		if i%2 == 0 {
+			method = zip.Store
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		assert.NoError(err)
+		_, err = w.Write(data)
+		assert.NoError(err)
+		contents[name] = data
+	}
+	assert.NoError(zw.Close())
+	zipData := buf.Bytes()
+
+	var numRequests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&numRequests, 1)
+		http.ServeContent(w, r, "archive.zip", time.Time{}, bytes.NewReader(zipData))
+	}))
+	defer server.Close()
+
+	f, err := htfs.Open(func() (string, error) {
+		return server.URL, nil
+	}, func(res *http.Response, body []byte) bool {
+		return false
+	}, &htfs.Settings{})
+	assert.NoError(err)
+	defer f.Close()
+
+	before := atomic.LoadInt64(&numRequests)
+	zr, err := Open(f, Settings{})
+	assert.NoError(err)
+	assert.EqualValues(defaultTailSize, zr.TailSize())
+	assert.True(atomic.LoadInt64(&numRequests)-before <= 1, "central directory fetched with one request")
+	assert.Len(zr.File, len(contents))
+
+	for _, name := range []string{"data/file-000.txt", "data/file-123.txt", "data/file-499.txt"} {
+		rc, err := zr.OpenEntry(name)
+		assert.NoError(err)
+		data, err := ioutil.ReadAll(rc)
+		assert.NoError(err)
+		assert.NoError(rc.Close())
+		assert.EqualValues(contents[name], data)
+	}
+
+	zf, err := zr.Entry("data/file-042.txt")
+	assert.NoError(err)
+	offset, length, err := zr.EntryRange(zf)
+	assert.NoError(err)
+	assert.EqualValues(len(contents["data/file-042.txt"]), length)
+	assert.EqualValues(contents["data/file-042.txt"], zipData[offset:offset+length])
+
+	_, err = zr.OpenEntry("nope.txt")
+	assert.True(os.IsNotExist(err))
+
+	// a tail smaller than the central directory still works
+	zr, err = Open(f, Settings{TailSize: 1024})
+	assert.NoError(err)
+	assert.EqualValues(1024, zr.TailSize())
+	rc, err := zr.OpenEntry("data/file-321.txt")
+	assert.NoError(err)
+	data, err := ioutil.ReadAll(rc)
+	assert.NoError(err)
+	assert.EqualValues(contents["data/file-321.txt"], data)
+}
+
+func Test_TailReaderAt(t *testing.T) {
+	assert := assert.New(t)
+
+	data := []byte("0123456789abcdef")
+	tr := &tailReaderAt{
+		upstream: bytes.NewReader(data),
+		offset:   10,
+		data:     data[10:],
+	}
+
+	buf := make([]byte, 8)
+	n, err := tr.ReadAt(buf, 6)
+	assert.NoError(err)
+	assert.EqualValues("6789abcd", string(buf[:n]))
+
+	n, err = tr.ReadAt(buf, 12)
+	assert.Error(err)
+	assert.EqualValues("cdef", string(buf[:n]))
+
+	n, err = tr.ReadAt(buf, 0)
+	assert.NoError(err)
+	assert.EqualValues("01234567", string(buf[:n]))
+
+	_, err = tr.ReadAt(buf, 16)
+	assert.Error(err)
+}
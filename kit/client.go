@@ -0,0 +1,159 @@
+// Package kit wires httpkit's packages together for the most common
+// flows: reading a remote file (htfs), downloading it to disk, and
+// uploading a local file to a resumable upload session (uploader).
+//
+// It lives in its own package because httpkit's root package holds the
+// types shared by all the others (Logger, Metrics, CommonOptions), so it
+// can't import them.
+package kit
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/htfs"
+	"github.com/itchio/httpkit/retrycontext"
+	"github.com/itchio/httpkit/timeout"
+	"github.com/itchio/httpkit/uploader"
+	"github.com/pkg/errors"
+)
+
+// Client bundles an HTTP client, retry settings, rate limiters and the
+// options shared by all subsystems. It's safe for concurrent use.
+type Client struct {
+	httpClient      *http.Client
+	retrySettings   *retrycontext.Settings
+	downloadLimiter httpkit.Limiter
+	uploadLimiter   httpkit.Limiter
+	common          httpkit.CommonOptions
+}
+
+// New returns a Client configured by opts. By default, it uses a
+// timeout client that never asks for compressed responses, htfs's
+// default retry settings, and no limiters.
+func New(opts ...Option) *Client {
+	c := &Client{}
+	for _, o := range opts {
+		o.Apply(c)
+	}
+
+	if c.httpClient == nil {
+		c.httpClient = timeout.NewClientWithOptions(
+			timeout.WithDisableCompression(),
+			// limiters are applied by htfs and uploader instead
+			timeout.WithCommon(httpkit.CommonOptions{
+				Logger: c.common.Logger,
+				Log:    c.common.Log,
+			}),
+		)
+	}
+	if c.downloadLimiter == nil {
+		c.downloadLimiter = c.common.Limiter
+	}
+	if c.uploadLimiter == nil {
+		c.uploadLimiter = c.common.Limiter
+	}
+	return c
+}
+
+// HTTPClient returns the client used for all requests
+func (c *Client) HTTPClient() *http.Client {
+	return c.httpClient
+}
+
+// OpenRemote opens the file at url with htfs. See OpenRemoteWithRenewal
+// for signed URLs that expire.
+func (c *Client) OpenRemote(url string) (*htfs.File, error) {
+	getURL := func() (string, error) {
+		return url, nil
+	}
+	needsRenewal := func(res *http.Response, body []byte) bool {
+		return false
+	}
+	return c.OpenRemoteWithRenewal(getURL, needsRenewal)
+}
+
+// OpenRemoteWithRenewal opens a remote file with htfs, see htfs.Open
+func (c *Client) OpenRemoteWithRenewal(getURL htfs.GetURLFunc, needsRenewal htfs.NeedsRenewalFunc) (*htfs.File, error) {
+	f, err := htfs.Open(getURL, needsRenewal, c.htfsSettings())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return f, nil
+}
+
+func (c *Client) htfsSettings() *htfs.Settings {
+	common := c.common
+	common.Limiter = c.downloadLimiter
+	return htfs.NewSettings(
+		htfs.WithClient(c.httpClient),
+		htfs.WithRetrySettings(c.retrySettings),
+		htfs.WithCommon(common),
+	)
+}
+
+// Download downloads the file at url to path, see DownloadContext
+func (c *Client) Download(url string, path string) (int64, error) {
+	return c.DownloadContext(context.Background(), url, path)
+}
+
+// DownloadContext downloads the file at url to path, over several
+// connections in parallel (see htfs.File.Download). path is created or
+// truncated. It returns the number of bytes written.
+func (c *Client) DownloadContext(ctx context.Context, url string, path string) (int64, error) {
+	src, err := c.OpenRemote(url)
+	if err != nil {
+		return 0, errors.Wrap(err, "in kit.Download, while opening remote file")
+	}
+	defer src.Close()
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	n, err := src.Download(ctx, dst, nil)
+	c.count("kit.downloaded_bytes", n)
+	if err != nil {
+		dst.Close()
+		return n, errors.Wrap(err, "in kit.Download")
+	}
+
+	err = dst.Close()
+	if err != nil {
+		return n, errors.WithStack(err)
+	}
+	return n, nil
+}
+
+// Upload uploads the file at path to a resumable upload session (see
+// package uploader), and finalizes it. It returns the number of bytes
+// uploaded. Uploads have their own retry logic, so the Client's retry
+// settings don't apply.
+func (c *Client) Upload(path string, sessionURL string) (int64, error) {
+	src, err := htfs.OpenLocal(path, nil, &htfs.Settings{})
+	if err != nil {
+		return 0, errors.Wrap(err, "in kit.Upload, while opening local file")
+	}
+	defer src.Close()
+
+	common := c.common
+	common.Limiter = c.uploadLimiter
+	opts := []uploader.Option{uploader.WithCommon(common)}
+
+	dst := uploader.NewResumableUpload(sessionURL, opts...)
+	n, err := uploader.Transfer(src, dst, opts...)
+	c.count("kit.uploaded_bytes", n)
+	if err != nil {
+		return n, errors.Wrap(err, "in kit.Upload")
+	}
+	return n, nil
+}
+
+func (c *Client) count(name string, delta int64) {
+	if c.common.Metrics != nil && delta > 0 {
+		c.common.Metrics.Add(name, delta)
+	}
+}
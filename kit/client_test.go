@@ -0,0 +1,81 @@
+package kit_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/kit"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMetrics struct {
+	mu       sync.Mutex
+	counters map[string]int64
+}
+
+func (fm *fakeMetrics) Add(name string, delta int64) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.counters[name] += delta
+}
+
+func Test_Client(t *testing.T) {
+	assert := assert.New(t)
+	content := bytes.Repeat([]byte("aaaabbbbccccdddd"), 1024)
+
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.dat", time.Time{}, bytes.NewReader(content))
+	}))
+	defer storage.Close()
+
+	var uploaded bytes.Buffer
+	session := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(err)
+		uploaded.Write(body)
+		w.WriteHeader(200)
+	}))
+	defer session.Close()
+
+	dir, err := ioutil.TempDir("", "kit")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	metrics := &fakeMetrics{counters: make(map[string]int64)}
+	c := kit.New(kit.WithCommon(httpkit.CommonOptions{
+		Metrics: metrics,
+	}))
+
+	f, err := c.OpenRemote(storage.URL + "/file.dat")
+	assert.NoError(err)
+	buf := make([]byte, 4)
+	_, err = f.ReadAt(buf, 4)
+	assert.NoError(err)
+	assert.EqualValues("bbbb", string(buf))
+	assert.NoError(f.Close())
+
+	path := filepath.Join(dir, "file.dat")
+	n, err := c.Download(storage.URL+"/file.dat", path)
+	assert.NoError(err)
+	assert.EqualValues(len(content), n)
+	downloaded, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.EqualValues(content, downloaded)
+
+	n, err = c.Upload(path, session.URL)
+	assert.NoError(err)
+	assert.EqualValues(len(content), n)
+	assert.EqualValues(content, uploaded.Bytes())
+
+	assert.EqualValues(len(content), metrics.counters["kit.downloaded_bytes"])
+	assert.EqualValues(len(content), metrics.counters["kit.uploaded_bytes"])
+	assert.True(metrics.counters["htfs.connections"] >= 2)
+}
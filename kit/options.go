@@ -0,0 +1,90 @@
+package kit
+
+import (
+	"net/http"
+
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/retrycontext"
+)
+
+// Option configures a Client, see New
+type Option interface {
+	Apply(c *Client)
+}
+
+// ---------
+
+type httpClientOption struct {
+	httpClient *http.Client
+}
+
+// WithHTTPClient specifies the client used for all requests. Clients
+// used for downloads shouldn't ask for compressed responses, see
+// timeout.ClientSettings.DisableCompression
+func WithHTTPClient(httpClient *http.Client) Option {
+	return &httpClientOption{
+		httpClient: httpClient,
+	}
+}
+
+func (o *httpClientOption) Apply(c *Client) {
+	c.httpClient = o.httpClient
+}
+
+// ---------
+
+type retrySettingsOption struct {
+	retrySettings *retrycontext.Settings
+}
+
+// WithRetrySettings specifies how failed downloads are retried
+func WithRetrySettings(retrySettings *retrycontext.Settings) Option {
+	return &retrySettingsOption{
+		retrySettings: retrySettings,
+	}
+}
+
+func (o *retrySettingsOption) Apply(c *Client) {
+	c.retrySettings = o.retrySettings
+}
+
+// ---------
+
+type limitersOption struct {
+	download httpkit.Limiter
+	upload   httpkit.Limiter
+}
+
+// WithLimiters caps download and upload throughput separately. Either
+// can be nil, in which case CommonOptions.Limiter is used, if set.
+// Pass the same limiter twice for an overall budget.
+func WithLimiters(download httpkit.Limiter, upload httpkit.Limiter) Option {
+	return &limitersOption{
+		download: download,
+		upload:   upload,
+	}
+}
+
+func (o *limitersOption) Apply(c *Client) {
+	c.downloadLimiter = o.download
+	c.uploadLimiter = o.upload
+}
+
+// ---------
+
+type commonOption struct {
+	common httpkit.CommonOptions
+}
+
+// WithCommon specifies the logger, metrics, clock and limiter passed to
+// all subsystems. Download and upload sizes are also reported to Metrics,
+// as "kit.downloaded_bytes" and "kit.uploaded_bytes".
+func WithCommon(common httpkit.CommonOptions) Option {
+	return &commonOption{
+		common: common,
+	}
+}
+
+func (o *commonOption) Apply(c *Client) {
+	c.common = o.common
+}
@@ -0,0 +1,146 @@
+package httpkit
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Level is the severity of a log message
+type Level int
+
+const (
+	// LevelDebug is for detailed activity, like every read and connection
+	LevelDebug Level = iota
+	// LevelInfo is for notable events, like retries and renewals
+	LevelInfo
+	// LevelWarn is for problems that are worked around, or given up on
+	LevelWarn
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// Logger is a leveled, structured logger. keyvals alternate between
+// keys (strings) and values, like "offset", 1024, "conn", "c3": it's up
+// to the Logger to format them, so messages that are dropped cost nothing.
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	// Enabled returns false if messages at level are dropped, so that
+	// callers can skip computing expensive values
+	Enabled(level Level) bool
+
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+}
+
+// FuncLogger adapts a LogFunc into a Logger that drops messages below
+// minLevel, and formats the rest as "msg key1=value1 key2=value2".
+// If fn is nil, everything is dropped.
+func FuncLogger(fn LogFunc, minLevel Level) Logger {
+	return &funcLogger{fn: fn, minLevel: minLevel}
+}
+
+type funcLogger struct {
+	fn       LogFunc
+	minLevel Level
+}
+
+func (fl *funcLogger) Enabled(level Level) bool {
+	return fl.fn != nil && level >= fl.minLevel
+}
+
+func (fl *funcLogger) Debug(msg string, keyvals ...interface{}) {
+	fl.log(LevelDebug, msg, keyvals)
+}
+
+func (fl *funcLogger) Info(msg string, keyvals ...interface{}) {
+	fl.log(LevelInfo, msg, keyvals)
+}
+
+func (fl *funcLogger) Warn(msg string, keyvals ...interface{}) {
+	fl.log(LevelWarn, msg, keyvals)
+}
+
+func (fl *funcLogger) log(level Level, msg string, keyvals []interface{}) {
+	if !fl.Enabled(level) {
+		return
+	}
+	fl.fn(FormatKeyvals(msg, keyvals...))
+}
+
+// FormatKeyvals formats a message and its keyvals as
+// "msg key1=value1 key2=value2". A trailing key without a value
+// is formatted as "key=?".
+func FormatKeyvals(msg string, keyvals ...interface{}) string {
+	if len(keyvals) == 0 {
+		return msg
+	}
+
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		sb.WriteByte(' ')
+		fmt.Fprint(&sb, keyvals[i])
+		sb.WriteByte('=')
+		if i+1 < len(keyvals) {
+			fmt.Fprint(&sb, keyvals[i+1])
+		} else {
+			sb.WriteByte('?')
+		}
+	}
+	return sb.String()
+}
+
+// NopLogger drops every message
+var NopLogger Logger = FuncLogger(nil, LevelWarn)
+
+// SugaredLogger is implemented by loggers that take keyvals like Logger
+// does, such as zap's *SugaredLogger.
+type SugaredLogger interface {
+	Debugw(msg string, keyvals ...interface{})
+	Infow(msg string, keyvals ...interface{})
+	Warnw(msg string, keyvals ...interface{})
+}
+
+// FromSugared adapts a SugaredLogger into a Logger that passes
+// messages at or above minLevel along, with their keyvals as-is.
+func FromSugared(sl SugaredLogger, minLevel Level) Logger {
+	return &sugaredLogger{sl: sl, minLevel: minLevel}
+}
+
+type sugaredLogger struct {
+	sl       SugaredLogger
+	minLevel Level
+}
+
+func (sl *sugaredLogger) Enabled(level Level) bool {
+	return level >= sl.minLevel
+}
+
+func (sl *sugaredLogger) Debug(msg string, keyvals ...interface{}) {
+	if sl.Enabled(LevelDebug) {
+		sl.sl.Debugw(msg, keyvals...)
+	}
+}
+
+func (sl *sugaredLogger) Info(msg string, keyvals ...interface{}) {
+	if sl.Enabled(LevelInfo) {
+		sl.sl.Infow(msg, keyvals...)
+	}
+}
+
+func (sl *sugaredLogger) Warn(msg string, keyvals ...interface{}) {
+	if sl.Enabled(LevelWarn) {
+		sl.sl.Warnw(msg, keyvals...)
+	}
+}
@@ -0,0 +1,45 @@
+//go:build go1.21
+// +build go1.21
+
+package httpkit
+
+import (
+	"context"
+	"log/slog"
+)
+
+// FromSlog adapts a *slog.Logger into a Logger. Levels map to their slog
+// counterparts, and whether they're enabled is up to l's handler.
+func FromSlog(l *slog.Logger) Logger {
+	return &slogLogger{l: l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func slogLevel(level Level) slog.Level {
+	switch level {
+	case LevelDebug:
+		return slog.LevelDebug
+	case LevelInfo:
+		return slog.LevelInfo
+	}
+	return slog.LevelWarn
+}
+
+func (sl *slogLogger) Enabled(level Level) bool {
+	return sl.l.Enabled(context.Background(), slogLevel(level))
+}
+
+func (sl *slogLogger) Debug(msg string, keyvals ...interface{}) {
+	sl.l.Debug(msg, keyvals...)
+}
+
+func (sl *slogLogger) Info(msg string, keyvals ...interface{}) {
+	sl.l.Info(msg, keyvals...)
+}
+
+func (sl *slogLogger) Warn(msg string, keyvals ...interface{}) {
+	sl.l.Warn(msg, keyvals...)
+}
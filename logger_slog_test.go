@@ -0,0 +1,34 @@
+//go:build go1.21
+// +build go1.21
+
+package httpkit_test
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/itchio/httpkit"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FromSlog(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	l := httpkit.FromSlog(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})))
+	assert.False(l.Enabled(httpkit.LevelDebug))
+	assert.True(l.Enabled(httpkit.LevelWarn))
+
+	l.Debug("dropped")
+	l.Warn("giving up", "offset", 12)
+	assert.EqualValues("level=WARN msg=\"giving up\" offset=12\n", buf.String())
+}
@@ -0,0 +1,84 @@
+package httpkit_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/itchio/httpkit"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FuncLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	var lines []string
+	l := httpkit.FuncLogger(func(msg string) {
+		lines = append(lines, msg)
+	}, httpkit.LevelInfo)
+
+	assert.False(l.Enabled(httpkit.LevelDebug))
+	assert.True(l.Enabled(httpkit.LevelInfo))
+	assert.True(l.Enabled(httpkit.LevelWarn))
+
+	l.Debug("dropped", "offset", 12)
+	l.Info("connected", "offset", 12, "host", "example.org")
+	l.Warn("giving up", "err", errors.New("boom"), "dangling")
+	assert.EqualValues([]string{
+		"connected offset=12 host=example.org",
+		"giving up err=boom dangling=?",
+	}, lines)
+
+	nop := httpkit.FuncLogger(nil, httpkit.LevelDebug)
+	assert.False(nop.Enabled(httpkit.LevelWarn))
+	nop.Warn("nobody hears this")
+
+	assert.EqualValues("warn", httpkit.LevelWarn.String())
+}
+
+type fakeSugared struct {
+	lines []string
+}
+
+func (fs *fakeSugared) Debugw(msg string, keyvals ...interface{}) {
+	fs.lines = append(fs.lines, "debug "+httpkit.FormatKeyvals(msg, keyvals...))
+}
+
+func (fs *fakeSugared) Infow(msg string, keyvals ...interface{}) {
+	fs.lines = append(fs.lines, "info "+httpkit.FormatKeyvals(msg, keyvals...))
+}
+
+func (fs *fakeSugared) Warnw(msg string, keyvals ...interface{}) {
+	fs.lines = append(fs.lines, "warn "+httpkit.FormatKeyvals(msg, keyvals...))
+}
+
+func Test_FromSugared(t *testing.T) {
+	assert := assert.New(t)
+
+	fs := &fakeSugared{}
+	l := httpkit.FromSugared(fs, httpkit.LevelInfo)
+	assert.False(l.Enabled(httpkit.LevelDebug))
+
+	l.Debug("dropped")
+	l.Info("connected", "offset", 12)
+	l.Warn("giving up", "err", errors.New("boom"))
+	assert.EqualValues([]string{
+		"info connected offset=12",
+		"warn giving up err=boom",
+	}, fs.lines)
+
+	assert.False(httpkit.NopLogger.Enabled(httpkit.LevelWarn))
+}
+
+func Test_MetricsFunc(t *testing.T) {
+	assert := assert.New(t)
+
+	counters := make(map[string]int64)
+	var m httpkit.Metrics = httpkit.MetricsFunc(func(name string, delta int64) {
+		counters[name] += delta
+	})
+	m.Add("htfs.connections", 2)
+	m.Add("htfs.connections", 1)
+	assert.EqualValues(3, counters["htfs.connections"])
+
+	httpkit.NopMetrics.Add("htfs.connections", 1)
+}
@@ -0,0 +1,93 @@
+package neterr
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultRetryDelay is the delay Advise suggests for most network errors
+	DefaultRetryDelay = 1 * time.Second
+	// DNSRetryDelay is the delay Advise suggests for name resolution failures,
+	// which rarely clear up immediately
+	DNSRetryDelay = 5 * time.Second
+)
+
+// Advise returns whether an operation that failed with err should be
+// retried, and how long to wait before doing so. Non-network errors are
+// never retried. DNS failures get a longer delay, connection resets
+// are retried immediately.
+func Advise(err error) (retry bool, suggestedDelay time.Duration) {
+	if !IsNetworkError(err) {
+		return false, 0
+	}
+
+	if isDNSError(err) {
+		return true, DNSRetryDelay
+	}
+
+	if isConnectionReset(err) {
+		return true, 0
+	}
+
+	return true, DefaultRetryDelay
+}
+
+func isDNSError(err error) bool {
+	for err != nil {
+		if _, ok := err.(*net.DNSError); ok {
+			return true
+		}
+		err = unwrap(err)
+	}
+	return false
+}
+
+func isConnectionReset(err error) bool {
+	for err != nil {
+		if urlError, ok := err.(*url.Error); ok {
+			// see https://github.com/itchio/butler/issues/167
+			if urlError.Err == io.EOF {
+				return true
+			}
+		}
+
+		if err == syscall.ECONNRESET {
+			return true
+		}
+
+		next := unwrap(err)
+		if next == nil {
+			// only look at the message of the innermost error, all
+			// others include it anyway
+			msg := err.Error()
+			if strings.Contains(msg, "connection reset by peer") {
+				return true
+			}
+			if strings.Contains(msg, "forcibly closed by the remote host") {
+				return true
+			}
+		}
+		err = next
+	}
+	return false
+}
+
+func unwrap(err error) error {
+	switch e := err.(type) {
+	case causer:
+		return e.Cause()
+	case *url.Error:
+		return e.Err
+	case *net.OpError:
+		return e.Err
+	case *os.SyscallError:
+		return e.Err
+	}
+	return nil
+}
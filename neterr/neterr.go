@@ -1,11 +1,9 @@
 package neterr
 
 import (
-	"fmt"
 	"io"
 	"net"
 	"net/url"
-	"strings"
 
 	"github.com/getlantern/idletiming"
 )
@@ -13,62 +11,38 @@ import (
 // IsNetworkError returns true if the error's cause is: io.ErrUnexpectedEOF,
 // any *net.OpError, any *url.Error, any URL that implements `Temporary()`
 // (and returns true)
+//
+// It's called on every failed attempt of hot retry loops, so concrete
+// types are checked first: error messages are only formatted (to match
+// them against patterns) when nothing else identifies the error.
 func IsNetworkError(err error) bool {
-	if err == nil {
-		return false
-	}
-
-	if err == io.ErrUnexpectedEOF {
-		return true
-	}
-
-	if causer, ok := err.(causer); ok {
-		return IsNetworkError(causer.Cause())
-	}
-
-	if urlError, ok := err.(*url.Error); ok {
-		// EOF in this case can signify connection reset,
-		// see https://github.com/itchio/butler/issues/167
-		if urlError.Err == io.EOF {
+	for err != nil {
+		if err == io.ErrUnexpectedEOF || err == idletiming.ErrIdled {
 			return true
 		}
-		return IsNetworkError(urlError.Err)
-	}
-
-	if _, ok := err.(*net.OpError); ok {
-		return true
-	}
-
-	if err == idletiming.ErrIdled {
-		return true
-	}
 
-	{
-		// net/http's http2 errors are unexported structs, I don't know
-		// of a better way to detect this :(
-		// see net/http/h2_bundle.go
-		msg := fmt.Sprintf("%v", err)
-		if strings.HasPrefix(msg, "stream error: stream ID ") {
-			return true
-		}
-		if strings.HasPrefix(msg, "connection error: ") {
-			return true
-		}
-		if strings.Contains(msg, "forcibly closed by the remote host") {
+		switch e := err.(type) {
+		case causer:
+			err = e.Cause()
+			continue
+		case *url.Error:
+			// EOF in this case can signify connection reset,
+			// see https://github.com/itchio/butler/issues/167
+			if e.Err == io.EOF {
+				return true
+			}
+			err = e.Err
+			continue
+		case *net.OpError:
 			return true
 		}
-		if strings.Contains(msg, "broken pipe") {
-			return true
-		}
-		if strings.Contains(msg, "protocol wrong type for socket") {
+
+		if te, ok := err.(temporary); ok && te.Temporary() {
 			return true
 		}
-	}
 
-	if te, ok := err.(temporary); ok {
-		return te.Temporary()
+		return matchesPattern(err.Error())
 	}
-
 	return false
 }
 
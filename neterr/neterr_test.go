@@ -4,6 +4,10 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -109,3 +113,114 @@ func Test_UnexpectedEof(t *testing.T) {
 	t.Logf("%v", err)
 	assert.True(neterr.IsNetworkError(err))
 }
+
+func Test_Advise(t *testing.T) {
+	assert := assert.New(t)
+
+	retry, delay := neterr.Advise(nil)
+	assert.False(retry)
+	assert.EqualValues(0, delay)
+
+	retry, _ = neterr.Advise(errors.New("not a network error"))
+	assert.False(retry)
+
+	dnsErr := &net.OpError{
+		Op:  "dial",
+		Err: &net.DNSError{Err: "no such host", Name: "no.example.org"},
+	}
+	retry, delay = neterr.Advise(errors.WithStack(dnsErr))
+	assert.True(retry)
+	assert.EqualValues(neterr.DNSRetryDelay, delay)
+
+	resetErr := &net.OpError{
+		Op:  "read",
+		Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET},
+	}
+	retry, delay = neterr.Advise(errors.WithStack(resetErr))
+	assert.True(retry)
+	assert.EqualValues(0, delay)
+
+	retry, delay = neterr.Advise(&url.Error{Op: "Get", URL: "http://example.org", Err: io.EOF})
+	assert.True(retry)
+	assert.EqualValues(0, delay)
+
+	retry, delay = neterr.Advise(io.ErrUnexpectedEOF)
+	assert.True(retry)
+	assert.EqualValues(neterr.DefaultRetryDelay, delay)
+}
+
+func Test_Patterns(t *testing.T) {
+	assert := assert.New(t)
+	defer neterr.ResetPatterns()
+
+	assert.NotEmpty(neterr.BuiltinPatterns())
+	assert.True(neterr.IsNetworkError(errors.New("write: broken pipe")))
+
+	proxyErr := errors.New("proxy: upstream went away (code 7)")
+	tlsErr := errors.New("tls: handshake interrupted by middlebox")
+	assert.False(neterr.IsNetworkError(proxyErr))
+	assert.False(neterr.IsNetworkError(tlsErr))
+
+	err := neterr.LoadPatterns(strings.NewReader(`
+# seen behind corporate proxies
+upstream went away
+^tls: handshake interrupted
+`))
+	assert.NoError(err)
+	assert.Len(neterr.ExtraPatterns(), 2)
+	assert.True(neterr.IsNetworkError(proxyErr))
+	assert.True(neterr.IsNetworkError(errors.WithStack(tlsErr)))
+	assert.False(neterr.IsNetworkError(errors.New("oh: tls: handshake interrupted")))
+
+	neterr.ResetPatterns()
+	assert.False(neterr.IsNetworkError(proxyErr))
+}
+
+func classificationCases() map[string]error {
+	opErr := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	return map[string]error{
+		"op":         errors.Wrap(errors.WithStack(opErr), "while reading"),
+		"url-eof":    errors.WithStack(&url.Error{Op: "Get", URL: "http://example.org", Err: io.EOF}),
+		"unexpected": errors.WithStack(io.ErrUnexpectedEOF),
+		"pattern":    errors.WithStack(errors.New("write: broken pipe")),
+		"other":      errors.Wrap(os.ErrNotExist, "while opening"),
+	}
+}
+
+func Test_IsNetworkErrorAllocs(t *testing.T) {
+	assert := assert.New(t)
+
+	// types tell these apart, no need to look at messages
+	cases := classificationCases()
+	for _, name := range []string{"op", "url-eof", "unexpected"} {
+		err := cases[name]
+		allocs := testing.AllocsPerRun(100, func() {
+			neterr.IsNetworkError(err)
+		})
+		assert.EqualValues(0, allocs, "for %s", name)
+	}
+}
+
+func BenchmarkIsNetworkError(b *testing.B) {
+	for name, err := range classificationCases() {
+		err := err
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				neterr.IsNetworkError(err)
+			}
+		})
+	}
+}
+
+func BenchmarkAdvise(b *testing.B) {
+	for name, err := range classificationCases() {
+		err := err
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				neterr.Advise(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package neterr
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// A Pattern matches the message of errors that should be
+// considered network errors, when nothing else identifies them.
+type Pattern struct {
+	// Prefix, if set, must be a prefix of the error message
+	Prefix string
+	// Substring, if set, must be contained in the error message
+	Substring string
+}
+
+func (p Pattern) matches(msg string) bool {
+	if p.Prefix == "" && p.Substring == "" {
+		return false
+	}
+	return strings.HasPrefix(msg, p.Prefix) && strings.Contains(msg, p.Substring)
+}
+
+var builtinPatterns = []Pattern{
+	// net/http's http2 errors are unexported structs, I don't know
+	// of a better way to detect this :(
+	// see net/http/h2_bundle.go
+	{Prefix: "stream error: stream ID "},
+	{Prefix: "connection error: "},
+	{Substring: "forcibly closed by the remote host"},
+	{Substring: "broken pipe"},
+	{Substring: "protocol wrong type for socket"},
+}
+
+var extraPatterns []Pattern
+var extraPatternsLock sync.RWMutex
+
+// BuiltinPatterns returns a copy of the patterns IsNetworkError
+// always checks, for auditing.
+func BuiltinPatterns() []Pattern {
+	return append([]Pattern(nil), builtinPatterns...)
+}
+
+// ExtraPatterns returns a copy of the patterns added at runtime.
+func ExtraPatterns() []Pattern {
+	extraPatternsLock.RLock()
+	defer extraPatternsLock.RUnlock()
+
+	return append([]Pattern(nil), extraPatterns...)
+}
+
+// AddPatterns makes IsNetworkError also match the given patterns,
+// for error strings observed in the wild after release.
+func AddPatterns(patterns ...Pattern) {
+	extraPatternsLock.Lock()
+	defer extraPatternsLock.Unlock()
+
+	extraPatterns = append(extraPatterns, patterns...)
+}
+
+// ResetPatterns removes all patterns added at runtime.
+func ResetPatterns() {
+	extraPatternsLock.Lock()
+	defer extraPatternsLock.Unlock()
+
+	extraPatterns = nil
+}
+
+// LoadPatterns reads patterns from r and adds them (see AddPatterns).
+// There's one pattern per line: a substring, or a prefix if the line
+// starts with '^'. Empty lines and lines starting with '#' are ignored.
+func LoadPatterns(r io.Reader) error {
+	var patterns []Pattern
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "^") {
+			patterns = append(patterns, Pattern{Prefix: line[1:]})
+		} else {
+			patterns = append(patterns, Pattern{Substring: line})
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		return errors.Wrap(err, "while reading neterr patterns")
+	}
+
+	AddPatterns(patterns...)
+	return nil
+}
+
+// LoadPatternsFile is LoadPatterns for the file at path. Applications
+// call it at startup, if they ship or download a patterns file.
+func LoadPatternsFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	return LoadPatterns(f)
+}
+
+func matchesPattern(msg string) bool {
+	for _, p := range builtinPatterns {
+		if p.matches(msg) {
+			return true
+		}
+	}
+
+	extraPatternsLock.RLock()
+	defer extraPatternsLock.RUnlock()
+
+	for _, p := range extraPatterns {
+		if p.matches(msg) {
+			return true
+		}
+	}
+	return false
+}
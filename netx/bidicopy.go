@@ -0,0 +1,233 @@
+// Package netx contains networking helpers that don't fit in net/http:
+// relaying bytes between two connections, and the PROXY protocol.
+package netx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Direction is one of the two ways bytes go in a BidiCopyContext
+type Direction int
+
+const (
+	// AToB copies what's read from a to b
+	AToB Direction = iota
+	// BToA copies what's read from b to a
+	BToA
+)
+
+func (d Direction) String() string {
+	switch d {
+	case AToB:
+		return "a->b"
+	case BToA:
+		return "b->a"
+	}
+	return fmt.Sprintf("direction(%d)", int(d))
+}
+
+// Side is the end of a copy an error came from
+type Side int
+
+const (
+	// SideNone is for copies that didn't fail
+	SideNone Side = iota
+	// SideReader means reading from the source failed
+	SideReader
+	// SideWriter means writing to the destination failed
+	SideWriter
+)
+
+func (s Side) String() string {
+	switch s {
+	case SideNone:
+		return "none"
+	case SideReader:
+		return "reader"
+	case SideWriter:
+		return "writer"
+	}
+	return fmt.Sprintf("side(%d)", int(s))
+}
+
+// CopyResult is how one direction of a BidiCopyContext went
+type CopyResult struct {
+	Direction Direction
+	// Bytes is how many bytes were written to the destination
+	Bytes int64
+	// Err is nil if the source reached EOF
+	Err error
+	// FailedSide is which end Err came from
+	FailedSide Side
+	// Stopped is set if the copy was still going when the other
+	// direction finished (or the context was done), so Err is
+	// only the result of closing both ends under it
+	Stopped bool
+}
+
+// BidiResult is the outcome of a BidiCopyContext
+type BidiResult struct {
+	// First is the direction that finished first, Second the
+	// one that was stopped, unless it was done by then too
+	First  CopyResult
+	Second CopyResult
+	// CloseErr is the first error closing a or b returned
+	CloseErr error
+
+	ctxErr error
+}
+
+// Direction returns the result for d
+func (br *BidiResult) Direction(d Direction) CopyResult {
+	if br.First.Direction == d {
+		return br.First
+	}
+	return br.Second
+}
+
+// Err returns what BidiCopy does: the context's error if it was done
+// first, otherwise the error of the direction that finished first,
+// otherwise the error from closing.
+func (br *BidiResult) Err() error {
+	if br.ctxErr != nil {
+		return errors.Wrap(br.ctxErr, "in BidiCopy")
+	}
+	if br.First.Err != nil {
+		return br.First.Err
+	}
+	return br.CloseErr
+}
+
+// BidiCopy copies data from a to b and from b to a, until either side
+// is done. Both a and b are closed when BidiCopy returns. The first
+// error encountered is returned, io.EOF on either side is not an error.
+func BidiCopy(a io.ReadWriteCloser, b io.ReadWriteCloser) error {
+	return BidiCopyContext(context.Background(), a, b).Err()
+}
+
+// BidiCopyContext is BidiCopy, except it stops when ctx is done, and
+// reports how many bytes went each way, and which end of which
+// direction failed, so proxies can account for traffic accurately.
+func BidiCopyContext(ctx context.Context, a io.ReadWriteCloser, b io.ReadWriteCloser) *BidiResult {
+	results := make(chan CopyResult, 2)
+
+	go doCopy(AToB, b, a, results)
+	go doCopy(BToA, a, b, results)
+
+	br := &BidiResult{}
+	pending := 2
+
+	// wait for one side to be done, then close both
+	// so that the other copy returns too.
+	select {
+	case br.First = <-results:
+		pending--
+	case <-ctx.Done():
+		br.ctxErr = ctx.Err()
+	}
+
+	closeErrA := a.Close()
+	closeErrB := b.Close()
+	if closeErrA != nil {
+		br.CloseErr = errors.Wrap(closeErrA, "in BidiCopy, while closing")
+	} else if closeErrB != nil {
+		br.CloseErr = errors.Wrap(closeErrB, "in BidiCopy, while closing")
+	}
+
+	for ; pending > 0; pending-- {
+		res := <-results
+		res.Stopped = res.Err != nil
+		if pending == 2 {
+			br.First = res
+		} else {
+			br.Second = res
+		}
+	}
+	return br
+}
+
+func doCopy(dir Direction, dst io.Writer, src io.Reader, results chan<- CopyResult) {
+	res := CopyResult{Direction: dir}
+
+	var err error
+	_, srcWriterTo := src.(io.WriterTo)
+	_, dstReaderFrom := dst.(io.ReaderFrom)
+	if srcWriterTo || dstReaderFrom {
+		// io.Copy's fast paths (like splice between TCP conns)
+		// need the ends themselves, not wrappers
+		res.Bytes, err = io.Copy(dst, src)
+		if err != nil {
+			res.FailedSide = fastCopySide(err, srcWriterTo)
+		}
+	} else {
+		sr := &sideReader{Reader: src}
+		sw := &sideWriter{Writer: dst}
+		res.Bytes, err = io.Copy(sw, sr)
+		if err != nil {
+			res.FailedSide = SideReader
+			if sw.err != nil {
+				res.FailedSide = SideWriter
+			}
+		}
+	}
+
+	if err != nil {
+		if res.FailedSide == SideWriter {
+			res.Err = errors.Wrapf(err, "in BidiCopy, while writing %s", dir)
+		} else {
+			res.Err = errors.Wrapf(err, "in BidiCopy, while reading %s", dir)
+		}
+	}
+	results <- res
+}
+
+// fastCopySide tells which end an error from src.WriteTo or
+// dst.ReadFrom came from, when net says, or guesses it was the
+// end whose method was called
+func fastCopySide(err error, srcWriterTo bool) Side {
+	if opErr, ok := err.(*net.OpError); ok {
+		switch opErr.Op {
+		case "read":
+			return SideReader
+		case "write":
+			return SideWriter
+		}
+	}
+	if srcWriterTo {
+		return SideReader
+	}
+	return SideWriter
+}
+
+// sideReader remembers whether reading failed, io.Copy doesn't say
+type sideReader struct {
+	io.Reader
+	err error
+}
+
+func (sr *sideReader) Read(buf []byte) (int, error) {
+	n, err := sr.Reader.Read(buf)
+	if err != nil && err != io.EOF {
+		sr.err = err
+	}
+	return n, err
+}
+
+// sideWriter remembers whether writing failed, io.Copy doesn't say
+type sideWriter struct {
+	io.Writer
+	err error
+}
+
+func (sw *sideWriter) Write(buf []byte) (int, error) {
+	n, err := sw.Writer.Write(buf)
+	if err != nil {
+		sw.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,321 @@
+package netx_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/clock"
+	"github.com/itchio/httpkit/netx"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ProxyHeaderRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	headers := []*netx.ProxyHeader{
+		{
+			Version:    netx.ProxyProtocolV1,
+			SourceAddr: &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324},
+			DestAddr:   &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 443},
+		},
+		{
+			Version:    netx.ProxyProtocolV1,
+			SourceAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234},
+			DestAddr:   &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80},
+		},
+		{Version: netx.ProxyProtocolV1},
+		{
+			Version:    netx.ProxyProtocolV2,
+			SourceAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1},
+			DestAddr:   &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 65535},
+		},
+		{
+			Version:    netx.ProxyProtocolV2,
+			SourceAddr: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 4000},
+			DestAddr:   &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 5000},
+		},
+		{Version: netx.ProxyProtocolV2},
+	}
+
+	for _, h := range headers {
+		buf := new(bytes.Buffer)
+		_, err := h.WriteTo(buf)
+		assert.NoError(err)
+		buf.WriteString("payload")
+
+		r := bufio.NewReader(buf)
+		parsed, err := netx.ReadProxyHeader(r)
+		assert.NoError(err)
+		assert.Equal(h.Version, parsed.Version)
+		if h.SourceAddr == nil {
+			assert.Nil(parsed.SourceAddr)
+			assert.Nil(parsed.DestAddr)
+		} else {
+			assert.Equal(h.SourceAddr.String(), parsed.SourceAddr.String())
+			assert.Equal(h.DestAddr.String(), parsed.DestAddr.String())
+		}
+
+		rest, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal("payload", string(rest))
+	}
+}
+
+func Test_ReadProxyHeaderNone(t *testing.T) {
+	assert := assert.New(t)
+
+	r := bufio.NewReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n")))
+	_, err := netx.ReadProxyHeader(r)
+	assert.Equal(netx.ErrNoProxyHeader, err)
+
+	rest, err := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal("GET / HTTP/1.1\r\n\r\n", string(rest), "nothing should be consumed")
+
+	r = bufio.NewReader(bytes.NewReader([]byte("PROXY TCP4 nope\r\n")))
+	_, err = netx.ReadProxyHeader(r)
+	assert.Error(err)
+}
+
+func Test_Relay(t *testing.T) {
+	assert := assert.New(t)
+
+	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer upstreamListener.Close()
+
+	relayListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer relayListener.Close()
+
+	received := make(chan []byte)
+	go func() {
+		conn, err := upstreamListener.Accept()
+		assert.NoError(err)
+		buf, err := ioutil.ReadAll(conn)
+		assert.NoError(err)
+		conn.Close()
+		received <- buf
+	}()
+
+	relayed := make(chan error)
+	go func() {
+		client, err := relayListener.Accept()
+		assert.NoError(err)
+		upstream, err := net.Dial("tcp", upstreamListener.Addr().String())
+		assert.NoError(err)
+		relayed <- netx.Relay(client, upstream, &netx.RelaySettings{
+			ParseProxyHeader: true,
+			EmitProxyHeader:  netx.ProxyProtocolV2,
+		})
+	}()
+
+	client, err := net.Dial("tcp", relayListener.Addr().String())
+	assert.NoError(err)
+	_, err = client.Write([]byte("PROXY TCP4 203.0.113.7 192.168.0.11 56324 443\r\nhello"))
+	assert.NoError(err)
+	client.Close()
+
+	assert.NoError(<-relayed)
+
+	r := bufio.NewReader(bytes.NewReader(<-received))
+	h, err := netx.ReadProxyHeader(r)
+	assert.NoError(err)
+	assert.Equal(netx.ProxyProtocolV2, h.Version)
+	assert.Equal("203.0.113.7:56324", h.SourceAddr.String())
+	assert.Equal("192.168.0.11:443", h.DestAddr.String())
+
+	rest, err := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal("hello", string(rest))
+}
+
+func Test_BidiCopyContext(t *testing.T) {
+	assert := assert.New(t)
+
+	// x <-> a, relayed to b <-> y
+	x, a := net.Pipe()
+	b, y := net.Pipe()
+	done := make(chan *netx.BidiResult)
+	go func() {
+		done <- netx.BidiCopyContext(context.Background(), a, b)
+	}()
+
+	_, err := x.Write([]byte("hello"))
+	assert.NoError(err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(y, buf)
+	assert.NoError(err)
+	_, err = y.Write([]byte("hi"))
+	assert.NoError(err)
+	_, err = io.ReadFull(x, buf[:2])
+	assert.NoError(err)
+
+	assert.NoError(x.Close())
+	res := <-done
+	assert.NoError(res.Err())
+	assert.EqualValues(netx.AToB, res.First.Direction)
+	assert.EqualValues(netx.SideNone, res.First.FailedSide)
+	assert.EqualValues(5, res.Direction(netx.AToB).Bytes)
+	assert.EqualValues(2, res.Direction(netx.BToA).Bytes)
+	assert.True(res.Second.Stopped)
+
+	// writer failures are told apart from reader failures
+	x, a = net.Pipe()
+	go func() {
+		x.Write([]byte("hello"))
+	}()
+	res = netx.BidiCopyContext(context.Background(), a, &failingConn{closed: make(chan struct{})})
+	assert.Error(res.Err())
+	assert.EqualValues(netx.AToB, res.First.Direction)
+	assert.EqualValues(netx.SideWriter, res.First.FailedSide)
+	x.Close()
+
+	// contexts stop copies
+	x, a = net.Pipe()
+	b, y = net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancel()
+	res = netx.BidiCopyContext(ctx, a, b)
+	assert.Error(res.Err())
+	assert.Contains(res.Err().Error(), "context canceled")
+	assert.True(res.First.Stopped)
+	assert.True(res.Second.Stopped)
+	x.Close()
+	y.Close()
+}
+
+// failingConn has nothing to read until closed, and fails all writes
+type failingConn struct {
+	closed chan struct{}
+}
+
+func (fc *failingConn) Read(buf []byte) (int, error) {
+	<-fc.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (fc *failingConn) Write(buf []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func (fc *failingConn) Close() error {
+	close(fc.closed)
+	return nil
+}
+
+func Test_Pipe(t *testing.T) {
+	assert := assert.New(t)
+
+	a, b := netx.Pipe(nil)
+	go func() {
+		_, err := a.Write([]byte("hello"))
+		assert.NoError(err)
+		assert.NoError(a.Close())
+	}()
+
+	received, err := ioutil.ReadAll(b)
+	assert.NoError(err)
+	assert.Equal("hello", string(received))
+
+	_, err = b.Write([]byte("too late"))
+	assert.Error(err)
+}
+
+func Test_PipeShaping(t *testing.T) {
+	assert := assert.New(t)
+
+	a, b := netx.Pipe(&netx.PipeSettings{
+		Latency:        50 * time.Millisecond,
+		BytesPerSecond: 100 * 1024,
+	})
+
+	payload := bytes.Repeat([]byte{42}, 20*1024)
+	start := time.Now()
+	go func() {
+		_, err := a.Write(payload)
+		assert.NoError(err)
+		a.Close()
+	}()
+
+	received, err := ioutil.ReadAll(b)
+	assert.NoError(err)
+	assert.Equal(payload, received)
+
+	// 200ms for transmission, 50ms latency
+	elapsed := time.Since(start)
+	t.Logf("transferred %d bytes in %s", len(payload), elapsed)
+	assert.True(elapsed >= 250*time.Millisecond)
+}
+
+func Test_PipeLoss(t *testing.T) {
+	assert := assert.New(t)
+
+	fc := clock.NewFake(time.Now())
+	a, b := netx.Pipe(&netx.PipeSettings{
+		Latency:           10 * time.Millisecond,
+		Loss:              1,
+		RetransmitTimeout: 100 * time.Millisecond,
+		Clock:             fc,
+	})
+	start := fc.Now()
+
+	_, err := a.Write([]byte("x"))
+	assert.NoError(err)
+
+	received := make(chan time.Time)
+	go func() {
+		_, err := b.Read(make([]byte, 1))
+		assert.NoError(err)
+		received <- fc.Now()
+	}()
+
+	for {
+		select {
+		case at := <-received:
+			// every retransmission is lost, up to the limit
+			assert.True(at.Sub(start) >= 10*time.Millisecond+10*100*time.Millisecond)
+			return
+		default:
+			fc.Advance(10 * time.Millisecond)
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func Test_PipeDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	fc := clock.NewFake(time.Now())
+	a, b := netx.Pipe(&netx.PipeSettings{
+		Latency: 10 * time.Millisecond,
+		Clock:   fc,
+	})
+
+	_, err := a.Write([]byte("x"))
+	assert.NoError(err)
+
+	assert.NoError(b.SetReadDeadline(fc.Now().Add(5 * time.Millisecond)))
+	done := make(chan error)
+	go func() {
+		_, err := b.Read(make([]byte, 1))
+		done <- err
+	}()
+	for {
+		select {
+		case err := <-done:
+			ne, ok := err.(net.Error)
+			assert.True(ok && ne.Timeout())
+			return
+		default:
+			fc.Advance(time.Millisecond)
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package netx
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/itchio/httpkit/clock"
+)
+
+// PipeSettings shapes the links of a Pipe. The zero value gives an
+// instantaneous link with unlimited bandwidth, like net.Pipe (except
+// writes never wait for the other side to read).
+type PipeSettings struct {
+	// Latency is added to every segment, in each direction
+	Latency time.Duration
+	// Jitter is the maximum random latency added on top of Latency.
+	// Segments are never reordered.
+	Jitter time.Duration
+	// BytesPerSecond is the bandwidth of each direction. Zero means unlimited.
+	BytesPerSecond int64
+	// Loss is the probability (between 0 and 1) that a segment is lost.
+	// Lost segments are retransmitted after RetransmitTimeout, like TCP would.
+	Loss float64
+	// RetransmitTimeout defaults to 200ms
+	RetransmitTimeout time.Duration
+	// SegmentSize is the size writes are split into. Defaults to 16KiB.
+	SegmentSize int
+	// Seed makes jitter and loss deterministic
+	Seed int64
+	// Clock is used for all delays. If nil, clock.Real is used.
+	Clock clock.Clock
+}
+
+const (
+	defaultPipeSegmentSize       = 16 * 1024
+	defaultPipeRetransmitTimeout = 200 * time.Millisecond
+	// so that a Loss of 1 doesn't hang forever
+	maxPipeRetransmits = 10
+)
+
+// Pipe returns two ends of an in-memory connection, whose links
+// are shaped according to settings. It's meant for tests that need
+// slow or lossy networks without binding real sockets.
+func Pipe(settings *PipeSettings) (net.Conn, net.Conn) {
+	if settings == nil {
+		settings = &PipeSettings{}
+	}
+	s := *settings
+	if s.SegmentSize <= 0 {
+		s.SegmentSize = defaultPipeSegmentSize
+	}
+	if s.RetransmitTimeout <= 0 {
+		s.RetransmitTimeout = defaultPipeRetransmitTimeout
+	}
+	clk := clock.Or(s.Clock)
+	prng := &lockedRand{r: rand.New(rand.NewSource(s.Seed))}
+
+	ab := newPipeLink(&s, clk, prng)
+	ba := newPipeLink(&s, clk, prng)
+
+	a := &pipeConn{clock: clk, in: ba, out: ab, local: pipeAddr("pipe-a"), remote: pipeAddr("pipe-b")}
+	b := &pipeConn{clock: clk, in: ab, out: ba, local: pipeAddr("pipe-b"), remote: pipeAddr("pipe-a")}
+	return a, b
+}
+
+type pipeAddr string
+
+func (pa pipeAddr) Network() string { return "pipe" }
+func (pa pipeAddr) String() string  { return string(pa) }
+
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (lr *lockedRand) Float64() float64 {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	return lr.r.Float64()
+}
+
+type pipeSegment struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// pipeLink is one direction of a Pipe
+type pipeLink struct {
+	settings *PipeSettings
+	clock    clock.Clock
+	prng     *lockedRand
+
+	mu          sync.Mutex
+	segments    []*pipeSegment
+	changed     chan struct{}
+	nextFree    time.Time
+	lastDeliver time.Time
+	// writer closed its end: reader gets EOF once drained
+	writerClosed bool
+	// reader closed its end: writer gets io.ErrClosedPipe
+	readerClosed bool
+}
+
+func newPipeLink(settings *PipeSettings, clk clock.Clock, prng *lockedRand) *pipeLink {
+	return &pipeLink{
+		settings: settings,
+		clock:    clk,
+		prng:     prng,
+		changed:  make(chan struct{}),
+	}
+}
+
+// must be called with mu held
+func (l *pipeLink) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// send queues a segment and returns the time at which it's
+// done being transmitted (according to bandwidth)
+func (l *pipeLink) send(data []byte) (time.Time, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.readerClosed || l.writerClosed {
+		return time.Time{}, io.ErrClosedPipe
+	}
+
+	s := l.settings
+	now := l.clock.Now()
+
+	departure := now
+	if l.nextFree.After(departure) {
+		departure = l.nextFree
+	}
+	if s.BytesPerSecond > 0 {
+		departure = departure.Add(time.Duration(float64(len(data)) / float64(s.BytesPerSecond) * float64(time.Second)))
+	}
+	l.nextFree = departure
+
+	deliverAt := departure.Add(s.Latency)
+	if s.Jitter > 0 {
+		deliverAt = deliverAt.Add(time.Duration(l.prng.Float64() * float64(s.Jitter)))
+	}
+	for i := 0; i < maxPipeRetransmits && s.Loss > 0 && l.prng.Float64() < s.Loss; i++ {
+		deliverAt = deliverAt.Add(s.RetransmitTimeout)
+	}
+	// no reordering
+	if deliverAt.Before(l.lastDeliver) {
+		deliverAt = l.lastDeliver
+	}
+	l.lastDeliver = deliverAt
+
+	l.segments = append(l.segments, &pipeSegment{
+		data:      append([]byte(nil), data...),
+		deliverAt: deliverAt,
+	})
+	l.notify()
+	return departure, nil
+}
+
+func (l *pipeLink) closeWriter() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.writerClosed = true
+	l.notify()
+}
+
+func (l *pipeLink) closeReader() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.readerClosed = true
+	l.segments = nil
+	l.notify()
+}
+
+func (l *pipeLink) receive(buf []byte, deadline <-chan time.Time) (int, error) {
+	for {
+		l.mu.Lock()
+		if l.readerClosed {
+			l.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+
+		var wait <-chan time.Time
+		if len(l.segments) > 0 {
+			seg := l.segments[0]
+			delay := seg.deliverAt.Sub(l.clock.Now())
+			if delay <= 0 {
+				n := copy(buf, seg.data)
+				seg.data = seg.data[n:]
+				if len(seg.data) == 0 {
+					l.segments = l.segments[1:]
+				}
+				l.mu.Unlock()
+				return n, nil
+			}
+			wait = l.clock.After(delay)
+		} else if l.writerClosed {
+			l.mu.Unlock()
+			return 0, io.EOF
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-wait:
+		case <-deadline:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+type pipeConn struct {
+	clock  clock.Clock
+	in     *pipeLink
+	out    *pipeLink
+	local  net.Addr
+	remote net.Addr
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closeOnce     sync.Once
+}
+
+var _ net.Conn = (*pipeConn)(nil)
+
+func (pc *pipeConn) Read(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	pc.mu.Lock()
+	deadline := pc.readDeadline
+	pc.mu.Unlock()
+
+	var deadlineChan <-chan time.Time
+	if !deadline.IsZero() {
+		remaining := deadline.Sub(pc.clock.Now())
+		if remaining <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		deadlineChan = pc.clock.After(remaining)
+	}
+
+	return pc.in.receive(buf, deadlineChan)
+}
+
+func (pc *pipeConn) Write(buf []byte) (int, error) {
+	pc.mu.Lock()
+	deadline := pc.writeDeadline
+	pc.mu.Unlock()
+
+	segmentSize := pc.out.settings.SegmentSize
+	written := 0
+	for written < len(buf) {
+		if !deadline.IsZero() && !pc.clock.Now().Before(deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+
+		end := written + segmentSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+
+		departure, err := pc.out.send(buf[written:end])
+		if err != nil {
+			return written, err
+		}
+		written = end
+
+		// simulate backpressure: wait for the segment to leave
+		if wait := departure.Sub(pc.clock.Now()); wait > 0 {
+			pc.clock.Sleep(wait)
+		}
+	}
+	return written, nil
+}
+
+func (pc *pipeConn) Close() error {
+	pc.closeOnce.Do(func() {
+		pc.out.closeWriter()
+		pc.in.closeReader()
+	})
+	return nil
+}
+
+func (pc *pipeConn) LocalAddr() net.Addr {
+	return pc.local
+}
+
+func (pc *pipeConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+func (pc *pipeConn) SetDeadline(t time.Time) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.readDeadline = t
+	pc.writeDeadline = t
+	return nil
+}
+
+func (pc *pipeConn) SetReadDeadline(t time.Time) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.readDeadline = t
+	return nil
+}
+
+func (pc *pipeConn) SetWriteDeadline(t time.Time) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.writeDeadline = t
+	return nil
+}
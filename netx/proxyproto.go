@@ -0,0 +1,271 @@
+package netx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ProxyProtocolVersion is a version of HAProxy's PROXY protocol,
+// see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+type ProxyProtocolVersion int
+
+const (
+	// ProxyProtocolNone means no PROXY header is sent
+	ProxyProtocolNone ProxyProtocolVersion = 0
+	// ProxyProtocolV1 is the human-readable version of the header
+	ProxyProtocolV1 ProxyProtocolVersion = 1
+	// ProxyProtocolV2 is the binary version of the header
+	ProxyProtocolV2 ProxyProtocolVersion = 2
+)
+
+// ProxyHeader holds the original addresses of a relayed connection.
+// If SourceAddr or DestAddr is nil, the connection is relayed
+// as "UNKNOWN" (v1) or "LOCAL" (v2), and backends should use
+// the addresses of the connection itself.
+type ProxyHeader struct {
+	Version    ProxyProtocolVersion
+	SourceAddr *net.TCPAddr
+	DestAddr   *net.TCPAddr
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV1Prefix = "PROXY "
+	// longest possible v1 header, including CRLF
+	proxyV1MaxLength = 107
+)
+
+// ErrNoProxyHeader is returned by ReadProxyHeader when the connection
+// does not start with a PROXY protocol header.
+var ErrNoProxyHeader = errors.New("no PROXY protocol header")
+
+// NewProxyHeader returns a header describing conn, as seen from a relay:
+// the source is conn's remote address, the destination its local address.
+func NewProxyHeader(version ProxyProtocolVersion, conn net.Conn) *ProxyHeader {
+	h := &ProxyHeader{Version: version}
+	src, srcOK := conn.RemoteAddr().(*net.TCPAddr)
+	dst, dstOK := conn.LocalAddr().(*net.TCPAddr)
+	if srcOK && dstOK {
+		h.SourceAddr = src
+		h.DestAddr = dst
+	}
+	return h
+}
+
+func (h *ProxyHeader) known() bool {
+	return h.SourceAddr != nil && h.DestAddr != nil
+}
+
+func (h *ProxyHeader) ipv4() bool {
+	return h.SourceAddr.IP.To4() != nil && h.DestAddr.IP.To4() != nil
+}
+
+// WriteTo writes the header in the format specified by h.Version.
+func (h *ProxyHeader) WriteTo(w io.Writer) (int64, error) {
+	var buf []byte
+	switch h.Version {
+	case ProxyProtocolV1:
+		buf = h.formatV1()
+	case ProxyProtocolV2:
+		buf = h.formatV2()
+	default:
+		return 0, errors.Errorf("unsupported PROXY protocol version %d", h.Version)
+	}
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func (h *ProxyHeader) formatV1() []byte {
+	if !h.known() {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP6"
+	if h.ipv4() {
+		family = "TCP4"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+		family, h.SourceAddr.IP, h.DestAddr.IP, h.SourceAddr.Port, h.DestAddr.Port))
+}
+
+func (h *ProxyHeader) formatV2() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(proxyV2Signature)
+
+	if !h.known() {
+		// version 2, LOCAL command, unspecified family, no addresses
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	// version 2, PROXY command
+	buf.WriteByte(0x21)
+
+	var srcIP, dstIP net.IP
+	if h.ipv4() {
+		// TCP over IPv4
+		buf.WriteByte(0x11)
+		srcIP, dstIP = h.SourceAddr.IP.To4(), h.DestAddr.IP.To4()
+	} else {
+		// TCP over IPv6
+		buf.WriteByte(0x21)
+		srcIP, dstIP = h.SourceAddr.IP.To16(), h.DestAddr.IP.To16()
+	}
+
+	binary.Write(buf, binary.BigEndian, uint16(len(srcIP)*2+4))
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	binary.Write(buf, binary.BigEndian, uint16(h.SourceAddr.Port))
+	binary.Write(buf, binary.BigEndian, uint16(h.DestAddr.Port))
+	return buf.Bytes()
+}
+
+// ReadProxyHeader parses a v1 or v2 PROXY protocol header from r.
+// If r doesn't start with one, ErrNoProxyHeader is returned and
+// nothing is consumed from r.
+func ReadProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	// only peek as much as needed, so we don't block on clients
+	// that send very short messages and wait for a reply.
+	prefix, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, ErrNoProxyHeader
+	}
+
+	if string(prefix) == proxyV1Prefix {
+		return readProxyHeaderV1(r)
+	}
+
+	if bytes.Equal(prefix, proxyV2Signature[:len(prefix)]) {
+		sig, err := r.Peek(len(proxyV2Signature))
+		if err == nil && bytes.Equal(sig, proxyV2Signature) {
+			return readProxyHeaderV2(r)
+		}
+	}
+
+	return nil, ErrNoProxyHeader
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.Wrap(err, "while reading PROXY v1 header")
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.Errorf("PROXY v1 header too long")
+	}
+
+	h := &ProxyHeader{Version: ProxyProtocolV1}
+	tokens := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(tokens) >= 2 && tokens[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(tokens) != 6 {
+		return nil, errors.Errorf("invalid PROXY v1 header %q", line)
+	}
+
+	switch tokens[1] {
+	case "TCP4", "TCP6":
+	default:
+		return nil, errors.Errorf("invalid PROXY v1 protocol family %q", tokens[1])
+	}
+
+	var err error
+	h.SourceAddr, err = parseTCPAddr(tokens[2], tokens[4])
+	if err != nil {
+		return nil, err
+	}
+	h.DestAddr, err = parseTCPAddr(tokens[3], tokens[5])
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseTCPAddr(ipStr string, portStr string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, errors.Errorf("invalid IP address %q in PROXY header", ipStr)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid port %q in PROXY header", portStr)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (*ProxyHeader, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading PROXY v2 header")
+	}
+
+	verCmd := header[12]
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	if verCmd>>4 != 2 {
+		return nil, errors.Errorf("invalid PROXY v2 version %d", verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading PROXY v2 addresses")
+	}
+
+	h := &ProxyHeader{Version: ProxyProtocolV2}
+
+	switch verCmd & 0xF {
+	case 0x0:
+		// LOCAL: health checks etc., addresses must be ignored
+		return h, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, errors.Errorf("invalid PROXY v2 command %d", verCmd&0xF)
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11:
+		ipLen = net.IPv4len
+	case 0x21:
+		ipLen = net.IPv6len
+	default:
+		// unspecified or non-TCP, we don't know what to make of it
+		return h, nil
+	}
+
+	if len(payload) < ipLen*2+4 {
+		return nil, errors.Errorf("PROXY v2 address block too short (%d bytes)", len(payload))
+	}
+
+	h.SourceAddr = &net.TCPAddr{
+		IP:   net.IP(payload[0:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[ipLen*2:])),
+	}
+	h.DestAddr = &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : ipLen*2]),
+		Port: int(binary.BigEndian.Uint16(payload[ipLen*2+2:])),
+	}
+	// any remaining bytes are TLVs, which we ignore
+	return h, nil
+}
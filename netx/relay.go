@@ -0,0 +1,71 @@
+package netx
+
+import (
+	"bufio"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// RelaySettings configures how Relay handles PROXY protocol headers.
+type RelaySettings struct {
+	// ParseProxyHeader expects a PROXY protocol header (v1 or v2) at the
+	// start of the client connection, such as one sent by a load balancer
+	// in front of us. It's consumed, and never forwarded as-is.
+	ParseProxyHeader bool
+
+	// EmitProxyHeader, if set, sends a PROXY protocol header of that version
+	// to upstream before any client data. It carries the addresses from the
+	// parsed header if there was one, and the client conn's addresses otherwise.
+	EmitProxyHeader ProxyProtocolVersion
+}
+
+// Relay copies data between client and upstream (see BidiCopy), optionally
+// parsing and emitting PROXY protocol headers so that the original client
+// address survives the relay.
+func Relay(client net.Conn, upstream net.Conn, settings *RelaySettings) error {
+	if settings == nil {
+		settings = &RelaySettings{}
+	}
+
+	var header *ProxyHeader
+	var clientRWC = &bufferedConn{Conn: client, reader: bufio.NewReader(client)}
+
+	if settings.ParseProxyHeader {
+		var err error
+		header, err = ReadProxyHeader(clientRWC.reader)
+		if err != nil {
+			client.Close()
+			upstream.Close()
+			return errors.Wrap(err, "in Relay, while parsing PROXY header")
+		}
+	}
+
+	if settings.EmitProxyHeader != ProxyProtocolNone {
+		out := NewProxyHeader(settings.EmitProxyHeader, client)
+		if header != nil {
+			out.SourceAddr = header.SourceAddr
+			out.DestAddr = header.DestAddr
+		}
+
+		_, err := out.WriteTo(upstream)
+		if err != nil {
+			client.Close()
+			upstream.Close()
+			return errors.Wrap(err, "in Relay, while emitting PROXY header")
+		}
+	}
+
+	return BidiCopy(clientRWC, upstream)
+}
+
+// bufferedConn is a net.Conn that reads through a bufio.Reader,
+// so bytes peeked while looking for a PROXY header aren't lost.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(buf []byte) (int, error) {
+	return bc.reader.Read(buf)
+}
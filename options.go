@@ -0,0 +1,66 @@
+// Package httpkit holds what's shared by all its subpackages: each of them
+// (htfs, uploader, rate, timeout) has its own options, plus a WithCommon
+// option that takes a CommonOptions, so that an application can configure
+// logging, metrics, time and bandwidth once for the whole kit.
+package httpkit
+
+import "github.com/itchio/httpkit/clock"
+
+// A LogFunc prints a debug message
+type LogFunc func(msg string)
+
+// Metrics receives counters from subsystems, for example when an
+// htfs.File is closed. Names are dot-separated and prefixed with the
+// subsystem, like "htfs.fetched_bytes".
+type Metrics interface {
+	// Add adds delta to the counter called name
+	Add(name string, delta int64)
+}
+
+// MetricsFunc adapts a function into Metrics, for example to feed
+// a Prometheus CounterVec keyed by name:
+//
+//	httpkit.MetricsFunc(func(name string, delta int64) {
+//		counters.WithLabelValues(name).Add(float64(delta))
+//	})
+type MetricsFunc func(name string, delta int64)
+
+// Add calls mf
+func (mf MetricsFunc) Add(name string, delta int64) {
+	mf(name, delta)
+}
+
+// NopMetrics drops every counter
+var NopMetrics Metrics = MetricsFunc(func(name string, delta int64) {})
+
+// Limiter caps throughput. *rate.Limiter implements it.
+type Limiter interface {
+	// Take waits until n bytes can be transferred
+	Take(n int64)
+}
+
+// TryLimiter is a Limiter that can also hand out bytes only if they're
+// available right away, for opportunistic transfers like read-ahead,
+// which must not delay callers of Take. *rate.Limiter implements it.
+type TryLimiter interface {
+	Limiter
+	// TryTake takes n bytes if they're available now, without waiting,
+	// and returns whether it did
+	TryTake(n int64) bool
+}
+
+// CommonOptions are accepted by every subsystem, through their
+// WithCommon option. Each subsystem uses the fields that make sense for
+// it and ignores the others, and nil fields leave its defaults alone.
+type CommonOptions struct {
+	// Logger is used by htfs, uploader and timeout
+	Logger Logger
+	// Log is used instead, if Logger isn't set
+	Log LogFunc
+	// Metrics is used by htfs
+	Metrics Metrics
+	// Clock is used by htfs, uploader and rate
+	Clock clock.Clock
+	// Limiter is used by htfs, uploader and timeout
+	Limiter Limiter
+}
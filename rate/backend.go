@@ -0,0 +1,121 @@
+package rate
+
+import (
+	"sync"
+	"time"
+)
+
+// A Bucket is a token bucket in a Backend, along with how it's refilled
+type Bucket struct {
+	// Key identifies the bucket, see Settings.Key
+	Key string
+	// BytesPerSecond is how fast the bucket is refilled
+	BytesPerSecond int64
+	// Burst is how many tokens the bucket holds, at most
+	Burst int64
+}
+
+// A Backend stores the token buckets of Limiters, see Settings.Backend.
+// Implementations can keep them outside of the process, in a small local
+// daemon or in Redis for example, so that several processes on the same
+// machine (like butler and the itch app) stay under a combined rate, such
+// as per-IP API limits. BucketState does the math for them.
+// Implementations must be safe for concurrent use.
+type Backend interface {
+	// Take removes n tokens from bucket, after refilling it for the time
+	// elapsed until now, and returns how long the caller has to wait before
+	// using them. Tokens can go negative, which makes later callers wait.
+	Take(bucket Bucket, n int64, now time.Time) (time.Duration, error)
+
+	// TryTake removes n tokens from bucket only if they're all available
+	// now, and returns whether it did.
+	TryTake(bucket Bucket, n int64, now time.Time) (bool, error)
+}
+
+// BucketState is what a Backend stores for a Bucket. The zero value is
+// a full bucket.
+type BucketState struct {
+	Tokens float64
+	Last   time.Time
+}
+
+// Take implements Backend.Take for a single bucket
+func (bs *BucketState) Take(bucket Bucket, n int64, now time.Time) time.Duration {
+	bs.refill(bucket, now)
+	bs.Tokens -= float64(n)
+	if bs.Tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bs.Tokens / float64(bucket.BytesPerSecond) * float64(time.Second))
+}
+
+// TryTake implements Backend.TryTake for a single bucket
+func (bs *BucketState) TryTake(bucket Bucket, n int64, now time.Time) bool {
+	bs.refill(bucket, now)
+	if bs.Tokens < float64(n) {
+		return false
+	}
+	bs.Tokens -= float64(n)
+	return true
+}
+
+func (bs *BucketState) refill(bucket Bucket, now time.Time) {
+	if bs.Last.IsZero() {
+		bs.Tokens = float64(bucket.Burst)
+		bs.Last = now
+		return
+	}
+
+	elapsed := now.Sub(bs.Last)
+	if elapsed <= 0 {
+		return
+	}
+	bs.Last = now
+
+	bs.Tokens += elapsed.Seconds() * float64(bucket.BytesPerSecond)
+	if bs.Tokens > float64(bucket.Burst) {
+		bs.Tokens = float64(bucket.Burst)
+	}
+}
+
+// MemoryBackend keeps buckets in memory. It's what Limiters use when
+// no Backend is specified, and Limiters of the same process that share
+// one, with the same Key, share their limit. It never fails.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	buckets map[string]*BucketState
+}
+
+var _ Backend = (*MemoryBackend)(nil)
+
+// NewMemoryBackend returns a MemoryBackend with no buckets
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		buckets: make(map[string]*BucketState),
+	}
+}
+
+// Take implements Backend
+func (mb *MemoryBackend) Take(bucket Bucket, n int64, now time.Time) (time.Duration, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	return mb.stateLocked(bucket.Key).Take(bucket, n, now), nil
+}
+
+// TryTake implements Backend
+func (mb *MemoryBackend) TryTake(bucket Bucket, n int64, now time.Time) (bool, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	return mb.stateLocked(bucket.Key).TryTake(bucket, n, now), nil
+}
+
+func (mb *MemoryBackend) stateLocked(key string) *BucketState {
+	bs, ok := mb.buckets[key]
+	if !ok {
+		bs = &BucketState{}
+		mb.buckets[key] = bs
+	}
+	return bs
+}
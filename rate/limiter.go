@@ -0,0 +1,156 @@
+// Package rate provides a byte limiter, to cap the throughput of
+// downloads and uploads.
+package rate
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/clock"
+)
+
+// Settings configures a Limiter.
+type Settings struct {
+	// BytesPerSecond is the sustained rate. Zero or negative means unlimited.
+	BytesPerSecond int64
+	// Burst is the amount of bytes that can be taken at once after the limiter
+	// has been idle for a while. Defaults to BytesPerSecond (one second's worth).
+	Burst int64
+	// Clock is used to refill the bucket and wait. If nil, clock.Real is used.
+	Clock clock.Clock
+
+	// Jitter, between 0 and 1, randomly lengthens waits in Take by up to
+	// that fraction, so that many clients started at the same time (and
+	// taking one token per request) don't end up sending requests in
+	// lockstep. It only ever adds delay, never lets more through.
+	Jitter float64
+	// Seed makes jitter deterministic. If zero, a random seed is used.
+	Seed int64
+
+	// Backend, if set, stores the token bucket, under Key, so it can be
+	// shared with other Limiters, possibly in other processes. If it
+	// fails, the Limiter falls back to a bucket of its own, see
+	// BackendErrors. Defaults to a MemoryBackend of the Limiter's own.
+	Backend Backend
+	// Key identifies the bucket in Backend. Limiters that share a
+	// Backend and a Key share their limit, so they should agree on
+	// BytesPerSecond and Burst.
+	Key string
+}
+
+// Limiter is a token bucket, where tokens are bytes.
+// It's safe for concurrent use.
+type Limiter struct {
+	settings Settings
+	clock    clock.Clock
+
+	backend Backend
+	// fallback is used when backend fails
+	fallback *MemoryBackend
+
+	mu            sync.Mutex
+	prng          *rand.Rand
+	backendErrors int64
+}
+
+var _ httpkit.TryLimiter = (*Limiter)(nil)
+
+// New returns a new Limiter, initially full.
+func New(settings Settings) *Limiter {
+	if settings.Burst <= 0 {
+		settings.Burst = settings.BytesPerSecond
+	}
+
+	seed := settings.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	clk := clock.Or(settings.Clock)
+	l := &Limiter{
+		settings: settings,
+		clock:    clk,
+		backend:  settings.Backend,
+		fallback: NewMemoryBackend(),
+		prng:     rand.New(rand.NewSource(seed)),
+	}
+	if l.backend == nil {
+		l.backend = l.fallback
+	}
+	return l
+}
+
+// bucket returns the Limiter's bucket, for its Backend
+func (l *Limiter) bucket() Bucket {
+	return Bucket{
+		Key:            l.settings.Key,
+		BytesPerSecond: l.settings.BytesPerSecond,
+		Burst:          l.settings.Burst,
+	}
+}
+
+// BackendErrors returns how many times Settings.Backend failed, and
+// the Limiter used a bucket of its own instead
+func (l *Limiter) BackendErrors() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.backendErrors
+}
+
+// backendFailed counts a Backend error
+func (l *Limiter) backendFailed() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.backendErrors++
+}
+
+// Unlimited returns true if the limiter lets everything through.
+func (l *Limiter) Unlimited() bool {
+	return l.settings.BytesPerSecond <= 0
+}
+
+// Take waits until n bytes can be transferred. Requests larger than the
+// burst size are allowed, they'll just make subsequent calls wait longer.
+func (l *Limiter) Take(n int64) {
+	if l.Unlimited() || n <= 0 {
+		return
+	}
+
+	now := l.clock.Now()
+	wait, err := l.backend.Take(l.bucket(), n, now)
+	if err != nil {
+		l.backendFailed()
+		wait, _ = l.fallback.Take(l.bucket(), n, now)
+	}
+	if wait > 0 && l.settings.Jitter > 0 {
+		l.mu.Lock()
+		wait += time.Duration(l.prng.Float64() * l.settings.Jitter * float64(wait))
+		l.mu.Unlock()
+	}
+
+	if wait > 0 {
+		l.clock.Sleep(wait)
+	}
+}
+
+// TryTake takes n bytes only if they're available right now, and
+// returns whether it did. It never blocks, and never borrows against
+// future bandwidth, so opportunistic consumers (like read-ahead) only
+// ever use spare bandwidth and can't delay callers of Take.
+func (l *Limiter) TryTake(n int64) bool {
+	if l.Unlimited() || n <= 0 {
+		return true
+	}
+
+	now := l.clock.Now()
+	ok, err := l.backend.TryTake(l.bucket(), n, now)
+	if err != nil {
+		l.backendFailed()
+		ok, _ = l.fallback.TryTake(l.bucket(), n, now)
+	}
+	return ok
+}
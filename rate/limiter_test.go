@@ -0,0 +1,162 @@
+package rate_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/clock"
+	"github.com/itchio/httpkit/rate"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Limiter(t *testing.T) {
+	assert := assert.New(t)
+
+	fc := clock.NewFake(time.Now())
+	l := rate.New(rate.Settings{
+		BytesPerSecond: 1000,
+		Clock:          fc,
+	})
+
+	// initially full: one second's worth
+	l.Take(1000)
+	assert.EqualValues(0, fc.Slept())
+
+	// going over makes us wait
+	l.Take(500)
+	assert.EqualValues(500*time.Millisecond, fc.Slept())
+}
+
+func Test_LimiterTryTake(t *testing.T) {
+	assert := assert.New(t)
+
+	fc := clock.NewFake(time.Now())
+	l := rate.New(rate.Settings{
+		BytesPerSecond: 1000,
+		Burst:          200,
+		Clock:          fc,
+	})
+
+	assert.True(l.TryTake(150))
+	assert.False(l.TryTake(100), "only 50 bytes left")
+	assert.True(l.TryTake(50))
+
+	fc.Advance(100 * time.Millisecond)
+	assert.True(l.TryTake(100))
+	assert.False(l.TryTake(1))
+
+	assert.EqualValues(0, fc.Slept(), "TryTake never sleeps")
+
+	// foreground takes wait for their bytes, and leave
+	// nothing for opportunistic takes
+	l.Take(100)
+	assert.EqualValues(100*time.Millisecond, fc.Slept())
+	assert.False(l.TryTake(1))
+	fc.Advance(50 * time.Millisecond)
+	assert.True(l.TryTake(1))
+}
+
+func Test_LimiterUnlimited(t *testing.T) {
+	assert := assert.New(t)
+
+	fc := clock.NewFake(time.Now())
+	l := rate.New(rate.Settings{Clock: fc})
+	assert.True(l.Unlimited())
+
+	l.Take(1024 * 1024 * 1024)
+	assert.True(l.TryTake(1024 * 1024 * 1024))
+	assert.EqualValues(0, fc.Slept())
+}
+
+func Test_LimiterJitter(t *testing.T) {
+	assert := assert.New(t)
+
+	// one request every 100ms
+	run := func(jitter float64, seed int64) time.Duration {
+		fc := clock.NewFake(time.Now())
+		l := rate.New(rate.Settings{
+			BytesPerSecond: 10,
+			Burst:          1,
+			Clock:          fc,
+			Jitter:         jitter,
+			Seed:           seed,
+		})
+		for i := 0; i < 11; i++ {
+			l.Take(1)
+		}
+		return fc.Slept()
+	}
+
+	assert.EqualValues(time.Second, run(0, 1))
+
+	a := run(0.5, 1)
+	b := run(0.5, 2)
+	assert.True(a > time.Second, "jitter adds delay (%s)", a)
+	assert.True(a <= 1500*time.Millisecond, "jitter is bounded (%s)", a)
+	assert.NotEqual(a, b, "different seeds give different spacing")
+	assert.Equal(a, run(0.5, 1), "same seed gives same spacing")
+}
+
+func Test_LimiterBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	// two processes, sharing a bucket
+	fc := clock.NewFake(time.Now())
+	backend := rate.NewMemoryBackend()
+	newLimiter := func() *rate.Limiter {
+		return rate.NewWithOptions(1000,
+			rate.WithClock(fc),
+			rate.WithBackend(backend, "api"),
+		)
+	}
+	butler := newLimiter()
+	app := newLimiter()
+
+	butler.Take(600)
+	app.Take(400)
+	assert.EqualValues(0, fc.Slept())
+	// the combined rate is capped
+	app.Take(500)
+	assert.EqualValues(500*time.Millisecond, fc.Slept())
+	assert.False(butler.TryTake(1))
+
+	// other keys have their own bucket
+	other := rate.NewWithOptions(1000, rate.WithClock(fc), rate.WithBackend(backend, "cdn"))
+	assert.True(other.TryTake(1000))
+	assert.EqualValues(0, butler.BackendErrors())
+
+	// a failing backend falls back on a bucket of the Limiter's own
+	failing := rate.NewWithOptions(1000, rate.WithClock(fc), rate.WithBackend(&failingBackend{}, "api"))
+	assert.True(failing.TryTake(1000))
+	assert.False(failing.TryTake(1))
+	failing.Take(100)
+	assert.EqualValues(600*time.Millisecond, fc.Slept())
+	assert.EqualValues(3, failing.BackendErrors())
+}
+
+type failingBackend struct{}
+
+func (fb *failingBackend) Take(bucket rate.Bucket, n int64, now time.Time) (time.Duration, error) {
+	return 0, errors.New("daemon not running")
+}
+
+func (fb *failingBackend) TryTake(bucket rate.Bucket, n int64, now time.Time) (bool, error) {
+	return false, errors.New("daemon not running")
+}
+
+func Test_LimiterOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	fc := clock.NewFake(time.Now())
+	l := rate.NewWithOptions(1000,
+		rate.WithBurst(200),
+		rate.WithCommon(httpkit.CommonOptions{Clock: fc}),
+	)
+
+	l.Take(200)
+	assert.EqualValues(0, fc.Slept())
+	l.Take(100)
+	assert.EqualValues(100*time.Millisecond, fc.Slept())
+}
@@ -0,0 +1,118 @@
+package rate
+
+import (
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/clock"
+)
+
+// Option configures Settings, see NewWithOptions
+type Option interface {
+	Apply(s *Settings)
+}
+
+// NewWithOptions returns a new Limiter that lets through bytesPerSecond,
+// configured by opts. See Settings for defaults.
+func NewWithOptions(bytesPerSecond int64, opts ...Option) *Limiter {
+	s := Settings{BytesPerSecond: bytesPerSecond}
+	for _, o := range opts {
+		o.Apply(&s)
+	}
+	return New(s)
+}
+
+// ---------
+
+type burstOption struct {
+	burst int64
+}
+
+// WithBurst specifies how many bytes can be taken at once after the
+// limiter has been idle, see Settings.Burst
+func WithBurst(burst int64) Option {
+	return &burstOption{
+		burst: burst,
+	}
+}
+
+func (o *burstOption) Apply(s *Settings) {
+	s.Burst = o.burst
+}
+
+// ---------
+
+type jitterOption struct {
+	jitter float64
+	seed   int64
+}
+
+// WithJitter randomly lengthens waits by up to jitter, between 0 and 1.
+// A non-zero seed makes it deterministic, see Settings.Jitter
+func WithJitter(jitter float64, seed int64) Option {
+	return &jitterOption{
+		jitter: jitter,
+		seed:   seed,
+	}
+}
+
+func (o *jitterOption) Apply(s *Settings) {
+	s.Jitter = o.jitter
+	s.Seed = o.seed
+}
+
+// ---------
+
+type clockOption struct {
+	clock clock.Clock
+}
+
+// WithClock specifies the clock used to refill the bucket and wait
+func WithClock(clock clock.Clock) Option {
+	return &clockOption{
+		clock: clock,
+	}
+}
+
+func (o *clockOption) Apply(s *Settings) {
+	s.Clock = o.clock
+}
+
+// ---------
+
+type backendOption struct {
+	backend Backend
+	key     string
+}
+
+// WithBackend stores the token bucket in backend, under key, so that
+// Limiters sharing them share their limit, see Settings.Backend
+func WithBackend(backend Backend, key string) Option {
+	return &backendOption{
+		backend: backend,
+		key:     key,
+	}
+}
+
+func (o *backendOption) Apply(s *Settings) {
+	s.Backend = o.backend
+	s.Key = o.key
+}
+
+// ---------
+
+type commonOption struct {
+	common httpkit.CommonOptions
+}
+
+// WithCommon applies options shared by all httpkit subsystems.
+// Only Clock is relevant to a Limiter.
+func WithCommon(common httpkit.CommonOptions) Option {
+	return &commonOption{
+		common: common,
+	}
+}
+
+func (o *commonOption) Apply(s *Settings) {
+	if o.common.Clock != nil {
+		s.Clock = o.common.Clock
+	}
+}
@@ -0,0 +1,148 @@
+package rate
+
+import (
+	"sync"
+	"time"
+
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/clock"
+)
+
+// consumerIdleAfter is how long after its last Take (or the end of
+// its wait) a consumer stops counting towards the split
+const consumerIdleAfter = 250 * time.Millisecond
+
+// Shared splits a byte budget between named consumers (like "downloads",
+// "uploads" and "api"), in proportion to their weights when they compete.
+// Consumers that haven't taken anything lately leave their share to the
+// others, so a single busy consumer gets the whole budget.
+// It's safe for concurrent use.
+type Shared struct {
+	settings Settings
+	clock    clock.Clock
+
+	mu        sync.Mutex
+	consumers map[string]*Consumer
+}
+
+// Consumer is a named user of a Shared budget, see Shared.Consumer.
+// Each consumer is a token bucket, refilled at its current share of
+// the budget.
+type Consumer struct {
+	shared *Shared
+	name   string
+
+	// protected by shared.mu
+	weight int
+	tokens float64
+	last   time.Time
+	// activeUntil is when the consumer's latest wait ends,
+	// plus consumerIdleAfter
+	activeUntil time.Time
+	taken       int64
+}
+
+var _ httpkit.Limiter = (*Consumer)(nil)
+
+// NewShared returns a new Shared budget. Settings.Jitter
+// and Settings.Seed are ignored.
+func NewShared(settings Settings) *Shared {
+	if settings.Burst <= 0 {
+		settings.Burst = settings.BytesPerSecond
+	}
+
+	return &Shared{
+		settings:  settings,
+		clock:     clock.Or(settings.Clock),
+		consumers: make(map[string]*Consumer),
+	}
+}
+
+// Consumer returns the consumer registered under name, registering it
+// if needed, with the given weight. Weights are relative: consumers of
+// weight 3 get three times as many bytes as those of weight 1, when they
+// compete. Weights under 1 are treated as 1. Calling it again for the
+// same name updates the weight.
+func (s *Shared) Consumer(name string, weight int) *Consumer {
+	if weight < 1 {
+		weight = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.consumers[name]
+	if !ok {
+		now := s.clock.Now()
+		c = &Consumer{
+			shared: s,
+			name:   name,
+			last:   now,
+		}
+		s.consumers[name] = c
+	}
+	c.weight = weight
+	return c
+}
+
+// Name returns the name the consumer was registered under
+func (c *Consumer) Name() string {
+	return c.name
+}
+
+// Taken returns how many bytes the consumer took so far
+func (c *Consumer) Taken() int64 {
+	c.shared.mu.Lock()
+	defer c.shared.mu.Unlock()
+	return c.taken
+}
+
+// Take waits until n bytes can be transferred by this consumer, at its
+// share of the budget: its weight over the sum of the weights of all
+// active consumers, including itself.
+func (c *Consumer) Take(n int64) {
+	s := c.shared
+	if s.settings.BytesPerSecond <= 0 || n <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	now := s.clock.Now()
+	share := s.shareLocked(c, now)
+
+	// a consumer that was idle starts with a full bucket, but
+	// no more than its share of the burst
+	burst := float64(s.settings.Burst) * share / float64(s.settings.BytesPerSecond)
+	if elapsed := now.Sub(c.last); elapsed > 0 {
+		c.tokens += elapsed.Seconds() * share
+	}
+	if c.tokens > burst {
+		c.tokens = burst
+	}
+	c.last = now
+
+	c.tokens -= float64(n)
+	var wait time.Duration
+	if c.tokens < 0 {
+		wait = time.Duration(-c.tokens / share * float64(time.Second))
+	}
+	c.taken += n
+	c.activeUntil = now.Add(wait + consumerIdleAfter)
+	s.mu.Unlock()
+
+	if wait > 0 {
+		s.clock.Sleep(wait)
+	}
+}
+
+// shareLocked returns how many bytes per second c gets right now.
+// It must be called with mu held.
+func (s *Shared) shareLocked(c *Consumer, now time.Time) float64 {
+	totalWeight := c.weight
+	for _, other := range s.consumers {
+		if other != c && now.Before(other.activeUntil) {
+			totalWeight += other.weight
+		}
+	}
+	return float64(s.settings.BytesPerSecond) * float64(c.weight) / float64(totalWeight)
+}
@@ -0,0 +1,58 @@
+package rate_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/rate"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Shared(t *testing.T) {
+	assert := assert.New(t)
+
+	const bytesPerSecond = 200 * 1024
+	s := rate.NewShared(rate.Settings{
+		BytesPerSecond: bytesPerSecond,
+		Burst:          1024,
+	})
+	downloads := s.Consumer("downloads", 3)
+	uploads := s.Consumer("uploads", 1)
+	api := s.Consumer("api", 1)
+	assert.Equal(downloads, s.Consumer("downloads", 3))
+
+	run := func(duration time.Duration, consumers ...*rate.Consumer) {
+		deadline := time.Now().Add(duration)
+		var wg sync.WaitGroup
+		for _, c := range consumers {
+			wg.Add(1)
+			go func(c *rate.Consumer) {
+				defer wg.Done()
+				for time.Now().Before(deadline) {
+					c.Take(1024)
+				}
+			}(c)
+		}
+		wg.Wait()
+	}
+
+	// contended: 3 to 1
+	run(500*time.Millisecond, downloads, uploads)
+	ratio := float64(downloads.Taken()) / float64(uploads.Taken())
+	assert.True(ratio > 2 && ratio < 4, "downloads should get 3x uploads, got %.2fx", ratio)
+	assert.EqualValues(0, api.Taken())
+
+	// alone, api borrows everyone's share
+	run(500*time.Millisecond, api)
+	assert.True(api.Taken() > bytesPerSecond/4, "api should get most of the budget, got %d", api.Taken())
+}
+
+func Test_SharedUnlimited(t *testing.T) {
+	assert := assert.New(t)
+
+	s := rate.NewShared(rate.Settings{})
+	c := s.Consumer("downloads", 0)
+	c.Take(1024 * 1024 * 1024)
+	assert.EqualValues("downloads", c.Name())
+}
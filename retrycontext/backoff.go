@@ -0,0 +1,70 @@
+package retrycontext
+
+import "sync"
+
+// A Backoff carries the backoff across Contexts that share it (see
+// Settings.Backoff), like the chunks of an upload, each of which gets its
+// own Context and MaxTries. Fruitless tries in any of them grow it, and it
+// only starts over after ResetAfter consecutive successes (see
+// Context.Succeed), so a flaky network isn't hammered again as soon as
+// one request gets through, but a bad patch early on doesn't slow down
+// recovery for the rest of a long transfer either.
+// It's safe for concurrent use.
+type Backoff struct {
+	// ResetAfter is how many consecutive successes start the backoff
+	// over. Values below 1 mean 1.
+	ResetAfter int
+
+	mu        sync.Mutex
+	level     int
+	successes int
+}
+
+// NewBackoff returns a Backoff that starts over after resetAfter
+// consecutive successes
+func NewBackoff(resetAfter int) *Backoff {
+	return &Backoff{ResetAfter: resetAfter}
+}
+
+// Level returns the exponent of the next delay: it's 2^Level seconds,
+// plus jitter, unless the error says otherwise (see DelayError).
+func (b *Backoff) Level() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.level
+}
+
+// escalate returns the level for a fruitless try, and grows it
+// for the next one
+func (b *Backoff) escalate() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	level := b.level
+	b.level++
+	b.successes = 0
+	return level
+}
+
+// succeed records a success, and starts over if there's been enough
+// of them in a row
+func (b *Backoff) succeed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.successes++
+	if b.successes >= b.ResetAfter {
+		b.level = 0
+		b.successes = 0
+	}
+}
+
+// reset starts over right away
+func (b *Backoff) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.level = 0
+	b.successes = 0
+}
@@ -1,13 +1,17 @@
 package retrycontext
 
 import (
+	"context"
+	"fmt"
 	"math"
 	"math/rand"
 	"time"
 
+	"github.com/itchio/httpkit/clock"
 	"github.com/itchio/httpkit/neterr"
 
 	"github.com/itchio/headway/state"
+	"github.com/pkg/errors"
 )
 
 // Context stores state related to an operation that should
@@ -17,16 +21,89 @@ type Context struct {
 
 	Tries     int
 	LastError error
+
+	// number of tries since the last one that made progress,
+	// which is what the backoff is based on
+	fruitlessTries int
+}
+
+// Outcome describes how far a failed attempt got, see RetryWithOutcome
+type Outcome int
+
+const (
+	// NoProgress is for attempts that failed before doing
+	// anything useful. The backoff keeps growing.
+	NoProgress Outcome = iota
+	// PartialProgress is for attempts that did some of the work
+	// before failing, like uploading part of a chunk. The backoff
+	// starts over, since things are moving along.
+	PartialProgress
+)
+
+// An OutcomeError knows how far the attempt that returned it got.
+// Do uses it to pick the backoff, errors that don't implement it
+// are taken to mean NoProgress.
+type OutcomeError interface {
+	error
+	Outcome() Outcome
+}
+
+// A DelayError knows how long to wait before the next attempt, like
+// servers that answer with a Retry-After header. Retry sleeps for that
+// long (plus jitter) instead of the backoff, if it's positive.
+type DelayError interface {
+	error
+	RetryDelay() time.Duration
 }
 
 // Settings configures a retry context, allowing to specify
-// a maximum number of tries, whether to sleep or not, and
-// an optional consumer to log activity to.
+// a maximum number of tries, an optional consumer to log activity to,
+// and the clock used to sleep between tries.
 type Settings struct {
-	MaxTries  int
-	Consumer  *state.Consumer
-	NoSleep   bool
-	FakeSleep func(d time.Duration)
+	MaxTries int
+	Consumer *state.Consumer
+
+	// Clock is used to sleep between tries. If nil, clock.Real is used.
+	// Tests can pass a *clock.Fake to avoid actually waiting.
+	Clock clock.Clock
+
+	// RecoverPanics makes Do recover panics in the attempt function,
+	// and treat them as failed attempts (see PanicError).
+	RecoverPanics bool
+
+	// Connectivity, if set, suspends retries while the machine is offline:
+	// instead of sleeping, Retry waits for connectivity to come back, then
+	// returns right away, and the failed attempt doesn't count against
+	// MaxTries nor grow the backoff.
+	Connectivity Connectivity
+
+	// Context, if set, stops waiting for connectivity when it's done.
+	// The failed attempt then counts as usual.
+	Context context.Context
+
+	// Backoff, if set, is used instead of the Context's own backoff,
+	// so it carries over to other Contexts that share it. Tries still
+	// count against each Context's MaxTries. See Succeed.
+	Backoff *Backoff
+}
+
+// Connectivity tells whether the machine is online.
+// *timeout.Monitor implements it.
+type Connectivity interface {
+	Online() bool
+	// WaitOnline returns once Online is true, or ctx is done
+	WaitOnline(ctx context.Context) error
+}
+
+// PanicError is returned by Do when an attempt panicked and
+// Settings.RecoverPanics is set. It's wrapped with the stack
+// of the panic.
+type PanicError struct {
+	Value interface{}
+}
+
+func (pe *PanicError) Error() string {
+	return fmt.Sprintf("panic during attempt: %v", pe.Value)
 }
 
 // New returns a new retry context with specific settings.
@@ -74,7 +151,20 @@ func (rc *Context) ShouldTry() bool {
 // If a consumer was passed, it'll pause progress, and log the error.
 // It's also in charge of sleeping (following exponential backoff)
 func (rc *Context) Retry(err error) {
+	rc.RetryWithOutcome(err, NoProgress)
+}
+
+// RetryWithOutcome is Retry, except if the attempt made some progress
+// before failing, the backoff starts over instead of growing. It still
+// counts against MaxTries.
+func (rc *Context) RetryWithOutcome(err error, outcome Outcome) {
 	rc.LastError = err
+	if outcome == PartialProgress {
+		rc.fruitlessTries = 0
+		if rc.Settings.Backoff != nil {
+			rc.Settings.Backoff.reset()
+		}
+	}
 
 	if rc.Settings.Consumer != nil {
 		rc.Settings.Consumer.PauseProgress()
@@ -85,28 +175,101 @@ func (rc *Context) Retry(err error) {
 		}
 	}
 
+	if rc.waitOnline() {
+		// the attempt never stood a chance, and the network
+		// is back: no need to wait any longer
+		rc.fruitlessTries = 0
+		if rc.Settings.Backoff != nil {
+			rc.Settings.Backoff.reset()
+		}
+		if rc.Settings.Consumer != nil {
+			rc.Settings.Consumer.ResumeProgress()
+		}
+		return
+	}
+
+	level := rc.fruitlessTries
+	if rc.Settings.Backoff != nil {
+		level = rc.Settings.Backoff.escalate()
+	}
 	// exponential backoff: 1, 2, 4, 8 seconds...
-	delay := int(math.Pow(2, float64(rc.Tries)))
+	delay := time.Second * time.Duration(math.Pow(2, float64(level)))
+	if de, ok := errors.Cause(err).(DelayError); ok && de.RetryDelay() > 0 {
+		// ...unless we were told when to come back
+		delay = de.RetryDelay()
+	}
 	// ...plus a random number of milliseconds.
 	// see https://cloud.google.com/storage/docs/exponential-backoff
 	jitter := rand.Int() % 1000
 
 	if rc.Settings.Consumer != nil {
-		rc.Settings.Consumer.Infof("Sleeping %d seconds then retrying", delay)
+		rc.Settings.Consumer.Infof("Sleeping %s then retrying", delay)
 	}
 
-	sleepDuration := time.Second*time.Duration(delay) + time.Millisecond*time.Duration(jitter)
-	if rc.Settings.NoSleep {
-		if rc.Settings.FakeSleep != nil {
-			rc.Settings.FakeSleep(sleepDuration)
-		}
-	} else {
-		time.Sleep(sleepDuration)
-	}
+	sleepDuration := delay + time.Millisecond*time.Duration(jitter)
+	clock.Or(rc.Settings.Clock).Sleep(sleepDuration)
 
 	rc.Tries++
+	rc.fruitlessTries++
 
 	if rc.Settings.Consumer != nil {
 		rc.Settings.Consumer.ResumeProgress()
 	}
 }
+
+// Succeed records that an attempt succeeded, which counts towards
+// starting the shared Backoff over, if there's one. Do calls it.
+func (rc *Context) Succeed() {
+	if rc.Settings.Backoff != nil {
+		rc.Settings.Backoff.succeed()
+	}
+}
+
+// Do calls attempt until it returns nil, retrying (see Retry) on every
+// error, up to MaxTries times. When giving up, the last error is returned.
+// Errors that implement OutcomeError pick the backoff, see RetryWithOutcome.
+// Callers that need to tell retriable errors apart should write the
+// ShouldTry loop themselves.
+func (rc *Context) Do(attempt func() error) error {
+	for rc.ShouldTry() {
+		err := rc.try(attempt)
+		if err == nil {
+			rc.Succeed()
+			return nil
+		}
+		outcome := NoProgress
+		if oe, ok := errors.Cause(err).(OutcomeError); ok {
+			outcome = oe.Outcome()
+		}
+		rc.RetryWithOutcome(err, outcome)
+	}
+	return errors.Wrap(rc.LastError, "too many failures, giving up")
+}
+
+// waitOnline returns true if we were offline, and now are online again
+func (rc *Context) waitOnline() bool {
+	conn := rc.Settings.Connectivity
+	if conn == nil || conn.Online() {
+		return false
+	}
+
+	if rc.Settings.Consumer != nil {
+		rc.Settings.Consumer.Infof("Offline, waiting for network to come back")
+	}
+	ctx := rc.Settings.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return conn.WaitOnline(ctx) == nil
+}
+
+func (rc *Context) try(attempt func() error) (err error) {
+	if rc.Settings.RecoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.WithStack(&PanicError{Value: r})
+			}
+		}()
+	}
+	return attempt()
+}
@@ -1,10 +1,12 @@
 package retrycontext_test
 
 import (
+	"context"
 	"math"
 	"testing"
 	"time"
 
+	"github.com/itchio/httpkit/clock"
 	"github.com/itchio/httpkit/retrycontext"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
@@ -17,12 +19,14 @@ func Test_Retry(t *testing.T) {
 	var totalSleep time.Duration = 0
 
 	run := func() error {
-		totalSleep = 0
+		fc := clock.NewFake(time.Now())
+		start := fc.Now()
+		defer func() {
+			totalSleep = clock.Since(fc, start)
+		}()
+
 		ctx := retrycontext.NewDefault()
-		ctx.Settings.NoSleep = true
-		ctx.Settings.FakeSleep = func(d time.Duration) {
-			totalSleep += d
-		}
+		ctx.Settings.Clock = fc
 		ctx.Settings.MaxTries = 3
 
 		count := failCount
@@ -79,3 +83,286 @@ func Test_Retry(t *testing.T) {
 	failCount = 4
 	assert.EqualError(run(), markerError.Error())
 }
+
+func Test_Do(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := retrycontext.New(retrycontext.Settings{
+		MaxTries: 3,
+		Clock:    clock.NewFake(time.Now()),
+	})
+	attempts := 0
+	err := ctx.Do(func() error {
+		attempts++
+		if attempts < 2 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	assert.NoError(err)
+	assert.EqualValues(2, attempts)
+
+	ctx = retrycontext.New(retrycontext.Settings{
+		MaxTries: 3,
+		Clock:    clock.NewFake(time.Now()),
+	})
+	err = ctx.Do(func() error {
+		return errors.New("always")
+	})
+	assert.Error(err)
+	assert.EqualValues(3, ctx.Tries)
+}
+
+func Test_DoRecoverPanics(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := retrycontext.New(retrycontext.Settings{
+		MaxTries:      3,
+		Clock:         clock.NewFake(time.Now()),
+		RecoverPanics: true,
+	})
+	attempts := 0
+	err := ctx.Do(func() error {
+		attempts++
+		if attempts < 3 {
+			panic("transient library panic")
+		}
+		return nil
+	})
+	assert.NoError(err)
+	assert.EqualValues(3, attempts)
+	pe, ok := errors.Cause(ctx.LastError).(*retrycontext.PanicError)
+	assert.True(ok)
+	assert.EqualValues("transient library panic", pe.Value)
+
+	ctx = retrycontext.New(retrycontext.Settings{
+		MaxTries: 3,
+		Clock:    clock.NewFake(time.Now()),
+	})
+	assert.Panics(func() {
+		ctx.Do(func() error {
+			panic("not recovered")
+		})
+	})
+}
+
+func Test_RetryWithOutcome(t *testing.T) {
+	assert := assert.New(t)
+
+	fc := clock.NewFake(time.Now())
+	ctx := retrycontext.New(retrycontext.Settings{
+		MaxTries: 10,
+		Clock:    fc,
+	})
+
+	sleep := func(outcome retrycontext.Outcome) time.Duration {
+		start := fc.Now()
+		ctx.RetryWithOutcome(errors.New("failed"), outcome)
+		return clock.Since(fc, start)
+	}
+	inRange := func(d time.Duration, seconds int) {
+		t.Helper()
+		lower := time.Duration(seconds) * time.Second
+		assert.True(d >= lower && d < lower+time.Second, "%s should be about %ds", d, seconds)
+	}
+
+	inRange(sleep(retrycontext.NoProgress), 1)
+	inRange(sleep(retrycontext.NoProgress), 2)
+	inRange(sleep(retrycontext.NoProgress), 4)
+	// progress was made: start over
+	inRange(sleep(retrycontext.PartialProgress), 1)
+	inRange(sleep(retrycontext.NoProgress), 2)
+	assert.EqualValues(5, ctx.Tries)
+}
+
+type progressError struct{}
+
+func (pe *progressError) Error() string {
+	return "failed after some progress"
+}
+
+func (pe *progressError) Outcome() retrycontext.Outcome {
+	return retrycontext.PartialProgress
+}
+
+func Test_DoOutcome(t *testing.T) {
+	assert := assert.New(t)
+
+	fc := clock.NewFake(time.Now())
+	ctx := retrycontext.New(retrycontext.Settings{
+		MaxTries: 4,
+		Clock:    fc,
+	})
+	start := fc.Now()
+	err := ctx.Do(func() error {
+		return errors.WithStack(&progressError{})
+	})
+	assert.Error(err)
+	assert.EqualValues(4, ctx.Tries)
+	// 4 times 1s (plus jitter), instead of 1+2+4+8s
+	assert.True(clock.Since(fc, start) < 8*time.Second)
+}
+
+type delayError struct {
+	delay time.Duration
+}
+
+func (de *delayError) Error() string {
+	return "come back later"
+}
+
+func (de *delayError) RetryDelay() time.Duration {
+	return de.delay
+}
+
+func Test_RetryDelayError(t *testing.T) {
+	assert := assert.New(t)
+
+	fc := clock.NewFake(time.Now())
+	ctx := retrycontext.New(retrycontext.Settings{
+		MaxTries: 10,
+		Clock:    fc,
+	})
+
+	sleep := func(err error) time.Duration {
+		start := fc.Now()
+		ctx.Retry(err)
+		return clock.Since(fc, start)
+	}
+
+	// the server's delay replaces the backoff, even when wrapped
+	d := sleep(errors.Wrap(&delayError{delay: 30 * time.Second}, "in test"))
+	assert.True(d >= 30*time.Second && d < 31*time.Second, "%s should be about 30s", d)
+	// no delay: back to the backoff, which kept growing
+	d = sleep(&delayError{})
+	assert.True(d >= 2*time.Second && d < 3*time.Second, "%s should be about 2s", d)
+	assert.EqualValues(2, ctx.Tries)
+}
+
+func Test_RetryBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	fc := clock.NewFake(time.Now())
+	backoff := retrycontext.NewBackoff(3)
+	newContext := func() *retrycontext.Context {
+		return retrycontext.New(retrycontext.Settings{
+			MaxTries: 2,
+			Clock:    fc,
+			Backoff:  backoff,
+		})
+	}
+	sleep := func(ctx *retrycontext.Context) time.Duration {
+		start := fc.Now()
+		ctx.Retry(errors.New("failed"))
+		return clock.Since(fc, start)
+	}
+	inRange := func(d time.Duration, seconds int) {
+		t.Helper()
+		lower := time.Duration(seconds) * time.Second
+		assert.True(d >= lower && d < lower+time.Second, "%s should be about %ds", d, seconds)
+	}
+
+	// a bad patch: the backoff carries over to the next context...
+	ctx := newContext()
+	inRange(sleep(ctx), 1)
+	inRange(sleep(ctx), 2)
+	assert.False(ctx.ShouldTry())
+	ctx = newContext()
+	inRange(sleep(ctx), 4)
+	ctx.Succeed()
+
+	// ...until enough successes in a row
+	assert.EqualValues(3, backoff.Level())
+	newContext().Succeed()
+	assert.EqualValues(3, backoff.Level())
+	newContext().Succeed()
+	assert.EqualValues(0, backoff.Level())
+
+	ctx = newContext()
+	inRange(sleep(ctx), 1)
+	// a failure in between starts the count over
+	assert.NoError(newContext().Do(func() error { return nil }))
+	inRange(sleep(newContext()), 2)
+	assert.EqualValues(2, backoff.Level())
+
+	// progress starts over right away, however many
+	// successes it takes otherwise
+	ctx = newContext()
+	start := fc.Now()
+	ctx.RetryWithOutcome(errors.New("partial"), retrycontext.PartialProgress)
+	inRange(clock.Since(fc, start), 1)
+	ctx = newContext()
+	start = fc.Now()
+	ctx.RetryWithOutcome(errors.New("partial"), retrycontext.PartialProgress)
+	inRange(clock.Since(fc, start), 1)
+	inRange(sleep(ctx), 2)
+}
+
+type fakeConnectivity struct {
+	online bool
+	// if set, WaitOnline comes back online
+	comesBack bool
+	waits     int
+}
+
+func (fc *fakeConnectivity) Online() bool {
+	return fc.online
+}
+
+func (fc *fakeConnectivity) WaitOnline(ctx context.Context) error {
+	fc.waits++
+	if fc.comesBack {
+		fc.online = true
+		return nil
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func Test_RetryConnectivity(t *testing.T) {
+	assert := assert.New(t)
+
+	fc := clock.NewFake(time.Now())
+	conn := &fakeConnectivity{comesBack: true}
+	rc := retrycontext.New(retrycontext.Settings{
+		MaxTries:     2,
+		Clock:        fc,
+		Connectivity: conn,
+	})
+
+	failures := 0
+	err := rc.Do(func() error {
+		failures++
+		if failures == 1 {
+			// the network went away, and the monitor noticed
+			return errors.New("offline")
+		}
+		if failures == 2 {
+			conn.online = true
+			return errors.New("flaky")
+		}
+		return nil
+	})
+	assert.NoError(err)
+	assert.EqualValues(1, conn.waits)
+	// the offline failure didn't count, nor sleep
+	assert.EqualValues(1, rc.Tries)
+	assert.True(fc.Slept() < 2*time.Second)
+
+	// when Context is done, the attempt counts as usual
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	conn = &fakeConnectivity{}
+	rc = retrycontext.New(retrycontext.Settings{
+		MaxTries:     2,
+		Clock:        clock.NewFake(time.Now()),
+		Connectivity: conn,
+		Context:      ctx,
+	})
+	err = rc.Do(func() error {
+		return errors.New("offline")
+	})
+	assert.Error(err)
+	assert.EqualValues(2, conn.waits)
+	assert.EqualValues(2, rc.Tries)
+}
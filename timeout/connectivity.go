@@ -0,0 +1,309 @@
+package timeout
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/clock"
+	"github.com/pkg/errors"
+)
+
+// Connectivity is what a Monitor makes of the network
+type Connectivity int
+
+const (
+	// ConnectivityUnknown is the state until the first probe is done
+	ConnectivityUnknown Connectivity = iota
+	// ConnectivityOnline means the probe got the expected response
+	ConnectivityOnline
+	// ConnectivityOffline means the probe couldn't reach the endpoint at all
+	ConnectivityOffline
+	// ConnectivityCaptivePortal means the probe got a response, but not the
+	// expected one: typically a login page served by hotel or airport Wi-Fi,
+	// through which no other request will succeed either.
+	ConnectivityCaptivePortal
+)
+
+func (c Connectivity) String() string {
+	switch c {
+	case ConnectivityUnknown:
+		return "unknown"
+	case ConnectivityOnline:
+		return "online"
+	case ConnectivityOffline:
+		return "offline"
+	case ConnectivityCaptivePortal:
+		return "captive-portal"
+	}
+	return fmt.Sprintf("connectivity(%d)", int(c))
+}
+
+const (
+	// DefaultProbeURL answers 204 with an empty body. It's plain HTTP
+	// on purpose, captive portals can't intercept HTTPS cleanly.
+	DefaultProbeURL = "http://connectivitycheck.gstatic.com/generate_204"
+	// DefaultProbeInterval is how often a Monitor probes while online
+	DefaultProbeInterval = 30 * time.Second
+	// DefaultOfflineProbeInterval is how often a Monitor probes while
+	// offline, so that it notices quickly when the network comes back
+	DefaultOfflineProbeInterval = 5 * time.Second
+	// DefaultProbeTimeout is how long a single probe may take
+	DefaultProbeTimeout = 10 * time.Second
+)
+
+// MonitorSettings configures a Monitor, see NewMonitor
+type MonitorSettings struct {
+	// URL is the endpoint to probe. Defaults to DefaultProbeURL.
+	URL string
+	// ExpectedStatus is the status code URL answers with when the
+	// network works. Defaults to 204.
+	ExpectedStatus int
+	// ExpectedBody, if set, must be the body URL answers with (leading
+	// and trailing whitespace is ignored)
+	ExpectedBody string
+
+	// Interval defaults to DefaultProbeInterval
+	Interval time.Duration
+	// OfflineInterval is used instead of Interval while offline or behind
+	// a captive portal. Defaults to DefaultOfflineProbeInterval.
+	OfflineInterval time.Duration
+	// ProbeTimeout defaults to DefaultProbeTimeout
+	ProbeTimeout time.Duration
+
+	// Client is used for probes. It's copied so that redirects aren't
+	// followed, since they're how most captive portals show up. Defaults
+	// to a client returned by NewClient, so SetSimulateOffline applies.
+	Client *http.Client
+	// Clock schedules probes. If nil, clock.Real is used.
+	Clock clock.Clock
+	// Logger, if set, gets an info message on every state change
+	Logger httpkit.Logger
+}
+
+// A ConnectivityListener is called with the previous and
+// the new state whenever a Monitor's state changes.
+type ConnectivityListener func(previous Connectivity, current Connectivity)
+
+// Monitor probes an endpoint periodically in the background, to tell
+// whether the machine is online. Retry loops can use it to wait for
+// the network to come back instead of burning their retry budgets.
+// It's safe for concurrent use.
+type Monitor struct {
+	url             string
+	expectedStatus  int
+	expectedBody    string
+	interval        time.Duration
+	offlineInterval time.Duration
+	probeTimeout    time.Duration
+	client          *http.Client
+	clock           clock.Clock
+	logger          httpkit.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu        sync.Mutex
+	state     Connectivity
+	changed   chan struct{}
+	listeners map[int]ConnectivityListener
+	nextID    int
+}
+
+// NewMonitor returns a Monitor that starts probing right away,
+// until Close is called.
+func NewMonitor(settings *MonitorSettings) *Monitor {
+	m := &Monitor{
+		url:             settings.URL,
+		expectedStatus:  settings.ExpectedStatus,
+		expectedBody:    strings.TrimSpace(settings.ExpectedBody),
+		interval:        settings.Interval,
+		offlineInterval: settings.OfflineInterval,
+		probeTimeout:    settings.ProbeTimeout,
+		clock:           clock.Or(settings.Clock),
+		logger:          settings.Logger,
+
+		done:      make(chan struct{}),
+		changed:   make(chan struct{}),
+		listeners: make(map[int]ConnectivityListener),
+	}
+	if m.url == "" {
+		m.url = DefaultProbeURL
+	}
+	if m.expectedStatus == 0 {
+		m.expectedStatus = http.StatusNoContent
+	}
+	if m.interval <= 0 {
+		m.interval = DefaultProbeInterval
+	}
+	if m.offlineInterval <= 0 {
+		m.offlineInterval = DefaultOfflineProbeInterval
+	}
+	if m.probeTimeout <= 0 {
+		m.probeTimeout = DefaultProbeTimeout
+	}
+
+	client := settings.Client
+	if client == nil {
+		client = NewClient(m.probeTimeout, m.probeTimeout)
+	}
+	noRedirects := *client
+	noRedirects.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	m.client = &noRedirects
+
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	go m.run()
+	return m
+}
+
+func (m *Monitor) run() {
+	defer close(m.done)
+
+	for {
+		interval := m.interval
+		if m.Check(m.ctx) != ConnectivityOnline {
+			interval = m.offlineInterval
+		}
+
+		select {
+		case <-m.clock.After(interval):
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// Check probes the endpoint now, updates the state, and returns it.
+// If ctx is done before the probe completes, the state is left alone.
+func (m *Monitor) Check(ctx context.Context) Connectivity {
+	state, err := m.probe(ctx)
+	if ctx.Err() != nil {
+		return m.State()
+	}
+	if err != nil && m.logger != nil {
+		m.logger.Debug("connectivity: probe failed", "state", state, "err", err)
+	}
+	m.set(state)
+	return state
+}
+
+func (m *Monitor) probe(ctx context.Context) (Connectivity, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.probeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", m.url, nil)
+	if err != nil {
+		return ConnectivityOffline, errors.WithStack(err)
+	}
+	req = req.WithContext(ctx)
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		return ConnectivityOffline, errors.WithStack(err)
+	}
+	defer res.Body.Close()
+
+	// portals may serve large pages, we only need to tell them apart
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	if err != nil {
+		return ConnectivityOffline, errors.WithStack(err)
+	}
+
+	if res.StatusCode != m.expectedStatus {
+		return ConnectivityCaptivePortal, errors.Errorf("got HTTP %d, expected %d", res.StatusCode, m.expectedStatus)
+	}
+	if m.expectedBody != "" && strings.TrimSpace(string(body)) != m.expectedBody {
+		return ConnectivityCaptivePortal, errors.Errorf("got unexpected body")
+	}
+	return ConnectivityOnline, nil
+}
+
+func (m *Monitor) set(state Connectivity) {
+	m.mu.Lock()
+	previous := m.state
+	if previous == state {
+		m.mu.Unlock()
+		return
+	}
+	m.state = state
+	close(m.changed)
+	m.changed = make(chan struct{})
+	var listeners []ConnectivityListener
+	for _, l := range m.listeners {
+		listeners = append(listeners, l)
+	}
+	m.mu.Unlock()
+
+	if m.logger != nil {
+		m.logger.Info("connectivity: changed", "from", previous, "to", state)
+	}
+	for _, l := range listeners {
+		l(previous, state)
+	}
+}
+
+// State returns the result of the last probe
+func (m *Monitor) State() Connectivity {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Online returns false if the last probe found the machine offline
+// or behind a captive portal. Before the first probe, it's true.
+func (m *Monitor) Online() bool {
+	state := m.State()
+	return state != ConnectivityOffline && state != ConnectivityCaptivePortal
+}
+
+// OnChange registers l to be called, from the Monitor's goroutine (or
+// Check's caller), on every state change. The returned func unregisters it.
+func (m *Monitor) OnChange(l ConnectivityListener) (remove func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := m.nextID
+	m.nextID++
+	m.listeners[id] = l
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.listeners, id)
+	}
+}
+
+// WaitOnline returns as soon as Online is true, or with ctx's
+// error if it's done first.
+func (m *Monitor) WaitOnline(ctx context.Context) error {
+	for {
+		m.mu.Lock()
+		changed := m.changed
+		m.mu.Unlock()
+
+		if m.Online() {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		}
+	}
+}
+
+// Close stops probing. The last state is kept.
+func (m *Monitor) Close() error {
+	m.cancel()
+	<-m.done
+	return nil
+}
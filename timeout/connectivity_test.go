@@ -0,0 +1,81 @@
+package timeout_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/clock"
+	"github.com/itchio/httpkit/timeout"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Monitor(t *testing.T) {
+	assert := assert.New(t)
+
+	var portal int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&portal) == 1 {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	// with a fake clock, only the first probe happens in the background
+	m := timeout.NewMonitor(&timeout.MonitorSettings{
+		URL:   server.URL,
+		Clock: clock.NewFake(time.Now()),
+	})
+	defer m.Close()
+	for m.State() == timeout.ConnectivityUnknown {
+		time.Sleep(time.Millisecond)
+	}
+
+	var mu sync.Mutex
+	var changes []string
+	remove := m.OnChange(func(previous timeout.Connectivity, current timeout.Connectivity) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, previous.String()+">"+current.String())
+	})
+
+	ctx := context.Background()
+	assert.EqualValues(timeout.ConnectivityOnline, m.Check(ctx))
+	assert.True(m.Online())
+
+	atomic.StoreInt32(&portal, 1)
+	assert.EqualValues(timeout.ConnectivityCaptivePortal, m.Check(ctx))
+	assert.False(m.Online())
+
+	// comes back while someone waits for it
+	waited := make(chan error)
+	go func() {
+		waited <- m.WaitOnline(ctx)
+	}()
+	atomic.StoreInt32(&portal, 0)
+	assert.EqualValues(timeout.ConnectivityOnline, m.Check(ctx))
+	assert.NoError(<-waited)
+
+	remove()
+	server.CloseClientConnections()
+	m2 := timeout.NewMonitor(&timeout.MonitorSettings{
+		URL:   "http://127.0.0.1:1/generate_204",
+		Clock: clock.NewFake(time.Now()),
+	})
+	defer m2.Close()
+	assert.EqualValues(timeout.ConnectivityOffline, m2.Check(ctx))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.Error(m2.WaitOnline(timeoutCtx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.EqualValues([]string{"online>captive-portal", "captive-portal>online"}, changes)
+}
@@ -0,0 +1,98 @@
+package timeout
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type gzipTransport struct {
+	base http.RoundTripper
+}
+
+var _ http.RoundTripper = (*gzipTransport)(nil)
+
+// NewGzipTransport wraps base so that requests ask for gzip, and gzip
+// responses are decompressed transparently, but only when that's safe:
+// requests with a Range header, or that already set Accept-Encoding,
+// are left alone. Range requests get "Accept-Encoding: identity" so
+// that offsets always refer to the uncompressed resource.
+//
+// base should have compression disabled, otherwise the transport
+// may already ask for (and decompress) gzip by itself.
+func NewGzipTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &gzipTransport{base: base}
+}
+
+func (gt *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Accept-Encoding") != "" {
+		return gt.base.RoundTrip(req)
+	}
+
+	isRange := req.Header.Get("Range") != ""
+
+	// RoundTrippers must not modify the request
+	r2 := new(http.Request)
+	*r2 = *req
+	r2.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r2.Header[k] = v
+	}
+	if isRange {
+		r2.Header.Set("Accept-Encoding", "identity")
+	} else {
+		r2.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	res, err := gt.base.RoundTrip(r2)
+	if err != nil {
+		return nil, err
+	}
+
+	if isRange || req.Method == "HEAD" {
+		return res, nil
+	}
+	if !strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		return res, nil
+	}
+
+	res.Body = &gzipReader{body: res.Body}
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+	return res, nil
+}
+
+// gzipReader defers creating the gzip.Reader until the first Read,
+// so that RoundTrip doesn't block on the body.
+type gzipReader struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+	err  error
+}
+
+func (gr *gzipReader) Read(buf []byte) (int, error) {
+	if gr.err != nil {
+		return 0, gr.err
+	}
+	if gr.zr == nil {
+		zr, err := gzip.NewReader(gr.body)
+		if err != nil {
+			gr.err = errors.Wrap(err, "while decompressing gzip response")
+			return 0, gr.err
+		}
+		gr.zr = zr
+	}
+	return gr.zr.Read(buf)
+}
+
+func (gr *gzipReader) Close() error {
+	return gr.body.Close()
+}
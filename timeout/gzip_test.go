@@ -0,0 +1,77 @@
+package timeout_test
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/itchio/httpkit/timeout"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_GzipTransport(t *testing.T) {
+	assert := assert.New(t)
+	payload := "hello hello hello hello hello"
+
+	var lastAcceptEncoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastAcceptEncoding = r.Header.Get("Accept-Encoding")
+		if lastAcceptEncoding == "gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			zw.Write([]byte(payload))
+			zw.Close()
+			return
+		}
+		w.Write([]byte(payload))
+	}))
+	defer server.Close()
+
+	client := timeout.NewClientWithSettings(&timeout.ClientSettings{
+		DisableCompression: true,
+		TransparentGzip:    true,
+	})
+
+	res, err := client.Get(server.URL)
+	assert.NoError(err)
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(err)
+	res.Body.Close()
+	assert.EqualValues("gzip", lastAcceptEncoding)
+	assert.EqualValues(payload, string(body))
+	assert.True(res.Uncompressed)
+	assert.EqualValues("", res.Header.Get("Content-Encoding"))
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	assert.NoError(err)
+	req.Header.Set("Range", "bytes=0-")
+	res, err = client.Do(req)
+	assert.NoError(err)
+	body, err = ioutil.ReadAll(res.Body)
+	assert.NoError(err)
+	res.Body.Close()
+	assert.EqualValues("identity", lastAcceptEncoding)
+	assert.EqualValues(payload, string(body))
+	assert.False(res.Uncompressed)
+	assert.EqualValues("", req.Header.Get("Accept-Encoding"), "must not modify request")
+}
+
+func Test_DisableCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	var lastAcceptEncoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastAcceptEncoding = r.Header.Get("Accept-Encoding")
+	}))
+	defer server.Close()
+
+	client := timeout.NewClientWithSettings(&timeout.ClientSettings{
+		DisableCompression: true,
+	})
+	res, err := client.Get(server.URL)
+	assert.NoError(err)
+	res.Body.Close()
+	assert.EqualValues("", lastAcceptEncoding)
+}
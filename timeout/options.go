@@ -0,0 +1,168 @@
+package timeout
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/itchio/httpkit"
+)
+
+// Option configures ClientSettings, see NewClientWithOptions
+type Option interface {
+	Apply(s *ClientSettings)
+}
+
+// NewClientWithOptions returns a new http client configured by opts,
+// see NewClientWithSettings for defaults.
+func NewClientWithOptions(opts ...Option) *http.Client {
+	s := &ClientSettings{}
+	for _, o := range opts {
+		o.Apply(s)
+	}
+	return NewClientWithSettings(s)
+}
+
+// ---------
+
+type timeoutsOption struct {
+	connectTimeout time.Duration
+	idleTimeout    time.Duration
+}
+
+// WithTimeouts specifies how long to wait to establish a connection, and
+// how long a connection can stay idle before it's declared dead.
+func WithTimeouts(connectTimeout time.Duration, idleTimeout time.Duration) Option {
+	return &timeoutsOption{
+		connectTimeout: connectTimeout,
+		idleTimeout:    idleTimeout,
+	}
+}
+
+func (o *timeoutsOption) Apply(s *ClientSettings) {
+	s.ConnectTimeout = o.connectTimeout
+	s.IdleTimeout = o.idleTimeout
+}
+
+// ---------
+
+type proxyOption struct {
+	proxy func(req *http.Request) (*url.URL, error)
+}
+
+// WithProxy specifies which proxy to use for a request, for example
+// http.ProxyURL(u). The default is http.ProxyFromEnvironment.
+func WithProxy(proxy func(req *http.Request) (*url.URL, error)) Option {
+	return &proxyOption{
+		proxy: proxy,
+	}
+}
+
+func (o *proxyOption) Apply(s *ClientSettings) {
+	s.Proxy = o.proxy
+}
+
+// ---------
+
+type compressionOption struct {
+	disable     bool
+	transparent bool
+}
+
+// WithDisableCompression prevents the transport from asking for gzip,
+// see ClientSettings.DisableCompression
+func WithDisableCompression() Option {
+	return &compressionOption{disable: true}
+}
+
+// WithTransparentGzip asks for gzip on non-range requests only,
+// see ClientSettings.TransparentGzip
+func WithTransparentGzip() Option {
+	return &compressionOption{disable: true, transparent: true}
+}
+
+func (o *compressionOption) Apply(s *ClientSettings) {
+	s.DisableCompression = o.disable
+	s.TransparentGzip = o.transparent
+}
+
+// ---------
+
+type protocolStatsOption struct {
+	stats *ProtocolStats
+}
+
+// WithProtocolStats counts the client's requests in stats,
+// see ClientSettings.ProtocolStats
+func WithProtocolStats(stats *ProtocolStats) Option {
+	return &protocolStatsOption{
+		stats: stats,
+	}
+}
+
+func (o *protocolStatsOption) Apply(s *ClientSettings) {
+	s.ProtocolStats = o.stats
+}
+
+// ---------
+
+type tlsSessionCacheOption struct {
+	size int
+}
+
+// WithTLSSessionCache specifies how many TLS sessions are kept for
+// resumption, see ClientSettings.TLSSessionCacheSize
+func WithTLSSessionCache(size int) Option {
+	return &tlsSessionCacheOption{
+		size: size,
+	}
+}
+
+func (o *tlsSessionCacheOption) Apply(s *ClientSettings) {
+	s.TLSSessionCacheSize = o.size
+}
+
+// ---------
+
+type commonOption struct {
+	common httpkit.CommonOptions
+}
+
+// WithCommon applies options shared by all httpkit subsystems.
+// Logger (or Log) and Limiter are relevant to a client, nil fields
+// are left alone.
+func WithCommon(common httpkit.CommonOptions) Option {
+	return &commonOption{
+		common: common,
+	}
+}
+
+func (o *commonOption) Apply(s *ClientSettings) {
+	if logger := o.common.Logger; logger != nil {
+		s.Log = func(msg string) {
+			logger.Warn(msg)
+		}
+	} else if o.common.Log != nil {
+		s.Log = o.common.Log
+	}
+	if o.common.Limiter != nil {
+		s.Limiter = o.common.Limiter
+	}
+}
+
+// ---------
+
+// limitedConn applies ClientSettings.Limiter to reads
+type limitedConn struct {
+	net.Conn
+	limiter httpkit.Limiter
+}
+
+func (lc *limitedConn) Read(buf []byte) (int, error) {
+	n, err := lc.Conn.Read(buf)
+	if n > 0 {
+		lc.limiter.Take(int64(n))
+	}
+	return n, err
+}
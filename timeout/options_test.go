@@ -0,0 +1,53 @@
+package timeout_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/timeout"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingLimiter struct {
+	taken int64
+}
+
+func (cl *countingLimiter) Take(n int64) {
+	atomic.AddInt64(&cl.taken, n)
+}
+
+func Test_ClientOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	var proxiedHost string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedHost = r.URL.Host
+		fmt.Fprint(w, "via proxy")
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.NoError(err)
+
+	limiter := &countingLimiter{}
+	client := timeout.NewClientWithOptions(
+		timeout.WithProxy(http.ProxyURL(proxyURL)),
+		timeout.WithCommon(httpkit.CommonOptions{Limiter: limiter}),
+	)
+
+	res, err := client.Get("http://example.invalid/file.dat")
+	assert.NoError(err)
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(err)
+	assert.EqualValues("via proxy", string(body))
+	assert.EqualValues("example.invalid", proxiedHost)
+	assert.True(atomic.LoadInt64(&limiter.taken) > int64(len(body)), "limiter should see the whole response")
+}
@@ -0,0 +1,128 @@
+package timeout
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+)
+
+// ProtocolStats counts the requests a client made over each version of
+// HTTP, overall and per host, along with the ALPN protocol negotiated with
+// each host and how many connections were opened to it. It's how to check
+// that a CDN actually serves HTTP/2, and that requests share connections.
+// See ClientSettings.ProtocolStats. It's safe for concurrent use.
+type ProtocolStats struct {
+	mu       sync.Mutex
+	requests map[string]int64
+	hosts    map[string]*HostProtocolUsage
+}
+
+// ProtocolUsage is a snapshot of ProtocolStats
+type ProtocolUsage struct {
+	// Requests counts responses by protocol, like "HTTP/1.1" or "HTTP/2.0"
+	Requests map[string]int64
+	// Hosts has the same, and more, per host (with port, if any)
+	Hosts map[string]HostProtocolUsage
+}
+
+// HostProtocolUsage is the ProtocolUsage of one host
+type HostProtocolUsage struct {
+	// Requests counts responses by protocol, like "HTTP/1.1" or "HTTP/2.0"
+	Requests map[string]int64
+	// ALPN is the protocol negotiated over TLS by the latest
+	// response, like "h2". It's empty for plain HTTP.
+	ALPN string
+	// NewConns is how many connections were opened, as opposed to
+	// reused. With HTTP/2, it should stay low as requests go up.
+	NewConns int64
+}
+
+// NewProtocolStats returns an empty ProtocolStats
+func NewProtocolStats() *ProtocolStats {
+	return &ProtocolStats{
+		requests: make(map[string]int64),
+		hosts:    make(map[string]*HostProtocolUsage),
+	}
+}
+
+// Usage returns a snapshot of the counts so far
+func (ps *ProtocolStats) Usage() ProtocolUsage {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	usage := ProtocolUsage{
+		Requests: copyCounts(ps.requests),
+		Hosts:    make(map[string]HostProtocolUsage, len(ps.hosts)),
+	}
+	for host, hu := range ps.hosts {
+		copied := *hu
+		copied.Requests = copyCounts(hu.Requests)
+		usage.Hosts[host] = copied
+	}
+	return usage
+}
+
+// hostLocked returns the usage of host, creating it if needed
+func (ps *ProtocolStats) hostLocked(host string) *HostProtocolUsage {
+	hu, ok := ps.hosts[host]
+	if !ok {
+		hu = &HostProtocolUsage{Requests: make(map[string]int64)}
+		ps.hosts[host] = hu
+	}
+	return hu
+}
+
+func (ps *ProtocolStats) recordConn(host string, info httptrace.GotConnInfo) {
+	if info.Reused {
+		return
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.hostLocked(host).NewConns++
+}
+
+func (ps *ProtocolStats) recordResponse(host string, res *http.Response) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.requests[res.Proto]++
+	hu := ps.hostLocked(host)
+	hu.Requests[res.Proto]++
+	if res.TLS != nil {
+		hu.ALPN = res.TLS.NegotiatedProtocol
+	}
+}
+
+func copyCounts(counts map[string]int64) map[string]int64 {
+	copied := make(map[string]int64, len(counts))
+	for k, v := range counts {
+		copied[k] = v
+	}
+	return copied
+}
+
+// protocolsTransport records the requests it does in a ProtocolStats
+type protocolsTransport struct {
+	base  http.RoundTripper
+	stats *ProtocolStats
+}
+
+var _ http.RoundTripper = (*protocolsTransport)(nil)
+
+func (pt *protocolsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			pt.stats.recordConn(host, info)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	res, err := pt.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	pt.stats.recordResponse(host, res)
+	return res, nil
+}
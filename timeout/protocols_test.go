@@ -0,0 +1,68 @@
+package timeout_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/itchio/httpkit/timeout"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ProtocolStats(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hi")
+	})
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	h1 := httptest.NewServer(handler)
+	defer h1.Close()
+
+	// the test server's certificate is self-signed
+	ignore := timeout.IgnoreCertificateErrors
+	timeout.IgnoreCertificateErrors = true
+	defer func() { timeout.IgnoreCertificateErrors = ignore }()
+
+	stats := timeout.NewProtocolStats()
+	c := timeout.NewClientWithOptions(timeout.WithProtocolStats(stats))
+
+	get := func(url string) {
+		t.Helper()
+		res, err := c.Get(url)
+		if !assert.NoError(err) {
+			return
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	for i := 0; i < 3; i++ {
+		get(h2.URL)
+		get(h1.URL)
+	}
+
+	usage := stats.Usage()
+	assert.EqualValues(map[string]int64{"HTTP/2.0": 3, "HTTP/1.1": 3}, usage.Requests)
+
+	h2Host := strings.TrimPrefix(h2.URL, "https://")
+	assert.EqualValues("h2", usage.Hosts[h2Host].ALPN)
+	assert.EqualValues(3, usage.Hosts[h2Host].Requests["HTTP/2.0"])
+	assert.EqualValues(1, usage.Hosts[h2Host].NewConns)
+
+	h1Host := strings.TrimPrefix(h1.URL, "http://")
+	assert.EqualValues("", usage.Hosts[h1Host].ALPN)
+	assert.EqualValues(3, usage.Hosts[h1Host].Requests["HTTP/1.1"])
+	assert.EqualValues(1, usage.Hosts[h1Host].NewConns)
+
+	// snapshots don't change
+	get(h1.URL)
+	assert.EqualValues(3, usage.Hosts[h1Host].Requests["HTTP/1.1"])
+	assert.EqualValues(4, stats.Usage().Hosts[h1Host].Requests["HTTP/1.1"])
+}
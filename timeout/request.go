@@ -0,0 +1,122 @@
+package timeout
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RequestTimeouts bounds a single request made with Do.
+//
+// http.Client.Timeout covers the whole exchange, including reading the
+// body, so any value short enough for API calls eventually truncates
+// large downloads. RequestTimeouts splits it in two: HeaderTimeout bounds
+// everything up to the response headers, and StallTimeout only fails body
+// reads once the server stops sending data, however long the body is.
+type RequestTimeouts struct {
+	// HeaderTimeout is how long we wait for the response headers,
+	// including connecting, the TLS handshake and sending the request
+	// body. Zero means no limit (besides the client's own).
+	HeaderTimeout time.Duration
+
+	// StallTimeout makes body reads fail with a *StallError if no data
+	// arrives for that long, see NewStallBody. Zero means no limit
+	// (besides the client's idle timeout).
+	StallTimeout time.Duration
+}
+
+// HeaderTimeoutError is returned by Do when the response headers
+// didn't arrive within RequestTimeouts.HeaderTimeout.
+type HeaderTimeoutError struct {
+	// Wait is how long we waited for the headers
+	Wait time.Duration
+}
+
+var _ error = (*HeaderTimeoutError)(nil)
+
+func (hte *HeaderTimeoutError) Error() string {
+	return fmt.Sprintf("no response headers after %s", hte.Wait)
+}
+
+// Timeout returns true, see net.Error
+func (hte *HeaderTimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary returns true, so that header timeouts are considered
+// network errors (see neterr.IsNetworkError), and retried.
+func (hte *HeaderTimeoutError) Temporary() bool {
+	return true
+}
+
+// Do sends req with client, bounded by timeouts: it fails with a
+// *HeaderTimeoutError if the response headers take longer than
+// HeaderTimeout, and the response body is wrapped in a StallBody with
+// StallTimeout, instead of having a deadline. That way, API calls and
+// long downloads can share a client, which should have no Timeout of
+// its own (clients returned by NewClient don't).
+//
+// The request's context still applies to the whole exchange.
+func Do(client *http.Client, req *http.Request, timeouts RequestTimeouts) (*http.Response, error) {
+	if timeouts.HeaderTimeout <= 0 {
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		res.Body = NewStallBody(res.Body, timeouts.StallTimeout)
+		return res, nil
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	var mu sync.Mutex
+	timedOut := false
+	timer := time.AfterFunc(timeouts.HeaderTimeout, func() {
+		mu.Lock()
+		timedOut = true
+		mu.Unlock()
+		cancel()
+	})
+
+	res, err := client.Do(req.WithContext(ctx))
+	timer.Stop()
+	mu.Lock()
+	expired := timedOut
+	mu.Unlock()
+
+	if expired {
+		if err == nil {
+			// the headers made it just as we gave up
+			res.Body.Close()
+		}
+		cancel()
+		return nil, errors.WithStack(&HeaderTimeoutError{Wait: timeouts.HeaderTimeout})
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// the context has to outlive Do, since it governs reading the body
+	res.Body = &cancelBody{
+		ReadCloser: NewStallBody(res.Body, timeouts.StallTimeout),
+		cancel:     cancel,
+	}
+	return res, nil
+}
+
+// cancelBody releases a request's context when its body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (cb *cancelBody) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.cancel()
+	return err
+}
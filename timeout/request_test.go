@@ -0,0 +1,81 @@
+package timeout_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/neterr"
+	"github.com/itchio/httpkit/timeout"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Do(t *testing.T) {
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow-headers":
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+		case "/slow-body":
+			// takes longer than the header timeout, but never stalls
+			w.WriteHeader(200)
+			for i := 0; i < 6; i++ {
+				w.Write([]byte("data"))
+				w.(http.Flusher).Flush()
+				time.Sleep(40 * time.Millisecond)
+			}
+		case "/stalled-body":
+			w.WriteHeader(200)
+			w.Write([]byte("data"))
+			w.(http.Flusher).Flush()
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := &http.Client{}
+	timeouts := timeout.RequestTimeouts{
+		HeaderTimeout: 100 * time.Millisecond,
+		StallTimeout:  100 * time.Millisecond,
+	}
+	do := func(path string) (*http.Response, error) {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		assert.NoError(err)
+		return timeout.Do(client, req, timeouts)
+	}
+
+	_, err := do("/slow-headers")
+	assert.Error(err)
+	hte, ok := errors.Cause(err).(*timeout.HeaderTimeoutError)
+	assert.True(ok, "should be a HeaderTimeoutError")
+	assert.EqualValues(timeouts.HeaderTimeout, hte.Wait)
+	assert.True(neterr.IsNetworkError(err), "should be retried")
+
+	res, err := do("/slow-body")
+	assert.NoError(err)
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(err)
+	assert.EqualValues(strings.Repeat("data", 6), string(body))
+	assert.NoError(res.Body.Close())
+
+	res, err = do("/stalled-body")
+	assert.NoError(err)
+	body, err = ioutil.ReadAll(res.Body)
+	assert.EqualValues("data", string(body))
+	_, ok = errors.Cause(err).(*timeout.StallError)
+	assert.True(ok, "should be a StallError")
+	assert.NoError(res.Body.Close())
+}
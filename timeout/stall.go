@@ -0,0 +1,133 @@
+package timeout
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StallError is returned by a StallBody when no data
+// arrived within its window.
+type StallError struct {
+	// Window is how long we waited for data
+	Window time.Duration
+	// BytesRead is how many bytes were read before the stall
+	BytesRead int64
+}
+
+var _ error = (*StallError)(nil)
+
+func (se *StallError) Error() string {
+	return fmt.Sprintf("response body stalled: no data for %s (after %d bytes)", se.Window, se.BytesRead)
+}
+
+// Timeout returns true, see net.Error
+func (se *StallError) Timeout() bool {
+	return true
+}
+
+// Temporary returns true, so that stalls are considered
+// network errors (see neterr.IsNetworkError), and retried.
+func (se *StallError) Temporary() bool {
+	return true
+}
+
+// StallBody wraps a response body so that, if a Read gets no data within
+// a window, the body is closed and Read returns a *StallError. The window
+// only runs while a Read is pending: time spent by the caller between
+// reads (like a conn sitting idle in a pool) doesn't count as a stall.
+//
+// Unlike the idle timeout of clients returned by NewClient, it works for
+// any transport, and catches servers that keep the connection alive
+// without sending anything.
+type StallBody struct {
+	body   io.ReadCloser
+	window time.Duration
+	timer  *time.Timer
+
+	mu        sync.Mutex
+	bytesRead int64
+	// reading is set while a Read is pending, until deadline
+	reading  bool
+	deadline time.Time
+	stalled  bool
+	closed   bool
+}
+
+var _ io.ReadCloser = (*StallBody)(nil)
+
+// NewStallBody returns body wrapped in a StallBody. If window
+// is zero or negative, body is returned as-is.
+func NewStallBody(body io.ReadCloser, window time.Duration) io.ReadCloser {
+	if window <= 0 {
+		return body
+	}
+
+	sb := &StallBody{
+		body:   body,
+		window: window,
+	}
+	// armed by Read
+	sb.timer = time.AfterFunc(window, sb.stall)
+	sb.timer.Stop()
+	return sb
+}
+
+func (sb *StallBody) stall() {
+	sb.mu.Lock()
+	if sb.closed || !sb.reading || time.Now().Before(sb.deadline) {
+		// the Read returned in time, and this firing is stale
+		sb.mu.Unlock()
+		return
+	}
+	sb.stalled = true
+	sb.mu.Unlock()
+
+	// unblocks the pending Read
+	sb.body.Close()
+}
+
+// Read implements io.Reader
+func (sb *StallBody) Read(buf []byte) (int, error) {
+	sb.mu.Lock()
+	if !sb.closed && !sb.stalled {
+		sb.reading = true
+		sb.deadline = time.Now().Add(sb.window)
+		sb.timer.Reset(sb.window)
+	}
+	sb.mu.Unlock()
+
+	n, err := sb.body.Read(buf)
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	sb.reading = false
+	sb.timer.Stop()
+	sb.bytesRead += int64(n)
+	if sb.stalled {
+		return n, errors.WithStack(&StallError{
+			Window:    sb.window,
+			BytesRead: sb.bytesRead,
+		})
+	}
+	return n, err
+}
+
+// Close stops the stall timer and closes the underlying body
+func (sb *StallBody) Close() error {
+	sb.mu.Lock()
+	sb.closed = true
+	stalled := sb.stalled
+	sb.mu.Unlock()
+
+	sb.timer.Stop()
+	if stalled {
+		// already closed by stall
+		return nil
+	}
+	return sb.body.Close()
+}
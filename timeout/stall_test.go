@@ -0,0 +1,64 @@
+package timeout_test
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/neterr"
+	"github.com/itchio/httpkit/timeout"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_StallBody(t *testing.T) {
+	assert := assert.New(t)
+
+	pr, pw := io.Pipe()
+	body := timeout.NewStallBody(pr, 100*time.Millisecond)
+
+	go func() {
+		// each write is well within the window, but the total isn't
+		for i := 0; i < 5; i++ {
+			time.Sleep(40 * time.Millisecond)
+			pw.Write([]byte("data"))
+		}
+		// then nothing
+	}()
+
+	contents, err := ioutil.ReadAll(body)
+	assert.Error(err)
+	assert.EqualValues("datadatadatadatadata", string(contents))
+
+	se, ok := errors.Cause(err).(*timeout.StallError)
+	assert.True(ok, "should be a StallError")
+	assert.EqualValues(20, se.BytesRead)
+	assert.True(neterr.IsNetworkError(err), "should be retried")
+	assert.NoError(body.Close())
+
+	// closing early stops the timer
+	pr, pw = io.Pipe()
+	body = timeout.NewStallBody(pr, 50*time.Millisecond)
+	assert.NoError(body.Close())
+	time.Sleep(100 * time.Millisecond)
+	_, err = pw.Write([]byte("data"))
+	assert.Equal(io.ErrClosedPipe, err)
+
+	// only pending reads count: pausing between them doesn't stall
+	body = timeout.NewStallBody(ioutil.NopCloser(strings.NewReader("datadata")), 50*time.Millisecond)
+	time.Sleep(120 * time.Millisecond)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(body, buf)
+	assert.NoError(err)
+	time.Sleep(120 * time.Millisecond)
+	_, err = io.ReadFull(body, buf)
+	assert.NoError(err)
+	assert.EqualValues("data", string(buf))
+	assert.NoError(body.Close())
+
+	// no window, no wrapper
+	pr, _ = io.Pipe()
+	assert.Equal(pr, timeout.NewStallBody(pr, 0))
+}
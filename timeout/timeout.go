@@ -4,9 +4,11 @@ package timeout
 
 import (
 	"crypto/tls"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
 	"time"
@@ -14,6 +16,7 @@ import (
 	"github.com/certifi/gocertifi"
 	"github.com/efarrer/iothrottler"
 	"github.com/getlantern/idletiming"
+	"github.com/itchio/httpkit"
 	"github.com/pkg/errors"
 	"golang.org/x/net/http2"
 )
@@ -29,6 +32,8 @@ const (
 	DefaultConnectTimeout time.Duration = 30 * time.Second
 	// DefaultIdleTimeout is the duration after which, if there's no I/O activity, we declare a connection dead
 	DefaultIdleTimeout = 60 * time.Second
+	// DefaultTLSSessionCacheSize is the number of TLS sessions a client keeps, see ClientSettings.TLSSessionCacheSize
+	DefaultTLSSessionCacheSize = 64
 )
 
 // ThrottlerPool is the singleton pool from `iothrottler`
@@ -49,7 +54,7 @@ func SetSimulateOffline(enabled bool) {
 	simulateOffline = enabled
 }
 
-func timeoutDialer(cTimeout time.Duration, rwTimeout time.Duration) func(net, addr string) (net.Conn, error) {
+func timeoutDialer(cTimeout time.Duration, rwTimeout time.Duration, limiter httpkit.Limiter) func(net, addr string) (net.Conn, error) {
 	return func(netw, addr string) (net.Conn, error) {
 		if simulateOffline {
 			return nil, &net.OpError{
@@ -68,6 +73,10 @@ func timeoutDialer(cTimeout time.Duration, rwTimeout time.Duration) func(net, ad
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
+		// respect per-client limiter
+		if limiter != nil {
+			throttledConn = &limitedConn{Conn: throttledConn, limiter: limiter}
+		}
 		// measure bps
 		monitorConn := &monitoringConn{
 			Conn: throttledConn,
@@ -80,11 +89,81 @@ func timeoutDialer(cTimeout time.Duration, rwTimeout time.Duration) func(net, ad
 	}
 }
 
+// ClientSettings configures a client returned by NewClientWithSettings.
+type ClientSettings struct {
+	// ConnectTimeout is the duration we're willing to wait to establish a connection
+	ConnectTimeout time.Duration
+	// IdleTimeout is the duration after which, if there's no I/O activity, we declare a connection dead
+	IdleTimeout time.Duration
+
+	// DisableCompression prevents the transport from asking for gzip
+	// and decompressing responses behind our back. Clients used for
+	// range requests (like htfs) should set it, so that offsets always
+	// refer to the identity encoding.
+	DisableCompression bool
+
+	// TransparentGzip wraps the transport so that non-range requests
+	// ask for gzip and are decompressed transparently, see NewGzipTransport.
+	// It's meant for API clients, which also set DisableCompression.
+	TransparentGzip bool
+
+	// Proxy returns the proxy to use for a request, like http.Transport.Proxy.
+	// Defaults to http.ProxyFromEnvironment.
+	Proxy func(req *http.Request) (*url.URL, error)
+
+	// Limiter, if set, caps how fast this client's connections are read from
+	Limiter httpkit.Limiter
+
+	// ProtocolStats, if set, counts this client's requests
+	// by HTTP version and host, see NewProtocolStats
+	ProtocolStats *ProtocolStats
+
+	// TLSSessionCacheSize is how many TLS sessions are kept, so that new
+	// connections to the same hosts can resume them, with a shorter
+	// handshake. Defaults to DefaultTLSSessionCacheSize, negative values
+	// disable resumption.
+	TLSSessionCacheSize int
+
+	// Log, if set, is used instead of the standard logger to warn about
+	// problems while setting up the transport
+	Log httpkit.LogFunc
+}
+
 // NewClient returns a new http client with custom connect and r/w timeouts.
 func NewClient(connectTimeout time.Duration, readWriteTimeout time.Duration) *http.Client {
+	return NewClientWithSettings(&ClientSettings{
+		ConnectTimeout: connectTimeout,
+		IdleTimeout:    readWriteTimeout,
+	})
+}
+
+// NewClientWithSettings returns a new http client configured by settings.
+// Zero timeouts are replaced with DefaultConnectTimeout and DefaultIdleTimeout.
+func NewClientWithSettings(settings *ClientSettings) *http.Client {
+	connectTimeout := settings.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = DefaultConnectTimeout
+	}
+	idleTimeout := settings.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+
+	proxy := settings.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	logf := log.Printf
+	if settings.Log != nil {
+		logf = func(format string, args ...interface{}) {
+			settings.Log(fmt.Sprintf(format, args...))
+		}
+	}
+
 	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		Dial:  timeoutDialer(connectTimeout, readWriteTimeout),
+		Proxy:              proxy,
+		Dial:               timeoutDialer(connectTimeout, idleTimeout, settings.Limiter),
+		DisableCompression: settings.DisableCompression,
 	}
 	if IgnoreCertificateErrors {
 		transport.TLSClientConfig = &tls.Config{
@@ -94,20 +173,38 @@ func NewClient(connectTimeout time.Duration, readWriteTimeout time.Duration) *ht
 	if runtime.GOOS == "darwin" {
 		certPool, err := gocertifi.CACerts()
 		if err != nil {
-			log.Printf("Could not get gocertifi CA certs: %+v", err)
+			logf("Could not get gocertifi CA certs: %+v", err)
 		} else {
 			transport.TLSClientConfig = &tls.Config{
 				RootCAs: certPool,
 			}
 		}
 	}
+	if settings.TLSSessionCacheSize >= 0 {
+		cacheSize := settings.TLSSessionCacheSize
+		if cacheSize == 0 {
+			cacheSize = DefaultTLSSessionCacheSize
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(cacheSize)
+	}
 	err := http2.ConfigureTransport(transport)
 	if err != nil {
-		log.Printf("Could not configure transport for http/2: %+v", err)
+		logf("Could not configure transport for http/2: %+v", err)
+	}
+
+	var rt http.RoundTripper = transport
+	if settings.ProtocolStats != nil {
+		rt = &protocolsTransport{base: rt, stats: settings.ProtocolStats}
+	}
+	if settings.TransparentGzip {
+		rt = NewGzipTransport(rt)
 	}
 
 	return &http.Client{
-		Transport: transport,
+		Transport: rt,
 	}
 }
 
@@ -0,0 +1,45 @@
+package timeout_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/itchio/httpkit/timeout"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TLSSessionResumption(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// every request gets a new connection, and a new handshake
+		w.Header().Set("Connection", "close")
+		io.WriteString(w, "hi")
+	}))
+	defer server.Close()
+
+	// the test server's certificate is self-signed
+	ignore := timeout.IgnoreCertificateErrors
+	timeout.IgnoreCertificateErrors = true
+	defer func() { timeout.IgnoreCertificateErrors = ignore }()
+
+	resumed := func(c *http.Client) []bool {
+		var results []bool
+		for i := 0; i < 3; i++ {
+			res, err := c.Get(server.URL)
+			if !assert.NoError(err) {
+				return nil
+			}
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			results = append(results, res.TLS.DidResume)
+		}
+		return results
+	}
+
+	assert.EqualValues([]bool{false, true, true}, resumed(timeout.NewDefaultClient()))
+	assert.EqualValues([]bool{false, false, false}, resumed(timeout.NewClientWithOptions(timeout.WithTLSSessionCache(-1))))
+}
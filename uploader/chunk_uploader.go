@@ -10,7 +10,9 @@ import (
 	"github.com/itchio/headway/state"
 	"github.com/itchio/headway/united"
 
+	"github.com/itchio/httpkit"
 	"github.com/itchio/httpkit/retrycontext"
+	"github.com/itchio/httpkit/timeout"
 	"github.com/pkg/errors"
 )
 
@@ -23,10 +25,14 @@ type chunkUploader struct {
 	uploadURL  string
 	httpClient *http.Client
 	id         int
+	// backoff is shared by the retries of all chunks
+	backoff *retrycontext.Backoff
 
 	// set later
 	progressListener ProgressListenerFunc
+	chunkListener    ChunkListenerFunc
 	consumer         *state.Consumer
+	logger           httpkit.Logger
 
 	// internal
 	offset int64
@@ -45,13 +51,14 @@ func (cu *chunkUploader) put(buf []byte, last bool) error {
 			} else if re, ok := err.(*retryError); ok {
 				cu.offset += re.committedBytes
 				buf = buf[re.committedBytes:]
-				retryCtx.Retry(errors.Errorf("Having troubles uploading some blocks"))
+				retryCtx.RetryWithOutcome(errors.Errorf("Having troubles uploading some blocks"), re.Outcome())
 				continue
 			} else {
 				return errors.WithStack(err)
 			}
 		} else {
 			cu.offset += int64(len(buf))
+			retryCtx.Succeed()
 			return nil
 		}
 	}
@@ -92,88 +99,124 @@ func (cu *chunkUploader) tryPut(buf []byte, last bool) error {
 
 	req.Header.Set("content-range", contentRange)
 	req.ContentLength = buflen
-	if last {
-		cu.debugf("→ Uploading %d-%d (final slice)", start, end)
-	} else {
-		cu.debugf("→ Uploading %d-%d (more to come)", start, end)
-	}
+	cu.debug("→ Uploading", "start", start, "end", end, "last", last)
 
 	startTime := time.Now()
 
 	res, err := cu.httpClient.Do(req)
 	if err != nil {
-		cu.debugf("while uploading %d-%d: \n%s", start, end, err.Error())
+		cu.debug("Upload failed", "start", start, "end", end, "err", err)
+		if last {
+			// the server may have committed the last chunk before the
+			// connection broke: find out before sending it all again
+			statusRes, queryErr := cu.tryQueryStatus()
+			if queryErr == nil {
+				return cu.resumeFromStatus(statusRes, buflen, last, time.Since(startTime))
+			}
+			cu.debug("Could not query upload status", "err", queryErr)
+		}
 		return &netError{err, gcsUnknown}
 	}
 
 	callDuration := time.Since(startTime)
-	cu.debugf("← %s (in %s)", res.Status, callDuration)
+	cu.debug("← Uploaded", "status", res.Status, "duration", callDuration)
+
+	stats := readChunkStats(res)
+	stats.Start = start
+	stats.End = start + buflen
+	stats.Last = last
+	stats.CallDuration = callDuration
+	if len(stats.ServerTiming) > 0 {
+		cu.debug("Server timing", "processing", stats.ServerDuration(), "uploadID", stats.UploadID)
+	}
+	if cu.chunkListener != nil {
+		cu.chunkListener(stats)
+	}
 
 	status := interpretGcsStatusCode(res.StatusCode)
 	if status == gcsUploadComplete && last {
-		cu.debugf("✓ %s upload complete!", united.FormatBytes(int64(cu.offset+buflen)))
+		cu.debug("✓ Upload complete", "size", united.FormatBytes(int64(cu.offset+buflen)))
 		return nil
 	}
 
 	if status == gcsNeedQuery {
-		cu.debugf("  → Need to query upload status (because of HTTP %s)", res.Status)
+		cu.debug("→ Querying upload status", "status", res.Status)
 		statusRes, err := cu.queryStatus()
 		if err != nil {
 			// this happens after we retry the query a few times
 			return errors.Wrap(err, "in chunkUpload.tryPut, while querying status")
 		}
+		return cu.resumeFromStatus(statusRes, buflen, last, callDuration)
+	}
 
-		if statusRes.StatusCode == 308 {
-			cu.debugf("  ← Got upload status, trying to resume")
-			res = statusRes
-			status = gcsResume
-		} else {
-			status = interpretGcsStatusCode(statusRes.StatusCode)
-			err = errors.Errorf("expected upload status, got HTTP %s (%s) instead", statusRes.Status, status)
-			cu.debugf(err.Error())
-			return errors.Wrap(err, "in chunkUpload.tryPut, after getting non-308 status code")
-		}
+	if status == gcsResume {
+		return cu.checkCommitted(res, buflen, callDuration)
 	}
 
+	return errors.Errorf("got HTTP %d (%s)", res.StatusCode, status)
+}
+
+// resumeFromStatus picks up from the upload status queried after a
+// failed PUT of buflen bytes. That PUT may have gone through anyway:
+// for the last chunk, that means the upload is complete, and there's
+// nothing left to do.
+func (cu *chunkUploader) resumeFromStatus(statusRes *http.Response, buflen int64, last bool, callDuration time.Duration) error {
+	defer statusRes.Body.Close()
+
+	status := interpretGcsStatusCode(statusRes.StatusCode)
 	if status == gcsResume {
-		expectedOffset := cu.offset + buflen
-		rangeHeader := res.Header.Get("Range")
-		if rangeHeader == "" {
-			cu.debugf("❌ Commit failed (null range), retrying")
-			return &retryError{committedBytes: 0}
-		}
+		cu.debug("← Got upload status, trying to resume")
+		return cu.checkCommitted(statusRes, buflen, callDuration)
+	}
 
-		committedRange, err := parseRangeHeader(rangeHeader)
-		if err != nil {
-			return errors.Wrap(err, "in chunkUploader.tryPut, while parsing range header")
-		}
+	if status == gcsUploadComplete && last {
+		cu.debug("✓ Upload was complete after all", "size", united.FormatBytes(int64(cu.offset+buflen)))
+		return nil
+	}
 
-		if committedRange.start != 0 {
-			return errors.Errorf("upload failed: beginning not committed somehow (committed range: %s)", committedRange)
-		}
+	err := errors.Errorf("expected upload status, got HTTP %s (%s) instead", statusRes.Status, status)
+	cu.debug("Could not get upload status", "err", err)
+	return errors.Wrap(err, "in chunkUpload.tryPut, after getting non-308 status code")
+}
 
-		committedBytes := committedRange.end - cu.offset
-		perSec := united.FormatBPS(committedBytes, callDuration)
+// checkCommitted looks at the Range header of a 308 response, to find
+// out how much of the buflen bytes just sent were committed
+func (cu *chunkUploader) checkCommitted(res *http.Response, buflen int64, callDuration time.Duration) error {
+	expectedOffset := cu.offset + buflen
+	rangeHeader := res.Header.Get("Range")
+	if rangeHeader == "" {
+		cu.debug("❌ Commit failed (null range), retrying")
+		return &retryError{committedBytes: 0}
+	}
 
-		if committedRange.end == expectedOffset {
-			cu.debugf("✓ Commit succeeded (%d blocks stored @ %s)", buflen/gcsChunkSize, perSec)
-			return nil
-		}
+	committedRange, err := parseRangeHeader(rangeHeader)
+	if err != nil {
+		return errors.Wrap(err, "in chunkUploader.tryPut, while parsing range header")
+	}
 
-		if committedBytes < 0 {
-			return errors.Errorf("upload failed: committed negative bytes somehow (committed range: %s, expectedOffset: %d)", committedRange, expectedOffset)
-		}
+	if committedRange.start != 0 {
+		return errors.Errorf("upload failed: beginning not committed somehow (committed range: %s)", committedRange)
+	}
 
-		if committedBytes > 0 {
-			cu.debugf("✓ Commit partially succeeded (%d / %d byte, %d blocks stored @ %s / s)", committedBytes, buflen, committedBytes/gcsChunkSize, perSec)
-			return &retryError{committedBytes}
-		}
+	committedBytes := committedRange.end - cu.offset
+	perSec := united.FormatBPS(committedBytes, callDuration)
 
-		cu.debugf("❌ Commit failed (retrying %d blocks)", buflen/gcsChunkSize)
+	if committedRange.end == expectedOffset {
+		cu.debug("✓ Commit succeeded", "blocks", buflen/gcsChunkSize, "speed", perSec)
+		return nil
+	}
+
+	if committedBytes < 0 {
+		return errors.Errorf("upload failed: committed negative bytes somehow (committed range: %s, expectedOffset: %d)", committedRange, expectedOffset)
+	}
+
+	if committedBytes > 0 {
+		cu.debug("✓ Commit partially succeeded", "committed", committedBytes, "size", buflen, "blocks", committedBytes/gcsChunkSize, "speed", perSec)
 		return &retryError{committedBytes}
 	}
 
-	return errors.Errorf("got HTTP %d (%s)", res.StatusCode, status)
+	cu.debug("❌ Commit failed, retrying", "blocks", buflen/gcsChunkSize)
+	return &retryError{committedBytes}
 }
 
 func (cu *chunkUploader) queryStatus() (*http.Response, error) {
@@ -181,7 +224,7 @@ func (cu *chunkUploader) queryStatus() (*http.Response, error) {
 	for retryCtx.ShouldTry() {
 		res, err := cu.tryQueryStatus()
 		if err != nil {
-			cu.debugf("while querying status of upload: %s", err.Error())
+			cu.debug("Could not query upload status", "err", err)
 			retryCtx.Retry(err)
 			continue
 		}
@@ -207,26 +250,27 @@ func (cu *chunkUploader) tryQueryStatus() (*http.Response, error) {
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	// status responses are small, don't let a stuck one hang the upload
+	res.Body = timeout.NewStallBody(res.Body, resumableIdleTimeout)
 
 	status := interpretGcsStatusCode(res.StatusCode)
-	if status == gcsResume {
-		// got what we wanted (Range header, etc.)
+	if status == gcsResume || status == gcsUploadComplete {
+		// got what we wanted (Range header, or the upload is done)
 		return res, nil
 	}
+	res.Body.Close()
 
 	return nil, errors.Errorf("while querying status, got HTTP %s (status %s)", res.Status, status)
 }
 
-func (cu *chunkUploader) debugf(msg string, args ...interface{}) {
-	if cu.consumer != nil {
-		fmsg := fmt.Sprintf(msg, args...)
-		cu.consumer.Debugf("[cu-%d] %s", cu.id, fmsg)
-	}
+func (cu *chunkUploader) debug(msg string, keyvals ...interface{}) {
+	logDebug(cu.logger, cu.consumer, "cu", cu.id, msg, keyvals)
 }
 
 func (cu *chunkUploader) newRetryContext() *retrycontext.Context {
 	return retrycontext.New(retrycontext.Settings{
 		MaxTries: resumableMaxRetries,
 		Consumer: cu.consumer,
+		Backoff:  cu.backoff,
 	})
 }
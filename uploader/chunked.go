@@ -0,0 +1,297 @@
+package uploader
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/itchio/headway/counter"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/neterr"
+	"github.com/itchio/httpkit/retrycontext"
+	"github.com/itchio/httpkit/timeout"
+	"github.com/pkg/errors"
+)
+
+// chunkedUpload streams everything written to it in a single PUT
+// request with chunked transfer-encoding, for simple servers that don't
+// implement resumable uploads and don't want a Content-Range header.
+type chunkedUpload struct {
+	uploadURL  string
+	httpClient *http.Client
+	id         int
+
+	consumer        *state.Consumer
+	logger          httpkit.Logger
+	progress        *throttledProgress
+	chunkListener   ChunkListenerFunc
+	checksumTrailer bool
+
+	startOnce sync.Once
+	pw        *io.PipeWriter
+	done      chan struct{}
+	err       error
+	closed    bool
+}
+
+var _ ResumableUpload = (*chunkedUpload)(nil)
+
+// NewChunkedUpload returns an upload that sends everything written to it
+// to uploadURL, in a single streaming PUT request with chunked
+// transfer-encoding and no Content-Range header.
+//
+// Since written data isn't kept around, a failed request can't be
+// retried: Write or Close will return the error. To retry, use
+// UploadChunked with a seekable source.
+func NewChunkedUpload(uploadURL string, opts ...Option) ResumableUpload {
+	s := defaultSettings()
+	for _, o := range opts {
+		o.Apply(s)
+	}
+
+	id := seed
+	seed++
+
+	return &chunkedUpload{
+		uploadURL:  uploadURL,
+		httpClient: timeout.NewClient(resumableConnectTimeout, resumableIdleTimeout),
+		id:         id,
+		consumer:   s.Consumer,
+		logger:     s.Logger,
+		progress:   s.newProgress(),
+		done:       make(chan struct{}),
+
+		checksumTrailer: s.ChecksumTrailer,
+	}
+}
+
+// Write implements io.Writer.
+func (cu *chunkedUpload) Write(buf []byte) (int, error) {
+	if cu.closed {
+		return 0, errors.New("write to closed chunked upload")
+	}
+
+	cu.start()
+	n, err := cu.pw.Write(buf)
+	if err != nil {
+		<-cu.done
+		if cu.err == nil {
+			// the server answered before getting everything
+			return n, errors.Wrap(io.ErrClosedPipe, "chunked upload: request finished before all data was written")
+		}
+		return n, errors.WithStack(cu.err)
+	}
+	return n, nil
+}
+
+// Close implements io.Closer.
+func (cu *chunkedUpload) Close() error {
+	if cu.closed {
+		return cu.err
+	}
+	cu.closed = true
+
+	cu.start()
+	cu.pw.Close()
+	<-cu.done
+	cu.progress.flush()
+	return cu.err
+}
+
+func (cu *chunkedUpload) SetConsumer(consumer *state.Consumer) {
+	cu.consumer = consumer
+}
+
+func (cu *chunkedUpload) SetProgressListener(progressListener ProgressListenerFunc) {
+	cu.progress.setListener(progressListener)
+}
+
+func (cu *chunkedUpload) SetProgressThrottle(throttle ProgressThrottle) {
+	cu.progress.setThrottle(throttle)
+}
+
+func (cu *chunkedUpload) SetChunkListener(chunkListener ChunkListenerFunc) {
+	cu.chunkListener = chunkListener
+}
+
+// start sends the request in the background, on first Write or Close,
+// so that listeners can be set after NewChunkedUpload.
+func (cu *chunkedUpload) start() {
+	cu.startOnce.Do(func() {
+		pr, pw := io.Pipe()
+		cu.pw = pw
+
+		go func() {
+			defer close(cu.done)
+			err := chunkedPut(cu.httpClient, cu.uploadURL, pr, cu.checksumTrailer, cu.progress.report, cu.chunkListener, cu.debug)
+			if err != nil {
+				cu.err = err
+				// unblock any pending Write
+				pr.CloseWithError(err)
+				return
+			}
+			pr.Close()
+		}()
+	})
+}
+
+func (cu *chunkedUpload) debug(msg string, keyvals ...interface{}) {
+	logDebug(cu.logger, cu.consumer, "chu", cu.id, msg, keyvals)
+}
+
+// UploadChunked uploads src to uploadURL, starting at its current offset,
+// in a single streaming PUT request with chunked transfer-encoding and no
+// Content-Range header. On network errors and 5xx responses, src is seeked
+// back and the whole upload is retried.
+func UploadChunked(uploadURL string, src io.ReadSeeker, opts ...Option) error {
+	s := defaultSettings()
+	for _, o := range opts {
+		o.Apply(s)
+	}
+
+	startOffset, err := src.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.Wrap(err, "in UploadChunked, while getting start offset")
+	}
+
+	httpClient := timeout.NewClient(resumableConnectTimeout, resumableIdleTimeout)
+	debug := func(msg string, keyvals ...interface{}) {
+		logDebug(s.Logger, s.Consumer, "chu", -1, msg, keyvals)
+	}
+
+	progress := s.newProgress()
+	defer progress.flush()
+
+	retryCtx := retrycontext.New(retrycontext.Settings{
+		MaxTries: resumableMaxRetries,
+		Consumer: s.Consumer,
+	})
+	for retryCtx.ShouldTry() {
+		_, err := src.Seek(startOffset, io.SeekStart)
+		if err != nil {
+			return errors.Wrap(err, "in UploadChunked, while seeking back")
+		}
+
+		err = chunkedPut(httpClient, uploadURL, src, s.ChecksumTrailer, progress.report, nil, debug)
+		if err != nil {
+			if isRetriableChunkedError(err) {
+				retryCtx.Retry(err)
+				continue
+			}
+			return err
+		}
+		return nil
+	}
+
+	return errors.Wrap(retryCtx.LastError, "in UploadChunked, too many errors, giving up")
+}
+
+// chunkedStatusError is returned when the server responds to
+// a chunked PUT with a non-2xx status code.
+type chunkedStatusError struct {
+	statusCode int
+	body       string
+}
+
+func (cse *chunkedStatusError) Error() string {
+	return fmt.Sprintf("chunked upload failed: HTTP %d: %s", cse.statusCode, cse.body)
+}
+
+func isRetriableChunkedError(err error) bool {
+	if se, ok := errors.Cause(err).(*chunkedStatusError); ok {
+		switch se.statusCode {
+		case 408, 429:
+			return true
+		}
+		return se.statusCode/100 == 5
+	}
+	return neterr.IsNetworkError(err)
+}
+
+func chunkedPut(httpClient *http.Client, uploadURL string, body io.Reader, checksumTrailer bool, progressListener ProgressListenerFunc, chunkListener ChunkListenerFunc, debug func(msg string, keyvals ...interface{})) error {
+	countingReader := counter.NewReaderCallback(func(count int64) {
+		if progressListener != nil {
+			progressListener(count)
+		}
+	}, body)
+
+	var reqBody io.Reader = countingReader
+	trailer := make(http.Header)
+	if checksumTrailer {
+		// announced now, filled in once the body is fully read
+		trailer.Set("Content-MD5", "")
+		reqBody = &md5TrailerReader{
+			reader:  countingReader,
+			hash:    md5.New(),
+			trailer: trailer,
+		}
+	}
+
+	// wrap so that net/http can't guess the length (or close src)
+	req, err := http.NewRequest("PUT", uploadURL, ioutil.NopCloser(reqBody))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	if checksumTrailer {
+		req.Trailer = trailer
+	}
+
+	debug("→ Uploading (chunked)")
+	startTime := time.Now()
+	res, err := httpClient.Do(req)
+	if err != nil {
+		debug("Upload failed", "err", err)
+		return errors.WithStack(err)
+	}
+	defer res.Body.Close()
+
+	callDuration := time.Since(startTime)
+	debug("← Uploaded", "status", res.Status, "duration", callDuration)
+
+	stats := readChunkStats(res)
+	stats.End = countingReader.Count()
+	stats.Last = true
+	stats.CallDuration = callDuration
+	if chunkListener != nil {
+		chunkListener(stats)
+	}
+
+	if res.StatusCode/100 != 2 {
+		errBody := timeout.NewStallBody(res.Body, resumableIdleTimeout)
+		defer errBody.Close()
+		resBody, _ := ioutil.ReadAll(io.LimitReader(errBody, 4*1024))
+		return errors.WithStack(&chunkedStatusError{
+			statusCode: res.StatusCode,
+			body:       string(resBody),
+		})
+	}
+
+	return nil
+}
+
+// md5TrailerReader hashes everything read through it, and sets
+// the Content-MD5 trailer when reaching EOF, which is the last
+// moment net/http lets us change a request's trailers.
+type md5TrailerReader struct {
+	reader  io.Reader
+	hash    hash.Hash
+	trailer http.Header
+}
+
+func (mtr *md5TrailerReader) Read(buf []byte) (int, error) {
+	n, err := mtr.reader.Read(buf)
+	mtr.hash.Write(buf[:n])
+	if err == io.EOF {
+		mtr.trailer.Set("Content-MD5", base64.StdEncoding.EncodeToString(mtr.hash.Sum(nil)))
+	}
+	return n, err
+}
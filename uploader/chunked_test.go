@@ -0,0 +1,164 @@
+package uploader
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/itchio/randsource/fullyrandom"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeChunkedServer struct {
+	*httptest.Server
+	data      []byte
+	numPUT    int
+	failFirst int
+	// contentMD5 is the Content-MD5 trailer of the last PUT, if any
+	contentMD5 string
+}
+
+func makeChunkedTestServer(t *testing.T) *fakeChunkedServer {
+	fs := &fakeChunkedServer{}
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			w.WriteHeader(400)
+			return
+		}
+		fs.numPUT++
+
+		if len(r.TransferEncoding) == 0 || r.TransferEncoding[0] != "chunked" {
+			http.Error(w, "expected chunked transfer-encoding", 400)
+			return
+		}
+		if r.Header.Get("content-range") != "" {
+			http.Error(w, "unexpected content-range", 400)
+			return
+		}
+
+		buf, err := ioutil.ReadAll(r.Body)
+		tmust(t, err)
+
+		if fs.failFirst > 0 {
+			fs.failFirst--
+			http.Error(w, "try again later", 503)
+			return
+		}
+
+		fs.data = buf
+		fs.contentMD5 = r.Trailer.Get("Content-MD5")
+		w.WriteHeader(201)
+	}))
+	return fs
+}
+
+func Test_ChunkedUpload(t *testing.T) {
+	assert := assert.New(t)
+
+	server := makeChunkedTestServer(t)
+	defer server.Close()
+
+	var progress int64
+	cu := NewChunkedUpload(server.URL, WithProgressListener(func(count int64) {
+		progress = count
+	}))
+
+	ref := new(bytes.Buffer)
+	tmust(t, fullyrandom.Write(ref, 3*1024*1024, time.Now().UnixNano()))
+	_, err := cu.Write(ref.Bytes()[:1024*1024])
+	tmust(t, err)
+	_, err = cu.Write(ref.Bytes()[1024*1024:])
+	tmust(t, err)
+	tmust(t, cu.Close())
+
+	assert.Equal(1, server.numPUT)
+	assert.EqualValues(ref.Bytes(), server.data)
+	assert.EqualValues(ref.Len(), progress)
+
+	// servers errors are surfaced on Close
+	server.failFirst = 1
+	cu = NewChunkedUpload(server.URL)
+	_, err = cu.Write([]byte("hello"))
+	tmust(t, err)
+	assert.Error(cu.Close())
+}
+
+func Test_ChunkedUploadEarlyResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	// answers without reading the body
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(201)
+	}))
+	defer server.Close()
+
+	cu := NewChunkedUpload(server.URL)
+	buf := make([]byte, 1024*1024)
+	var err error
+	for i := 0; i < 64 && err == nil; i++ {
+		var n int
+		n, err = cu.Write(buf)
+		if err == nil {
+			assert.EqualValues(len(buf), n)
+		}
+	}
+	assert.Error(err, "short writes must come with an error")
+	assert.Equal(io.ErrClosedPipe, errors.Cause(err))
+}
+
+func Test_UploadChunked(t *testing.T) {
+	assert := assert.New(t)
+
+	server := makeChunkedTestServer(t)
+	defer server.Close()
+	server.failFirst = 1
+
+	ref := new(bytes.Buffer)
+	tmust(t, fullyrandom.Write(ref, 1024*1024, time.Now().UnixNano()))
+
+	src := bytes.NewReader(ref.Bytes())
+	_, err := src.Seek(1024, 0)
+	tmust(t, err)
+
+	tmust(t, UploadChunked(server.URL, src))
+	assert.Equal(2, server.numPUT)
+	assert.EqualValues(ref.Bytes()[1024:], server.data)
+}
+
+func Test_UploadChunkedChecksumTrailer(t *testing.T) {
+	assert := assert.New(t)
+
+	server := makeChunkedTestServer(t)
+	defer server.Close()
+	server.failFirst = 1
+
+	ref := new(bytes.Buffer)
+	tmust(t, fullyrandom.Write(ref, 1024*1024, time.Now().UnixNano()))
+	sum := md5.Sum(ref.Bytes())
+
+	// retries hash from scratch
+	tmust(t, UploadChunked(server.URL, bytes.NewReader(ref.Bytes()), WithChecksumTrailer(true)))
+	assert.Equal(2, server.numPUT)
+	assert.EqualValues(ref.Bytes(), server.data)
+	assert.EqualValues(base64.StdEncoding.EncodeToString(sum[:]), server.contentMD5)
+
+	cu := NewChunkedUpload(server.URL, WithChecksumTrailer(true))
+	_, err := cu.Write(ref.Bytes())
+	tmust(t, err)
+	tmust(t, cu.Close())
+	assert.EqualValues(base64.StdEncoding.EncodeToString(sum[:]), server.contentMD5)
+
+	// off by default
+	cu = NewChunkedUpload(server.URL)
+	_, err = cu.Write(ref.Bytes())
+	tmust(t, err)
+	tmust(t, cu.Close())
+	assert.EqualValues("", server.contentMD5)
+}
@@ -1,6 +1,10 @@
 package uploader
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/itchio/httpkit/retrycontext"
+)
 
 type netError struct {
 	err    error
@@ -21,3 +25,12 @@ type retryError struct {
 func (re *retryError) Error() string {
 	return fmt.Sprintf("retrying, %d bytes committed", re.committedBytes)
 }
+
+// Outcome implements retrycontext.OutcomeError: committing some bytes
+// counts as progress, so the backoff starts over
+func (re *retryError) Outcome() retrycontext.Outcome {
+	if re.committedBytes > 0 {
+		return retrycontext.PartialProgress
+	}
+	return retrycontext.NoProgress
+}
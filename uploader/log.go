@@ -0,0 +1,32 @@
+package uploader
+
+import (
+	"fmt"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/httpkit"
+)
+
+// logDebug sends a structured message to logger if set, or formats it
+// for consumer otherwise. tag and id (if non-negative) tell uploads apart.
+func logDebug(logger httpkit.Logger, consumer *state.Consumer, tag string, id int, msg string, keyvals []interface{}) {
+	if logger != nil {
+		if !logger.Enabled(httpkit.LevelDebug) {
+			return
+		}
+		keyvals = append(keyvals, "upload", tag)
+		if id >= 0 {
+			keyvals = append(keyvals, "id", id)
+		}
+		logger.Debug(msg, keyvals...)
+		return
+	}
+
+	if consumer != nil {
+		prefix := tag
+		if id >= 0 {
+			prefix = fmt.Sprintf("%s-%d", tag, id)
+		}
+		consumer.Debugf("[%s] %s", prefix, httpkit.FormatKeyvals(msg, keyvals...))
+	}
+}
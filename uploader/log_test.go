@@ -0,0 +1,40 @@
+package uploader
+
+import (
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/httpkit"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_LogDebug(t *testing.T) {
+	assert := assert.New(t)
+
+	var consumerLines []string
+	consumer := &state.Consumer{
+		OnMessage: func(level string, msg string) {
+			consumerLines = append(consumerLines, msg)
+		},
+	}
+
+	logDebug(nil, consumer, "cu", 3, "Uploading", []interface{}{"start", 0, "end", 1024})
+	logDebug(nil, consumer, "transfer", -1, "Done", nil)
+	assert.EqualValues([]string{
+		"[cu-3] Uploading start=0 end=1024",
+		"[transfer] Done",
+	}, consumerLines)
+
+	var loggerLines []string
+	logger := httpkit.FuncLogger(func(msg string) {
+		loggerLines = append(loggerLines, msg)
+	}, httpkit.LevelDebug)
+	logDebug(logger, consumer, "cu", 3, "Uploading", []interface{}{"start", 0})
+	assert.EqualValues([]string{"Uploading start=0 upload=cu id=3"}, loggerLines)
+	assert.Len(consumerLines, 2, "consumer shouldn't get messages when there's a logger")
+
+	quiet := httpkit.FuncLogger(func(msg string) {
+		t.Errorf("should be dropped: %q", msg)
+	}, httpkit.LevelInfo)
+	logDebug(quiet, consumer, "cu", 3, "Uploading", nil)
+}
@@ -0,0 +1,125 @@
+package uploader
+
+import (
+	"sync"
+	"time"
+
+	"github.com/itchio/httpkit/clock"
+)
+
+// ProgressThrottle limits how often a ProgressListenerFunc gets called.
+// The listener is called when either limit allows it. The zero value
+// disables throttling: the listener is called on every read of the
+// request body, which can be thousands of times per second.
+type ProgressThrottle struct {
+	// MaxPerSecond is the maximum number of calls per second
+	MaxPerSecond int
+	// EveryBytes, if non-zero, triggers a call whenever that many
+	// bytes have been processed since the last call
+	EveryBytes int64
+}
+
+func (pt ProgressThrottle) enabled() bool {
+	return pt.MaxPerSecond > 0 || pt.EveryBytes > 0
+}
+
+// throttledProgress wraps a ProgressListenerFunc according to a ProgressThrottle.
+// Suppressed values are remembered, so flush can report the last one.
+type throttledProgress struct {
+	listener ProgressListenerFunc
+	throttle ProgressThrottle
+	clock    clock.Clock
+
+	mu         sync.Mutex
+	lastCall   time.Time
+	lastCount  int64
+	pending    int64
+	hasPending bool
+}
+
+func newThrottledProgress(listener ProgressListenerFunc, throttle ProgressThrottle) *throttledProgress {
+	return &throttledProgress{
+		listener: listener,
+		throttle: throttle,
+		clock:    clock.Real,
+	}
+}
+
+func (tp *throttledProgress) setListener(listener ProgressListenerFunc) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	tp.listener = listener
+}
+
+func (tp *throttledProgress) setThrottle(throttle ProgressThrottle) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	tp.throttle = throttle
+}
+
+func (tp *throttledProgress) report(count int64) {
+	tp.mu.Lock()
+	listener := tp.listener
+	if listener == nil {
+		tp.mu.Unlock()
+		return
+	}
+
+	if !tp.throttle.enabled() {
+		tp.mu.Unlock()
+		listener(count)
+		return
+	}
+
+	now := tp.clock.Now()
+	fire := tp.lastCall.IsZero()
+	if tp.throttle.MaxPerSecond > 0 {
+		interval := time.Second / time.Duration(tp.throttle.MaxPerSecond)
+		if now.Sub(tp.lastCall) >= interval {
+			fire = true
+		}
+	}
+	if tp.throttle.EveryBytes > 0 {
+		delta := count - tp.lastCount
+		if delta < 0 {
+			// went backwards (retried blocks)
+			delta = -delta
+		}
+		if delta >= tp.throttle.EveryBytes {
+			fire = true
+		}
+	}
+
+	if !fire {
+		tp.pending = count
+		tp.hasPending = true
+		tp.mu.Unlock()
+		return
+	}
+
+	tp.lastCall = now
+	tp.lastCount = count
+	tp.hasPending = false
+	tp.mu.Unlock()
+
+	listener(count)
+}
+
+// flush reports the last suppressed value, if any
+func (tp *throttledProgress) flush() {
+	tp.mu.Lock()
+	if !tp.hasPending || tp.listener == nil {
+		tp.mu.Unlock()
+		return
+	}
+	listener := tp.listener
+	count := tp.pending
+	tp.hasPending = false
+	tp.lastCall = tp.clock.Now()
+	tp.lastCount = count
+	tp.mu.Unlock()
+
+	listener(count)
+}
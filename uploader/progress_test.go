@@ -0,0 +1,54 @@
+package uploader
+
+import (
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ThrottledProgress(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls []int64
+	listener := func(count int64) {
+		calls = append(calls, count)
+	}
+
+	// no throttle: every call goes through
+	tp := newThrottledProgress(listener, ProgressThrottle{})
+	for i := int64(1); i <= 5; i++ {
+		tp.report(i)
+	}
+	assert.EqualValues([]int64{1, 2, 3, 4, 5}, calls)
+
+	// time-based
+	calls = nil
+	fc := clock.NewFake(time.Now())
+	tp = newThrottledProgress(listener, ProgressThrottle{MaxPerSecond: 10})
+	tp.clock = fc
+	for i := int64(1); i <= 100; i++ {
+		tp.report(i)
+		fc.Advance(10 * time.Millisecond)
+	}
+	tp.flush()
+	// first call, one every 100ms after that, and the final value
+	assert.Len(calls, 11)
+	assert.EqualValues(1, calls[0])
+	assert.EqualValues(100, calls[len(calls)-1])
+
+	// byte-based
+	calls = nil
+	tp = newThrottledProgress(listener, ProgressThrottle{EveryBytes: 1000})
+	tp.clock = fc
+	for i := int64(0); i <= 5000; i += 100 {
+		tp.report(i)
+	}
+	tp.flush()
+	assert.EqualValues([]int64{0, 1000, 2000, 3000, 4000, 5000}, calls)
+
+	// flush doesn't repeat values
+	tp.flush()
+	assert.Len(calls, 6)
+}
@@ -2,6 +2,7 @@ package uploader
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 
@@ -13,32 +14,44 @@ type httpRange struct {
 	end   int64
 }
 
-func parseRangeHeader(rangeHeader string) (r *httpRange, err error) {
+// rangeHeaderError is returned by parseRangeHeader for malformed values
+type rangeHeaderError struct {
+	value  string
+	reason string
+}
+
+func (rhe *rangeHeaderError) Error() string {
+	return fmt.Sprintf("invalid range header %q: %s", rhe.value, rhe.reason)
+}
+
+// parseRangeHeader parses "bytes=0-99", as sent by GCS, into 0, 100
+func parseRangeHeader(rangeHeader string) (*httpRange, error) {
+	invalid := func(reason string) error {
+		return errors.WithStack(&rangeHeaderError{value: rangeHeader, reason: reason})
+	}
+
 	keyval := strings.Split(rangeHeader, "=")
 	if len(keyval) != 2 {
-		err = errors.Errorf("invalid range header, expected \"key=val\", got \"%s\"", rangeHeader)
-		return
+		return nil, invalid("expected key=val")
 	}
 	val := keyval[1]
 
 	startEnd := strings.Split(val, "-")
 	if len(startEnd) != 2 {
-		err = errors.Errorf("invalid range header, expected \"start-end\", got \"%s\"", val)
-		return
+		return nil, invalid("expected start-end")
 	}
 
 	start, err := strconv.ParseInt(startEnd[0], 10, 64)
-	if err != nil {
-		return
+	if err != nil || start < 0 {
+		return nil, invalid("invalid start")
 	}
 
 	end, err := strconv.ParseInt(startEnd[1], 10, 64)
-	if err != nil {
-		return
+	if err != nil || end < start || end == math.MaxInt64 {
+		return nil, invalid("invalid end")
 	}
 
-	r = &httpRange{start, end + 1}
-	return
+	return &httpRange{start, end + 1}, nil
 }
 
 func (r *httpRange) String() string {
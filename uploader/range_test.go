@@ -0,0 +1,59 @@
+//go:build go1.18
+// +build go1.18
+
+package uploader
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// rangeHeaderSeeds are Range values GCS sends, and some it shouldn't
+var rangeHeaderSeeds = []string{
+	"bytes=0-99",
+	"bytes=0-0",
+	"bytes=5-4",
+	"bytes=-1",
+	"bytes=0-",
+	"bytes=0-9223372036854775807",
+	"bytes=0-1-2",
+	"bytes",
+	"=",
+	"",
+}
+
+func Test_ParseRangeHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	r, err := parseRangeHeader("bytes=0-99")
+	assert.NoError(err)
+	assert.EqualValues(0, r.start)
+	assert.EqualValues(100, r.end)
+	assert.EqualValues("bytes=0-99", r.String())
+
+	for _, value := range []string{"bytes=5-4", "bytes=0-", "bytes=0-9223372036854775807", "bytes"} {
+		_, err := parseRangeHeader(value)
+		_, ok := errors.Cause(err).(*rangeHeaderError)
+		assert.True(ok, "%q should give a rangeHeaderError, got %v", value, err)
+	}
+}
+
+func FuzzParseRangeHeader(f *testing.F) {
+	for _, seed := range rangeHeaderSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		r, err := parseRangeHeader(value)
+		if err != nil {
+			if _, ok := errors.Cause(err).(*rangeHeaderError); !ok {
+				t.Fatalf("expected a rangeHeaderError, got %#v", err)
+			}
+			return
+		}
+		if r.start < 0 || r.end <= r.start {
+			t.Fatalf("%q parsed into invalid range %d-%d", value, r.start, r.end)
+		}
+	})
+}
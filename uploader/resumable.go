@@ -2,20 +2,22 @@ package uploader
 
 import (
 	"bytes"
-	"fmt"
 	"io"
 	"sync"
 	"time"
 
 	"github.com/itchio/headway/state"
+	"github.com/itchio/httpkit"
 	"github.com/itchio/httpkit/timeout"
 	"github.com/pkg/errors"
 )
 
 type resumableUpload struct {
-	maxChunkGroup    int
-	consumer         *state.Consumer
-	progressListener ProgressListenerFunc
+	maxChunkGroup int
+	queueSize     int
+	consumer      *state.Consumer
+	logger        httpkit.Logger
+	progress      *throttledProgress
 
 	closed        bool
 	err           error
@@ -34,6 +36,8 @@ type ResumableUpload interface {
 	io.WriteCloser
 	SetConsumer(consumer *state.Consumer)
 	SetProgressListener(progressListener ProgressListenerFunc)
+	SetChunkListener(chunkListener ChunkListenerFunc)
+	SetProgressThrottle(throttle ProgressThrottle)
 }
 
 type rblock struct {
@@ -61,10 +65,16 @@ func NewResumableUpload(uploadURL string, opts ...Option) ResumableUpload {
 		uploadURL:  uploadURL,
 		httpClient: timeout.NewClient(resumableConnectTimeout, resumableIdleTimeout),
 		id:         id,
+		backoff:    s.newBackoff(),
+		logger:     s.Logger,
 	}
 
+	maxChunkGroup, queueSize := s.bufferSizes()
 	ru := &resumableUpload{
-		maxChunkGroup: s.MaxChunkGroup,
+		maxChunkGroup: maxChunkGroup,
+		queueSize:     queueSize,
+		logger:        s.Logger,
+		progress:      s.newProgress(),
 
 		err:           nil,
 		pushedErr:     make(chan struct{}, 0),
@@ -75,6 +85,10 @@ func NewResumableUpload(uploadURL string, opts ...Option) ResumableUpload {
 		id:            id,
 	}
 	ru.splitBuf.Grow(rblockSize)
+	if s.Consumer != nil {
+		ru.SetConsumer(s.Consumer)
+	}
+	chunkUploader.progressListener = ru.progress.report
 
 	go ru.work()
 
@@ -143,6 +157,7 @@ func (ru *resumableUpload) Close() error {
 	case <-ru.done: // muffin
 	case <-ru.pushedErr: // muffin
 	}
+	ru.progress.flush()
 
 	// return any errors
 	return ru.checkError()
@@ -154,7 +169,15 @@ func (ru *resumableUpload) SetConsumer(consumer *state.Consumer) {
 }
 
 func (ru *resumableUpload) SetProgressListener(progressListener ProgressListenerFunc) {
-	ru.chunkUploader.progressListener = progressListener
+	ru.progress.setListener(progressListener)
+}
+
+func (ru *resumableUpload) SetProgressThrottle(throttle ProgressThrottle) {
+	ru.progress.setThrottle(throttle)
+}
+
+func (ru *resumableUpload) SetChunkListener(chunkListener ChunkListenerFunc) {
+	ru.chunkUploader.chunkListener = chunkListener
 }
 
 //===========================================
@@ -170,7 +193,7 @@ func (ru *resumableUpload) work() {
 
 	// same as ru.blocks, but `.last` is set properly, no matter
 	// what the size is
-	annotatedBlocks := make(chan *rblock, ru.maxChunkGroup)
+	annotatedBlocks := make(chan *rblock, ru.queueSize)
 	go func() {
 		var lastBlock *rblock
 		defer close(annotatedBlocks)
@@ -264,7 +287,7 @@ aggregate:
 		}
 
 		// send what we have so far
-		ru.debugf("Uploading %d chunks", chunkGroupSize)
+		ru.debug("Uploading chunks", "chunks", chunkGroupSize)
 		err := ru.chunkUploader.put(sendBuf.Bytes(), false)
 		if err != nil {
 			ru.pushError(errors.WithStack(err))
@@ -273,7 +296,7 @@ aggregate:
 	}
 
 	// send the last block
-	ru.debugf("Uploading last %d chunks", chunkGroupSize)
+	ru.debug("Uploading last chunks", "chunks", chunkGroupSize)
 	err := ru.chunkUploader.put(sendBuf.Bytes(), true)
 	if err != nil {
 		ru.pushError(errors.WithStack(err))
@@ -281,11 +304,8 @@ aggregate:
 	}
 }
 
-func (ru *resumableUpload) debugf(msg string, args ...interface{}) {
-	if ru.consumer != nil {
-		fmsg := fmt.Sprintf(msg, args...)
-		ru.consumer.Debugf("[ru-%d] %s", ru.id, fmsg)
-	}
+func (ru *resumableUpload) debug(msg string, keyvals ...interface{}) {
+	logDebug(ru.logger, ru.consumer, "ru", ru.id, msg, keyvals)
 }
 
 func (ru *resumableUpload) checkError() error {
@@ -1,13 +1,32 @@
 package uploader
 
+import (
+	"github.com/itchio/headway/state"
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/clock"
+	"github.com/itchio/httpkit/retrycontext"
+)
+
 type settings struct {
-	MaxChunkGroup int
+	MaxChunkGroup    int
+	MaxInFlightBytes int64
+	Consumer         *state.Consumer
+	Logger           httpkit.Logger
+	ProgressListener ProgressListenerFunc
+	ProgressThrottle ProgressThrottle
+	Limiter          httpkit.Limiter
+	ChecksumTrailer  bool
+	Clock            clock.Clock
+	// BackoffResetAfter is how many requests in a row must succeed
+	// for the retry backoff to start over, see WithBackoffReset
+	BackoffResetAfter int
 }
 
 func defaultSettings() *settings {
 	return &settings{
 		// 64 * 256KiB = 16MiB
-		MaxChunkGroup: 64,
+		MaxChunkGroup:     64,
+		BackoffResetAfter: 1,
 	}
 }
 
@@ -15,6 +34,43 @@ type Option interface {
 	Apply(s *settings)
 }
 
+// bufferSizes returns how many blocks are sent in a single PUT, and how
+// many more can be queued while it's in flight, so that all of them (plus
+// the block being filled by Write, and the one being annotated) fit in
+// MaxInFlightBytes. Without a cap, the queue is as large as a group.
+func (s *settings) bufferSizes() (maxChunkGroup int, queueSize int) {
+	if s.MaxInFlightBytes <= 0 {
+		return s.MaxChunkGroup, s.MaxChunkGroup
+	}
+
+	budget := int(s.MaxInFlightBytes/rblockSize) - 2
+	maxChunkGroup = s.MaxChunkGroup
+	if maxChunkGroup > budget/2 {
+		maxChunkGroup = budget / 2
+	}
+	if maxChunkGroup < 1 {
+		maxChunkGroup = 1
+	}
+	queueSize = budget - maxChunkGroup
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	return maxChunkGroup, queueSize
+}
+
+// newBackoff returns the backoff shared by all the retries of an upload
+func (s *settings) newBackoff() *retrycontext.Backoff {
+	return retrycontext.NewBackoff(s.BackoffResetAfter)
+}
+
+func (s *settings) newProgress() *throttledProgress {
+	tp := newThrottledProgress(s.ProgressListener, s.ProgressThrottle)
+	if s.Clock != nil {
+		tp.clock = s.Clock
+	}
+	return tp
+}
+
 // ---------
 
 type maxChunkGroupOption struct {
@@ -35,3 +91,223 @@ func WithMaxChunkGroup(maxChunkGroup int) *maxChunkGroupOption {
 func (o *maxChunkGroupOption) Apply(s *settings) {
 	s.MaxChunkGroup = o.maxChunkGroup
 }
+
+// ---------
+
+type chunkSizeOption struct {
+	chunkSize int64
+}
+
+// WithChunkSize is like WithMaxChunkGroup, but in bytes. It's
+// rounded up to a multiple of 256KiB, since that's what GCS expects.
+//
+// The default value is 16MiB
+func WithChunkSize(chunkSize int64) *chunkSizeOption {
+	return &chunkSizeOption{
+		chunkSize: chunkSize,
+	}
+}
+
+func (o *chunkSizeOption) Apply(s *settings) {
+	group := (o.chunkSize + gcsChunkSize - 1) / gcsChunkSize
+	if group < 1 {
+		group = 1
+	}
+	s.MaxChunkGroup = int(group)
+}
+
+// ---------
+
+type maxInFlightBytesOption struct {
+	maxInFlightBytes int64
+}
+
+// WithMaxInFlightBytes caps how much data an upload holds in memory:
+// blocks waiting to be sent, plus the chunk group being sent. If needed,
+// chunk groups are made smaller than WithMaxChunkGroup says. The cap can't
+// go below 768KiB (three 256KiB blocks).
+//
+// The default value is 0, which means about twice the chunk group
+// size (32MiB with default settings)
+func WithMaxInFlightBytes(maxInFlightBytes int64) *maxInFlightBytesOption {
+	return &maxInFlightBytesOption{
+		maxInFlightBytes: maxInFlightBytes,
+	}
+}
+
+func (o *maxInFlightBytesOption) Apply(s *settings) {
+	s.MaxInFlightBytes = o.maxInFlightBytes
+}
+
+// ---------
+
+type consumerOption struct {
+	consumer *state.Consumer
+}
+
+// WithConsumer specifies a consumer to log upload activity to.
+// It's equivalent to calling SetConsumer on the returned upload.
+func WithConsumer(consumer *state.Consumer) *consumerOption {
+	return &consumerOption{
+		consumer: consumer,
+	}
+}
+
+func (o *consumerOption) Apply(s *settings) {
+	s.Consumer = o.consumer
+}
+
+// ---------
+
+type loggerOption struct {
+	logger httpkit.Logger
+}
+
+// WithLogger specifies a structured logger for upload activity. It takes
+// precedence over the consumer for debug messages, but the consumer still
+// gets retry messages.
+func WithLogger(logger httpkit.Logger) *loggerOption {
+	return &loggerOption{
+		logger: logger,
+	}
+}
+
+func (o *loggerOption) Apply(s *settings) {
+	s.Logger = o.logger
+}
+
+// ---------
+
+type progressListenerOption struct {
+	progressListener ProgressListenerFunc
+}
+
+// WithProgressListener specifies a function to call with the
+// number of bytes uploaded so far. It's equivalent to calling
+// SetProgressListener on the returned upload.
+func WithProgressListener(progressListener ProgressListenerFunc) *progressListenerOption {
+	return &progressListenerOption{
+		progressListener: progressListener,
+	}
+}
+
+func (o *progressListenerOption) Apply(s *settings) {
+	s.ProgressListener = o.progressListener
+}
+
+// ---------
+
+type progressThrottleOption struct {
+	throttle ProgressThrottle
+}
+
+// WithProgressThrottle limits how often the progress listener is called.
+// It's equivalent to calling SetProgressThrottle on the returned upload.
+func WithProgressThrottle(throttle ProgressThrottle) *progressThrottleOption {
+	return &progressThrottleOption{
+		throttle: throttle,
+	}
+}
+
+func (o *progressThrottleOption) Apply(s *settings) {
+	s.ProgressThrottle = o.throttle
+}
+
+// ---------
+
+type limiterOption struct {
+	limiter httpkit.Limiter
+}
+
+// WithLimiter caps the throughput of Transfer. The same limiter can be
+// shared by several transfers, to give them an overall bandwidth budget.
+// It's typically a *rate.Limiter, or a *rate.Consumer of a rate.Shared
+// budget.
+func WithLimiter(limiter httpkit.Limiter) *limiterOption {
+	return &limiterOption{
+		limiter: limiter,
+	}
+}
+
+func (o *limiterOption) Apply(s *settings) {
+	s.Limiter = o.limiter
+}
+
+// ---------
+
+type checksumTrailerOption struct {
+	checksumTrailer bool
+}
+
+// WithChecksumTrailer makes chunked uploads compute the MD5 digest of
+// the data as it's streamed, and send it as a Content-MD5 trailer, so that
+// servers that support it can validate the object without the client
+// buffering or re-reading it.
+func WithChecksumTrailer(checksumTrailer bool) *checksumTrailerOption {
+	return &checksumTrailerOption{
+		checksumTrailer: checksumTrailer,
+	}
+}
+
+func (o *checksumTrailerOption) Apply(s *settings) {
+	s.ChecksumTrailer = o.checksumTrailer
+}
+
+// ---------
+
+type backoffResetOption struct {
+	successes int
+}
+
+// WithBackoffReset specifies how many chunks in a row must be uploaded
+// without errors for the retry backoff to start over. Until then, it keeps
+// growing with every failure, from one chunk to the next, so that a flaky
+// network isn't hammered as soon as a chunk gets through. For Transfer,
+// it also applies to reads from the source.
+//
+// The default value is 1: every chunk that succeeds starts it over.
+func WithBackoffReset(successes int) *backoffResetOption {
+	return &backoffResetOption{
+		successes: successes,
+	}
+}
+
+func (o *backoffResetOption) Apply(s *settings) {
+	s.BackoffResetAfter = o.successes
+}
+
+// ---------
+
+type commonOption struct {
+	common httpkit.CommonOptions
+}
+
+// WithCommon applies options shared by all httpkit subsystems.
+// Logger is like WithLogger, Log is used if no consumer was specified,
+// Limiter is like WithLimiter, and Clock paces progress reports.
+// Nil fields are left alone.
+func WithCommon(common httpkit.CommonOptions) *commonOption {
+	return &commonOption{
+		common: common,
+	}
+}
+
+func (o *commonOption) Apply(s *settings) {
+	c := o.common
+	if c.Logger != nil {
+		s.Logger = c.Logger
+	}
+	if c.Log != nil && s.Consumer == nil {
+		s.Consumer = &state.Consumer{
+			OnMessage: func(level string, msg string) {
+				c.Log(msg)
+			},
+		}
+	}
+	if c.Limiter != nil {
+		s.Limiter = c.Limiter
+	}
+	if c.Clock != nil {
+		s.Clock = c.Clock
+	}
+}
@@ -0,0 +1,59 @@
+package uploader
+
+import (
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit"
+	"github.com/itchio/httpkit/clock"
+	"github.com/itchio/httpkit/rate"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Options(t *testing.T) {
+	assert := assert.New(t)
+
+	apply := func(opts ...Option) *settings {
+		s := defaultSettings()
+		for _, o := range opts {
+			o.Apply(s)
+		}
+		return s
+	}
+
+	assert.EqualValues(64, apply().MaxChunkGroup)
+	assert.EqualValues(4, apply(WithChunkSize(1024*1024)).MaxChunkGroup)
+	assert.EqualValues(2, apply(WithChunkSize(300*1024)).MaxChunkGroup)
+	assert.EqualValues(1, apply(WithChunkSize(0)).MaxChunkGroup)
+
+	sizes := func(opts ...Option) []int {
+		g, q := apply(opts...).bufferSizes()
+		return []int{g, q}
+	}
+	assert.EqualValues([]int{64, 64}, sizes())
+	assert.EqualValues([]int{8, 8}, sizes(WithMaxChunkGroup(8)))
+	// 4MiB is 16 blocks: 2 of them are buffered by Write and the annotator
+	assert.EqualValues([]int{7, 7}, sizes(WithMaxInFlightBytes(4*1024*1024)))
+	assert.EqualValues([]int{4, 10}, sizes(WithMaxInFlightBytes(4*1024*1024), WithMaxChunkGroup(4)))
+	assert.EqualValues([]int{64, 190}, sizes(WithMaxInFlightBytes(64*1024*1024)))
+	assert.EqualValues([]int{1, 0}, sizes(WithMaxInFlightBytes(1)))
+
+	assert.Nil(apply(WithLimiter(nil)).Limiter)
+	consumer := rate.NewShared(rate.Settings{BytesPerSecond: 1024}).Consumer("uploads", 1)
+	assert.Equal(consumer, apply(WithLimiter(consumer)).Limiter)
+
+	assert.EqualValues(1, apply().BackoffResetAfter)
+	assert.EqualValues(5, apply(WithBackoffReset(5)).newBackoff().ResetAfter)
+
+	var logged []string
+	fc := clock.NewFake(time.Now())
+	s := apply(WithCommon(httpkit.CommonOptions{
+		Log: func(msg string) {
+			logged = append(logged, msg)
+		},
+		Clock: fc,
+	}))
+	s.Consumer.Infof("hello")
+	assert.EqualValues([]string{"hello"}, logged)
+	assert.True(s.newProgress().clock == fc)
+}
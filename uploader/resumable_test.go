@@ -2,20 +2,14 @@ package uploader
 
 import (
 	"bytes"
-	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
-	"net/http/httptest"
 	"os"
-	"strconv"
-	"strings"
 	"testing"
 	"time"
 
 	"github.com/itchio/headway/state"
-	"github.com/itchio/headway/united"
+	"github.com/itchio/httpkit/uploader/uploadertest"
 
 	"github.com/itchio/randsource/fullyrandom"
 	"github.com/stretchr/testify/assert"
@@ -32,9 +26,12 @@ func Test_ChunkUploader(t *testing.T) {
 		}
 	}
 
-	server := makeTestServer(t, log)
-	server.settings.latency = 200 * time.Millisecond
-	server.settings.bandwidthBytesPerSec = 10 * 1024 * 1024 // 10 MB/s
+	server := uploadertest.NewServer(uploadertest.Settings{
+		Latency:              200 * time.Millisecond,
+		BandwidthBytesPerSec: 10 * 1024 * 1024, // 10 MB/s
+		Logf:                 log,
+	})
+	defer server.Close()
 	ru := NewResumableUpload(server.URL)
 	ru.SetConsumer(&state.Consumer{
 		OnMessage: func(lvl string, msg string) {
@@ -51,105 +48,93 @@ func Test_ChunkUploader(t *testing.T) {
 	}
 	tmust(t, ru.Close())
 
-	assert.EqualValues(ref.Bytes(), server.state.data)
-	log("num blocks stored: %+v", server.state.numBlocksStored)
+	assert.EqualValues(ref.Bytes(), server.Data())
+	log("bytes committed per request: %+v", server.Commits())
 }
 
-type fakeGCS struct {
-	*httptest.Server
-	state struct {
-		data            []byte
-		head            int64
-		numBlocksStored []int64
-	}
-	settings struct {
-		latency              time.Duration
-		bandwidthBytesPerSec int64
+func Test_ChunkListener(t *testing.T) {
+	assert := assert.New(t)
+
+	server := uploadertest.NewServer(uploadertest.Settings{
+		ServerTiming: `storage;dur=12.5;desc="Storage backend", app;dur=2`,
+		Logf:         t.Logf,
+	})
+	defer server.Close()
+
+	var stats []*ChunkStats
+	ru := NewResumableUpload(server.URL)
+	ru.SetChunkListener(func(cs *ChunkStats) {
+		stats = append(stats, cs)
+	})
+
+	ref := new(bytes.Buffer)
+	mw := io.MultiWriter(ref, ru)
+	tmust(t, fullyrandom.Write(mw, 1*1024*1024, time.Now().UnixNano()))
+	tmust(t, ru.Close())
+	assert.EqualValues(ref.Bytes(), server.Data())
+
+	if assert.NotEmpty(stats) {
+		last := stats[len(stats)-1]
+		assert.True(last.Last)
+		assert.EqualValues(ref.Len(), last.End)
+		assert.EqualValues(200, last.StatusCode)
+		assert.EqualValues("fake-upload-id", last.UploadID)
+		assert.Len(last.ServerTiming, 2)
+		assert.EqualValues(14500*time.Microsecond, last.ServerDuration())
 	}
 }
 
-func makeTestServer(t *testing.T, log func(msg string, a ...interface{})) *fakeGCS {
-	fg := &fakeGCS{}
+func Test_ResumableConformance(t *testing.T) {
+	uploadertest.TestResumable(t, func(sessionURL string, data []byte) error {
+		ru := NewResumableUpload(sessionURL)
+		_, err := ru.Write(data)
+		if err != nil {
+			return err
+		}
+		return ru.Close()
+	})
+}
 
-	var chunkSize int64 = 256 * 1024
+func Test_ResumableFinalizeRecovery(t *testing.T) {
+	assert := assert.New(t)
 
-	fg.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if fg.settings.latency > 0 {
-			log("Sleeping %s (to simulate latency)", fg.settings.latency)
-			time.Sleep(fg.settings.latency)
-		}
+	for _, fault := range []uploadertest.Fault{
+		{Status: 500, Commit: 1234},
+		uploadertest.Unavailable(1234),
+		{Drop: true, Commit: 1234},
+	} {
+		server := uploadertest.NewServer(uploadertest.Settings{Logf: t.Logf})
+		server.Script(fault)
+
+		data := make([]byte, 1234)
+		ru := NewResumableUpload(server.URL)
+		_, err := ru.Write(data)
+		assert.NoError(err)
+		assert.NoError(ru.Close(), "%s", fault)
+
+		// the status query says it's complete: not sent again
+		assert.True(server.Complete())
+		assert.EqualValues(1, server.NumPuts(), "%s", fault)
+		assert.EqualValues(1, server.NumQueries(), "%s", fault)
+		server.Close()
+	}
+}
 
-		switch r.Method {
-		case "PUT":
-			log("Putting...")
-			contentRange := r.Header.Get("content-range")
-			if !strings.HasPrefix(contentRange, "bytes ") {
-				w.WriteHeader(400)
-				fmt.Fprintf(w, "Missing 'bytes ' prefix in content-range header")
-				return
-			}
-
-			contentRange = strings.TrimPrefix(contentRange, "bytes ")
-
-			log("contentRange: %s", contentRange)
-			slashTokens := strings.Split(contentRange, "/")
-			storedString := slashTokens[0]
-			totalString := slashTokens[1]
-
-			storedTokens := strings.SplitN(storedString, "-", 2)
-			start, err := strconv.ParseInt(storedTokens[0], 10, 64)
-			tmust(t, err)
-			end, err := strconv.ParseInt(storedTokens[1], 10, 64)
-			tmust(t, err)
-			end++
-
-			sentBytes := int64(end - start)
-			if sentBytes%chunkSize != 0 {
-				w.WriteHeader(400)
-				fmt.Fprintf(w, "Sent bytes (%d) were not a multiple of chunk size (%d)", sentBytes, chunkSize)
-				return
-			}
-
-			total, _ := strconv.ParseInt(totalString, 10, 64)
-
-			log("start=%d, end=%d, total=%d", start, end, total)
-			committedRange := &httpRange{
-				start: 0,
-				end:   end,
-			}
-			w.Header().Set("range", committedRange.String())
-
-			if totalString != "*" {
-				log("last block!")
-				w.WriteHeader(200)
-			} else {
-				log("committing blocks...")
-				w.WriteHeader(308)
-			}
-
-			defer r.Body.Close()
-			buf, err := ioutil.ReadAll(r.Body)
-			tmust(t, err)
-			fg.state.data = append(fg.state.data, buf...)
-			fg.state.head += int64(len(buf))
-			fg.state.numBlocksStored = append(fg.state.numBlocksStored, sentBytes/chunkSize)
-
-			if fg.settings.bandwidthBytesPerSec > 0 {
-				bps := fg.settings.bandwidthBytesPerSec
-				sleepDuration := time.Millisecond * time.Duration(float64(sentBytes)/float64(bps)*1000.0)
-				log("Sleeping %s (to simulating %s bandwidth)", sleepDuration, united.FormatBPS(bps, time.Second))
-				time.Sleep(sleepDuration)
-			}
-
-			return
-		default:
-			log("Dunno what to do with request: %#v", r)
-			w.WriteHeader(400)
-			return
-		}
-	}))
+func Test_ParseServerTiming(t *testing.T) {
+	assert := assert.New(t)
 
-	return fg
+	assert.Empty(parseServerTiming(nil))
+
+	timings := parseServerTiming([]string{
+		`db;dur=53, app;dur=47.2;desc="Application logic"`,
+		`cache;desc=miss, ;dur=4, bad;dur=nope`,
+	})
+	assert.EqualValues([]ServerTiming{
+		{Name: "db", Duration: 53 * time.Millisecond},
+		{Name: "app", Duration: 47200 * time.Microsecond, Description: "Application logic"},
+		{Name: "cache", Description: "miss"},
+		{Name: "bad"},
+	}, timings)
 }
 
 // must shows a complete error stack and fails a test immediately
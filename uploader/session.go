@@ -0,0 +1,154 @@
+package uploader
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/itchio/httpkit/clock"
+	"github.com/itchio/httpkit/retrycontext"
+	"github.com/itchio/httpkit/timeout"
+	"github.com/pkg/errors"
+)
+
+// DefaultGCSEndpoint is where resumable upload sessions are started,
+// see SessionSettings.Endpoint
+const DefaultGCSEndpoint = "https://storage.googleapis.com"
+
+// An AuthHeaderFunc returns the value of the Authorization header to
+// start a session with, like "Bearer <token>". It's called for every
+// attempt, so it may refresh tokens that expired.
+type AuthHeaderFunc func() (string, error)
+
+// SessionSettings configures StartResumableSession
+type SessionSettings struct {
+	Bucket string
+	Object string
+	// AuthHeader is required
+	AuthHeader AuthHeaderFunc
+	// ContentType is the object's. Defaults to application/octet-stream.
+	ContentType string
+	// Header holds extra headers for the initial request, like
+	// x-goog-meta-* or x-goog-content-length-range
+	Header http.Header
+
+	// Endpoint defaults to DefaultGCSEndpoint
+	Endpoint string
+	// Client defaults to one returned by timeout.NewClient,
+	// with the resumable upload timeouts
+	Client *http.Client
+	// MaxTries defaults to the resumable upload retries
+	MaxTries int
+	// Clock is used to sleep between tries. If nil, clock.Real is used.
+	Clock clock.Clock
+}
+
+// StartResumableSession makes the initial `POST` of a GCS resumable upload
+// (with `x-goog-resumable: start`) and returns the session URI, to pass to
+// NewResumableUpload. Network errors, 5xx and 429 responses are retried.
+func StartResumableSession(ctx context.Context, settings *SessionSettings) (string, error) {
+	if settings.Bucket == "" || settings.Object == "" {
+		return "", errors.Errorf("starting upload session: bucket and object must be set")
+	}
+	if settings.AuthHeader == nil {
+		return "", errors.Errorf("starting upload session: AuthHeader must be set")
+	}
+
+	client := settings.Client
+	if client == nil {
+		client = timeout.NewClient(resumableConnectTimeout, resumableIdleTimeout)
+	}
+	maxTries := settings.MaxTries
+	if maxTries <= 0 {
+		maxTries = resumableMaxRetries
+	}
+
+	retryCtx := retrycontext.New(retrycontext.Settings{
+		MaxTries: maxTries,
+		Context:  ctx,
+		Clock:    settings.Clock,
+	})
+	var lastErr error
+	for retryCtx.ShouldTry() {
+		sessionURI, err := tryStartSession(ctx, client, settings)
+		if err == nil {
+			return sessionURI, nil
+		}
+		if _, ok := err.(*netError); !ok {
+			return "", err
+		}
+		if ctx.Err() != nil {
+			return "", errors.WithStack(ctx.Err())
+		}
+		lastErr = err
+		retryCtx.Retry(err)
+	}
+	return "", errors.Wrap(lastErr, "starting upload session: too many errors")
+}
+
+func tryStartSession(ctx context.Context, client *http.Client, settings *SessionSettings) (string, error) {
+	auth, err := settings.AuthHeader()
+	if err != nil {
+		return "", errors.Wrap(err, "starting upload session: getting auth header")
+	}
+
+	req, err := http.NewRequest("POST", sessionURL(settings), nil)
+	if err != nil {
+		// does not include HTTP errors, more like golang API usage errors
+		return "", errors.WithStack(err)
+	}
+	req = req.WithContext(ctx)
+	for k, vv := range settings.Header {
+		for _, v := range vv {
+			req.Header.Add(k, v)
+		}
+	}
+	contentType := settings.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("x-goog-resumable", "start")
+	req.ContentLength = 0
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", &netError{err, gcsUnknown}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 200 || res.StatusCode == 201 {
+		sessionURI := res.Header.Get("Location")
+		if sessionURI == "" {
+			return "", errors.Errorf("starting upload session: got HTTP %s without a Location header", res.Status)
+		}
+		return sessionURI, nil
+	}
+
+	// error responses are short XML documents, they help with 4xx
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	err = errors.Errorf("starting upload session: got HTTP %s: %s", res.Status, strings.TrimSpace(string(body)))
+	if res.StatusCode/100 == 5 || res.StatusCode == 429 {
+		return "", &netError{err, gcsUnknown}
+	}
+	return "", err
+}
+
+// sessionURL returns the XML API URL for settings' object
+func sessionURL(settings *SessionSettings) string {
+	endpoint := settings.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultGCSEndpoint
+	}
+
+	// object names may contain slashes, which stay as-is
+	segments := strings.Split(settings.Object, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/" + url.PathEscape(settings.Bucket) + "/" + strings.Join(segments, "/")
+}
@@ -0,0 +1,66 @@
+package uploader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_StartResumableSession(t *testing.T) {
+	assert := assert.New(t)
+
+	var numRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&numRequests, 1) == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer good" {
+			http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+			return
+		}
+		assert.EqualValues("POST", r.Method)
+		assert.EqualValues("/builds/some%20dir/file.zip", r.URL.EscapedPath())
+		assert.EqualValues("start", r.Header.Get("x-goog-resumable"))
+		assert.EqualValues("application/zip", r.Header.Get("Content-Type"))
+		assert.EqualValues("1", r.Header.Get("x-goog-meta-build"))
+		w.Header().Set("Location", "http://"+r.Host+"/upload?upload_id=abc")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("x-goog-meta-build", "1")
+	settings := &SessionSettings{
+		Bucket:      "builds",
+		Object:      "some dir/file.zip",
+		ContentType: "application/zip",
+		Header:      header,
+		AuthHeader: func() (string, error) {
+			return "Bearer good", nil
+		},
+		Endpoint: server.URL,
+		Clock:    clock.NewFake(time.Now()),
+	}
+
+	ctx := context.Background()
+	sessionURI, err := StartResumableSession(ctx, settings)
+	assert.NoError(err)
+	assert.EqualValues(server.URL+"/upload?upload_id=abc", sessionURI)
+	assert.EqualValues(2, atomic.LoadInt32(&numRequests))
+
+	// client errors aren't retried
+	settings.AuthHeader = func() (string, error) {
+		return "Bearer bad", nil
+	}
+	_, err = StartResumableSession(ctx, settings)
+	assert.Error(err)
+	assert.Contains(err.Error(), "AccessDenied")
+	assert.EqualValues(3, atomic.LoadInt32(&numRequests))
+}
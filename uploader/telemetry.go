@@ -0,0 +1,100 @@
+package uploader
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChunkStats describes a single chunk group PUT request, as seen
+// from both sides: how long the whole call took, and how long the
+// server says it spent processing it (when it tells us).
+type ChunkStats struct {
+	// Start is the offset of the first byte sent
+	Start int64
+	// End is the offset of the byte after the last one sent
+	End int64
+	// Last is true for the final chunk group of an upload
+	Last bool
+
+	StatusCode   int
+	CallDuration time.Duration
+
+	// UploadID is the value of the X-GUploader-UploadID header, which
+	// identifies the upload session on Google's side.
+	UploadID string
+	// ServerTiming holds metrics parsed from the Server-Timing header, if any.
+	ServerTiming []ServerTiming
+}
+
+// ServerTiming is a single metric from a Server-Timing response header,
+// see https://www.w3.org/TR/server-timing/
+type ServerTiming struct {
+	Name        string
+	Duration    time.Duration
+	Description string
+}
+
+// ServerDuration returns the sum of all durations reported by the server.
+// If it's close to CallDuration, the storage backend is slow. If it's
+// much smaller, the network is.
+func (cs *ChunkStats) ServerDuration() time.Duration {
+	var total time.Duration
+	for _, st := range cs.ServerTiming {
+		total += st.Duration
+	}
+	return total
+}
+
+// ChunkListenerFunc is called after each chunk group PUT request
+// gets a response.
+type ChunkListenerFunc func(stats *ChunkStats)
+
+func readChunkStats(res *http.Response) *ChunkStats {
+	return &ChunkStats{
+		StatusCode:   res.StatusCode,
+		UploadID:     res.Header.Get("X-GUploader-UploadID"),
+		ServerTiming: parseServerTiming(res.Header["Server-Timing"]),
+	}
+}
+
+// parseServerTiming parses Server-Timing header values like:
+// `db;dur=53, app;dur=47.2;desc="Application logic", cache`
+// Malformed parameters are ignored.
+func parseServerTiming(values []string) []ServerTiming {
+	var timings []ServerTiming
+
+	for _, value := range values {
+		for _, metric := range strings.Split(value, ",") {
+			params := strings.Split(metric, ";")
+			name := strings.TrimSpace(params[0])
+			if name == "" {
+				continue
+			}
+
+			st := ServerTiming{Name: name}
+			for _, param := range params[1:] {
+				keyval := strings.SplitN(param, "=", 2)
+				if len(keyval) != 2 {
+					continue
+				}
+				key := strings.ToLower(strings.TrimSpace(keyval[0]))
+				val := strings.Trim(strings.TrimSpace(keyval[1]), `"`)
+
+				switch key {
+				case "dur":
+					millis, err := strconv.ParseFloat(val, 64)
+					if err == nil {
+						st.Duration = time.Duration(millis * float64(time.Millisecond))
+					}
+				case "desc":
+					st.Description = val
+				}
+			}
+			timings = append(timings, st)
+		}
+	}
+
+	return timings
+}
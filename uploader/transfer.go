@@ -0,0 +1,104 @@
+package uploader
+
+import (
+	"io"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/itchio/httpkit/neterr"
+	"github.com/itchio/httpkit/retrycontext"
+	"github.com/pkg/errors"
+)
+
+// Transfer copies src (a remote file) into dst, and closes dst when
+// everything has been written, which finalizes the upload. It returns
+// the number of bytes transferred.
+//
+// Reads that fail with network errors (after htfs's own retries) are
+// retried from the same offset, after dropping src's connections. dst
+// retries its own chunks. If anything fails for good, dst is not closed,
+// so a partial upload is never finalized.
+//
+// The consumer, progress listener and throttle options apply to the
+// transfer as a whole, and WithLimiter caps its throughput.
+func Transfer(src *htfs.File, dst ResumableUpload, opts ...Option) (int64, error) {
+	s := defaultSettings()
+	for _, o := range opts {
+		o.Apply(s)
+	}
+
+	stats, err := src.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "in Transfer, while getting source size")
+	}
+	size := stats.Size()
+
+	progress := s.newProgress()
+	defer progress.flush()
+
+	backoff := s.newBackoff()
+	buf := make([]byte, rblockSize)
+	var offset int64
+	for offset < size {
+		readLen := int64(len(buf))
+		if size-offset < readLen {
+			readLen = size - offset
+		}
+
+		n, err := transferRead(src, buf[:readLen], offset, backoff, s)
+		if err != nil {
+			return offset, errors.Wrapf(err, "in Transfer, while reading at offset %d", offset)
+		}
+
+		if s.Limiter != nil {
+			s.Limiter.Take(int64(n))
+		}
+
+		_, err = dst.Write(buf[:n])
+		if err != nil {
+			return offset, errors.Wrapf(err, "in Transfer, while writing at offset %d", offset)
+		}
+
+		offset += int64(n)
+		progress.report(offset)
+	}
+
+	logDebug(s.Logger, s.Consumer, "transfer", -1, "All bytes read, finalizing upload", []interface{}{"size", offset})
+	err = dst.Close()
+	if err != nil {
+		return offset, errors.Wrap(err, "in Transfer, while finalizing upload")
+	}
+	return offset, nil
+}
+
+// transferRead fills buf from src at offset, resuming from the
+// same offset on network errors.
+func transferRead(src *htfs.File, buf []byte, offset int64, backoff *retrycontext.Backoff, s *settings) (int, error) {
+	retryCtx := retrycontext.New(retrycontext.Settings{
+		MaxTries: resumableMaxRetries,
+		Consumer: s.Consumer,
+		Backoff:  backoff,
+	})
+
+	for retryCtx.ShouldTry() {
+		n, err := src.ReadAt(buf, offset)
+		if err == io.EOF && n == len(buf) {
+			err = nil
+		}
+		if err == nil {
+			retryCtx.Succeed()
+			return n, nil
+		}
+
+		if !neterr.IsNetworkError(err) {
+			return 0, err
+		}
+
+		// start over with fresh connections
+		resetErr := src.Reset()
+		if resetErr != nil {
+			return 0, errors.WithStack(resetErr)
+		}
+		retryCtx.Retry(err)
+	}
+	return 0, errors.Wrap(retryCtx.LastError, "too many errors, giving up")
+}
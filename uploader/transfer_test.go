@@ -0,0 +1,58 @@
+package uploader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/clock"
+	"github.com/itchio/httpkit/htfs"
+	"github.com/itchio/httpkit/rate"
+	"github.com/itchio/randsource/fullyrandom"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Transfer(t *testing.T) {
+	assert := assert.New(t)
+
+	server := makeChunkedTestServer(t)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "uploader-transfer")
+	tmust(t, err)
+	defer os.RemoveAll(dir)
+
+	data := fullyrandom.Bytes(1024 * 1024)
+	path := filepath.Join(dir, "build.dat")
+	tmust(t, ioutil.WriteFile(path, data, 0644))
+
+	src, err := htfs.OpenLocal(path, nil, &htfs.Settings{})
+	tmust(t, err)
+	defer src.Close()
+
+	fc := clock.NewFake(time.Now())
+	start := fc.Now()
+	limiter := rate.New(rate.Settings{
+		BytesPerSecond: 256 * 1024,
+		Clock:          fc,
+	})
+
+	var lastProgress int64
+	dst := NewChunkedUpload(server.URL)
+	n, err := Transfer(src, dst,
+		WithLimiter(limiter),
+		WithProgressListener(func(count int64) {
+			lastProgress = count
+		}),
+	)
+	assert.NoError(err)
+	assert.EqualValues(len(data), n)
+	assert.EqualValues(len(data), lastProgress)
+	assert.EqualValues(data, server.data)
+	assert.EqualValues(1, server.numPUT)
+
+	// first 256KiB are free (burst), the rest is 3 seconds' worth
+	assert.EqualValues(3*time.Second, clock.Since(fc, start))
+}
@@ -0,0 +1,71 @@
+package uploadertest
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// An UploadFunc uploads data to the resumable upload session
+// at sessionURL, and returns once it's complete
+type UploadFunc func(sessionURL string, data []byte) error
+
+// A Scenario is an upload of Size bytes, during which the server
+// misbehaves as scripted by Faults
+type Scenario struct {
+	Name   string
+	Size   int64
+	Faults []Fault
+}
+
+// Scenarios are what TestResumable runs. Faults are on the first request
+// that carries data, whichever part of the upload that is, and uploads
+// that fit in one chunk show what happens on the last one.
+var Scenarios = []Scenario{
+	{Name: "clean", Size: 4*DefaultChunkSize + 17},
+	{Name: "partial commit", Size: 4 * DefaultChunkSize, Faults: []Fault{PartialCommit(DefaultChunkSize)}},
+	{Name: "failed commit", Size: 4 * DefaultChunkSize, Faults: []Fault{{}}},
+	{Name: "503, nothing committed", Size: 4 * DefaultChunkSize, Faults: []Fault{Unavailable(0)}},
+	{Name: "503, some committed", Size: 4 * DefaultChunkSize, Faults: []Fault{Unavailable(2 * DefaultChunkSize)}},
+	{Name: "503 on last chunk", Size: 1234, Faults: []Fault{Unavailable(0)}},
+	{Name: "failed commit on last chunk", Size: 1234, Faults: []Fault{{}}},
+	{Name: "500 after committing last chunk", Size: 1234, Faults: []Fault{{Status: 500, Commit: 1234}}},
+	{Name: "dropped connection after committing last chunk", Size: 1234, Faults: []Fault{{Drop: true, Commit: 1234}}},
+}
+
+// TestResumable checks that upload copes with every one of Scenarios,
+// each against its own Server: the upload must succeed, and the server
+// must end up with the exact data. Scenarios run in parallel, since
+// uploaders typically wait a second or two between retries.
+func TestResumable(t *testing.T, upload UploadFunc) {
+	for _, scenario := range Scenarios {
+		scenario := scenario
+		t.Run(scenario.Name, func(t *testing.T) {
+			t.Parallel()
+			RunScenario(t, upload, scenario)
+		})
+	}
+}
+
+// RunScenario checks that upload copes with scenario, see TestResumable
+func RunScenario(t *testing.T, upload UploadFunc, scenario Scenario) {
+	t.Helper()
+
+	server := NewServer(Settings{Logf: t.Logf})
+	defer server.Close()
+	server.Script(scenario.Faults...)
+
+	data := make([]byte, scenario.Size)
+	rand.New(rand.NewSource(scenario.Size)).Read(data)
+
+	err := upload(server.URL, data)
+	if err != nil {
+		t.Fatalf("%s: upload failed: %+v", scenario.Name, err)
+	}
+	if !server.Complete() {
+		t.Fatalf("%s: upload returned, but isn't complete", scenario.Name)
+	}
+	if !bytes.Equal(data, server.Data()) {
+		t.Fatalf("%s: server has %d bytes, which don't match the %d uploaded", scenario.Name, len(server.Data()), len(data))
+	}
+}
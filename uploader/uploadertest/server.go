@@ -0,0 +1,322 @@
+// Package uploadertest provides a fake resumable upload server, with the
+// semantics of GCS resumable uploads, and a conformance suite that checks
+// uploaders cope with partial commits, failed commits and 503s.
+package uploadertest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultChunkSize is what GCS requires every chunk but the
+// last to be a multiple of, see Settings.ChunkSize
+const DefaultChunkSize = 256 * 1024
+
+// Settings configures a Server, the zero value is fine
+type Settings struct {
+	// Latency is waited before answering every request
+	Latency time.Duration
+	// BandwidthBytesPerSec, if non-zero, makes storing data
+	// take as long as receiving it at that speed would
+	BandwidthBytesPerSec int64
+	// ServerTiming, if set, is sent as the Server-Timing
+	// header of responses to requests that carry data
+	ServerTiming string
+	// ChunkSize is what the data of every request but the last must be
+	// a multiple of. Defaults to DefaultChunkSize.
+	ChunkSize int64
+	// UploadID is sent as the X-GUploader-UploadID header.
+	// Defaults to "fake-upload-id".
+	UploadID string
+	// Logf, if set, is told about every request, like testing.T.Logf
+	Logf func(format string, args ...interface{})
+}
+
+// A Fault makes the server misbehave on one request that carries data,
+// see Server.Script. The zero value stores nothing and answers 308
+// without a Range header, like a commit that failed.
+type Fault struct {
+	// Status is answered instead of the usual 308 (or 200 for
+	// the last chunk). Zero means 308.
+	Status int
+	// Commit is how many bytes of the request's data are stored. Unless
+	// that's all of them, it's rounded down to a multiple of ChunkSize.
+	Commit int64
+	// Drop closes the connection instead of answering, like
+	// a response lost on the way back
+	Drop bool
+}
+
+// PartialCommit stores n bytes of a request's data and
+// answers 308, with a Range header that says so
+func PartialCommit(n int64) Fault {
+	return Fault{Status: 308, Commit: n}
+}
+
+// Unavailable stores n bytes of a request's data and answers 503,
+// so clients have to query the upload status to find out about them
+func Unavailable(n int64) Fault {
+	return Fault{Status: 503, Commit: n}
+}
+
+func (f Fault) String() string {
+	if f.Drop {
+		return fmt.Sprintf("dropped connection after committing %d bytes", f.Commit)
+	}
+	return fmt.Sprintf("HTTP %d after committing %d bytes", f.status(), f.Commit)
+}
+
+func (f Fault) status() int {
+	if f.Status == 0 {
+		return 308
+	}
+	return f.Status
+}
+
+// Server is a resumable upload session: requests are PUTs with a
+// Content-Range header, either "bytes start-end/total" with data (total
+// is "*" until the last chunk) or "bytes */total" to query the status.
+// Data that was already committed is skipped, like GCS does.
+// It's safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	settings Settings
+
+	mu         sync.Mutex
+	faults     []Fault
+	data       []byte
+	commits    []int64
+	complete   bool
+	numPuts    int
+	numQueries int
+}
+
+// NewServer starts a Server, callers must Close it
+func NewServer(settings Settings) *Server {
+	if settings.ChunkSize <= 0 {
+		settings.ChunkSize = DefaultChunkSize
+	}
+	if settings.UploadID == "" {
+		settings.UploadID = "fake-upload-id"
+	}
+
+	s := &Server{settings: settings}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Script queues faults for the next requests that carry data, in order.
+// Requests after that are answered normally.
+func (s *Server) Script(faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = append(s.faults, faults...)
+}
+
+// Data returns the data committed so far
+func (s *Server) Data() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]byte(nil), s.data...)
+}
+
+// Complete returns true once the last chunk is committed
+func (s *Server) Complete() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.complete
+}
+
+// Commits returns how many bytes each request that carried data committed
+func (s *Server) Commits() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]int64(nil), s.commits...)
+}
+
+// NumPuts returns how many requests carried data
+func (s *Server) NumPuts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.numPuts
+}
+
+// NumQueries returns how many requests queried the upload status
+func (s *Server) NumQueries() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.numQueries
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.settings.Logf != nil {
+		s.settings.Logf(format, args...)
+	}
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if s.settings.Latency > 0 {
+		time.Sleep(s.settings.Latency)
+	}
+
+	if r.Method != "PUT" {
+		s.logf("uploadertest: unexpected %s request", r.Method)
+		http.Error(w, fmt.Sprintf("Unexpected method %s", r.Method), 400)
+		return
+	}
+
+	contentRange := r.Header.Get("Content-Range")
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		http.Error(w, "Missing 'bytes ' prefix in content-range header", 400)
+		return
+	}
+	contentRange = strings.TrimPrefix(contentRange, "bytes ")
+	if strings.HasPrefix(contentRange, "*/") {
+		s.handleQuery(w)
+		return
+	}
+	s.handlePut(w, r, contentRange)
+}
+
+func (s *Server) handleQuery(w http.ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.numQueries++
+	s.logf("uploadertest: status query, %d bytes committed", len(s.data))
+	if s.complete {
+		w.WriteHeader(200)
+		return
+	}
+	s.setRangeLocked(w)
+	w.WriteHeader(308)
+}
+
+func (s *Server) handlePut(w http.ResponseWriter, r *http.Request, contentRange string) {
+	slashTokens := strings.SplitN(contentRange, "/", 2)
+	startEnd := strings.SplitN(slashTokens[0], "-", 2)
+	if len(slashTokens) != 2 || len(startEnd) != 2 {
+		http.Error(w, fmt.Sprintf("Invalid content-range %q", contentRange), 400)
+		return
+	}
+	start, err := strconv.ParseInt(startEnd[0], 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid start in content-range %q", contentRange), 400)
+		return
+	}
+	end, err := strconv.ParseInt(startEnd[1], 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid end in content-range %q", contentRange), 400)
+		return
+	}
+	end++
+	var total int64 = -1
+	if slashTokens[1] != "*" {
+		total, err = strconv.ParseInt(slashTokens[1], 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid total in content-range %q", contentRange), 400)
+			return
+		}
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		s.logf("uploadertest: reading body: %v", err)
+		return
+	}
+	if int64(len(body)) != end-start {
+		http.Error(w, fmt.Sprintf("Got %d bytes, content-range says %d", len(body), end-start), 400)
+		return
+	}
+	if total < 0 && int64(len(body))%s.settings.ChunkSize != 0 {
+		http.Error(w, fmt.Sprintf("Sent bytes (%d) were not a multiple of chunk size (%d)", len(body), s.settings.ChunkSize), 400)
+		return
+	}
+
+	if bps := s.settings.BandwidthBytesPerSec; bps > 0 {
+		time.Sleep(time.Duration(float64(len(body)) / float64(bps) * float64(time.Second)))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.numPuts++
+	committed := int64(len(s.data))
+	if start > committed {
+		http.Error(w, fmt.Sprintf("Got data at %d, only %d bytes committed", start, committed), 400)
+		return
+	}
+	// skip what was already committed
+	data := body[committed-start:]
+
+	status := 0
+	drop := false
+	commit := int64(len(data))
+	if len(s.faults) > 0 {
+		fault := s.faults[0]
+		s.faults = s.faults[1:]
+		s.logf("uploadertest: simulating %s", fault)
+		status = fault.status()
+		drop = fault.Drop
+		if fault.Commit < commit {
+			commit = fault.Commit - fault.Commit%s.settings.ChunkSize
+			if commit < 0 {
+				commit = 0
+			}
+		}
+	}
+
+	s.data = append(s.data, data[:commit]...)
+	s.commits = append(s.commits, commit)
+	if total >= 0 && int64(len(s.data)) == total {
+		s.complete = true
+	}
+	s.logf("uploadertest: put %d-%d/%s, committed %d bytes", start, end, slashTokens[1], commit)
+
+	if drop {
+		if hj, ok := w.(http.Hijacker); ok {
+			conn, _, err := hj.Hijack()
+			if err == nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+
+	w.Header().Set("X-GUploader-UploadID", s.settings.UploadID)
+	if s.settings.ServerTiming != "" {
+		w.Header().Set("Server-Timing", s.settings.ServerTiming)
+	}
+	if status == 0 {
+		status = 308
+		if s.complete {
+			status = 200
+		}
+	}
+	if status == 308 {
+		s.setRangeLocked(w)
+	}
+	w.WriteHeader(status)
+}
+
+// setRangeLocked sets the Range header of a 308 response to what's
+// committed, GCS leaves it out if nothing is
+func (s *Server) setRangeLocked(w http.ResponseWriter) {
+	if len(s.data) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.data)-1))
+	}
+}